@@ -0,0 +1,91 @@
+// Package embedded runs gortcd TURN server in other programs on provided
+// net.PacketConn, configured in same format as gortcd command (gortcd.yml),
+// including credentials and filtering rules.
+package embedded
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"go.uber.org/zap"
+
+	"gortc.io/gortcd/internal/cli"
+	"gortc.io/gortcd/internal/server"
+)
+
+// Options of Server.
+type Options struct {
+	// Conn is connection that requests are read from and responses are
+	// written to, required. Any net.PacketConn can be used, but its local
+	// and remote addresses should be *net.UDPAddr. Relayed transport
+	// addresses are allocated on UDP sockets of local address.
+	Conn net.PacketConn
+	// Config is configuration in gortcd.yml format, defaults are used if
+	// nil. Listeners, api, pprof and prometheus endpoints are ignored.
+	Config io.Reader
+	// Log is logger, zap.NewNop() if nil.
+	Log *zap.Logger
+}
+
+// Server is TURN server that serves single connection.
+type Server struct {
+	log     *zap.Logger
+	options server.Options // initial options
+	u       *server.Updater
+	s       *server.Server
+}
+
+// New initializes server, Serve should be called to process requests.
+func New(o Options) (*Server, error) {
+	if o.Conn == nil {
+		return nil, errors.New("embedded: Conn is required")
+	}
+	if o.Log == nil {
+		o.Log = zap.NewNop()
+	}
+	v, err := cli.ReadConfig(o.Config)
+	if err != nil {
+		return nil, err
+	}
+	opt, err := cli.ServerOptions(v, o.Log)
+	if err != nil {
+		return nil, err
+	}
+	opt.Conn = o.Conn
+	// Additional sockets can't be bound to address of arbitrary Conn.
+	opt.ReusePort = false
+	s, err := server.New(opt)
+	if err != nil {
+		return nil, err
+	}
+	u := server.NewUpdater(opt)
+	u.Subscribe(s)
+	return &Server{log: o.Log, options: opt, u: u, s: s}, nil
+}
+
+// Serve processes requests from Conn until Close is called.
+func (s *Server) Serve() error { return s.s.Serve() }
+
+// Close stops server and closes Conn.
+func (s *Server) Close() error { return s.s.Close() }
+
+// Drain makes server reject new allocations, keeping existing ones until
+// they expire, so server can be gracefully rotated.
+func (s *Server) Drain() { s.u.Drain() }
+
+// Reload applies reloadable settings of config, e.g. filtering rules and
+// rate limits, same as on gortcd config reload. Other settings, including
+// credentials, are kept.
+func (s *Server) Reload(config io.Reader) error {
+	v, err := cli.ReadConfig(config)
+	if err != nil {
+		return err
+	}
+	opt, err := cli.ReloadOptions(v, s.log, s.options)
+	if err != nil {
+		return err
+	}
+	s.u.Set(opt)
+	return nil
+}
@@ -0,0 +1,48 @@
+package embedded
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	if _, err := New(Options{}); err == nil {
+		t.Error("should error without Conn")
+	}
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Options{
+		Conn: conn,
+		Config: strings.NewReader(`version: "1"
+server:
+  realm: example.org
+auth:
+  static:
+    - username: user
+      password: secret
+`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- s.Serve() }()
+	if err = s.Reload(strings.NewReader(`version: "1"
+server:
+  realm: example.com
+`)); err != nil {
+		t.Error(err)
+	}
+	if err = s.Reload(strings.NewReader("server:\n  realm: ${GORTCD_EMBEDDED_NOT_SET}\n")); err == nil {
+		t.Error("should error on unset variable")
+	}
+	if err = s.Close(); err != nil {
+		t.Error(err)
+	}
+	if err = <-done; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,48 @@
+package allocator
+
+import "time"
+
+// ageBuckets are upper bounds of allocation age histogram in seconds,
+// from short calls to sessions that are alive for a day.
+var ageBuckets = [...]float64{10, 30, 60, 300, 600, 1800, 3600, 7200, 21600, 86400}
+
+// ageHistogram is distribution of ages of current allocations.
+type ageHistogram struct {
+	counts [len(ageBuckets)]uint64 // per bucket of ageBuckets, not cumulative
+	count  uint64
+	sum    float64 // seconds
+}
+
+func (h *ageHistogram) observe(age time.Duration) {
+	if age < 0 {
+		age = 0
+	}
+	seconds := age.Seconds()
+	h.count++
+	h.sum += seconds
+	for i, upper := range ageBuckets {
+		if seconds <= upper {
+			h.counts[i]++
+			return
+		}
+	}
+}
+
+func (h *ageHistogram) add(b ageHistogram) {
+	for i := range h.counts {
+		h.counts[i] += b.counts[i]
+	}
+	h.count += b.count
+	h.sum += b.sum
+}
+
+// buckets returns cumulative counts of h keyed by upper bound.
+func (h *ageHistogram) buckets() map[float64]uint64 {
+	buckets := make(map[float64]uint64, len(ageBuckets))
+	var total uint64
+	for i, upper := range ageBuckets {
+		total += h.counts[i]
+		buckets[upper] = total
+	}
+	return buckets
+}
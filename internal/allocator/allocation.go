@@ -1,9 +1,12 @@
 package allocator
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -38,6 +41,8 @@ type Permission struct {
 	IP       net.IP
 	Timeout  time.Time
 	Bindings []Binding
+
+	writeFailures int // consecutive, see Options.MaxWriteFailures
 }
 
 func (p Permission) String() string {
@@ -66,29 +71,229 @@ func (p *Permission) conflicts(n turn.ChannelNumber, peer turn.Addr) bool {
 //
 // See RFC 5766 Section 2.2
 type Allocation struct {
-	Tuple       turn.FiveTuple
-	Permissions []Permission
-	RelayedAddr turn.Addr      // relayed transport address
-	Conn        net.PacketConn // on RelayedAddr
-	Callback    PeerHandler    // for data from Conn
-	Timeout     time.Time      // time-to-expiry
-	Buf         []byte         // read buffer
-	Log         *zap.Logger
+	ID           string // random short identifier, logged as "id"
+	Tuple        turn.FiveTuple
+	Username     string // authenticated username, if any
+	Realm        string // realm of authenticated credential, if any
+	Permissions  []Permission
+	RelayedAddr  turn.Addr      // relayed transport address
+	Conn         net.PacketConn // on RelayedAddr
+	RelayedAddr6 turn.Addr      // IPv6 relayed transport address of dual allocation
+	Conn6        net.PacketConn // on RelayedAddr6, nil if allocation is not dual
+	Callback     PeerHandler    // for data from Conn and Conn6
+	Timeout      time.Time      // time-to-expiry
+	Created      time.Time
+	Buf          []byte // read buffer
+	Log          *zap.Logger
+	DontFragment bool // DF bit is requested on allocation, set for ChannelData
+
+	activity *int64 // last activity in unix nanoseconds, accessed atomically
+	df       *dontFragment
+	df6      *dontFragment // of Conn6
+	buf6     []byte        // read buffer of Conn6
+	traffic  *traffic
+	channels map[turn.ChannelNumber]turn.Addr // index of Bindings
+	peers    map[peerKey]turn.ChannelNumber   // reverse index of Bindings
+}
+
+// newAllocationID returns random short identifier of allocation, so all log
+// entries of single allocation can be easily correlated.
+func newAllocationID() string {
+	var b [4]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		// Identifier is only used in logs, so zero one is fine.
+		return "00000000"
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// peerKey is comparable representation of peer turn.Addr.
+type peerKey struct {
+	ip   [net.IPv6len]byte
+	port int
+}
+
+func newPeerKey(addr turn.Addr) peerKey {
+	k := peerKey{port: addr.Port}
+	copy(k.ip[:], addr.IP.To16())
+	return k
+}
+
+// traffic counts relayed bytes and is shared between copies of Allocation.
+type traffic struct {
+	in          uint64   // received from peers, accessed atomically
+	out         uint64   // sent to peers, accessed atomically
+	unreachable uint64   // ICMP errors for sent packets, accessed atomically
+	parent      *traffic // optional, e.g. allocator totals
+}
+
+func (t *traffic) add(in, out int) {
+	for ; t != nil; t = t.parent {
+		if in > 0 {
+			atomic.AddUint64(&t.in, uint64(in))
+		}
+		if out > 0 {
+			atomic.AddUint64(&t.out, uint64(out))
+		}
+	}
+}
+
+func (t *traffic) addUnreachable() {
+	for ; t != nil; t = t.parent {
+		atomic.AddUint64(&t.unreachable, 1)
+	}
+}
+
+func (t *traffic) loadUnreachable() uint64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&t.unreachable)
+}
+
+func (t *traffic) load() (in, out uint64) {
+	if t == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&t.in), atomic.LoadUint64(&t.out)
+}
+
+// Bytes returns count of bytes received from peers and sent to peers
+// via relayed transport address.
+func (a *Allocation) Bytes() (in, out uint64) {
+	return a.traffic.load()
+}
+
+// canRelayTo reports whether relayed address and peer are of same address
+// family, i.e. data can be relayed to peer. Always true if relayed address
+// is not allocated yet or allocation is dual.
+func (a *Allocation) canRelayTo(peer turn.Addr) bool {
+	if a.RelayedAddr.IP == nil || a.Conn6 != nil {
+		return true
+	}
+	return (a.RelayedAddr.IP.To4() == nil) == (peer.IP.To4() == nil)
+}
+
+// relay returns relay socket for peer with its DF bit state, that is
+// IPv6 one for IPv6 peer of dual allocation.
+func (a *Allocation) relay(peer net.IP) (net.PacketConn, *dontFragment) {
+	if a.Conn6 != nil && peer.To4() == nil {
+		return a.Conn6, a.df6
+	}
+	return a.Conn, a.df
+}
+
+// permission returns permission for peer ip or nil if there is none.
+func (a *Allocation) permission(ip net.IP) *Permission {
+	for i := range a.Permissions {
+		if a.Permissions[i].IP.Equal(ip) {
+			return &a.Permissions[i]
+		}
+	}
+	return nil
+}
+
+// bindings returns count of channel bindings in all permissions.
+func (a *Allocation) bindings() int {
+	n := 0
+	for i := range a.Permissions {
+		n += len(a.Permissions[i].Bindings)
+	}
+	return n
+}
+
+// bindChannel adds channel binding to indexes, so bound peer or channel
+// can be found without permissions scan.
+func (a *Allocation) bindChannel(n turn.ChannelNumber, peer turn.Addr) {
+	if a.channels == nil {
+		a.channels = make(map[turn.ChannelNumber]turn.Addr)
+		a.peers = make(map[peerKey]turn.ChannelNumber)
+	}
+	addr := turn.Addr{
+		IP:   make(net.IP, len(peer.IP)),
+		Port: peer.Port,
+	}
+	copy(addr.IP, peer.IP)
+	a.channels[n] = addr
+	a.peers[newPeerKey(peer)] = n
+}
+
+// unbindChannel removes channel binding from indexes.
+func (a *Allocation) unbindChannel(n turn.ChannelNumber) {
+	addr, ok := a.channels[n]
+	if !ok {
+		return
+	}
+	delete(a.channels, n)
+	k := newPeerKey(addr)
+	if a.peers[k] == n {
+		delete(a.peers, k)
+	}
+}
+
+// removeFamily removes permissions of IPv6 peers if ipv6 is set or IPv4
+// ones otherwise, with their channel bindings.
+func (a *Allocation) removeFamily(ipv6 bool) {
+	permissions := a.Permissions[:0]
+	for _, p := range a.Permissions {
+		if (p.IP.To4() == nil) != ipv6 {
+			permissions = append(permissions, p)
+			continue
+		}
+		for _, b := range p.Bindings {
+			a.unbindChannel(b.Channel)
+		}
+	}
+	a.Permissions = permissions
+}
+
+// touch updates last activity time of allocation.
+func (a *Allocation) touch(t time.Time) {
+	if a.activity == nil {
+		return
+	}
+	atomic.StoreInt64(a.activity, t.UnixNano())
+}
+
+// idleSince reports whether there was no activity on allocation since t.
+func (a *Allocation) idleSince(t time.Time) bool {
+	if a.activity == nil {
+		return false
+	}
+	return atomic.LoadInt64(a.activity) < t.UnixNano()
 }
 
 // ReadUntilClosed starts network loop that passes all received data to
-// PeerHandler. Stops on connection close or any error.
+// PeerHandler. Stops on connection close or any error except ICMP ones,
+// that are only counted. Conn6 of dual allocation is read in separate
+// goroutine.
 func (a *Allocation) ReadUntilClosed() {
+	if a.Conn6 != nil {
+		go a.readUntilClosed(a.Conn6, a.buf6)
+	}
+	a.readUntilClosed(a.Conn, a.Buf)
+}
+
+func (a *Allocation) readUntilClosed(conn net.PacketConn, buf []byte) {
 	a.Log.Debug("start")
 	defer func() {
 		a.Log.Debug("stop")
 	}()
 	for {
-		if err := a.Conn.SetReadDeadline(time.Now().Add(time.Minute)); err != nil {
+		if err := conn.SetReadDeadline(time.Now().Add(time.Minute)); err != nil {
 			a.Log.Warn("SetReadDeadline failed", zap.Error(err))
 			break
 		}
-		n, addr, err := a.Conn.ReadFrom(a.Buf)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil && isICMPError(err) {
+			// Peer is unreachable, so relayed data was lost.
+			a.traffic.addUnreachable()
+			drainErrQueue(conn)
+			if ce := a.Log.Check(zapcore.DebugLevel, "peer unreachable"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+			continue
+		}
 		if err != nil && err != io.EOF {
 			netErr, ok := err.(net.Error)
 			if ok && (netErr.Temporary() || netErr.Timeout()) {
@@ -99,13 +304,20 @@ func (a *Allocation) ReadUntilClosed() {
 			)
 			break
 		}
-		if ce := a.Log.Check(zapcore.DebugLevel, "read"); ce != nil {
-			ce.Write(zap.Int("n", n))
-		}
 		udpAddr := addr.(*net.UDPAddr)
-		a.Callback.HandlePeerData(a.Buf[:n], a.Tuple, turn.Addr{
+		a.handle(buf[:n], turn.Addr{
 			IP:   udpAddr.IP,
 			Port: udpAddr.Port,
 		})
 	}
 }
+
+// handle passes data that is received from peer to PeerHandler.
+func (a *Allocation) handle(data []byte, peer turn.Addr) {
+	if ce := a.Log.Check(zapcore.DebugLevel, "read"); ce != nil {
+		ce.Write(zap.Int("n", len(data)))
+	}
+	a.touch(time.Now())
+	a.traffic.add(len(data), 0)
+	a.Callback.HandlePeerData(data, a.Tuple, peer)
+}
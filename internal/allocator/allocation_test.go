@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"syscall"
 	"testing"
 	"time"
 
@@ -167,7 +169,8 @@ func TestAllocation_ReadUntilClosed(t *testing.T) {
 					t.Error("incorrect length")
 				}
 			}),
-			Buf: make([]byte, 1024),
+			Buf:     make([]byte, 1024),
+			traffic: &traffic{parent: new(traffic)},
 		}
 		a.ReadUntilClosed()
 		if !deadlineSet {
@@ -179,6 +182,38 @@ func TestAllocation_ReadUntilClosed(t *testing.T) {
 		if !called {
 			t.Error("callback not called")
 		}
+		if in, out := a.Bytes(); in != 10 || out != 0 {
+			t.Errorf("unexpected traffic: in %d, out %d", in, out)
+		}
+		if in, _ := a.traffic.parent.load(); in != 10 {
+			t.Errorf("unexpected total traffic: in %d", in)
+		}
+	})
+	t.Run("Unreachable", func(t *testing.T) {
+		reads := 0
+		a := &Allocation{
+			Log: zap.NewNop(),
+			Conn: &netConnMock{
+				setReadDeadline: func(t time.Time) error { return nil },
+				readFrom: func(b []byte) (n int, addr net.Addr, err error) {
+					reads++
+					if reads > 1 {
+						return 0, nil, io.ErrUnexpectedEOF
+					}
+					return 0, nil, &net.OpError{
+						Op: "read", Err: os.NewSyscallError("recvfrom", syscall.ECONNREFUSED),
+					}
+				},
+			},
+			traffic: &traffic{parent: new(traffic)},
+		}
+		a.ReadUntilClosed()
+		if reads != 2 {
+			t.Errorf("should continue reading after ICMP error, got %d reads", reads)
+		}
+		if got := a.traffic.parent.loadUnreachable(); got != 1 {
+			t.Errorf("unexpected unreachable count %d", got)
+		}
 	})
 	t.Run("Deadline error", func(t *testing.T) {
 		deadlineSet := false
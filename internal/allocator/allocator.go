@@ -4,9 +4,9 @@
 package allocator
 
 import (
-	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -19,9 +19,32 @@ import (
 
 // Options contain possible settings for Allocator.
 type Options struct {
-	Log    *zap.Logger
-	Conn   RelayedAddrAllocator
-	Labels prometheus.Labels
+	Log            *zap.Logger
+	Conn           RelayedAddrAllocator
+	Labels         prometheus.Labels
+	MaxAllocations int // no limit if zero
+	MaxPermissions int // per allocation, no limit if zero
+	MaxChannels    int // channel bindings per allocation, no limit if zero
+	// IdleTimeout is maximum duration without relayed data after which
+	// allocation is removed regardless of its lifetime, disabled if zero.
+	IdleTimeout time.Duration
+	// Events is optional handler for allocation lifecycle events.
+	Events EventHandler
+	// SocketBuffers are buffer sizes of relay sockets, OS defaults if zero.
+	SocketBuffers SocketBuffers
+	// DSCP marks relayed packets, e.g. for QoS of media; not set if zero.
+	// See DSCPSupported.
+	DSCP int
+	// DryRun disables sending data to peers, Send and SendBound only log
+	// it, e.g. to audit relay destinations. Not for production traffic.
+	DryRun bool
+	// MaxWriteFailures is count of consecutive failed writes to peer
+	// after which its permission is removed with all bindings, e.g. when
+	// peer network is down; disabled if zero.
+	MaxWriteFailures int
+	// Readers reads relay sockets of allocations if set, otherwise
+	// each allocation is read by its own goroutine.
+	Readers *ReaderPool
 }
 
 // NewAllocator initializes and returns new *Allocator.
@@ -29,9 +52,20 @@ func NewAllocator(o Options) *Allocator {
 	if o.Log == nil {
 		o.Log = zap.NewNop()
 	}
-	return &Allocator{
-		log:   o.Log,
-		raddr: o.Conn,
+	a := &Allocator{
+		log:       o.Log,
+		raddr:     o.Conn,
+		maxAllocs: o.MaxAllocations,
+		maxPerms:  o.MaxPermissions,
+		maxChans:  o.MaxChannels,
+		idle:      o.IdleTimeout,
+		events:    o.Events,
+		buffers:   o.SocketBuffers,
+		dscp:      o.DSCP,
+		dryRun:    o.DryRun,
+		maxFails:  o.MaxWriteFailures,
+		readers:   o.Readers,
+		traffic:   new(traffic),
 		metrics: map[string]*prometheus.Desc{
 			"allocation_count": prometheus.NewDesc("gortcd_allocation_count",
 				"Total number of allocations.", []string{}, o.Labels),
@@ -39,17 +73,45 @@ func NewAllocator(o Options) *Allocator {
 				"Total number of permissions.", []string{}, o.Labels),
 			"binding_count": prometheus.NewDesc("gortcd_binding_count",
 				"Total number of bindings.", []string{}, o.Labels),
+			"permissions_expired": prometheus.NewDesc("gortcd_permissions_expired_total",
+				"Total number of expired permissions and bindings.", []string{}, o.Labels),
+			"peer_unreachable": prometheus.NewDesc("gortcd_peer_unreachable_total",
+				"Total number of ICMP errors received for relayed packets.", []string{}, o.Labels),
+			"allocation_age": prometheus.NewDesc("gortcd_allocation_age_seconds",
+				"Age of current allocations, sampled on prune.", []string{}, o.Labels),
 		},
 	}
+	for i := range a.shards {
+		a.shards[i].allocs = make(map[tupleKey]*Allocation)
+	}
+	return a
 }
 
 // Allocator handles allocation.
 type Allocator struct {
 	log       *zap.Logger
-	allocsMux sync.RWMutex
-	allocs    []Allocation
+	shards    [allocShards]allocShard
+	newMux    sync.Mutex // serializes allocation creation
 	raddr     RelayedAddrAllocator
 	metrics   map[string]*prometheus.Desc
+	maxAllocs int
+	maxPerms  int
+	maxChans  int
+	idle      time.Duration
+	events    EventHandler
+	buffers   SocketBuffers // of relay sockets
+	dscp      int           // of relayed packets
+	dryRun    bool          // only log sent data
+	maxFails  int           // consecutive write failures of permission
+	readers   *ReaderPool   // of relay sockets, goroutine per allocation if nil
+	traffic   *traffic      // totals of all allocations
+	expired   uint64        // permissions and bindings, accessed atomically
+
+	joinedMux sync.Mutex
+	joined    []*Allocator // reported in metrics of a, see Join
+
+	agesMux sync.Mutex
+	ages    ageHistogram // sampled on Prune
 }
 
 // Describe implements Collector.
@@ -59,9 +121,35 @@ func (a *Allocator) Describe(c chan<- *prometheus.Desc) {
 	}
 }
 
+// Join adds statistics of b to metrics of a, e.g. when allocators of
+// multiple servers are reported with same labels.
+func (a *Allocator) Join(b *Allocator) {
+	a.joinedMux.Lock()
+	a.joined = append(a.joined, b)
+	a.joinedMux.Unlock()
+}
+
 // Collect implements Collector.
 func (a *Allocator) Collect(c chan<- prometheus.Metric) {
 	s := a.Stats()
+	expired := atomic.LoadUint64(&a.expired)
+	a.agesMux.Lock()
+	ages := a.ages
+	a.agesMux.Unlock()
+	a.joinedMux.Lock()
+	joined := a.joined
+	a.joinedMux.Unlock()
+	for _, b := range joined {
+		b.agesMux.Lock()
+		ages.add(b.ages)
+		b.agesMux.Unlock()
+		bs := b.Stats()
+		s.Allocations += bs.Allocations
+		s.Permissions += bs.Permissions
+		s.Bindings += bs.Bindings
+		s.Unreachable += bs.Unreachable
+		expired += atomic.LoadUint64(&b.expired)
+	}
 	for _, m := range []prometheus.Metric{
 		prometheus.MustNewConstMetric(
 			a.metrics["allocation_count"],
@@ -78,6 +166,20 @@ func (a *Allocator) Collect(c chan<- prometheus.Metric) {
 			prometheus.GaugeValue,
 			float64(s.Bindings),
 		),
+		prometheus.MustNewConstMetric(
+			a.metrics["permissions_expired"],
+			prometheus.CounterValue,
+			float64(expired),
+		),
+		prometheus.MustNewConstMetric(
+			a.metrics["peer_unreachable"],
+			prometheus.CounterValue,
+			float64(s.Unreachable),
+		),
+		prometheus.MustNewConstHistogram(
+			a.metrics["allocation_age"],
+			ages.count, ages.sum, ages.buckets(),
+		),
 	} {
 		c <- m
 	}
@@ -90,41 +192,41 @@ var ErrPermissionNotFound = errors.New("permission not found")
 // to send data.
 func (a *Allocator) SendBound(tuple turn.FiveTuple, n turn.ChannelNumber, data []byte) (int, error) {
 	var (
-		conn net.PacketConn
-		addr turn.Addr
+		conn    net.PacketConn
+		addr    turn.Addr
+		counter *traffic
+		log     *zap.Logger
+		fails   int // of permission before write
+		df      *dontFragment
+		setDF   bool
 	)
 	if ce := a.log.Check(zapcore.DebugLevel, "searching for bound allocation"); ce != nil {
 		ce.Write(zap.Stringer("tuple", tuple), zap.Stringer("n", n))
 	}
-	a.allocsMux.RLock()
-	for i := range a.allocs {
-		if !a.allocs[i].Tuple.Equal(tuple) {
-			continue
-		}
-		for _, p := range a.allocs[i].Permissions {
-			if len(p.Bindings) == 0 {
-				continue
+	k := newTupleKey(tuple)
+	s := a.shard(k)
+	s.mux.RLock()
+	if alloc, ok := s.allocs[k]; ok {
+		// Address in channel index is never modified, so no copy is needed.
+		if bound, ok := alloc.channels[n]; ok {
+			if a.idle > 0 {
+				alloc.touch(time.Now())
 			}
-			for _, b := range p.Bindings {
-				if b.Channel != n {
-					continue
-				}
-				conn = a.allocs[i].Conn
-				// Copy p.Addr to turn.Addr.
-				addr = turn.Addr{
-					Port: b.Port,
-					IP:   make(net.IP, len(p.IP)),
-				}
-				copy(addr.IP, p.IP)
+			conn, df = alloc.relay(bound.IP)
+			counter = alloc.traffic
+			log = alloc.Log
+			addr = bound
+			setDF = alloc.DontFragment
+			if p := alloc.permission(bound.IP); p != nil {
+				fails = p.writeFailures
 			}
 		}
 	}
-	a.allocsMux.RUnlock()
+	s.mux.RUnlock()
 	if conn == nil {
 		return 0, ErrPermissionNotFound
 	}
-	a.log.Debug("sending data",
-		zap.Stringer("tuple", tuple),
+	log.Debug("sending data",
 		zap.Stringer("addr", addr),
 		zap.Int("len", len(data)),
 		zap.Stringer("laddr", conn.LocalAddr()),
@@ -133,119 +235,279 @@ func (a *Allocator) SendBound(tuple turn.FiveTuple, n turn.ChannelNumber, data [
 			Port: addr.Port,
 		}),
 	)
-	return conn.WriteTo(data, &net.UDPAddr{
+	if a.dryRun {
+		logDryRun(log, addr, data)
+		return len(data), nil
+	}
+	written, err := df.writeTo(conn, data, &net.UDPAddr{
 		IP:   addr.IP,
 		Port: addr.Port,
-	})
+	}, setDF)
+	counter.add(0, written)
+	if a.maxFails > 0 && (err != nil || fails > 0) {
+		a.trackWrite(tuple, addr.IP, err)
+	}
+	return written, err
 }
 
 // Send uses existing allocation for client to write data to remote turn.Addr.
+// DF bit is not set, even if it was requested on allocation.
 //
 // Returns ErrPermissionNotFound if no allocation found for (client,addr).
 func (a *Allocator) Send(tuple turn.FiveTuple, peer turn.Addr, data []byte) (int, error) {
+	return a.send(tuple, peer, data, false)
+}
+
+// SendDontFragment is same as Send, but sets DF bit on relayed datagram,
+// as requested by DONT-FRAGMENT attribute of Send indication.
+//
+// See RFC 5766 Section 10.2.
+func (a *Allocator) SendDontFragment(tuple turn.FiveTuple, peer turn.Addr, data []byte) (int, error) {
+	if !DontFragmentSupported {
+		return 0, errDontFragmentNotSupported
+	}
+	return a.send(tuple, peer, data, true)
+}
+
+func (a *Allocator) send(tuple turn.FiveTuple, peer turn.Addr, data []byte, setDF bool) (int, error) {
 	var (
-		conn net.PacketConn
+		conn    net.PacketConn
+		counter *traffic
+		log     *zap.Logger
+		fails   int // of permission before write
+		df      *dontFragment
 	)
 	a.log.Debug("searching for allocation",
 		zap.Stringer("t", tuple),
 		zap.Stringer("peer", peer),
 	)
-	a.allocsMux.RLock()
-	for i := range a.allocs {
-		if !a.allocs[i].Tuple.Equal(tuple) {
-			continue
-		}
-		for _, p := range a.allocs[i].Permissions {
+	k := newTupleKey(tuple)
+	s := a.shard(k)
+	s.mux.RLock()
+	if alloc, ok := s.allocs[k]; ok {
+		for _, p := range alloc.Permissions {
 			if !peer.IP.Equal(p.IP) {
 				continue
 			}
-			conn = a.allocs[i].Conn
+			if a.idle > 0 {
+				alloc.touch(time.Now())
+			}
+			conn, df = alloc.relay(peer.IP)
+			counter = alloc.traffic
+			log = alloc.Log
+			fails = p.writeFailures
+			break
 		}
 	}
-	a.allocsMux.RUnlock()
+	s.mux.RUnlock()
 	if conn == nil {
 		return 0, ErrPermissionNotFound
 	}
-	a.log.Debug("sending data",
-		zap.Stringer("tuple", tuple),
+	log.Debug("sending data",
 		zap.Stringer("addr", peer),
 		zap.Int("len", len(data)),
 	)
-	return conn.WriteTo(data, &net.UDPAddr{
+	if a.dryRun {
+		logDryRun(log, peer, data)
+		return len(data), nil
+	}
+	n, err := df.writeTo(conn, data, &net.UDPAddr{
 		IP:   peer.IP,
 		Port: peer.Port,
-	})
+	}, setDF)
+	counter.add(0, n)
+	if a.maxFails > 0 && (err != nil || fails > 0) {
+		a.trackWrite(tuple, peer.IP, err)
+	}
+	return n, err
 }
 
-// Remove de-allocates and removes allocation.
-func (a *Allocator) Remove(t turn.FiveTuple) error {
-	var (
-		newAllocs []Allocation
-		toDealloc []Allocation
-	)
-	a.allocsMux.Lock()
-	for i := range a.allocs {
-		if !a.allocs[i].Tuple.Equal(t) {
-			newAllocs = append(newAllocs, a.allocs[i])
+// trackWrite updates consecutive write failure count of permission for
+// peer by result of write, removing permission with all its bindings
+// if maxFails is reached. Only called if write failed or previous one
+// did, so successful writes don't take shard lock.
+func (a *Allocator) trackWrite(tuple turn.FiveTuple, peer net.IP, err error) {
+	k := newTupleKey(tuple)
+	s := a.shard(k)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	alloc, ok := s.allocs[k]
+	if !ok {
+		return
+	}
+	for i := range alloc.Permissions {
+		p := &alloc.Permissions[i]
+		if !p.IP.Equal(peer) {
 			continue
 		}
-		toDealloc = append(toDealloc, a.allocs[i])
+		if err == nil {
+			p.writeFailures = 0
+			return
+		}
+		p.writeFailures++
+		if p.writeFailures < a.maxFails {
+			return
+		}
+		alloc.Log.Info("removing permission after write failures",
+			zap.Stringer("peer", peer),
+			zap.Int("failures", p.writeFailures),
+			zap.Error(err),
+		)
+		for _, b := range p.Bindings {
+			alloc.unbindChannel(b.Channel)
+		}
+		alloc.Permissions = append(alloc.Permissions[:i], alloc.Permissions[i+1:]...)
+		return
 	}
-	n := copy(a.allocs, newAllocs)
-	a.allocs = a.allocs[:n]
-	a.allocsMux.Unlock()
-	if len(toDealloc) == 0 {
+}
+
+// logDryRun logs data that would be relayed to peer in dry run mode to
+// allocation logger l.
+func logDryRun(l *zap.Logger, peer turn.Addr, data []byte) {
+	l.Info("dry run, not relaying",
+		zap.Stringer("peer", peer),
+		zap.Int("len", len(data)),
+	)
+}
+
+// Remove de-allocates and removes allocation.
+func (a *Allocator) Remove(t turn.FiveTuple) error {
+	k := newTupleKey(t)
+	s := a.shard(k)
+	s.mux.Lock()
+	alloc, ok := s.allocs[k]
+	delete(s.allocs, k)
+	s.mux.Unlock()
+	if !ok {
 		return ErrAllocationMismatch
 	}
-	for i := range toDealloc {
-		if err := a.raddr.Remove(toDealloc[i].Tuple.Server, toDealloc[i].Tuple.Proto); err != nil {
-			a.log.Warn("failed to remove allocation", zap.Error(err))
-		}
+	alloc.Log.Debug("removed")
+	a.stopReading(*alloc)
+	a.release(alloc.Log, alloc.Tuple.Proto, alloc.RelayedAddr, alloc.RelayedAddr6)
+	a.notify(EventDeallocate, *alloc, time.Now())
+	return nil
+}
+
+// RemoveFamily de-allocates relayed transport address of dual allocation
+// that is IPv6 one if ipv6 is set or IPv4 one otherwise, removing
+// permissions and channel bindings of peers of that family. Other relayed
+// address is kept with its permissions. Allocation is removed if it is
+// not dual, see Remove.
+func (a *Allocator) RemoveFamily(t turn.FiveTuple, ipv6 bool) error {
+	k := newTupleKey(t)
+	s := a.shard(k)
+	s.mux.Lock()
+	alloc, ok := s.allocs[k]
+	if !ok {
+		s.mux.Unlock()
+		return ErrAllocationMismatch
+	}
+	if alloc.Conn6 == nil {
+		s.mux.Unlock()
+		return a.Remove(t)
+	}
+	conn, relayed := alloc.Conn6, alloc.RelayedAddr6
+	if !ipv6 {
+		// IPv6 relayed address is left, so it becomes the only one.
+		conn, relayed = alloc.Conn, alloc.RelayedAddr
+		alloc.Conn, alloc.RelayedAddr, alloc.df = alloc.Conn6, alloc.RelayedAddr6, alloc.df6
+	}
+	alloc.Conn6, alloc.RelayedAddr6, alloc.df6, alloc.buf6 = nil, turn.Addr{}, nil, nil
+	alloc.removeFamily(ipv6)
+	l := alloc.Log
+	s.mux.Unlock()
+	l.Debug("removed relayed address", zap.Stringer("raddr", relayed))
+	if a.readers != nil {
+		a.readers.remove(conn)
 	}
+	a.release(l, t.Proto, relayed, turn.Addr{})
 	return nil
 }
 
-// Prune removes any timed out permissions or allocations.
+// release removes relayed transport addresses of removed allocation,
+// relayed6 is zero if allocation is not dual.
+func (a *Allocator) release(l *zap.Logger, proto turn.Protocol, relayed, relayed6 turn.Addr) {
+	if err := a.raddr.Remove(relayed, proto); err != nil {
+		l.Warn("failed to remove allocation", zap.Error(err))
+	}
+	if relayed6.IP == nil {
+		return
+	}
+	if err := a.raddr.Remove(relayed6, proto); err != nil {
+		l.Warn("failed to remove IPv6 allocation", zap.Error(err))
+	}
+}
+
+// Prune removes any timed out permissions or allocations and samples
+// ages of remaining ones.
 func (a *Allocator) Prune(t time.Time) {
 	var (
-		newAllocs []Allocation
 		toDealloc []Allocation
+		ages      ageHistogram
 	)
-
-	a.allocsMux.Lock()
-	for i := range a.allocs {
-		var newPermissions []Permission
-		for _, p := range a.allocs[i].Permissions {
-			var newBindings []Binding
-			for _, b := range p.Bindings {
-				if b.Timeout.After(t) {
-					newBindings = append(newBindings, b)
-				}
+	for i := range a.shards {
+		s := &a.shards[i]
+		s.mux.Lock()
+		for k, alloc := range s.allocs {
+			a.prunePermissions(alloc, t)
+			if a.idle > 0 && alloc.idleSince(t.Add(-a.idle)) {
+				alloc.Log.Debug("idle, removed")
+				toDealloc = append(toDealloc, *alloc)
+				delete(s.allocs, k)
+				continue
 			}
-			p.Bindings = newBindings
-			if p.Timeout.After(t) {
-				newPermissions = append(newPermissions, p)
+			if !alloc.Timeout.After(t) {
+				alloc.Log.Debug("expired, removed")
+				toDealloc = append(toDealloc, *alloc)
+				delete(s.allocs, k)
 				continue
 			}
+			ages.observe(t.Sub(alloc.Created))
 		}
-		n := copy(a.allocs[i].Permissions, newPermissions)
-		a.allocs[i].Permissions = a.allocs[i].Permissions[:n]
-
-		if a.allocs[i].Timeout.After(t) {
-			newAllocs = append(newAllocs, a.allocs[i])
-		} else {
-			toDealloc = append(toDealloc, a.allocs[i])
-		}
+		s.mux.Unlock()
 	}
-	n := copy(a.allocs, newAllocs)
-	a.allocs = a.allocs[:n]
-	a.allocsMux.Unlock()
-
+	a.agesMux.Lock()
+	a.ages = ages
+	a.agesMux.Unlock()
 	for i := range toDealloc {
-		if err := a.raddr.Remove(toDealloc[i].Tuple.Server, toDealloc[i].Tuple.Proto); err != nil {
-			a.log.Warn("failed to remove allocation", zap.Error(err))
+		d := &toDealloc[i]
+		a.stopReading(*d)
+		a.release(d.Log, d.Tuple.Proto, d.RelayedAddr, d.RelayedAddr6)
+		a.notify(EventDeallocate, toDealloc[i], t)
+	}
+}
+
+// prunePermissions removes timed out permissions and bindings of
+// allocation, shard lock must be held.
+func (a *Allocator) prunePermissions(alloc *Allocation, t time.Time) {
+	var newPermissions []Permission
+	for _, p := range alloc.Permissions {
+		var newBindings []Binding
+		for _, b := range p.Bindings {
+			if b.Timeout.After(t) && p.Timeout.After(t) {
+				newBindings = append(newBindings, b)
+				continue
+			}
+			alloc.unbindChannel(b.Channel)
+			if !b.Timeout.After(t) {
+				atomic.AddUint64(&a.expired, 1)
+				if ce := alloc.Log.Check(zapcore.DebugLevel, "binding expired"); ce != nil {
+					ce.Write(zap.Stringer("peer", p.IP), zap.Stringer("binding", b.Channel))
+				}
+			}
+		}
+		p.Bindings = newBindings
+		if p.Timeout.After(t) {
+			newPermissions = append(newPermissions, p)
+			continue
+		}
+		atomic.AddUint64(&a.expired, 1)
+		if ce := alloc.Log.Check(zapcore.DebugLevel, "permission expired"); ce != nil {
+			ce.Write(zap.Stringer("permission", p))
 		}
 	}
+	n := copy(alloc.Permissions, newPermissions)
+	alloc.Permissions = alloc.Permissions[:n]
 }
 
 // RelayedAddrAllocator represents allocator for relayed turn.Addresses on
@@ -255,114 +517,332 @@ type RelayedAddrAllocator interface {
 	Remove(addr turn.Addr, proto turn.Protocol) error
 }
 
+// ipv6RelayedAddrAllocator is optionally implemented by
+// RelayedAddrAllocator to allocate IPv6 relayed transport addresses of
+// dual allocations, see NetAllocator.NewIPv6.
+type ipv6RelayedAddrAllocator interface {
+	NewIPv6(proto turn.Protocol) (turn.Addr, net.PacketConn, error)
+}
+
 // ErrAllocationMismatch is a 437 (Allocation Mismatch) error
 var ErrAllocationMismatch = errors.New("5-tuple is currently in use")
 
+// ErrInsufficientCapacity is a 508 (Insufficient Capacity) error, returned
+// when maximum allocation count is reached.
+var ErrInsufficientCapacity = errors.New("maximum allocation count reached")
+
+// ErrPermissionLimit is a 508 (Insufficient Capacity) error, returned
+// when maximum permission count of allocation is reached.
+var ErrPermissionLimit = errors.New("maximum permission count reached")
+
+// ErrPeerAddrFamilyMismatch is a 443 (Peer Address Family Mismatch) error,
+// returned when peer address family differs from relayed address one.
+//
+// See RFC 6156 Section 5.1.
+var ErrPeerAddrFamilyMismatch = errors.New("peer address family mismatch")
+
+// ErrChannelLimit is a 508 (Insufficient Capacity) error, returned
+// when maximum channel binding count of allocation is reached.
+var ErrChannelLimit = errors.New("maximum channel binding count reached")
+
+// ErrRealmQuota is a 486 (Allocation Quota Reached) error, returned
+// when maximum allocation count of realm is reached.
+var ErrRealmQuota = errors.New("realm allocation quota reached")
+
+// ErrAddrFamilyNotSupported is a 440 (Address Family not Supported) error,
+// returned when IPv6 relayed transport address of dual allocation can't be
+// allocated, e.g. there is no IPv6 relay address.
+//
+// See RFC 8656 Section 7.2.
+var ErrAddrFamilyNotSupported = errors.New("address family not supported")
+
 // New creates new allocation for provided client and proto. Any data received
 // by allocated socket is passed to callback.
-func (a *Allocator) New(tuple turn.FiveTuple, timeout time.Time, callback PeerHandler) (turn.Addr, error) {
-	l := a.log.Named("allocation").With(zap.Stringer("tuple", tuple))
-	l.Debug("new", zap.Time("timeout", timeout))
+//
+// The username is authenticated username of client, if any, and is only
+// used in allocation events.
+func (a *Allocator) New(tuple turn.FiveTuple, username string, timeout time.Time, callback PeerHandler) (turn.Addr, error) {
+	return a.NewInRealm(tuple, username, "", 0, timeout, callback)
+}
+
+// NewInRealm is same as New, but also associates allocation with realm
+// of authenticated credential, returning ErrRealmQuota if there are
+// already quota allocations in that realm. Quota is not checked if zero.
+func (a *Allocator) NewInRealm(tuple turn.FiveTuple, username, realm string, quota int, timeout time.Time, callback PeerHandler) (turn.Addr, error) {
+	relayed, _, err := a.newAllocation(tuple, username, realm, quota, timeout, callback, false)
+	return relayed, err
+}
+
+// NewDual is same as NewInRealm, but creates dual allocation that has both
+// IPv4 and IPv6 relayed transport addresses, as requested by
+// ADDITIONAL-ADDRESS-FAMILY attribute. Data to IPv6 peers is relayed via
+// IPv6 one. Returns ErrAddrFamilyNotSupported if IPv6 relayed transport
+// address can't be allocated, not creating allocation.
+//
+// See RFC 8656 Section 7.2.
+func (a *Allocator) NewDual(tuple turn.FiveTuple, username, realm string, quota int, timeout time.Time, callback PeerHandler) (relayed, relayed6 turn.Addr, err error) {
+	return a.newAllocation(tuple, username, realm, quota, timeout, callback, true)
+}
+
+func (a *Allocator) newAllocation(
+	tuple turn.FiveTuple, username, realm string, quota int, timeout time.Time, callback PeerHandler, dual bool,
+) (turn.Addr, turn.Addr, error) {
+	ipv6, ok := a.raddr.(ipv6RelayedAddrAllocator)
+	if dual && !ok {
+		return turn.Addr{}, turn.Addr{}, ErrAddrFamilyNotSupported
+	}
+	id := newAllocationID()
+	// Only allocation id is added to logger, as 5-tuple is verbose, so
+	// it is logged once here.
+	l := a.log.Named("allocation").With(zap.String("id", id))
+	l.Debug("new", zap.Stringer("tuple", tuple), zap.Time("timeout", timeout), zap.Bool("dual", dual))
 	switch tuple.Proto {
 	case turn.ProtoUDP:
 		// pass
 	default:
-		return turn.Addr{}, errors.Errorf("proto %s not implemented", tuple.Proto)
-	}
-	a.allocsMux.Lock()
-	// Searching for existing allocation.
-	for i := range a.allocs {
-		if a.allocs[i].Tuple.Equal(tuple) {
-			a.allocsMux.Unlock()
-			// The 5-tuple is currently in use by an existing allocation,
-			// returning allocation mismatch error.
-			return turn.Addr{}, ErrAllocationMismatch
-		}
+		return turn.Addr{}, turn.Addr{}, errors.Errorf("proto %s not implemented", tuple.Proto)
+	}
+	k := newTupleKey(tuple)
+	s := a.shard(k)
+	// Serializing allocation creation, so limits that span all shards
+	// are checked consistently.
+	a.newMux.Lock()
+	s.mux.RLock()
+	_, exists := s.allocs[k]
+	s.mux.RUnlock()
+	if exists {
+		a.newMux.Unlock()
+		// The 5-tuple is currently in use by an existing allocation,
+		// returning allocation mismatch error.
+		return turn.Addr{}, turn.Addr{}, ErrAllocationMismatch
+	}
+	if a.maxAllocs > 0 && a.count() >= a.maxAllocs {
+		a.newMux.Unlock()
+		return turn.Addr{}, turn.Addr{}, ErrInsufficientCapacity
+	}
+	if quota > 0 && a.realmAllocations(realm) >= quota {
+		a.newMux.Unlock()
+		return turn.Addr{}, turn.Addr{}, ErrRealmQuota
 	}
 	// Not found, creating new allocation.
-	allocation := Allocation{
+	now := time.Now()
+	allocation := &Allocation{
+		ID:       id,
 		Log:      l,
 		Tuple:    tuple,
+		Username: username,
+		Realm:    realm,
 		Callback: callback,
 		Timeout:  timeout,
+		Created:  now,
+		activity: new(int64),
+		df:       new(dontFragment),
+		traffic:  &traffic{parent: a.traffic},
 	}
-	a.allocs = append(a.allocs, allocation)
-	a.allocsMux.Unlock()
+	allocation.touch(now)
+	s.mux.Lock()
+	s.allocs[k] = allocation
+	s.mux.Unlock()
+	a.newMux.Unlock()
 
+	// Not keeping allocation without relayed address, so client
+	// can retry on same 5-tuple.
+	drop := func() {
+		s.mux.Lock()
+		if s.allocs[k] == allocation {
+			delete(s.allocs, k)
+		}
+		s.mux.Unlock()
+	}
 	raddr, conn, err := a.raddr.New(tuple.Proto)
 	if err != nil {
-		a.log.Error("failed",
-			zap.Stringer("tuple", tuple),
-			zap.Error(err),
-		)
-		return turn.Addr{}, errors.Wrap(err, "failed to allocate")
+		l.Error("failed", zap.Error(err))
+		drop()
+		return turn.Addr{}, turn.Addr{}, errors.Wrap(err, "failed to allocate")
+	}
+	var (
+		raddr6 turn.Addr
+		conn6  net.PacketConn
+	)
+	if dual {
+		if raddr6, conn6, err = ipv6.NewIPv6(tuple.Proto); err != nil {
+			l.Warn("failed to allocate IPv6", zap.Error(err))
+			drop()
+			if rmErr := a.raddr.Remove(raddr, tuple.Proto); rmErr != nil {
+				l.Warn("failed to remove allocation", zap.Error(rmErr))
+			}
+			if err == ErrAddrFamilyNotSupported {
+				return turn.Addr{}, turn.Addr{}, err
+			}
+			return turn.Addr{}, turn.Addr{}, errors.Wrap(err, "failed to allocate IPv6")
+		}
+		l = l.With(zap.Stringer("raddr6", raddr6))
 	}
 	l = l.With(zap.Stringer("raddr", raddr))
 	l.Debug("ok")
+	a.setup(l, conn)
+	if conn6 != nil {
+		a.setup(l, conn6)
+	}
 	buf := make([]byte, 2048)
 
-	a.allocsMux.Lock()
-	for i := range a.allocs {
-		if !a.allocs[i].Tuple.Equal(tuple) {
-			continue
+	s.mux.Lock()
+	if s.allocs[k] != allocation {
+		// Removed while relayed address was allocated, releasing it.
+		s.mux.Unlock()
+		a.release(l, tuple.Proto, raddr, raddr6)
+		return turn.Addr{}, turn.Addr{}, ErrAllocationMismatch
+	}
+	allocation.Conn = conn
+	allocation.RelayedAddr = raddr
+	allocation.Buf = buf
+	if conn6 != nil {
+		allocation.Conn6 = conn6
+		allocation.RelayedAddr6 = raddr6
+		allocation.df6 = new(dontFragment)
+		allocation.buf6 = make([]byte, 2048)
+	}
+	allocation.Log = l
+	// Copying under lock, as allocation can be already modified.
+	created := *allocation
+	s.mux.Unlock()
+
+	a.startReading(created)
+	a.notify(EventAllocate, created, now)
+	return raddr, raddr6, nil
+}
+
+// startReading starts reading relay sockets of new allocation, falling
+// back to goroutine per allocation if they can't be read by pool.
+func (a *Allocator) startReading(alloc Allocation) {
+	if a.readers == nil {
+		go alloc.ReadUntilClosed()
+		return
+	}
+	if err := a.readers.add(alloc); err != nil {
+		alloc.Log.Warn("failed to add to reader pool", zap.Error(err))
+		go alloc.ReadUntilClosed()
+	}
+}
+
+// stopReading removes relay sockets of allocation from reader pool before
+// they are released.
+func (a *Allocator) stopReading(alloc Allocation) {
+	if a.readers == nil {
+		return
+	}
+	a.readers.remove(alloc.Conn)
+	a.readers.remove(alloc.Conn6)
+}
+
+// setup sets socket options of new relay socket.
+func (a *Allocator) setup(l *zap.Logger, conn net.PacketConn) {
+	if recvErr := setRecvErr(conn); recvErr != nil {
+		l.Debug("ICMP errors are not reported", zap.Error(recvErr))
+	}
+	if a.buffers != (SocketBuffers{}) {
+		// OS can clamp requested sizes, so logging effective ones.
+		b, bufErr := SetSocketBuffers(conn, a.buffers)
+		if bufErr != nil {
+			l.Warn("failed to set socket buffers", zap.Error(bufErr))
+		} else {
+			l.Debug("socket buffers", zap.Int("rcvbuf", b.Read), zap.Int("sndbuf", b.Write))
 		}
-		allocation.Conn = conn
-		allocation.RelayedAddr = raddr
-		allocation.Buf = buf
-		allocation.Log = l
-		a.allocs[i] = allocation
-		break
 	}
-	a.allocsMux.Unlock()
+	if a.dscp != 0 {
+		if dscpErr := setDSCP(conn, a.dscp); dscpErr != nil {
+			l.Warn("failed to set DSCP", zap.Error(dscpErr))
+		}
+	}
+}
 
-	go allocation.ReadUntilClosed()
-	return raddr, nil
+// realmAllocations returns count of allocations in realm.
+func (a *Allocator) realmAllocations(realm string) int {
+	n := 0
+	for i := range a.shards {
+		s := &a.shards[i]
+		s.mux.RLock()
+		for _, alloc := range s.allocs {
+			if alloc.Realm == realm {
+				n++
+			}
+		}
+		s.mux.RUnlock()
+	}
+	return n
 }
 
 // CreatePermission creates new permission for existing client allocation.
 func (a *Allocator) CreatePermission(tuple turn.FiveTuple, peer turn.Addr, timeout time.Time) error {
-	permission := Permission{
-		Timeout: timeout,
+	return a.CreatePermissions(tuple, []turn.Addr{peer}, timeout)
+}
+
+// CreatePermissions creates or refreshes permissions for all peers of
+// existing client allocation. Either all permissions are installed or
+// refreshed, or none of them.
+//
+// See RFC 5766 Section 9.2.
+func (a *Allocator) CreatePermissions(tuple turn.FiveTuple, peers []turn.Addr, timeout time.Time) error {
+	k := newTupleKey(tuple)
+	s := a.shard(k)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	alloc, found := s.allocs[k]
+	if !found {
+		return ErrAllocationMismatch
 	}
-	permission.IP = append(permission.IP, peer.IP...)
-	var (
-		found   bool
-		updated bool
-	)
-	a.allocsMux.Lock()
-	for i := range a.allocs {
-		if !a.allocs[i].Tuple.Equal(tuple) {
-			continue
+	// Validating all peers before any change.
+	created := 0
+	for i, peer := range peers {
+		if !alloc.canRelayTo(peer) {
+			return ErrPeerAddrFamilyMismatch
 		}
-		found = true
-		for k := range a.allocs[i].Permissions {
-			if !a.allocs[i].Permissions[k].IP.Equal(peer.IP) {
-				continue
+		if alloc.permission(peer.IP) == nil && !containsIP(peers[:i], peer.IP) {
+			created++
+		}
+	}
+	if a.maxPerms > 0 && created > 0 && len(alloc.Permissions)+created > a.maxPerms {
+		return ErrPermissionLimit
+	}
+	for _, peer := range peers {
+		updated := false
+		if p := alloc.permission(peer.IP); p != nil {
+			// Updating. Permission should not expire before any of its
+			// channel bindings, otherwise bindings are pruned too.
+			p.Timeout = timeout
+			for _, b := range p.Bindings {
+				if b.Timeout.After(p.Timeout) {
+					p.Timeout = b.Timeout
+				}
 			}
-			// Updating.
-			a.allocs[i].Permissions[k].Timeout = timeout
 			updated = true
-			break
-		}
-		if !updated {
+		} else {
 			// Creating new permission instead.
-			a.allocs[i].Permissions = append(a.allocs[i].Permissions, permission)
+			permission := Permission{
+				Timeout: timeout,
+			}
+			permission.IP = append(permission.IP, peer.IP...)
+			alloc.Permissions = append(alloc.Permissions, permission)
 		}
-		break
-	}
-	a.allocsMux.Unlock()
-	if !found {
-		return ErrAllocationMismatch
+		alloc.Log.Debug("permission",
+			zap.Stringer("peer", peer),
+			zap.Bool("updated", updated),
+			zap.Time("timeout", timeout),
+		)
 	}
-	a.log.Debug("permission",
-		zap.Stringer("tuple", tuple),
-		zap.Stringer("peer", peer),
-		zap.Bool("updated", updated),
-		zap.Time("timeout", timeout),
-	)
 	return nil
 }
 
+// containsIP reports whether any of addrs has ip.
+func containsIP(addrs []turn.Addr, ip net.IP) bool {
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // ChannelBind represents channel bind request, creating or refreshing
 // channel binding.
 //
@@ -373,126 +853,156 @@ func (a *Allocator) ChannelBind(tuple turn.FiveTuple, n turn.ChannelNumber, peer
 	}
 	updated := false
 	found := false
-	allocFound := false
-	a.allocsMux.Lock()
-	defer a.allocsMux.Unlock()
-	for i := range a.allocs {
-		if !a.allocs[i].Tuple.Equal(tuple) {
+	k := newTupleKey(tuple)
+	s := a.shard(k)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	alloc, ok := s.allocs[k]
+	if !ok {
+		// No allocation found.
+		return ErrAllocationMismatch
+	}
+	if !alloc.canRelayTo(peer) {
+		return ErrPeerAddrFamilyMismatch
+	}
+	channelLimitReached := a.maxChans > 0 && alloc.bindings() >= a.maxChans
+	// Searching for existing permission.
+	for i := range alloc.Permissions {
+		p := &alloc.Permissions[i]
+		if !p.IP.Equal(peer.IP) {
 			continue
 		}
-		// Searching for existing permission.
-		for k := range a.allocs[i].Permissions {
-			pIP := a.allocs[i].Permissions[k].IP
-			if !pIP.Equal(peer.IP) {
+		// Checking for binding conflicts.
+		if p.conflicts(n, peer) {
+			// There is existing binding with same channel number or peer turn.Address.
+			alloc.Log.Debug("binding conflict",
+				zap.Stringer("addr", peer),
+				zap.Stringer("binding", n),
+			)
+			return ErrAllocationMismatch
+		}
+		for j := range p.Bindings {
+			if p.Bindings[j].Channel != n {
 				continue
 			}
-			// Checking for binding conflicts.
-			if a.allocs[i].Permissions[k].conflicts(n, peer) {
-				// There is existing binding with same channel number or peer turn.Address.
-				fmt.Printf("Conflict %+v: %d %s",
-					a.allocs[i].Permissions[k],
-					n, peer,
-				)
-				return ErrAllocationMismatch
-			}
-			for j := range a.allocs[i].Permissions[k].Bindings {
-				if a.allocs[i].Permissions[k].Bindings[j].Channel != n {
-					continue
-				}
-				// Updating existing binding and permission.
-				a.allocs[i].Permissions[k].Bindings[j].Timeout = timeout
-				if timeout.After(a.allocs[i].Permissions[k].Timeout) {
-					a.allocs[i].Permissions[k].Timeout = timeout
-				}
-				a.log.Debug("updated binding",
-					zap.Stringer("addr", peer),
-					zap.Stringer("tuple", tuple),
-					zap.Stringer("binding", n),
-				)
-				updated = true
-				break
-			}
-			if !updated {
-				// No binding found, creating new one.
-				a.log.Debug("created binding",
-					zap.Stringer("addr", peer),
-					zap.Stringer("tuple", tuple),
-					zap.Stringer("binding", n),
-				)
-				if timeout.After(a.allocs[i].Permissions[k].Timeout) {
-					a.allocs[i].Permissions[k].Timeout = timeout
-				}
-				a.allocs[i].Permissions[k].Bindings = append(a.allocs[i].Permissions[k].Bindings, Binding{
-					Port:    peer.Port,
-					Channel: n,
-					Timeout: timeout,
-				})
+			// Updating existing binding and permission.
+			p.Bindings[j].Timeout = timeout
+			if timeout.After(p.Timeout) {
+				p.Timeout = timeout
 			}
-			found = true
+			alloc.Log.Debug("updated binding",
+				zap.Stringer("addr", peer),
+				zap.Stringer("binding", n),
+			)
+			updated = true
 			break
 		}
-		if !found {
-			// No permission found, creating new one.
-			a.log.Debug("created permission via binding",
+		if !updated {
+			if channelLimitReached {
+				return ErrChannelLimit
+			}
+			// No binding found, creating new one.
+			alloc.Log.Debug("created binding",
 				zap.Stringer("addr", peer),
-				zap.Stringer("tuple", tuple),
 				zap.Stringer("binding", n),
 			)
-			a.allocs[i].Permissions = append(a.allocs[i].Permissions, Permission{
-				IP:      peer.IP,
+			if timeout.After(p.Timeout) {
+				p.Timeout = timeout
+			}
+			p.Bindings = append(p.Bindings, Binding{
+				Port:    peer.Port,
+				Channel: n,
 				Timeout: timeout,
-				Bindings: []Binding{
-					{
-						Timeout: timeout,
-						Channel: n,
-						Port:    peer.Port,
-					},
-				},
 			})
+			alloc.bindChannel(n, peer)
 		}
-		allocFound = true
+		found = true
+		break
 	}
-	if !allocFound {
-		// No allocation found.
-		return ErrAllocationMismatch
+	if !found {
+		if a.maxPerms > 0 && len(alloc.Permissions) >= a.maxPerms {
+			return ErrPermissionLimit
+		}
+		if channelLimitReached {
+			return ErrChannelLimit
+		}
+		// No permission found, creating new one.
+		alloc.Log.Debug("created permission via binding",
+			zap.Stringer("addr", peer),
+			zap.Stringer("binding", n),
+		)
+		alloc.Permissions = append(alloc.Permissions, Permission{
+			IP:      peer.IP,
+			Timeout: timeout,
+			Bindings: []Binding{
+				{
+					Timeout: timeout,
+					Channel: n,
+					Port:    peer.Port,
+				},
+			},
+		})
+		alloc.bindChannel(n, peer)
 	}
 	return nil
 }
 
 // Bound returns currently bound channel for provided 5-tuple.
 func (a *Allocator) Bound(tuple turn.FiveTuple, peer turn.Addr) (turn.ChannelNumber, error) {
-	a.allocsMux.RLock()
-	defer a.allocsMux.RUnlock()
-	for i := range a.allocs {
-		if !a.allocs[i].Tuple.Equal(tuple) {
-			continue
-		}
-		for k := range a.allocs[i].Permissions {
-			if !a.allocs[i].Permissions[k].IP.Equal(peer.IP) {
-				continue
-			}
-			for j := range a.allocs[i].Permissions[k].Bindings {
-				if a.allocs[i].Permissions[k].Bindings[j].Port == peer.Port {
-					return a.allocs[i].Permissions[k].Bindings[j].Channel, nil
-				}
-			}
-		}
+	k := newTupleKey(tuple)
+	s := a.shard(k)
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	alloc, ok := s.allocs[k]
+	if !ok {
+		return 0, ErrAllocationMismatch
+	}
+	// Called for every packet from peer, so using index instead of
+	// permissions scan.
+	if n, bound := alloc.peers[newPeerKey(peer)]; bound {
+		return n, nil
 	}
 	return 0, ErrAllocationMismatch
 }
 
+// RelayedAddr returns relayed transport address of allocation.
+func (a *Allocator) RelayedAddr(tuple turn.FiveTuple) (turn.Addr, error) {
+	k := newTupleKey(tuple)
+	s := a.shard(k)
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	alloc, ok := s.allocs[k]
+	if !ok {
+		return turn.Addr{}, ErrAllocationMismatch
+	}
+	return alloc.RelayedAddr, nil
+}
+
+// RelayedAddrs is same as RelayedAddr, but also returns IPv6 relayed
+// transport address of dual allocation, zero if allocation is not dual.
+func (a *Allocator) RelayedAddrs(tuple turn.FiveTuple) (relayed, relayed6 turn.Addr, err error) {
+	k := newTupleKey(tuple)
+	s := a.shard(k)
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	alloc, ok := s.allocs[k]
+	if !ok {
+		return turn.Addr{}, turn.Addr{}, ErrAllocationMismatch
+	}
+	return alloc.RelayedAddr, alloc.RelayedAddr6, nil
+}
+
 // Refresh updates existing allocation timeout.
 func (a *Allocator) Refresh(tuple turn.FiveTuple, timeout time.Time) error {
 	// TODO: handle permission not found error.
-	a.allocsMux.Lock()
-	for i := range a.allocs {
-		if !a.allocs[i].Tuple.Equal(tuple) {
-			continue
-		}
-		a.allocs[i].Timeout = timeout
-		break
+	k := newTupleKey(tuple)
+	s := a.shard(k)
+	s.mux.Lock()
+	if alloc, ok := s.allocs[k]; ok {
+		alloc.Timeout = timeout
+		alloc.Log.Debug("refreshed", zap.Time("timeout", timeout))
 	}
-	a.allocsMux.Unlock()
+	s.mux.Unlock()
 	return nil
 }
 
@@ -504,20 +1014,32 @@ type Stats struct {
 	Permissions int
 	// Bindings is the total number of channel bindings in all allocations.
 	Bindings int
+	// BytesIn is the total number of bytes received from peers by all
+	// allocations, including removed ones.
+	BytesIn uint64
+	// BytesOut is the total number of bytes sent to peers by all
+	// allocations, including removed ones.
+	BytesOut uint64
+	// Unreachable is the total number of ICMP errors received for relayed
+	// packets, e.g. port unreachable. Only reported on linux.
+	Unreachable uint64
 }
 
 // Stats returns current statistics.
 func (a *Allocator) Stats() Stats {
-	a.allocsMux.Lock()
-	s := Stats{
-		Allocations: len(a.allocs),
-	}
-	for i := range a.allocs {
-		s.Permissions += len(a.allocs[i].Permissions)
-		for k := range a.allocs[i].Permissions {
-			s.Bindings += len(a.allocs[i].Permissions[k].Bindings)
+	var s Stats
+	for i := range a.shards {
+		shard := &a.shards[i]
+		shard.mux.RLock()
+		s.Allocations += len(shard.allocs)
+		for _, alloc := range shard.allocs {
+			s.Permissions += len(alloc.Permissions)
+			s.Bindings += alloc.bindings()
 		}
+		shard.mux.RUnlock()
 	}
-	a.allocsMux.Unlock()
+	// Not holding the locks, traffic is counted atomically.
+	s.BytesIn, s.BytesOut = a.traffic.load()
+	s.Unreachable = a.traffic.loadUnreachable()
 	return s
 }
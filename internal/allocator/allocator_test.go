@@ -2,12 +2,16 @@ package allocator
 
 import (
 	"net"
+	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 
 	"gortc.io/turn"
 )
@@ -27,7 +31,7 @@ func TestAllocator_Collect(t *testing.T) {
 	a := NewAllocator(Options{Conn: p})
 	c := make(chan prometheus.Metric)
 	go a.Collect(c)
-	expectedCount := 3
+	expectedCount := 6
 	for i := 0; i < expectedCount; i++ {
 		select {
 		case <-time.After(time.Millisecond * 100):
@@ -38,6 +42,43 @@ func TestAllocator_Collect(t *testing.T) {
 	}
 }
 
+func TestAllocator_Ages(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		tuple := turn.FiveTuple{
+			Client: turn.Addr{Port: 200 + i, IP: net.IPv4(127, 0, 0, 1)},
+			Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+			Proto:  turn.ProtoUDP,
+		}
+		if _, err = a.New(tuple, "", now.Add(time.Minute*10*time.Duration(i+1)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// First allocation is expired, remaining are 15 minutes old.
+	a.Prune(now.Add(time.Minute * 15))
+	a.agesMux.Lock()
+	ages := a.ages
+	a.agesMux.Unlock()
+	if ages.count != 2 {
+		t.Fatalf("unexpected count %d", ages.count)
+	}
+	if ages.sum <= 2*14*60 || ages.sum > 2*15*60 {
+		t.Errorf("unexpected sum %f", ages.sum)
+	}
+	b := ages.buckets()
+	if b[600] != 0 || b[1800] != 2 || b[86400] != 2 {
+		t.Errorf("unexpected buckets %v", b)
+	}
+}
+
 func TestAllocator_New(t *testing.T) {
 	d := &DummyNetPortAlloc{
 		currentPort: 5100,
@@ -77,7 +118,7 @@ func TestAllocator_New(t *testing.T) {
 	if a.Stats().Allocations != 0 {
 		t.Error("unexpected allocation count")
 	}
-	relayedAddr, err := a.New(tuple, timeout, nil)
+	relayedAddr, err := a.New(tuple, "", timeout, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -96,16 +137,23 @@ func TestAllocator_New(t *testing.T) {
 			t.Fatal(err)
 		}
 		aErr := NewAllocator(Options{Conn: pErr})
-		if _, err := aErr.New(tuple, timeout, nil); errors.Cause(err) != dErr.err {
+		if _, err := aErr.New(tuple, "", timeout, nil); errors.Cause(err) != dErr.err {
 			t.Errorf("unexpected error: %s", err)
 		}
+		// Failed allocation should not hold 5-tuple.
+		if _, err := aErr.New(tuple, "", timeout, nil); errors.Cause(err) != dErr.err {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if n := aErr.Stats().Allocations; n != 0 {
+			t.Errorf("unexpected allocation count %d", n)
+		}
 	})
 	t.Run("BadProto", func(t *testing.T) {
 		if _, err := a.New(turn.FiveTuple{
 			Client: client,
 			Server: server,
 			Proto:  1,
-		}, timeout, nil); err == nil {
+		}, "", timeout, nil); err == nil {
 			t.Error("should error")
 		}
 	})
@@ -117,7 +165,7 @@ func TestAllocator_New(t *testing.T) {
 		t.Errorf("unexpected relayed addr: %s", relayedAddr)
 	}
 	// Creating allocation and two permissions.
-	if _, err = a.New(tuple, timeout, nil); err != ErrAllocationMismatch {
+	if _, err = a.New(tuple, "", timeout, nil); err != ErrAllocationMismatch {
 		t.Error("New() with same tuple should return mismatch error")
 	}
 	if a.Stats().Allocations != 1 {
@@ -160,6 +208,9 @@ func TestAllocator_New(t *testing.T) {
 	if _, err := a.Send(tuple, peer2, make([]byte, 100)); err != nil {
 		t.Error(err)
 	}
+	if expired := atomic.LoadUint64(&a.expired); expired != 1 {
+		t.Errorf("unexpected expired count: %d", expired)
+	}
 	// Collecting T+17. Entire allocation expires.
 	// Both permissions should expire too.
 	a.Prune(now.Add(time.Second * 17))
@@ -178,7 +229,7 @@ func TestAllocator_New(t *testing.T) {
 		t.Errorf("unexpected allocation count")
 	}
 	// Re-creating allocation with same tuple should now succeed.
-	relayedAddr, err = a.New(tuple, timeout, nil)
+	relayedAddr, err = a.New(tuple, "", timeout, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -234,7 +285,7 @@ func TestAllocator_ChannelBind(t *testing.T) {
 		Server: server,
 		Proto:  turn.ProtoUDP,
 	}
-	relayedAddr, err := a.New(tuple, timeout, nil)
+	relayedAddr, err := a.New(tuple, "", timeout, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -250,7 +301,7 @@ func TestAllocator_ChannelBind(t *testing.T) {
 			t.Fatal(err)
 		}
 		aErr := NewAllocator(Options{Conn: pErr})
-		if _, err := aErr.New(tuple, timeout, nil); errors.Cause(err) != dErr.err {
+		if _, err := aErr.New(tuple, "", timeout, nil); errors.Cause(err) != dErr.err {
 			t.Errorf("unexpected error: %s", err)
 		}
 	})
@@ -259,7 +310,7 @@ func TestAllocator_ChannelBind(t *testing.T) {
 			Client: client,
 			Server: server,
 			Proto:  1,
-		}, timeout, nil); err == nil {
+		}, "", timeout, nil); err == nil {
 			t.Error("should error")
 		}
 	})
@@ -271,7 +322,7 @@ func TestAllocator_ChannelBind(t *testing.T) {
 		t.Errorf("unexpected relayed addr: %s", relayedAddr)
 	}
 	// Creating allocation and two permissions.
-	if _, err = a.New(tuple, timeout, nil); err != ErrAllocationMismatch {
+	if _, err = a.New(tuple, "", timeout, nil); err != ErrAllocationMismatch {
 		t.Error("New() with same tuple should return mismatch error")
 	}
 	if err := a.ChannelBind(tuple, n, peer, now.Add(time.Second*5)); err != nil {
@@ -317,7 +368,7 @@ func TestAllocator_ChannelBind(t *testing.T) {
 		t.Error("unexpected allocation error, should be ErrAllocationNotFound")
 	}
 	// Re-creating allocation with same tuple should now succeed.
-	relayedAddr, err = a.New(tuple, timeout, nil)
+	relayedAddr, err = a.New(tuple, "", timeout, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -330,3 +381,1003 @@ func TestAllocator_ChannelBind(t *testing.T) {
 	}
 	a.Remove(tuple)
 }
+
+func TestAllocator_MaxAllocations(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p, MaxAllocations: 1})
+	timeout := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	if _, err = a.New(tuple, "", timeout, nil); err != nil {
+		t.Fatal(err)
+	}
+	tuple2 := tuple
+	tuple2.Client.Port = 201
+	if _, err = a.New(tuple2, "", timeout, nil); err != ErrInsufficientCapacity {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err = a.Remove(tuple); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.New(tuple2, "", timeout, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAllocator_NewInRealm(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p})
+	timeout := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	if _, err = a.NewInRealm(tuple, "user", "a.example.com", 1, timeout, nil); err != nil {
+		t.Fatal(err)
+	}
+	tuple2 := tuple
+	tuple2.Client.Port = 201
+	if _, err = a.NewInRealm(tuple2, "user", "a.example.com", 1, timeout, nil); err != ErrRealmQuota {
+		t.Errorf("unexpected error: %v", err)
+	}
+	t.Run("OtherRealm", func(t *testing.T) {
+		if _, err = a.NewInRealm(tuple2, "user", "b.example.com", 1, timeout, nil); err != nil {
+			t.Error(err)
+		}
+	})
+	if err = a.Remove(tuple); err != nil {
+		t.Fatal(err)
+	}
+	tuple3 := tuple
+	tuple3.Client.Port = 202
+	if _, err = a.NewInRealm(tuple3, "user", "a.example.com", 1, timeout, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAllocator_MaxPermissions(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p, MaxPermissions: 1})
+	timeout := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	if _, err = a.New(tuple, "", timeout, nil); err != nil {
+		t.Fatal(err)
+	}
+	peer := turn.Addr{Port: 400, IP: net.IPv4(127, 0, 0, 2)}
+	if err = a.CreatePermission(tuple, peer, timeout); err != nil {
+		t.Fatal(err)
+	}
+	// Refreshing existing permission is not limited.
+	if err = a.CreatePermission(tuple, peer, timeout.Add(time.Minute)); err != nil {
+		t.Error(err)
+	}
+	if err = a.ChannelBind(tuple, 0x4001, peer, timeout); err != nil {
+		t.Error(err)
+	}
+	other := turn.Addr{Port: 400, IP: net.IPv4(127, 0, 0, 3)}
+	if err = a.CreatePermission(tuple, other, timeout); err != ErrPermissionLimit {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err = a.ChannelBind(tuple, 0x4002, other, timeout); err != ErrPermissionLimit {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if s := a.Stats(); s.Permissions != 1 {
+		t.Errorf("unexpected permissions count %d", s.Permissions)
+	}
+}
+
+func TestAllocator_CreatePermissions(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p, MaxPermissions: 2})
+	timeout := time.Now().Add(time.Minute)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	if _, err = a.New(tuple, "", timeout, nil); err != nil {
+		t.Fatal(err)
+	}
+	peers := []turn.Addr{
+		{Port: 201, IP: net.IPv4(127, 0, 0, 1)},
+		{Port: 202, IP: net.IPv4(127, 0, 0, 1)}, // same permission
+		{Port: 201, IP: net.IPv4(127, 0, 0, 2)},
+	}
+	if err = a.CreatePermissions(tuple, peers, timeout); err != nil {
+		t.Fatal(err)
+	}
+	if s := a.Stats(); s.Permissions != 2 {
+		t.Errorf("unexpected permissions count %d", s.Permissions)
+	}
+	// Limit is exceeded by one of peers, so none should be installed.
+	err = a.CreatePermissions(tuple, []turn.Addr{
+		{Port: 201, IP: net.IPv4(127, 0, 0, 1)},
+		{Port: 201, IP: net.IPv4(127, 0, 0, 3)},
+	}, timeout.Add(time.Minute))
+	if err != ErrPermissionLimit {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if s := a.Stats(); s.Permissions != 2 {
+		t.Errorf("unexpected permissions count %d", s.Permissions)
+	}
+	if err = a.CreatePermissions(tuple, []turn.Addr{
+		{Port: 201, IP: net.IPv4(127, 0, 0, 1)},
+		{Port: 201, IP: net.ParseIP("2001:db8::1")},
+	}, timeout); err != ErrPeerAddrFamilyMismatch {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAllocator_MaxChannels(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const maxChannels = 3
+	a := NewAllocator(Options{Conn: p, MaxChannels: maxChannels})
+	timeout := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	if _, err = a.New(tuple, "", timeout, nil); err != nil {
+		t.Fatal(err)
+	}
+	peer := func(i int) turn.Addr {
+		// Using both new and existing permissions.
+		return turn.Addr{Port: 400 + i, IP: net.IPv4(127, 0, 0, byte(2+i%2))}
+	}
+	for i := 0; i < maxChannels; i++ {
+		if err = a.ChannelBind(tuple, turn.ChannelNumber(0x4001+i), peer(i), timeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := turn.ChannelNumber(0x4001 + maxChannels)
+	if err = a.ChannelBind(tuple, n, peer(maxChannels), timeout); err != ErrChannelLimit {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err = a.ChannelBind(tuple, n, turn.Addr{Port: 400, IP: net.IPv4(127, 0, 0, 10)}, timeout); err != ErrChannelLimit {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// Refreshing existing binding is not limited.
+	if err = a.ChannelBind(tuple, 0x4001, peer(0), timeout.Add(time.Minute)); err != nil {
+		t.Error(err)
+	}
+	for i := 0; i < maxChannels; i++ {
+		bound, boundErr := a.Bound(tuple, peer(i))
+		if boundErr != nil {
+			t.Fatal(boundErr)
+		}
+		if bound != turn.ChannelNumber(0x4001+i) {
+			t.Errorf("unexpected channel %s for %s", bound, peer(i))
+		}
+	}
+	if s := a.Stats(); s.Bindings != maxChannels {
+		t.Errorf("unexpected bindings count %d", s.Bindings)
+	}
+}
+
+func TestAllocator_PeerAddrFamilyMismatch(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p})
+	timeout := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	if _, err = a.New(tuple, "", timeout, nil); err != nil {
+		t.Fatal(err)
+	}
+	peer := turn.Addr{Port: 400, IP: net.ParseIP("2001:db8::1")}
+	if err = a.CreatePermission(tuple, peer, timeout); err != ErrPeerAddrFamilyMismatch {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err = a.ChannelBind(tuple, 0x4001, peer, timeout); err != ErrPeerAddrFamilyMismatch {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err = a.CreatePermission(tuple, turn.Addr{Port: 400, IP: net.IPv4(127, 0, 0, 2)}, timeout); err != nil {
+		t.Error(err)
+	}
+	if s := a.Stats(); s.Permissions != 1 {
+		t.Errorf("unexpected permissions count %d", s.Permissions)
+	}
+}
+
+func TestAllocator_NewDual(t *testing.T) {
+	peer6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip("IPv6 is not available")
+	}
+	defer peer6.Close()
+	peer4, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer4.Close()
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	}, SystemPortAllocator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan turn.Addr, 1)
+	handler := peerHandlerFunc(func(d []byte, tuple turn.FiveTuple, addr turn.Addr) {
+		received <- addr
+	})
+	a := NewAllocator(Options{Conn: p})
+	timeout := time.Now().Add(time.Minute)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	t.Run("NoIPv6", func(t *testing.T) {
+		if _, _, err := a.NewDual(tuple, "", "", 0, timeout, handler); err != ErrAddrFamilyNotSupported {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if n := a.Stats().Allocations; n != 0 {
+			t.Errorf("unexpected allocations count %d", n)
+		}
+	})
+	if err = p.SetIPv6(net.IPv4(127, 0, 0, 1)); err == nil {
+		t.Error("IPv4 address should be rejected")
+	}
+	if err = p.SetIPv6(net.IPv6loopback); err != nil {
+		t.Fatal(err)
+	}
+	relayed, relayed6, err := a.NewDual(tuple, "", "", 0, timeout, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relayed.IP.To4() == nil || !relayed6.IP.Equal(net.IPv6loopback) {
+		t.Fatalf("unexpected relayed addresses %s and %s", relayed, relayed6)
+	}
+	peers := []turn.Addr{
+		{IP: net.IPv4(127, 0, 0, 1), Port: peer4.LocalAddr().(*net.UDPAddr).Port},
+		{IP: net.IPv6loopback, Port: peer6.LocalAddr().(*net.UDPAddr).Port},
+	}
+	if err = a.CreatePermissions(tuple, peers, timeout); err != nil {
+		t.Fatal(err)
+	}
+	// Data to each peer should be relayed via relayed address of same
+	// family.
+	for i, peer := range []*net.UDPConn{peer4, peer6} {
+		if _, err = a.Send(tuple, peers[i], []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if err = peer.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 100)
+		_, from, readErr := peer.ReadFromUDP(buf)
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		expected := relayed
+		if i == 1 {
+			expected = relayed6
+		}
+		if from.Port != expected.Port {
+			t.Errorf("data to %s relayed from %s, expected %s", peers[i], from, expected)
+		}
+	}
+	if _, err = peer6.WriteToUDP([]byte("hello"), &net.UDPAddr{IP: relayed6.IP, Port: relayed6.Port}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case addr := <-received:
+		if !addr.Equal(peers[1]) {
+			t.Errorf("unexpected peer %s", addr)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("data from IPv6 peer is not received")
+	}
+	if _, gotRelayed6, err := a.RelayedAddrs(tuple); err != nil || !gotRelayed6.Equal(relayed6) {
+		t.Errorf("unexpected IPv6 relayed address %s: %v", gotRelayed6, err)
+	}
+	if err = a.Remove(tuple); err != nil {
+		t.Fatal(err)
+	}
+	// Both relayed addresses should be released.
+	for _, addr := range []turn.Addr{relayed, relayed6} {
+		conn, listenErr := net.ListenUDP("udp", &net.UDPAddr{IP: addr.IP, Port: addr.Port})
+		if listenErr != nil {
+			t.Errorf("relayed address %s is not released: %v", addr, listenErr)
+			continue
+		}
+		if err = conn.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestAllocator_RemoveFamily(t *testing.T) {
+	peer6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip("IPv6 is not available")
+	}
+	defer peer6.Close()
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	}, SystemPortAllocator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.SetIPv6(net.IPv6loopback); err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p})
+	timeout := time.Now().Add(time.Minute)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	relayed, relayed6, err := a.NewDual(tuple, "", "", 0, timeout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		peer4 = turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+		peer  = turn.Addr{IP: net.IPv6loopback, Port: peer6.LocalAddr().(*net.UDPAddr).Port}
+	)
+	if err = a.ChannelBind(tuple, 0x4000, peer4, timeout); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ChannelBind(tuple, 0x4001, peer, timeout); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.RemoveFamily(tuple, false); err != nil {
+		t.Fatal(err)
+	}
+	// IPv6 relayed address is the only one left.
+	gotRelayed, gotRelayed6, err := a.RelayedAddrs(tuple)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotRelayed.Equal(relayed6) || gotRelayed6.IP != nil {
+		t.Errorf("unexpected relayed addresses %s and %s", gotRelayed, gotRelayed6)
+	}
+	if s := a.Stats(); s.Permissions != 1 || s.Bindings != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	if _, err = a.Bound(tuple, peer4); err == nil {
+		t.Error("IPv4 binding should be removed")
+	}
+	if _, err = a.SendBound(tuple, 0x4001, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err = peer6.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatal(err)
+	}
+	_, from, err := peer6.ReadFromUDP(make([]byte, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.Port != relayed6.Port {
+		t.Errorf("data relayed from %s, expected %s", from, relayed6)
+	}
+	if _, err = a.Send(tuple, peer4, []byte("hello")); err == nil {
+		t.Error("IPv4 peer should not be relayed")
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: relayed.IP, Port: relayed.Port})
+	if err != nil {
+		t.Fatalf("IPv4 relayed address is not released: %v", err)
+	}
+	if err = conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Allocation is removed with the last relayed address.
+	if err = a.RemoveFamily(tuple, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := a.Stats().Allocations; n != 0 {
+		t.Errorf("unexpected allocations count %d", n)
+	}
+	if err = a.RemoveFamily(tuple, true); err != ErrAllocationMismatch {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAllocator_IdleTimeout(t *testing.T) {
+	ports := &recordingNetPortAlloc{DummyNetPortAlloc: DummyNetPortAlloc{currentPort: 5100}}
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p, IdleTimeout: time.Minute})
+	now := time.Now()
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	if _, err = a.New(tuple, "", now.Add(time.Hour), nil); err != nil {
+		t.Fatal(err)
+	}
+	a.Prune(now.Add(time.Second * 30))
+	if a.Stats().Allocations != 1 {
+		t.Error("allocation should not be idle yet")
+	}
+	if ports.conns[0].isClosed() {
+		t.Error("relay socket of active allocation should not be closed")
+	}
+	a.Prune(now.Add(time.Minute * 2))
+	if a.Stats().Allocations != 0 {
+		t.Error("idle allocation should be removed")
+	}
+	if !ports.conns[0].isClosed() {
+		t.Error("relay socket of idle allocation should be closed")
+	}
+}
+
+// recordingNetPortAlloc records relay connections.
+type recordingNetPortAlloc struct {
+	DummyNetPortAlloc
+	conns []*dummyConn
+}
+
+func (p *recordingNetPortAlloc) AllocatePort(proto turn.Protocol, network, defaultAddr string) (NetAllocation, error) {
+	n, err := p.DummyNetPortAlloc.AllocatePort(proto, network, defaultAddr)
+	if err == nil {
+		p.conns = append(p.conns, n.Conn.(*dummyConn))
+	}
+	return n, err
+}
+
+func (c *dummyConn) isClosed() bool {
+	c.closedMux.Lock()
+	defer c.closedMux.Unlock()
+	return c.closed
+}
+
+func TestAllocator_RemoveClosesRelay(t *testing.T) {
+	ports := &recordingNetPortAlloc{DummyNetPortAlloc: DummyNetPortAlloc{currentPort: 5100}}
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p})
+	now := time.Now()
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	tuple2 := tuple
+	tuple2.Client.Port = 201
+	if _, err = a.New(tuple, "", now.Add(time.Hour), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.New(tuple2, "", now.Add(time.Minute), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Remove(tuple); err != nil {
+		t.Fatal(err)
+	}
+	if !ports.conns[0].isClosed() {
+		t.Error("relay socket should be closed on remove")
+	}
+	if ports.conns[1].isClosed() {
+		t.Fatal("relay socket of other allocation should not be closed")
+	}
+	a.Prune(now.Add(time.Minute * 2))
+	if !ports.conns[1].isClosed() {
+		t.Error("relay socket should be closed on expiration")
+	}
+}
+
+func TestAllocator_ChannelBindRefresh(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p})
+	now := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	peer := turn.Addr{Port: 201, IP: net.IPv4(127, 0, 0, 1)}
+	const n = turn.ChannelNumber(0x4000)
+	if _, err = a.New(tuple, "", now.Add(time.Minute*30), nil); err != nil {
+		t.Fatal(err)
+	}
+	// Permission is valid until T+5, binding should extend it to T+10.
+	if err = a.CreatePermission(tuple, peer, now.Add(time.Minute*5)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ChannelBind(tuple, n, peer, now.Add(time.Minute*10)); err != nil {
+		t.Fatal(err)
+	}
+	a.Prune(now.Add(time.Minute * 7))
+	if _, err = a.SendBound(tuple, n, make([]byte, 10)); err != nil {
+		t.Errorf("channel should route after original permission timeout: %v", err)
+	}
+	// Re-binding at T+8 should refresh both binding and permission to T+18.
+	if err = a.ChannelBind(tuple, n, peer, now.Add(time.Minute*18)); err != nil {
+		t.Fatal(err)
+	}
+	a.Prune(now.Add(time.Minute * 15))
+	if _, err = a.SendBound(tuple, n, make([]byte, 10)); err != nil {
+		t.Errorf("channel should route after refresh: %v", err)
+	}
+	if _, err = a.Send(tuple, peer, make([]byte, 10)); err != nil {
+		t.Errorf("permission should be refreshed by binding: %v", err)
+	}
+	a.Prune(now.Add(time.Minute * 19))
+	if _, err = a.SendBound(tuple, n, make([]byte, 10)); err != ErrPermissionNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAllocator_CreatePermissionKeepsBinding(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p})
+	now := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	peer := turn.Addr{Port: 201, IP: net.IPv4(127, 0, 0, 1)}
+	const n = turn.ChannelNumber(0x4000)
+	if _, err = a.New(tuple, "", now.Add(time.Minute*30), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ChannelBind(tuple, n, peer, now.Add(time.Minute*10)); err != nil {
+		t.Fatal(err)
+	}
+	// Refreshing permission with timeout that is less than binding one.
+	if err = a.CreatePermission(tuple, peer, now.Add(time.Minute*5)); err != nil {
+		t.Fatal(err)
+	}
+	a.Prune(now.Add(time.Minute * 7))
+	if _, err = a.SendBound(tuple, n, make([]byte, 10)); err != nil {
+		t.Errorf("binding should not be shortened by permission refresh: %v", err)
+	}
+	// Refreshing permission beyond binding timeout.
+	if err = a.CreatePermission(tuple, peer, now.Add(time.Minute*15)); err != nil {
+		t.Fatal(err)
+	}
+	a.Prune(now.Add(time.Minute * 11))
+	if _, err = a.SendBound(tuple, n, make([]byte, 10)); err != ErrPermissionNotFound {
+		t.Errorf("binding should expire: %v", err)
+	}
+	if _, err = a.Send(tuple, peer, make([]byte, 10)); err != nil {
+		t.Errorf("permission should be valid: %v", err)
+	}
+}
+
+type eventRecorder []Event
+
+func (r *eventRecorder) HandleAllocationEvent(e Event) { *r = append(*r, e) }
+
+func TestAllocator_Events(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := new(eventRecorder)
+	a := NewAllocator(Options{Conn: p, Events: events})
+	now := time.Now()
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	relayed, err := a.New(tuple, "user", now.Add(time.Minute), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuple2 := tuple
+	tuple2.Client.Port = 201
+	if _, err = a.New(tuple2, "user2", now.Add(time.Hour), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Remove(tuple2); err != nil {
+		t.Fatal(err)
+	}
+	a.Prune(now.Add(time.Minute * 2))
+	if len(*events) != 4 {
+		t.Fatalf("unexpected events count %d", len(*events))
+	}
+	for i, e := range []struct {
+		t        EventType
+		username string
+	}{
+		{EventAllocate, "user"},
+		{EventAllocate, "user2"},
+		{EventDeallocate, "user2"},
+		{EventDeallocate, "user"},
+	} {
+		got := (*events)[i]
+		if got.Type != e.t || got.Allocation.Username != e.username {
+			t.Errorf("events[%d]: unexpected %s event for %q", i, got.Type, got.Allocation.Username)
+		}
+	}
+	if e := (*events)[0]; !e.Allocation.RelayedAddr.Equal(relayed) || e.Duration != 0 {
+		t.Errorf("unexpected allocate event %+v", e)
+	}
+	if e := (*events)[3]; e.Duration < time.Minute {
+		t.Errorf("unexpected duration %s", e.Duration)
+	}
+}
+
+func TestAllocator_LogID(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := new(eventRecorder)
+	a := NewAllocator(Options{Conn: p, Events: events, Log: zap.New(core)})
+	now := time.Now()
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	if _, err = a.New(tuple, "user", now.Add(time.Minute), nil); err != nil {
+		t.Fatal(err)
+	}
+	peer := turn.Addr{Port: 201, IP: net.IPv4(127, 0, 0, 1)}
+	if err = a.CreatePermission(tuple, peer, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ChannelBind(tuple, 0x4000, peer, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Refresh(tuple, now.Add(time.Minute*2)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Remove(tuple); err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 2 {
+		t.Fatalf("unexpected events count %d", len(*events))
+	}
+	id := (*events)[0].Allocation.ID
+	if len(id) != 8 || (*events)[1].Allocation.ID != id {
+		t.Fatalf("unexpected allocation id %q", id)
+	}
+	for _, msg := range []string{
+		"new", "permission", "created binding", "refreshed", "removed",
+	} {
+		entries := logs.FilterMessage(msg).All()
+		if len(entries) != 1 {
+			t.Errorf("%q: unexpected log entries count %d", msg, len(entries))
+			continue
+		}
+		if got := entries[0].ContextMap()["id"]; got != id {
+			t.Errorf("%q: unexpected id %v", msg, got)
+		}
+	}
+	// Other allocation should have other id.
+	if _, err = a.New(tuple, "user", now.Add(time.Minute), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := (*events)[2].Allocation.ID; got == id {
+		t.Error("allocation id reused")
+	}
+}
+
+func TestAllocator_Traffic(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p})
+	now := time.Now()
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	peer := turn.Addr{Port: 201, IP: net.IPv4(127, 0, 0, 1)}
+	const n = turn.ChannelNumber(0x4000)
+	if _, err = a.New(tuple, "", now.Add(time.Minute), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ChannelBind(tuple, n, peer, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Send(tuple, peer, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.SendBound(tuple, n, make([]byte, 15)); err != nil {
+		t.Fatal(err)
+	}
+	k := newTupleKey(tuple)
+	s := a.shard(k)
+	s.mux.RLock()
+	in, out := s.allocs[k].Bytes()
+	s.mux.RUnlock()
+	if in != 0 || out != 25 {
+		t.Errorf("unexpected allocation traffic: in %d, out %d", in, out)
+	}
+	if err = a.Remove(tuple); err != nil {
+		t.Fatal(err)
+	}
+	// Totals should include removed allocations.
+	if s := a.Stats(); s.BytesIn != 0 || s.BytesOut != 25 {
+		t.Errorf("unexpected stats traffic: in %d, out %d", s.BytesIn, s.BytesOut)
+	}
+}
+
+// BenchmarkAllocator_Readers measures goroutines and stack memory that
+// are used by relay read loops, one per allocation or pooled.
+func BenchmarkAllocator_Readers(b *testing.B) {
+	b.Run("Goroutine", func(b *testing.B) {
+		benchmarkAllocatorReaders(b, nil)
+	})
+	b.Run("Pool", func(b *testing.B) {
+		pool, err := NewReaderPool(zap.NewNop(), 4)
+		if err == ErrReadersNotSupported {
+			b.Skip(err)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer pool.Close()
+		benchmarkAllocatorReaders(b, pool)
+	})
+}
+
+func benchmarkAllocatorReaders(b *testing.B, pool *ReaderPool) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	}, SystemPortAllocator{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p, Readers: pool})
+	const allocations = 100
+	now := time.Now()
+	tuples := make([]turn.FiveTuple, allocations)
+	for i := range tuples {
+		tuples[i] = turn.FiveTuple{
+			Client: turn.Addr{Port: 10000 + i, IP: net.IPv4(127, 0, 0, 1)},
+			Server: turn.Addr{Port: 3478, IP: net.IPv4(127, 0, 0, 1)},
+			Proto:  turn.ProtoUDP,
+		}
+	}
+	var (
+		goroutines int
+		stack      uint64
+		stats      runtime.MemStats
+	)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		runtime.ReadMemStats(&stats)
+		startGoroutines, startStack := runtime.NumGoroutine(), stats.StackInuse
+		for _, tuple := range tuples {
+			if _, err = a.New(tuple, "", now.Add(time.Minute), nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+		runtime.ReadMemStats(&stats)
+		goroutines += runtime.NumGoroutine() - startGoroutines
+		if stats.StackInuse > startStack {
+			stack += stats.StackInuse - startStack
+		}
+		for _, tuple := range tuples {
+			if err = a.Remove(tuple); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(goroutines)/float64(b.N*allocations), "goroutines/allocation")
+	b.ReportMetric(float64(stack)/float64(b.N*allocations), "stack-B/allocation")
+}
+
+func TestAllocator_DryRun(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	}, SystemPortAllocator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p, DryRun: true})
+	peerConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close()
+	peerAddr := peerConn.LocalAddr().(*net.UDPAddr)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	peer := turn.Addr{Port: peerAddr.Port, IP: peerAddr.IP}
+	const n = turn.ChannelNumber(0x4000)
+	if _, err = a.New(tuple, "", time.Now().Add(time.Minute), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Remove(tuple)
+	if err = a.ChannelBind(tuple, n, peer, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if written, sendErr := a.Send(tuple, peer, make([]byte, 10)); sendErr != nil || written != 10 {
+		t.Fatalf("unexpected send result: %d, %v", written, sendErr)
+	}
+	if written, sendErr := a.SendBound(tuple, n, make([]byte, 15)); sendErr != nil || written != 15 {
+		t.Fatalf("unexpected send result: %d, %v", written, sendErr)
+	}
+	if err = peerConn.SetReadDeadline(time.Now().Add(time.Millisecond * 50)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = peerConn.ReadFrom(make([]byte, 100)); err == nil {
+		t.Error("peer should not receive data in dry run")
+	}
+	if s := a.Stats(); s.BytesOut != 0 {
+		t.Errorf("unexpected sent bytes: %d", s.BytesOut)
+	}
+	// Permissions are still checked.
+	other := turn.Addr{Port: 201, IP: net.IPv4(127, 0, 0, 2)}
+	if _, err = a.Send(tuple, other, make([]byte, 10)); err != ErrPermissionNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// failingConn fails writes while fail is set.
+type failingConn struct {
+	dummyConn
+	fail bool
+}
+
+var errFailingConnWrite = errors.New("write failed")
+
+func (c *failingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.fail {
+		return 0, errFailingConnWrite
+	}
+	return len(p), nil
+}
+
+type failingNetPortAlloc struct {
+	conn *failingConn
+}
+
+func (d failingNetPortAlloc) AllocatePort(proto turn.Protocol, network, defaultAddr string) (NetAllocation, error) {
+	return NetAllocation{
+		Proto: proto,
+		Addr:  turn.Addr{IP: net.IPv4(127, 1, 0, 2), Port: 5100},
+		Conn:  d.conn,
+	}, nil
+}
+
+func TestAllocator_MaxWriteFailures(t *testing.T) {
+	conn := new(failingConn)
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, failingNetPortAlloc{conn: conn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p, MaxWriteFailures: 3})
+	now := time.Now()
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	if _, err = a.New(tuple, "", now.Add(time.Minute), nil); err != nil {
+		t.Fatal(err)
+	}
+	peer := turn.Addr{Port: 201, IP: net.IPv4(127, 0, 0, 1)}
+	other := turn.Addr{Port: 202, IP: net.IPv4(127, 0, 0, 2)}
+	const n = turn.ChannelNumber(0x4000)
+	if err = a.ChannelBind(tuple, n, peer, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.CreatePermission(tuple, other, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	conn.fail = true
+	for i := 0; i < 2; i++ {
+		if _, err = a.Send(tuple, peer, make([]byte, 10)); err != errFailingConnWrite {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// Successful write resets failure count.
+	conn.fail = false
+	if _, err = a.SendBound(tuple, n, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	conn.fail = true
+	for i := 0; i < 2; i++ {
+		if _, err = a.SendBound(tuple, n, make([]byte, 10)); err != errFailingConnWrite {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if snap, _ := a.snapshot(tuple); len(snap.Permissions) != 2 {
+		t.Fatalf("permission removed before limit: %v", snap.Permissions)
+	}
+	if _, err = a.Send(tuple, peer, make([]byte, 10)); err != errFailingConnWrite {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	snap, ok := a.snapshot(tuple)
+	if !ok {
+		t.Fatal("allocation should not be removed")
+	}
+	if len(snap.Permissions) != 1 || !snap.Permissions[0].IP.Equal(other.IP) {
+		t.Errorf("unexpected permissions: %v", snap.Permissions)
+	}
+	if len(snap.Channels) != 0 {
+		t.Errorf("channel should be removed from index: %v", snap.Channels)
+	}
+	if _, err = a.SendBound(tuple, n, make([]byte, 10)); err != ErrPermissionNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
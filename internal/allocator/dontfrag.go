@@ -0,0 +1,106 @@
+package allocator
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"gortc.io/turn"
+)
+
+var errDontFragmentNotSupported = errors.New("DONT-FRAGMENT is not supported")
+
+// unwrapConn returns underlying connection of pooled port if any.
+func unwrapConn(conn net.PacketConn) net.PacketConn {
+	if w, ok := conn.(*wrappedConn); ok {
+		return w.PacketConn
+	}
+	return conn
+}
+
+// dontFragment is DF bit state of relay socket. The DF bit is requested
+// per datagram, but can only be set on socket, so writes with same state
+// are concurrent and state change is exclusive.
+type dontFragment struct {
+	mux sync.RWMutex
+	set bool // DF bit is set on socket
+}
+
+// writeTo writes b to addr via conn, setting or clearing DF bit on conn
+// before write if needed. Socket is not modified until DF bit is set once.
+func (d *dontFragment) writeTo(conn net.PacketConn, b []byte, addr net.Addr, df bool) (int, error) {
+	d.mux.RLock()
+	if d.set == df {
+		n, err := conn.WriteTo(b, addr)
+		d.mux.RUnlock()
+		return n, err
+	}
+	d.mux.RUnlock()
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if err := d.update(conn, df); err != nil {
+		return 0, err
+	}
+	return conn.WriteTo(b, addr)
+}
+
+// enable sets DF bit on conn.
+func (d *dontFragment) enable(conn net.PacketConn) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.update(conn, true)
+}
+
+// update sets or clears DF bit on conn, d.mux must be locked.
+func (d *dontFragment) update(conn net.PacketConn, df bool) error {
+	if d.set == df {
+		return nil
+	}
+	if err := setDontFragment(conn, df); err != nil {
+		return err
+	}
+	d.set = df
+	return nil
+}
+
+// SetDontFragment sets DF bit on packets relayed via channel bindings of
+// allocation identified by tuple, as requested by DONT-FRAGMENT attribute of
+// Allocate request. Send indications set DF bit on their own, see
+// SendDontFragment.
+//
+// See RFC 5766 Section 6.2.
+func (a *Allocator) SetDontFragment(tuple turn.FiveTuple) error {
+	var (
+		conn, conn6 net.PacketConn
+		df, df6     *dontFragment
+	)
+	k := newTupleKey(tuple)
+	s := a.shard(k)
+	s.mux.RLock()
+	if alloc, ok := s.allocs[k]; ok {
+		conn, df = alloc.Conn, alloc.df
+		conn6, df6 = alloc.Conn6, alloc.df6
+	}
+	s.mux.RUnlock()
+	if conn == nil {
+		return ErrAllocationMismatch
+	}
+	// Setting DF bit now to report failure before allocation is used.
+	if err := df.enable(conn); err != nil {
+		return err
+	}
+	if conn6 != nil {
+		if err := df6.enable(conn6); err != nil {
+			return err
+		}
+	}
+	a.log.Debug("set DF bit", zap.Stringer("tuple", tuple))
+	s.mux.Lock()
+	if alloc, ok := s.allocs[k]; ok {
+		alloc.DontFragment = true
+	}
+	s.mux.Unlock()
+	return nil
+}
@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+package allocator
+
+import (
+	"net"
+	"syscall"
+)
+
+// DontFragmentSupported reports whether DF bit can be set on relayed
+// packets on current platform.
+const DontFragmentSupported = true
+
+// setDontFragment sets DF bit on all packets sent via conn, disabling
+// fragmentation as required by DONT-FRAGMENT attribute, or clears it.
+// IPv6 has no DF bit, but disabling fragmentation by sender has same
+// effect.
+func setDontFragment(conn net.PacketConn, df bool) error {
+	c, ok := unwrapConn(conn).(syscall.Conn)
+	if !ok {
+		return errDontFragmentNotSupported
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	level, opt := syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER
+	v := syscall.IP_PMTUDISC_DONT
+	if df {
+		v = syscall.IP_PMTUDISC_DO
+	}
+	if isIPv6Conn(conn) {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER
+		v = syscall.IPV6_PMTUDISC_DONT
+		if df {
+			v = syscall.IPV6_PMTUDISC_DO
+		}
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), level, opt, v)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,163 @@
+//go:build linux
+// +build linux
+
+package allocator
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gortc.io/turn"
+)
+
+// mtuDiscover returns IP_MTU_DISCOVER (or IPV6_MTU_DISCOVER) value of
+// conn.
+func mtuDiscover(t *testing.T, conn net.PacketConn) int {
+	t.Helper()
+	raw, err := unwrapConn(conn).(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		v      int
+		optErr error
+	)
+	level, opt := syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER
+	if isIPv6Conn(conn) {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER
+	}
+	if err = raw.Control(func(fd uintptr) {
+		v, optErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+	return v
+}
+
+func TestSetDontFragment(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = setDontFragment(conn, true); err != nil {
+		t.Fatal(err)
+	}
+	if v := mtuDiscover(t, conn); v != syscall.IP_PMTUDISC_DO {
+		t.Errorf("unexpected IP_MTU_DISCOVER value %d", v)
+	}
+	if err = setDontFragment(conn, false); err != nil {
+		t.Fatal(err)
+	}
+	if v := mtuDiscover(t, conn); v != syscall.IP_PMTUDISC_DONT {
+		t.Errorf("unexpected IP_MTU_DISCOVER value %d", v)
+	}
+	t.Run("IPv6", func(t *testing.T) {
+		conn6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+		if err != nil {
+			t.Skip("IPv6 is not available")
+		}
+		defer conn6.Close()
+		if err = setDontFragment(conn6, true); err != nil {
+			t.Fatal(err)
+		}
+		if v := mtuDiscover(t, conn6); v != syscall.IPV6_PMTUDISC_DO {
+			t.Errorf("unexpected IPV6_MTU_DISCOVER value %d", v)
+		}
+	})
+}
+
+// connRecordingPortAlloc records relay connections of system allocator.
+type connRecordingPortAlloc struct {
+	SystemPortAllocator
+	conns []net.PacketConn
+}
+
+func (p *connRecordingPortAlloc) AllocatePort(proto turn.Protocol, network, defaultAddr string) (NetAllocation, error) {
+	n, err := p.SystemPortAllocator.AllocatePort(proto, network, defaultAddr)
+	if err == nil {
+		p.conns = append(p.conns, n.Conn)
+	}
+	return n, err
+}
+
+func TestAllocator_DontFragmentPerWrite(t *testing.T) {
+	ports := new(connRecordingPortAlloc)
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	}, ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p})
+	peerConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close()
+	peerAddr := peerConn.LocalAddr().(*net.UDPAddr)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	peer := turn.Addr{Port: peerAddr.Port, IP: peerAddr.IP}
+	const n = turn.ChannelNumber(0x4000)
+	if _, err = a.New(tuple, "", time.Now().Add(time.Minute), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Remove(tuple)
+	if err = a.ChannelBind(tuple, n, peer, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	conn := ports.conns[0]
+	initial := mtuDiscover(t, conn)
+	if _, err = a.Send(tuple, peer, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if v := mtuDiscover(t, conn); v != initial {
+		t.Errorf("socket should not be modified until DF bit is requested, got %d", v)
+	}
+	if _, err = a.SendDontFragment(tuple, peer, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if v := mtuDiscover(t, conn); v != syscall.IP_PMTUDISC_DO {
+		t.Errorf("DF bit should be set, got %d", v)
+	}
+	// DF bit is requested per indication.
+	if _, err = a.Send(tuple, peer, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if v := mtuDiscover(t, conn); v != syscall.IP_PMTUDISC_DONT {
+		t.Errorf("DF bit should be cleared, got %d", v)
+	}
+	if _, err = a.SendDontFragment(tuple, peer, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.SendBound(tuple, n, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if v := mtuDiscover(t, conn); v != syscall.IP_PMTUDISC_DONT {
+		t.Errorf("DF bit should be cleared for ChannelData, got %d", v)
+	}
+	// Requested on Allocate, so set for ChannelData.
+	if err = a.SetDontFragment(tuple); err != nil {
+		t.Fatal(err)
+	}
+	if v := mtuDiscover(t, conn); v != syscall.IP_PMTUDISC_DO {
+		t.Errorf("DF bit should be set, got %d", v)
+	}
+	if _, err = a.SendBound(tuple, n, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if v := mtuDiscover(t, conn); v != syscall.IP_PMTUDISC_DO {
+		t.Errorf("DF bit should be set for ChannelData, got %d", v)
+	}
+}
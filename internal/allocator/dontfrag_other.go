@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package allocator
+
+import "net"
+
+// DontFragmentSupported reports whether DF bit can be set on relayed
+// packets on current platform.
+const DontFragmentSupported = false
+
+func setDontFragment(conn net.PacketConn, df bool) error { return errDontFragmentNotSupported }
@@ -0,0 +1,8 @@
+package allocator
+
+import "errors"
+
+var errDSCPNotSupported = errors.New("DSCP marking is not supported")
+
+// MaxDSCP is maximum value of 6-bit DSCP field.
+const MaxDSCP = 63
@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package allocator
+
+import (
+	"net"
+	"syscall"
+)
+
+// DSCPSupported reports whether relayed packets can be marked with DSCP
+// on current platform.
+const DSCPSupported = true
+
+// setDSCP marks all packets sent via conn with dscp, setting IP_TOS or
+// IPV6_TCLASS depending on address family of conn.
+func setDSCP(conn net.PacketConn, dscp int) error {
+	c, ok := unwrapConn(conn).(syscall.Conn)
+	if !ok {
+		return errDSCPNotSupported
+	}
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+	if isIPv6Conn(conn) {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		// DSCP is upper 6 bits of traffic class, lower 2 are for ECN.
+		sockErr = syscall.SetsockoptInt(int(fd), level, opt, dscp<<2)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
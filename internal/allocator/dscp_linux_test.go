@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package allocator
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestSetDSCP(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		network string
+		ip      net.IP
+		level   int
+		opt     int
+	}{
+		{"IPv4", "udp4", net.IPv4(127, 0, 0, 1), syscall.IPPROTO_IP, syscall.IP_TOS},
+		{"IPv6", "udp6", net.IPv6loopback, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.ListenUDP(tc.network, &net.UDPAddr{IP: tc.ip})
+			if err != nil {
+				t.Skip(err)
+			}
+			defer conn.Close()
+			if err = setDSCP(&wrappedConn{PacketConn: conn}, 46); err != nil {
+				t.Fatal(err)
+			}
+			raw, err := conn.SyscallConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var (
+				v      int
+				optErr error
+			)
+			if err = raw.Control(func(fd uintptr) {
+				v, optErr = syscall.GetsockoptInt(int(fd), tc.level, tc.opt)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if optErr != nil {
+				t.Fatal(optErr)
+			}
+			if v != 46<<2 {
+				t.Errorf("unexpected traffic class %d", v)
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package allocator
+
+import "net"
+
+// DSCPSupported reports whether relayed packets can be marked with DSCP
+// on current platform.
+const DSCPSupported = false
+
+func setDSCP(conn net.PacketConn, dscp int) error { return errDSCPNotSupported }
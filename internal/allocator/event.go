@@ -0,0 +1,52 @@
+package allocator
+
+import "time"
+
+// EventType is type of allocation lifecycle event.
+type EventType byte
+
+// Possible allocation lifecycle events.
+const (
+	EventAllocate EventType = iota + 1
+	EventDeallocate
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventAllocate:
+		return "allocate"
+	case EventDeallocate:
+		return "deallocate"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes allocation lifecycle change.
+type Event struct {
+	Type       EventType
+	Allocation Allocation
+	Duration   time.Duration // since allocation creation, zero on EventAllocate
+}
+
+// EventHandler handles allocation lifecycle events.
+//
+// Handler is called synchronously from allocate and deallocate paths,
+// so it should not block.
+type EventHandler interface {
+	HandleAllocationEvent(e Event)
+}
+
+func (a *Allocator) notify(t EventType, allocation Allocation, now time.Time) {
+	if a.events == nil {
+		return
+	}
+	e := Event{
+		Type:       t,
+		Allocation: allocation,
+	}
+	if t == EventDeallocate {
+		e.Duration = now.Sub(allocation.Created)
+	}
+	a.events.HandleAllocationEvent(e)
+}
@@ -0,0 +1,27 @@
+package allocator
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+var errRecvErrNotSupported = errors.New("ICMP error reporting is not supported")
+
+// isICMPError reports whether err is read error that was caused by ICMP
+// destination unreachable message, e.g. port unreachable from peer.
+func isICMPError(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	switch err {
+	case syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,55 @@
+//go:build linux
+// +build linux
+
+package allocator
+
+import (
+	"net"
+	"syscall"
+)
+
+// setRecvErr enables IP_RECVERR (or IPV6_RECVERR) on conn, so ICMP errors
+// for relayed packets are reported on read instead of being silently
+// ignored.
+func setRecvErr(conn net.PacketConn) error {
+	c, ok := unwrapConn(conn).(syscall.Conn)
+	if !ok {
+		return errRecvErrNotSupported
+	}
+	level, opt := syscall.IPPROTO_IP, syscall.IP_RECVERR
+	if isIPv6Conn(conn) {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), level, opt, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// drainErrQueue discards queued ICMP errors of conn, because they are
+// accounted in socket receive buffer.
+func drainErrQueue(conn net.PacketConn) {
+	c, ok := unwrapConn(conn).(syscall.Conn)
+	if !ok {
+		return
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+	_ = raw.Control(func(fd uintptr) {
+		var buf, oob [512]byte
+		for {
+			if _, _, _, _, err := syscall.Recvmsg(int(fd), buf[:], oob[:], syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT); err != nil {
+				return
+			}
+		}
+	})
+}
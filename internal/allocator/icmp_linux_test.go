@@ -0,0 +1,41 @@
+//go:build linux
+// +build linux
+
+package allocator
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSetRecvErr(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = setRecvErr(conn); err != nil {
+		t.Fatal(err)
+	}
+	// Obtaining port that is not listened by closing socket.
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := closed.LocalAddr()
+	if err = closed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.WriteTo([]byte("hello"), peer); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = conn.ReadFrom(make([]byte, 64))
+	if !isICMPError(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	drainErrQueue(conn)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package allocator
+
+import "net"
+
+func setRecvErr(conn net.PacketConn) error { return errRecvErrNotSupported }
+
+func drainErrQueue(conn net.PacketConn) {}
@@ -2,8 +2,10 @@ package allocator
 
 import (
 	"errors"
+	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 
 	"go.uber.org/zap"
 
@@ -33,8 +35,51 @@ type NetAllocator struct {
 	newAllocs []NetAllocation
 	ports     NetPortAllocator
 
-	log         *zap.Logger
-	defaultAddr string
+	log      *zap.Logger
+	addrs    []string // local addresses of relayed transport addresses
+	addr6    string   // local IPv6 address of dual allocations, if any
+	strategy RelayStrategy
+	next     uint32 // next address for RelayRoundRobin
+}
+
+// RelayStrategy selects local address of new relayed transport address
+// from addresses of NetAllocator.
+type RelayStrategy byte
+
+// Possible relay address selection strategies.
+const (
+	// RelayListener always uses first address, e.g. listener address.
+	RelayListener RelayStrategy = iota
+	// RelayRoundRobin cycles through addresses.
+	RelayRoundRobin
+	// RelayRandom picks random address for each allocation.
+	RelayRandom
+)
+
+func (s RelayStrategy) String() string {
+	switch s {
+	case RelayListener:
+		return "listener"
+	case RelayRoundRobin:
+		return "round_robin"
+	case RelayRandom:
+		return "random"
+	default:
+		return "unknown"
+	}
+}
+
+// addr returns local address for new allocation.
+func (a *NetAllocator) addr() string {
+	switch a.strategy {
+	case RelayRoundRobin:
+		n := atomic.AddUint32(&a.next, 1) - 1
+		return a.addrs[n%uint32(len(a.addrs))]
+	case RelayRandom:
+		return a.addrs[rand.Intn(len(a.addrs))] // #nosec
+	default:
+		return a.addrs[0]
+	}
 }
 
 // NetPortAllocator allocates ports.
@@ -44,10 +89,46 @@ type NetPortAllocator interface {
 
 // New allocates new free port from internal port allocator.
 func (a *NetAllocator) New(proto turn.Protocol) (turn.Addr, net.PacketConn, error) {
-	n, err := a.ports.AllocatePort(proto, "udp4", a.defaultAddr)
+	n, err := a.ports.AllocatePort(proto, "udp4", a.addr())
+	if err != nil {
+		return turn.Addr{}, nil, err
+	}
+	return a.add(n)
+}
+
+// SetIPv6 sets local IPv6 address of relayed transport addresses that
+// are allocated by NewIPv6.
+func (a *NetAllocator) SetIPv6(ip net.IP) error {
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return errors.New("not IPv6 address")
+	}
+	a.addr6 = net.JoinHostPort(ip.String(), "0")
+	return nil
+}
+
+// NewIPv6 is same as New, but allocates port on IPv6 address, e.g. for
+// dual allocation. Returns ErrAddrFamilyNotSupported if there is no IPv6
+// address, see SetIPv6.
+func (a *NetAllocator) NewIPv6(proto turn.Protocol) (turn.Addr, net.PacketConn, error) {
+	if a.addr6 == "" {
+		return turn.Addr{}, nil, ErrAddrFamilyNotSupported
+	}
+	n, err := a.ports.AllocatePort(proto, "udp6", a.addr6)
 	if err != nil {
 		return turn.Addr{}, nil, err
 	}
+	if n.Addr.IP.To4() != nil {
+		// Port allocator ignored network, e.g. pooled one.
+		if closeErr := n.Close(); closeErr != nil {
+			a.log.Error("failed to remove", zap.Error(closeErr))
+		}
+		return turn.Addr{}, nil, ErrAddrFamilyNotSupported
+	}
+	return a.add(n)
+}
+
+// add tracks allocated port, so it can be removed.
+func (a *NetAllocator) add(n NetAllocation) (turn.Addr, net.PacketConn, error) {
 	a.allocsMux.Lock()
 	a.allocs = append(a.allocs, n)
 	a.allocsMux.Unlock()
@@ -93,17 +174,34 @@ func (a *NetAllocator) Remove(addr turn.Addr, proto turn.Protocol) error {
 // NewNetAllocator initializes new port allocation manager, addr currently supports
 // only *UDPAddr.
 func NewNetAllocator(l *zap.Logger, addr net.Addr, ports NetPortAllocator) (*NetAllocator, error) {
-	var defaultAddr string
-	switch tAddr := addr.(type) {
-	case *net.UDPAddr:
-		defaultAddr = tAddr.IP.String() + ":0"
-	default:
-		return nil, errors.New("unsupported addr")
+	return NewNetAllocatorPool(l, []net.Addr{addr}, RelayListener, ports)
+}
+
+// NewNetAllocatorPool initializes new port allocation manager that
+// allocates relayed transport addresses on addrs, selecting address of
+// each allocation with strategy. Only *UDPAddr is currently supported.
+func NewNetAllocatorPool(l *zap.Logger, addrs []net.Addr, strategy RelayStrategy, ports NetPortAllocator) (*NetAllocator, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no relay addresses")
 	}
 	a := NetAllocator{
-		log:         l,
-		defaultAddr: defaultAddr,
-		ports:       ports,
+		log:      l,
+		strategy: strategy,
+		ports:    ports,
+	}
+	for _, addr := range addrs {
+		tAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			return nil, errors.New("unsupported addr")
+		}
+		a.addrs = append(a.addrs, tAddr.IP.String()+":0")
 	}
 	return &a, nil
 }
+
+// isIPv6Conn reports whether conn is bound to IPv6 address, so socket
+// options of IPv6 level should be used.
+func isIPv6Conn(conn net.PacketConn) bool {
+	a, ok := conn.LocalAddr().(*net.UDPAddr)
+	return ok && a.IP.To4() == nil && len(a.IP) == net.IPv6len
+}
@@ -17,7 +17,7 @@ func (s SystemPortAllocator) AllocatePort(
 	if err != nil {
 		return NetAllocation{}, err
 	}
-	conn, err := net.ListenUDP("udp4", addr)
+	conn, err := net.ListenUDP(network, addr)
 	if err != nil {
 		return NetAllocation{}, err
 	}
@@ -22,6 +22,10 @@ type pooledPort struct {
 }
 
 // SystemPortPooledAllocator pre-allocates pool of ports.
+//
+// Unlike SystemPortAllocator, allocation does not involve system calls and
+// relayed ports are bounded by range, but all ports of range are bound for
+// the whole lifetime of allocator.
 type SystemPortPooledAllocator struct {
 	log     *zap.Logger
 	network string
@@ -38,6 +42,9 @@ type SystemPortPooledAllocator struct {
 func (a *SystemPortPooledAllocator) Close() error {
 	a.mux.Lock()
 	for i := range a.ports {
+		if a.ports[i].conn == nil {
+			continue
+		}
 		if err := a.ports[i].conn.Close(); err != nil {
 			a.log.Warn("failed to close conn while shutdown", zap.Error(err))
 		}
@@ -58,8 +65,40 @@ func (w *wrappedConn) Close() error {
 	return nil
 }
 
-func (a *SystemPortPooledAllocator) randomFree() pooledPort {
-	// Assuming a.mux is locked.
+// NewSystemPortPooledAllocator pre-allocates ports in [minPort, maxPort]
+// range on ip.
+func NewSystemPortPooledAllocator(l *zap.Logger, ip net.IP, minPort, maxPort int) (*SystemPortPooledAllocator, error) {
+	a := &SystemPortPooledAllocator{
+		log:     l,
+		ip:      ip,
+		network: "udp4",
+		minPort: minPort,
+		maxPort: maxPort,
+		rand:    rand.Reader,
+	}
+	if err := a.init(); err != nil {
+		// Releasing ports that were allocated before failure.
+		_ = a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// AllocatePort returns random free port from pool, ignoring network
+// and defaultAddr.
+func (a *SystemPortPooledAllocator) AllocatePort(
+	proto turn.Protocol, network, defaultAddr string,
+) (NetAllocation, error) {
+	n, err := a.allocate()
+	if err != nil {
+		return n, err
+	}
+	n.Proto = proto
+	return n, nil
+}
+
+func (a *SystemPortPooledAllocator) randomFree() int {
+	// Assuming a.mux is locked and a.free is not empty.
 	max := big.NewInt(int64(len(a.free)))
 	i := 0
 	// Trying to get cryptographically random port.
@@ -70,24 +109,26 @@ func (a *SystemPortPooledAllocator) randomFree() pooledPort {
 		// Falling back to pseudo-random.
 		i = mathRand.Intn(len(a.free))
 	}
-	return a.ports[i]
+	return a.free[i]
 }
 
 func (a *SystemPortPooledAllocator) allocate() (NetAllocation, error) {
 	a.mux.Lock()
-	var p pooledPort
 	a.free = a.free[:0]
 	for i := range a.ports {
-		if a.ports[i].allocated {
+		if a.ports[i].allocated || a.ports[i].conn == nil {
 			continue
 		}
 		a.free = append(a.free, i)
 	}
-	p = a.randomFree()
-	a.mux.Unlock()
-	if p.conn == nil {
+	if len(a.free) == 0 {
+		a.mux.Unlock()
 		return NetAllocation{}, errors.New("out of capacity")
 	}
+	i := a.randomFree()
+	a.ports[i].allocated = true
+	p := a.ports[i]
+	a.mux.Unlock()
 	return NetAllocation{
 		Addr: turn.Addr{
 			Port: p.port,
@@ -97,6 +138,7 @@ func (a *SystemPortPooledAllocator) allocate() (NetAllocation, error) {
 		Conn: &wrappedConn{
 			allocator:  a,
 			PacketConn: p.conn,
+			port:       p.port,
 		},
 	}, nil
 }
@@ -108,12 +150,16 @@ func (a *SystemPortPooledAllocator) dealloc(port int) {
 			continue
 		}
 		port := a.ports[i]
+		// Closing to unblock reader of allocation and re-binding, so
+		// next allocation on this port gets fresh connection.
 		if err := port.conn.Close(); err != nil {
 			a.log.Warn("failed to close on dealloc", zap.Error(err))
 		}
 		newConn, err := net.ListenUDP(a.network, port.addr)
 		if err != nil {
+			// Port is lost for pool, skipped by allocate.
 			a.log.Warn("failed to listen on dealloc", zap.Error(err))
+			a.ports[i].conn = nil
 			break
 		}
 		a.ports[i].allocated = false
@@ -136,6 +182,7 @@ func (a *SystemPortPooledAllocator) init() error {
 		conn, err := net.ListenUDP(a.network, addr)
 		if err != nil {
 			a.log.Error("failed to pre-allocate", zap.Error(err))
+			a.mux.Unlock()
 			return err
 		}
 		a.ports = append(a.ports, pooledPort{
@@ -8,6 +8,8 @@ import (
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest/observer"
+
+	"gortc.io/turn"
 )
 
 func TestSystemPortPooledAllocator_AllocatePort(t *testing.T) {
@@ -40,3 +42,47 @@ func TestSystemPortPooledAllocator_AllocatePort(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestNewSystemPortPooledAllocator(t *testing.T) {
+	a, err := NewSystemPortPooledAllocator(zap.NewNop(), net.IPv4(127, 0, 0, 1), 34020, 34021)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	var allocs []NetAllocation
+	for i := 0; i < 2; i++ {
+		n, allocErr := a.AllocatePort(turn.ProtoUDP, "udp4", "127.0.0.1:0")
+		if allocErr != nil {
+			t.Fatal(allocErr)
+		}
+		if n.Addr.Port < 34020 || n.Addr.Port > 34021 {
+			t.Errorf("unexpected port %d", n.Addr.Port)
+		}
+		if n.Proto != turn.ProtoUDP {
+			t.Errorf("unexpected proto %s", n.Proto)
+		}
+		allocs = append(allocs, n)
+	}
+	if allocs[0].Addr.Port == allocs[1].Addr.Port {
+		t.Error("same port allocated twice")
+	}
+	if _, err = a.AllocatePort(turn.ProtoUDP, "udp4", "127.0.0.1:0"); err == nil {
+		t.Error("should be out of capacity")
+	}
+	port := allocs[0].Addr.Port
+	if err = allocs[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	n, err := a.AllocatePort(turn.ProtoUDP, "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Addr.Port != port {
+		t.Errorf("port %d should be reused, got %d", port, n.Addr.Port)
+	}
+	t.Run("BadRange", func(t *testing.T) {
+		if _, err := NewSystemPortPooledAllocator(zap.NewNop(), net.IPv4(127, 0, 0, 1), 34021, 34020); err == nil {
+			t.Error("should error")
+		}
+	})
+}
@@ -135,3 +135,69 @@ func TestNetAllocation(t *testing.T) {
 	p.Remove(a2, turn.ProtoUDP)
 	p.Remove(a3, turn.ProtoUDP)
 }
+
+// addrNetPortAlloc records addresses of allocated ports.
+type addrNetPortAlloc struct {
+	addrs []string
+}
+
+func (d *addrNetPortAlloc) AllocatePort(proto turn.Protocol, network, defaultAddr string) (NetAllocation, error) {
+	d.addrs = append(d.addrs, defaultAddr)
+	return NetAllocation{Proto: proto, Conn: &dummyConn{}}, nil
+}
+
+func TestNetAllocatorPool(t *testing.T) {
+	addrs := []net.Addr{
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)},
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 3)},
+	}
+	t.Run("Empty", func(t *testing.T) {
+		if _, err := NewNetAllocatorPool(zap.NewNop(), nil, RelayRoundRobin, &addrNetPortAlloc{}); err == nil {
+			t.Error("should error")
+		}
+	})
+	for _, tc := range []struct {
+		strategy RelayStrategy
+		check    func(t *testing.T, got []string)
+	}{
+		{RelayListener, func(t *testing.T, got []string) {
+			for _, a := range got {
+				if a != "127.0.0.1:0" {
+					t.Errorf("unexpected addr %s", a)
+				}
+			}
+		}},
+		{RelayRoundRobin, func(t *testing.T, got []string) {
+			for i, a := range got {
+				if expected := addrs[i%len(addrs)].(*net.UDPAddr).IP.String() + ":0"; a != expected {
+					t.Errorf("%d: unexpected addr %s, expected %s", i, a, expected)
+				}
+			}
+		}},
+		{RelayRandom, func(t *testing.T, got []string) {
+			for _, a := range got {
+				switch a {
+				case "127.0.0.1:0", "127.0.0.2:0", "127.0.0.3:0":
+					// Pass.
+				default:
+					t.Errorf("unexpected addr %s", a)
+				}
+			}
+		}},
+	} {
+		t.Run(tc.strategy.String(), func(t *testing.T) {
+			ports := &addrNetPortAlloc{}
+			p, err := NewNetAllocatorPool(zap.NewNop(), addrs, tc.strategy, ports)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 7; i++ {
+				if _, _, err := p.New(turn.ProtoUDP); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tc.check(t, ports.addrs)
+		})
+	}
+}
@@ -0,0 +1,7 @@
+package allocator
+
+import "errors"
+
+// ErrReadersNotSupported means that relay sockets can't be read by
+// ReaderPool on current platform.
+var ErrReadersNotSupported = errors.New("reader pool is not supported")
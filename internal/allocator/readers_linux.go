@@ -0,0 +1,273 @@
+//go:build linux
+// +build linux
+
+package allocator
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"gortc.io/turn"
+)
+
+const (
+	// readerPollTimeout is epoll_wait timeout in milliseconds, bounding
+	// time that readers need to stop after Close.
+	readerPollTimeout = 500
+	// readerBatch is maximum count of datagrams that are read from single
+	// socket in a row, so busy allocation can't starve other ones.
+	readerBatch = 64
+)
+
+var errReaderPoolClosed = errors.New("reader pool is closed")
+
+// pooledSocket is relay socket that is read by ReaderPool.
+type pooledSocket struct {
+	id    int32
+	alloc Allocation // copy, as for ReadUntilClosed
+	conn  net.PacketConn
+	raw   syscall.RawConn
+}
+
+// ReaderPool reads relay sockets of allocations with fixed count of
+// goroutines that wait for data via epoll, instead of goroutine per
+// allocation, reducing memory and scheduling overhead when there are
+// many mostly idle allocations. Can be shared between allocators.
+type ReaderPool struct {
+	log    *zap.Logger
+	epfd   int
+	mux    sync.Mutex
+	ids    map[int32]*pooledSocket
+	conns  map[net.PacketConn]*pooledSocket
+	lastID int32
+	done   chan struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewReaderPool starts readers goroutines and returns *ReaderPool, that
+// should be closed after allocators that use it.
+func NewReaderPool(log *zap.Logger, readers int) (*ReaderPool, error) {
+	if readers <= 0 {
+		return nil, errors.New("readers count should be positive")
+	}
+	if log == nil {
+		log = zap.NewNop()
+	}
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	p := &ReaderPool{
+		log:   log,
+		epfd:  epfd,
+		ids:   make(map[int32]*pooledSocket),
+		conns: make(map[net.PacketConn]*pooledSocket),
+		done:  make(chan struct{}),
+	}
+	p.wg.Add(readers)
+	for i := 0; i < readers; i++ {
+		go p.read()
+	}
+	return p, nil
+}
+
+// Close stops readers. Sockets that were added are not closed.
+func (p *ReaderPool) Close() error {
+	p.mux.Lock()
+	if p.closed {
+		p.mux.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mux.Unlock()
+	close(p.done)
+	p.wg.Wait()
+	return syscall.Close(p.epfd)
+}
+
+// add starts reading Conn and Conn6 of allocation.
+func (p *ReaderPool) add(alloc Allocation) error {
+	if err := p.addConn(alloc, alloc.Conn); err != nil {
+		return err
+	}
+	if alloc.Conn6 == nil {
+		return nil
+	}
+	if err := p.addConn(alloc, alloc.Conn6); err != nil {
+		p.remove(alloc.Conn)
+		return err
+	}
+	return nil
+}
+
+func (p *ReaderPool) addConn(alloc Allocation, conn net.PacketConn) error {
+	c, ok := unwrapConn(conn).(syscall.Conn)
+	if !ok {
+		return ErrReadersNotSupported
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	p.mux.Lock()
+	if p.closed {
+		p.mux.Unlock()
+		return errReaderPoolClosed
+	}
+	// Identifier is stored in epoll event instead of file descriptor,
+	// because descriptor of closed socket can be reused by new one.
+	for {
+		p.lastID++
+		if p.lastID <= 0 {
+			p.lastID = 1
+		}
+		if _, used := p.ids[p.lastID]; !used {
+			break
+		}
+	}
+	s := &pooledSocket{id: p.lastID, alloc: alloc, conn: conn, raw: raw}
+	p.ids[s.id] = s
+	p.conns[conn] = s
+	p.mux.Unlock()
+	var ctlErr error
+	if err = raw.Control(func(fd uintptr) {
+		ctlErr = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, int(fd), s.event())
+	}); err == nil {
+		err = ctlErr
+	}
+	if err != nil {
+		p.forget(s)
+		return err
+	}
+	alloc.Log.Debug("start pooled")
+	return nil
+}
+
+// remove stops reading conn, should be called before conn is closed.
+func (p *ReaderPool) remove(conn net.PacketConn) {
+	if conn == nil {
+		return
+	}
+	p.mux.Lock()
+	s, ok := p.conns[conn]
+	p.mux.Unlock()
+	if !ok {
+		return
+	}
+	p.forget(s)
+	// Closing of socket also removes it from epoll, so error is ignored.
+	_ = s.raw.Control(func(fd uintptr) {
+		_ = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, int(fd), nil)
+	})
+	s.alloc.Log.Debug("stop pooled")
+}
+
+func (p *ReaderPool) forget(s *pooledSocket) {
+	p.mux.Lock()
+	if p.ids[s.id] == s {
+		delete(p.ids, s.id)
+		delete(p.conns, s.conn)
+	}
+	p.mux.Unlock()
+}
+
+// event returns epoll event that reports single readiness of s, so only
+// one reader handles socket until it is re-armed.
+func (s *pooledSocket) event() *syscall.EpollEvent {
+	return &syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLONESHOT,
+		Fd:     s.id,
+	}
+}
+
+func (p *ReaderPool) read() {
+	defer p.wg.Done()
+	var (
+		events = make([]syscall.EpollEvent, 32)
+		buf    = make([]byte, 2048)
+	)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, readerPollTimeout)
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			p.log.Error("epoll_wait failed", zap.Error(err))
+			return
+		}
+		for i := 0; i < n; i++ {
+			p.mux.Lock()
+			s, ok := p.ids[events[i].Fd]
+			p.mux.Unlock()
+			if !ok {
+				continue
+			}
+			if !s.drain(buf) {
+				p.forget(s)
+				continue
+			}
+			// Socket that is removed concurrently is not re-armed, error
+			// is ignored as socket can be already closed.
+			_ = s.raw.Control(func(fd uintptr) {
+				_ = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, int(fd), s.event())
+			})
+		}
+	}
+}
+
+// drain passes datagrams that are queued on socket to PeerHandler of
+// allocation, reporting false if socket should not be read anymore.
+func (s *pooledSocket) drain(buf []byte) bool {
+	for i := 0; i < readerBatch; i++ {
+		var (
+			n    int
+			from syscall.Sockaddr
+			err  error
+		)
+		if ctlErr := s.raw.Control(func(fd uintptr) {
+			n, from, err = syscall.Recvfrom(int(fd), buf, syscall.MSG_DONTWAIT)
+		}); ctlErr != nil {
+			// Socket is closed.
+			return false
+		}
+		switch {
+		case err == syscall.EAGAIN:
+			return true
+		case err == syscall.EINTR:
+			continue
+		case err != nil && isICMPError(err):
+			// Peer is unreachable, so relayed data was lost.
+			s.alloc.traffic.addUnreachable()
+			drainErrQueue(s.conn)
+			if ce := s.alloc.Log.Check(zapcore.DebugLevel, "peer unreachable"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+			continue
+		case err != nil:
+			s.alloc.Log.Error("read", zap.Error(err))
+			return false
+		}
+		var addr turn.Addr
+		switch sa := from.(type) {
+		case *syscall.SockaddrInet4:
+			addr.IP, addr.Port = append(net.IP(nil), sa.Addr[:]...), sa.Port
+		case *syscall.SockaddrInet6:
+			addr.IP, addr.Port = append(net.IP(nil), sa.Addr[:]...), sa.Port
+		default:
+			continue
+		}
+		s.alloc.handle(buf[:n], addr)
+	}
+	return true
+}
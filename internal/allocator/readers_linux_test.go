@@ -0,0 +1,115 @@
+//go:build linux
+// +build linux
+
+package allocator
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gortc.io/turn"
+)
+
+func TestReaderPool(t *testing.T) {
+	pool, err := NewReaderPool(zap.NewNop(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if closeErr := pool.Close(); closeErr != nil {
+			t.Error(closeErr)
+		}
+	}()
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	}, SystemPortAllocator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p, Readers: pool})
+	peerConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close()
+	peerAddr := peerConn.LocalAddr().(*net.UDPAddr)
+	type received struct {
+		data []byte
+		peer turn.Addr
+	}
+	got := make(chan received, 10)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	relayed, err := a.New(tuple, "", time.Now().Add(time.Minute), peerHandlerFunc(func(d []byte, t turn.FiveTuple, peer turn.Addr) {
+		got <- received{data: append([]byte(nil), d...), peer: peer}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.mux.Lock()
+	added := len(pool.conns)
+	pool.mux.Unlock()
+	if added != 1 {
+		t.Fatalf("unexpected pooled sockets: %d", added)
+	}
+	relayedAddr := &net.UDPAddr{IP: relayed.IP, Port: relayed.Port}
+	for _, msg := range []string{"first", "second"} {
+		if _, err = peerConn.WriteTo([]byte(msg), relayedAddr); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case r := <-got:
+			if !bytes.Equal(r.data, []byte(msg)) {
+				t.Errorf("unexpected data %q", r.data)
+			}
+			if !r.peer.IP.Equal(peerAddr.IP) || r.peer.Port != peerAddr.Port {
+				t.Errorf("unexpected peer %s", r.peer)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("data is not read")
+		}
+	}
+	if s := a.Stats(); s.BytesIn != 11 {
+		t.Errorf("unexpected received bytes: %d", s.BytesIn)
+	}
+	if err = a.Remove(tuple); err != nil {
+		t.Fatal(err)
+	}
+	pool.mux.Lock()
+	added = len(pool.conns) + len(pool.ids)
+	pool.mux.Unlock()
+	if added != 0 {
+		t.Errorf("removed allocation is still pooled: %d", added)
+	}
+}
+
+func TestReaderPool_Close(t *testing.T) {
+	if _, err := NewReaderPool(zap.NewNop(), 0); err == nil {
+		t.Error("should error on zero readers")
+	}
+	pool, err := NewReaderPool(zap.NewNop(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = pool.Close(); err != nil {
+		t.Error(err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = pool.add(Allocation{Conn: conn}); err != errReaderPoolClosed {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
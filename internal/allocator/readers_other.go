@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package allocator
+
+import (
+	"net"
+
+	"go.uber.org/zap"
+)
+
+// ReaderPool is not supported on current platform, so relay sockets are
+// read by goroutine per allocation.
+type ReaderPool struct{}
+
+// NewReaderPool returns ErrReadersNotSupported.
+func NewReaderPool(log *zap.Logger, readers int) (*ReaderPool, error) {
+	return nil, ErrReadersNotSupported
+}
+
+func (p *ReaderPool) add(alloc Allocation) error { return ErrReadersNotSupported }
+
+func (p *ReaderPool) remove(conn net.PacketConn) {}
+
+// Close is no-op.
+func (p *ReaderPool) Close() error { return nil }
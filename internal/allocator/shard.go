@@ -0,0 +1,58 @@
+package allocator
+
+import (
+	"net"
+	"sync"
+
+	"gortc.io/turn"
+)
+
+// allocShards is count of allocation shards. Allocations are sharded by
+// 5-tuple, so relay path lookups are O(1) and don't contend on single lock.
+const allocShards = 32
+
+// tupleKey is comparable representation of turn.FiveTuple.
+type tupleKey struct {
+	client     [net.IPv6len]byte
+	server     [net.IPv6len]byte
+	clientPort int
+	serverPort int
+	proto      turn.Protocol
+}
+
+func newTupleKey(t turn.FiveTuple) tupleKey {
+	k := tupleKey{
+		clientPort: t.Client.Port,
+		serverPort: t.Server.Port,
+		proto:      t.Proto,
+	}
+	// Using 16-byte form, so IPv4 and IPv4-mapped IPv6 addresses are equal
+	// as in net.IP.Equal.
+	copy(k.client[:], t.Client.IP.To16())
+	copy(k.server[:], t.Server.IP.To16())
+	return k
+}
+
+type allocShard struct {
+	mux    sync.RWMutex
+	allocs map[tupleKey]*Allocation
+}
+
+// shard returns shard of allocation with key k.
+func (a *Allocator) shard(k tupleKey) *allocShard {
+	// Client port and last bytes of client address are most variable.
+	h := uint(k.clientPort) ^ uint(k.client[net.IPv6len-1]) ^ uint(k.client[net.IPv6len-2])<<8
+	return &a.shards[h%allocShards]
+}
+
+// count returns total allocation count.
+func (a *Allocator) count() int {
+	n := 0
+	for i := range a.shards {
+		s := &a.shards[i]
+		s.mux.RLock()
+		n += len(s.allocs)
+		s.mux.RUnlock()
+	}
+	return n
+}
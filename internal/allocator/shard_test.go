@@ -0,0 +1,140 @@
+package allocator
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gortc.io/turn"
+)
+
+func TestNewTupleKey(t *testing.T) {
+	a := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	b := a
+	b.Client.IP = net.IPv4(127, 0, 0, 1).To4()
+	if newTupleKey(a) != newTupleKey(b) {
+		t.Error("keys of equal tuples should be equal")
+	}
+	b.Client.Port = 201
+	if newTupleKey(a) == newTupleKey(b) {
+		t.Error("keys of different tuples should differ")
+	}
+}
+
+func TestAllocator_Shards(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p})
+	now := time.Now()
+	const allocations = allocShards * 3
+	peer := turn.Addr{Port: 201, IP: net.IPv4(127, 0, 0, 1)}
+	tuples := make([]turn.FiveTuple, allocations)
+	for i := range tuples {
+		tuples[i] = turn.FiveTuple{
+			Client: turn.Addr{Port: 1000 + i, IP: net.IPv4(127, 0, 0, 1)},
+			Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+			Proto:  turn.ProtoUDP,
+		}
+		if _, err = a.New(tuples[i], "", now.Add(time.Minute), nil); err != nil {
+			t.Fatal(err)
+		}
+		n := turn.ChannelNumber(0x4000 + i)
+		if err = a.ChannelBind(tuples[i], n, peer, now.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := a.Stats(); s.Allocations != allocations || s.Bindings != allocations {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	for i := range tuples {
+		if n, boundErr := a.Bound(tuples[i], peer); boundErr != nil || n != turn.ChannelNumber(0x4000+i) {
+			t.Errorf("%s: unexpected channel %s (%v)", tuples[i], n, boundErr)
+		}
+		if _, sendErr := a.SendBound(tuples[i], turn.ChannelNumber(0x4000+i), []byte{1}); sendErr != nil {
+			t.Error(sendErr)
+		}
+	}
+	// Channel is bound to other allocation.
+	if _, err = a.SendBound(tuples[0], 0x4001, []byte{1}); err != ErrPermissionNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	a.Prune(now.Add(time.Hour))
+	if s := a.Stats(); s.Allocations != 0 {
+		t.Errorf("unexpected stats after prune %+v", s)
+	}
+}
+
+func TestAllocator_BoundOverlappingPermissions(t *testing.T) {
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(Options{Conn: p})
+	now := time.Now()
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	tuple2 := tuple
+	tuple2.Client.Port = 201
+	peer := turn.Addr{Port: 400, IP: net.IPv4(127, 0, 0, 1)}
+	peer2 := turn.Addr{Port: 401, IP: net.IPv4(127, 0, 0, 1)}
+	for _, tt := range []turn.FiveTuple{tuple, tuple2} {
+		if _, err = a.New(tt, "", now.Add(time.Hour), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Same peer is bound to different channels in both allocations, and
+	// first allocation also has binding for other port of peer.
+	if err = a.ChannelBind(tuple, 0x4000, peer, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ChannelBind(tuple, 0x4001, peer2, now.Add(time.Minute*20)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ChannelBind(tuple2, 0x4005, peer, now.Add(time.Minute*20)); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		tuple turn.FiveTuple
+		peer  turn.Addr
+		n     turn.ChannelNumber
+	}{
+		{tuple, peer, 0x4000},
+		{tuple, peer2, 0x4001},
+		{tuple2, peer, 0x4005},
+	} {
+		if n, boundErr := a.Bound(tc.tuple, tc.peer); boundErr != nil || n != tc.n {
+			t.Errorf("%s %s: unexpected channel %s (%v)", tc.tuple, tc.peer, n, boundErr)
+		}
+	}
+	if _, err = a.Bound(tuple2, peer2); err != ErrAllocationMismatch {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// Only first binding should expire.
+	a.Prune(now.Add(time.Minute * 10))
+	if _, err = a.Bound(tuple, peer); err != ErrAllocationMismatch {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if n, boundErr := a.Bound(tuple, peer2); boundErr != nil || n != 0x4001 {
+		t.Errorf("unexpected channel %s (%v)", n, boundErr)
+	}
+	if n, boundErr := a.Bound(tuple2, peer); boundErr != nil || n != 0x4005 {
+		t.Errorf("unexpected channel %s (%v)", n, boundErr)
+	}
+}
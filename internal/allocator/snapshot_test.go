@@ -0,0 +1,228 @@
+package allocator
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gortc.io/turn"
+)
+
+// allocationSnapshot is deep copy of allocation state that is relevant for
+// permission and binding timeouts.
+type allocationSnapshot struct {
+	Timeout     time.Time
+	Permissions []Permission
+	Channels    map[turn.ChannelNumber]turn.Addr // copy of bindings index
+}
+
+// snapshot returns deep copy of allocation for tuple, so tests can assert
+// internal state without holding shard lock or sharing slices with it.
+func (a *Allocator) snapshot(tuple turn.FiveTuple) (allocationSnapshot, bool) {
+	k := newTupleKey(tuple)
+	s := a.shard(k)
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	alloc, ok := s.allocs[k]
+	if !ok {
+		return allocationSnapshot{}, false
+	}
+	snap := allocationSnapshot{
+		Timeout:  alloc.Timeout,
+		Channels: make(map[turn.ChannelNumber]turn.Addr, len(alloc.channels)),
+	}
+	for _, p := range alloc.Permissions {
+		c := Permission{
+			IP:      append(net.IP(nil), p.IP...),
+			Timeout: p.Timeout,
+		}
+		c.Bindings = append(c.Bindings, p.Bindings...)
+		snap.Permissions = append(snap.Permissions, c)
+	}
+	for n, addr := range alloc.channels {
+		snap.Channels[n] = turn.Addr{
+			IP:   append(net.IP(nil), addr.IP...),
+			Port: addr.Port,
+		}
+	}
+	return snap, true
+}
+
+func newSnapshotAllocator(t *testing.T) *Allocator {
+	t.Helper()
+	p, err := NewNetAllocator(zap.NewNop(), &net.UDPAddr{
+		IP:   net.IPv4(127, 1, 0, 2),
+		Port: 5000,
+	}, &DummyNetPortAlloc{currentPort: 5100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAllocator(Options{Conn: p})
+}
+
+func TestAllocator_snapshot(t *testing.T) {
+	a := newSnapshotAllocator(t)
+	now := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	if _, ok := a.snapshot(tuple); ok {
+		t.Fatal("unexpected snapshot of missing allocation")
+	}
+	if _, err := a.New(tuple, "", now.Add(time.Minute*30), nil); err != nil {
+		t.Fatal(err)
+	}
+	peer := turn.Addr{Port: 201, IP: net.IPv4(127, 0, 0, 1)}
+	if err := a.ChannelBind(tuple, 0x4000, peer, now.Add(time.Minute*10)); err != nil {
+		t.Fatal(err)
+	}
+	snap, ok := a.snapshot(tuple)
+	if !ok {
+		t.Fatal("snapshot not found")
+	}
+	// Mutating snapshot should not affect allocator.
+	snap.Permissions[0].IP[0] = 10
+	snap.Permissions[0].Timeout = now
+	snap.Permissions[0].Bindings[0].Timeout = now
+	snap.Channels[0x4000].IP[0] = 10
+	got, _ := a.snapshot(tuple)
+	p := got.Permissions[0]
+	if !p.IP.Equal(peer.IP) || !got.Channels[0x4000].IP.Equal(peer.IP) {
+		t.Error("snapshot shares addresses with allocator")
+	}
+	if !p.Timeout.Equal(now.Add(time.Minute*10)) || !p.Bindings[0].Timeout.Equal(now.Add(time.Minute*10)) {
+		t.Error("snapshot shares permissions with allocator")
+	}
+}
+
+func TestAllocator_BindingPermissionTimeouts(t *testing.T) {
+	now := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return now.Add(time.Minute * time.Duration(minutes)) }
+	tuple := turn.FiveTuple{
+		Client: turn.Addr{Port: 200, IP: net.IPv4(127, 0, 0, 1)},
+		Server: turn.Addr{Port: 300, IP: net.IPv4(127, 0, 0, 1)},
+		Proto:  turn.ProtoUDP,
+	}
+	peer := turn.Addr{Port: 201, IP: net.IPv4(127, 0, 0, 1)}
+	const n = turn.ChannelNumber(0x4000)
+	type step func(a *Allocator) error
+	var (
+		permission = func(minutes int) step {
+			return func(a *Allocator) error { return a.CreatePermission(tuple, peer, at(minutes)) }
+		}
+		bind = func(minutes int) step {
+			return func(a *Allocator) error { return a.ChannelBind(tuple, n, peer, at(minutes)) }
+		}
+		refresh = func(minutes int) step {
+			return func(a *Allocator) error { return a.Refresh(tuple, at(minutes)) }
+		}
+		prune = func(minutes int) step {
+			return func(a *Allocator) error { a.Prune(at(minutes)); return nil }
+		}
+	)
+	for _, tc := range []struct {
+		name       string
+		steps      []step
+		permission int // expected permission timeout, -1 if pruned
+		binding    int // expected binding timeout, -1 if pruned
+		allocation int // expected allocation timeout
+	}{
+		{
+			name:       "BindCreatesPermission",
+			steps:      []step{bind(10)},
+			permission: 10, binding: 10, allocation: 30,
+		},
+		{
+			name:       "BindExtendsPermission",
+			steps:      []step{permission(5), bind(10)},
+			permission: 10, binding: 10, allocation: 30,
+		},
+		{
+			name:       "BindKeepsLongerPermission",
+			steps:      []step{permission(15), bind(10)},
+			permission: 15, binding: 10, allocation: 30,
+		},
+		{
+			name:       "PermissionDoesNotShortenBinding",
+			steps:      []step{bind(10), permission(5), prune(7)},
+			permission: 10, binding: 10, allocation: 30,
+		},
+		{
+			name:       "RebindAfterPrune",
+			steps:      []step{permission(5), bind(10), prune(7), bind(18), prune(15)},
+			permission: 18, binding: 18, allocation: 30,
+		},
+		{
+			name:       "BindingExpiresBeforePermission",
+			steps:      []step{bind(10), permission(15), prune(11)},
+			permission: 15, binding: -1, allocation: 30,
+		},
+		{
+			name:       "BothExpire",
+			steps:      []step{permission(5), bind(10), prune(10)},
+			permission: -1, binding: -1, allocation: 30,
+		},
+		{
+			name:       "RefreshKeepsPermissions",
+			steps:      []step{bind(10), refresh(40), prune(9)},
+			permission: 10, binding: 10, allocation: 40,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newSnapshotAllocator(t)
+			if _, err := a.New(tuple, "", at(30), nil); err != nil {
+				t.Fatal(err)
+			}
+			for i, s := range tc.steps {
+				if err := s(a); err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+			}
+			snap, ok := a.snapshot(tuple)
+			if !ok {
+				t.Fatal("allocation not found")
+			}
+			if !snap.Timeout.Equal(at(tc.allocation)) {
+				t.Errorf("allocation timeout %s, expected %s", snap.Timeout, at(tc.allocation))
+			}
+			if tc.permission < 0 {
+				if len(snap.Permissions) != 0 {
+					t.Fatalf("unexpected permissions: %v", snap.Permissions)
+				}
+				if len(snap.Channels) != 0 {
+					t.Errorf("unexpected channels: %v", snap.Channels)
+				}
+				return
+			}
+			if len(snap.Permissions) != 1 {
+				t.Fatalf("unexpected permissions count %d", len(snap.Permissions))
+			}
+			p := snap.Permissions[0]
+			if !p.Timeout.Equal(at(tc.permission)) {
+				t.Errorf("permission timeout %s, expected %s", p.Timeout, at(tc.permission))
+			}
+			if tc.binding < 0 {
+				if len(p.Bindings) != 0 {
+					t.Errorf("unexpected bindings: %v", p.Bindings)
+				}
+				if _, ok := snap.Channels[n]; ok {
+					t.Error("channel should be removed from index")
+				}
+				return
+			}
+			if len(p.Bindings) != 1 {
+				t.Fatalf("unexpected bindings count %d", len(p.Bindings))
+			}
+			if b := p.Bindings[0]; !b.Timeout.Equal(at(tc.binding)) || b.Channel != n || b.Port != peer.Port {
+				t.Errorf("unexpected binding %+v", b)
+			}
+			if addr, ok := snap.Channels[n]; !ok || !addr.Equal(peer) {
+				t.Errorf("unexpected channel index %v", snap.Channels)
+			}
+		})
+	}
+}
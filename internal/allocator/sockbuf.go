@@ -0,0 +1,38 @@
+package allocator
+
+import (
+	"errors"
+	"net"
+)
+
+var errSocketBuffersNotSupported = errors.New("socket buffers can't be set on connection")
+
+// SocketBuffers are sizes of SO_RCVBUF and SO_SNDBUF in bytes.
+type SocketBuffers struct {
+	Read  int
+	Write int
+}
+
+// SetSocketBuffers sets buffer sizes of conn, skipping zero ones, and
+// returns effective sizes, that can be clamped (or doubled on linux) by
+// OS. Effective sizes are zero if platform does not report them.
+func SetSocketBuffers(conn net.PacketConn, b SocketBuffers) (SocketBuffers, error) {
+	c, ok := unwrapConn(conn).(interface {
+		SetReadBuffer(bytes int) error
+		SetWriteBuffer(bytes int) error
+	})
+	if !ok {
+		return SocketBuffers{}, errSocketBuffersNotSupported
+	}
+	if b.Read > 0 {
+		if err := c.SetReadBuffer(b.Read); err != nil {
+			return SocketBuffers{}, err
+		}
+	}
+	if b.Write > 0 {
+		if err := c.SetWriteBuffer(b.Write); err != nil {
+			return SocketBuffers{}, err
+		}
+	}
+	return socketBuffers(conn)
+}
@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package allocator
+
+import (
+	"net"
+	"syscall"
+)
+
+// socketBuffers returns effective buffer sizes of conn.
+func socketBuffers(conn net.PacketConn) (SocketBuffers, error) {
+	c, ok := unwrapConn(conn).(syscall.Conn)
+	if !ok {
+		return SocketBuffers{}, errSocketBuffersNotSupported
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return SocketBuffers{}, err
+	}
+	var (
+		b       SocketBuffers
+		sockErr error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		if b.Read, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF); sockErr != nil {
+			return
+		}
+		b.Write, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	}); err != nil {
+		return SocketBuffers{}, err
+	}
+	return b, sockErr
+}
@@ -0,0 +1,35 @@
+//go:build linux
+// +build linux
+
+package allocator
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSetSocketBuffers(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	initial, err := socketBuffers(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Small sizes are not clamped by rmem_max, but are doubled by kernel.
+	b, err := SetSocketBuffers(&wrappedConn{PacketConn: conn}, SocketBuffers{Read: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Read != 2*16384 {
+		t.Errorf("unexpected rcvbuf %d", b.Read)
+	}
+	if b.Write != initial.Write {
+		t.Errorf("sndbuf should not be changed: %d != %d", b.Write, initial.Write)
+	}
+	if _, err = SetSocketBuffers(&dummyConn{}, SocketBuffers{Read: 16384}); err != errSocketBuffersNotSupported {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package allocator
+
+import "net"
+
+func socketBuffers(conn net.PacketConn) (SocketBuffers, error) { return SocketBuffers{}, nil }
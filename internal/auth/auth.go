@@ -10,13 +10,22 @@ import (
 
 // StaticCredential wraps plain Username, Password and Realm,
 // representing a long-term credential.
+//
+// If Key is set, it is used as pre-computed long-term key and Password
+// is ignored, so plaintext password can be omitted.
+//
+// If Realm is AnyRealm, credential matches any realm. Long-term key
+// depends on realm, so such credential requires Password.
 type StaticCredential struct {
 	Username string
 	Password string
 	Realm    string
-	Key      []byte
+	Key      []byte // MD5(username ":" realm ":" password)
 }
 
+// AnyRealm is wildcard realm of StaticCredential that matches any realm.
+const AnyRealm = "*"
+
 type staticKey struct {
 	username string
 	realm    string
@@ -24,38 +33,88 @@ type staticKey struct {
 
 // Static implements authentication with pre-defined static list
 // of long-term credentials.
+//
+// Long-term keys are derived once in NewStatic, so Auth performs only
+// map lookup and MESSAGE-INTEGRITY check, without key derivation. The
+// only exception is credentials with AnyRealm, keys of which depend on
+// realm of request, so they are derived on first Auth for that realm
+// and kept in LRU cache.
 type Static struct {
 	mux         sync.RWMutex
 	credentials map[staticKey]stun.MessageIntegrity
+	anyRealm    map[string]string // username -> password
+	keys        *keyCache         // of anyRealm, nil if disabled
 }
 
 // Auth perform authentication of m and returns integrity that can
 // be used to construct response to m.
 func (s *Static) Auth(m *stun.Message) (stun.MessageIntegrity, error) {
+	i, _, err := s.AuthAnyRealm(m)
+	return i, err
+}
+
+// AuthAnyRealm is same as Auth, but also reports whether m was
+// authenticated by credential with AnyRealm. Realm of such request is
+// chosen by client, so it should not be trusted, e.g. for per-realm
+// quotas.
+func (s *Static) AuthAnyRealm(m *stun.Message) (stun.MessageIntegrity, bool, error) {
 	username, err := m.Get(stun.AttrUsername)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	realm, err := m.Get(stun.AttrRealm)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	s.mux.RLock()
 	i := s.credentials[staticKey{username: string(username), realm: string(realm)}]
+	password, anyRealm := s.anyRealm[string(username)]
 	s.mux.RUnlock()
-	if i == nil {
-		return nil, errors.New("user not found")
+	if i != nil {
+		// Credentials for exact realm take precedence.
+		return i, false, i.Check(m)
+	}
+	if !anyRealm {
+		return nil, false, errors.New("user not found")
 	}
-	return i, i.Check(m)
+	if s.keys != nil {
+		i = s.keys.get(username, realm, password)
+	} else {
+		i = stun.NewLongTermIntegrity(string(username), string(realm), password)
+	}
+	return i, true, i.Check(m)
+}
+
+// KeyCacheStats returns statistics of long-term key cache of credentials
+// with AnyRealm.
+func (s *Static) KeyCacheStats() KeyCacheStats {
+	if s.keys == nil {
+		return KeyCacheStats{}
+	}
+	return s.keys.getStats()
 }
 
 // NewStatic initializes new static authenticator with list of long-term
-// credentials.
+// credentials, caching up to DefaultKeyCacheSize keys.
 func NewStatic(credentials []StaticCredential) *Static {
+	return NewStaticWithCache(credentials, DefaultKeyCacheSize)
+}
+
+// NewStaticWithCache is same as NewStatic, but caches up to cacheSize
+// long-term keys of credentials with AnyRealm, no cache if zero.
+func NewStaticWithCache(credentials []StaticCredential, cacheSize int) *Static {
 	s := &Static{
 		credentials: make(map[staticKey]stun.MessageIntegrity, len(credentials)),
+		anyRealm:    make(map[string]string),
 	}
 	for _, c := range credentials {
+		if c.Realm == AnyRealm {
+			// Key of wildcard credential can't be used for other realms.
+			if c.Password != "" {
+				s.anyRealm[c.Username] = c.Password
+			}
+			continue
+		}
 		k := staticKey{username: c.Username, realm: c.Realm}
 		if len(c.Key) > 0 {
 			s.credentials[k] = stun.MessageIntegrity(c.Key)
@@ -63,5 +122,8 @@ func NewStatic(credentials []StaticCredential) *Static {
 		}
 		s.credentials[k] = stun.NewLongTermIntegrity(c.Username, c.Realm, c.Password)
 	}
+	if cacheSize > 0 && len(s.anyRealm) > 0 {
+		s.keys = newKeyCache(cacheSize)
+	}
 	return s
 }
@@ -95,3 +95,93 @@ func BenchmarkStatic_Auth(b *testing.B) {
 		}
 	}
 }
+
+func TestStatic_AuthKey(t *testing.T) {
+	var (
+		u   = stun.NewUsername("username")
+		r   = stun.NewRealm("realm")
+		key = stun.NewLongTermIntegrity("username", "realm", "password")
+	)
+	for _, tc := range []struct {
+		name string
+		cred StaticCredential
+		i    stun.MessageIntegrity
+		ok   bool
+	}{
+		{
+			name: "KeyOnly",
+			cred: StaticCredential{Username: "username", Realm: "realm", Key: key},
+			i:    key,
+			ok:   true,
+		},
+		{
+			name: "PasswordOnly",
+			cred: StaticCredential{Username: "username", Realm: "realm", Password: "password"},
+			i:    key,
+			ok:   true,
+		},
+		{
+			name: "KeyAuthoritative",
+			cred: StaticCredential{Username: "username", Realm: "realm", Password: "other", Key: key},
+			i:    key,
+			ok:   true,
+		},
+		{
+			name: "PasswordIgnored",
+			cred: StaticCredential{Username: "username", Realm: "realm", Password: "other", Key: key},
+			i:    stun.NewLongTermIntegrity("username", "realm", "other"),
+			ok:   false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewStatic([]StaticCredential{tc.cred})
+			_, err := s.Auth(stun.MustBuild(stun.BindingRequest, u, r, tc.i))
+			if tc.ok && err != nil {
+				t.Error(err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestStatic_AuthAnyRealm(t *testing.T) {
+	s := NewStatic([]StaticCredential{
+		{Username: "service", Realm: AnyRealm, Password: "secret"},
+		{Username: "service", Realm: "exact.org", Password: "other"},
+		{Username: "keyed", Realm: AnyRealm, Key: stun.NewLongTermIntegrity("keyed", "a.org", "secret")},
+	})
+	for _, tc := range []struct {
+		name     string
+		username string
+		realm    string
+		password string
+		ok       bool
+		anyRealm bool
+	}{
+		{name: "FirstRealm", username: "service", realm: "a.org", password: "secret", ok: true, anyRealm: true},
+		{name: "SecondRealm", username: "service", realm: "b.org", password: "secret", ok: true, anyRealm: true},
+		{name: "BadPassword", username: "service", realm: "a.org", password: "bad"},
+		{name: "ExactRealm", username: "service", realm: "exact.org", password: "other", ok: true},
+		{name: "ExactRealmPrecedence", username: "service", realm: "exact.org", password: "secret"},
+		{name: "KeyOnly", username: "keyed", realm: "a.org", password: "secret"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := stun.MustBuild(stun.BindingRequest,
+				stun.NewUsername(tc.username), stun.NewRealm(tc.realm),
+				stun.NewLongTermIntegrity(tc.username, tc.realm, tc.password),
+			)
+			_, anyRealm, err := s.AuthAnyRealm(m)
+			if tc.ok && err != nil {
+				t.Error(err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("expected error")
+			}
+			if tc.ok && anyRealm != tc.anyRealm {
+				t.Errorf("unexpected any realm %v", anyRealm)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"container/list"
+	"sync"
+
+	"gortc.io/stun"
+)
+
+// DefaultKeyCacheSize is default maximum count of long-term keys that are
+// cached by Static for credentials with AnyRealm.
+const DefaultKeyCacheSize = 1024
+
+// KeyCacheStats contains statistics of long-term key cache.
+type KeyCacheStats struct {
+	Hits   uint64 // total lookups of cached keys
+	Misses uint64 // total key derivations
+	Size   int    // currently cached keys
+}
+
+type keyCacheEntry struct {
+	key       staticKey
+	integrity stun.MessageIntegrity
+}
+
+// keyCache is LRU cache of long-term keys, so key derivation is done only
+// once for repeated requests of same client.
+type keyCache struct {
+	mux     sync.Mutex
+	max     int
+	entries map[staticKey]*list.Element
+	lru     list.List // of keyCacheEntry, most recently used first
+	stats   KeyCacheStats
+}
+
+func newKeyCache(max int) *keyCache {
+	return &keyCache{
+		max:     max,
+		entries: make(map[staticKey]*list.Element, max),
+	}
+}
+
+// get returns long-term key of username in realm, deriving it from
+// password if it is not cached.
+func (c *keyCache) get(username, realm []byte, password string) stun.MessageIntegrity {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if e, ok := c.entries[staticKey{username: string(username), realm: string(realm)}]; ok {
+		c.stats.Hits++
+		c.lru.MoveToFront(e)
+		return e.Value.(keyCacheEntry).integrity
+	}
+	c.stats.Misses++
+	k := staticKey{username: string(username), realm: string(realm)}
+	i := stun.NewLongTermIntegrity(k.username, k.realm, password)
+	if c.lru.Len() >= c.max {
+		// Evicting least recently used key.
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(keyCacheEntry).key)
+	}
+	c.entries[k] = c.lru.PushFront(keyCacheEntry{key: k, integrity: i})
+	return i
+}
+
+func (c *keyCache) getStats() KeyCacheStats {
+	c.mux.Lock()
+	s := c.stats
+	s.Size = c.lru.Len()
+	c.mux.Unlock()
+	return s
+}
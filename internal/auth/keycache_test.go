@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"bytes"
+	"testing"
+
+	"gortc.io/stun"
+)
+
+func TestKeyCache(t *testing.T) {
+	c := newKeyCache(2)
+	get := func(realm string) stun.MessageIntegrity {
+		return c.get([]byte("service"), []byte(realm), "secret")
+	}
+	for _, realm := range []string{"a.org", "b.org", "a.org"} {
+		i := get(realm)
+		if !bytes.Equal(i, stun.NewLongTermIntegrity("service", realm, "secret")) {
+			t.Errorf("unexpected key for %s", realm)
+		}
+	}
+	if s := c.getStats(); s != (KeyCacheStats{Hits: 1, Misses: 2, Size: 2}) {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	t.Run("Eviction", func(t *testing.T) {
+		get("c.org") // evicts b.org, that is least recently used
+		get("a.org")
+		if s := c.getStats(); s != (KeyCacheStats{Hits: 2, Misses: 3, Size: 2}) {
+			t.Errorf("unexpected stats %+v", s)
+		}
+		get("b.org")
+		if s := c.getStats(); s != (KeyCacheStats{Hits: 2, Misses: 4, Size: 2}) {
+			t.Errorf("unexpected stats %+v", s)
+		}
+	})
+}
+
+func TestStatic_KeyCacheStats(t *testing.T) {
+	credentials := []StaticCredential{
+		{Username: "service", Realm: AnyRealm, Password: "secret"},
+	}
+	if s := NewStaticWithCache(credentials, 0).KeyCacheStats(); s != (KeyCacheStats{}) {
+		t.Errorf("unexpected stats of disabled cache %+v", s)
+	}
+	s := NewStatic(credentials)
+	if s.keys == nil || s.keys.max != DefaultKeyCacheSize {
+		t.Fatal("cache should be enabled by default")
+	}
+	s.keys.get([]byte("service"), []byte("a.org"), "secret")
+	if stats := s.KeyCacheStats(); stats.Misses != 1 || stats.Size != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -2,8 +2,13 @@ package auth
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"hash"
+	"net"
 	"sync"
 	"time"
 
@@ -18,9 +23,22 @@ import (
 //
 // TODO: Run timer that removes old nonces
 func NewNonceAuth(duration time.Duration) *NonceAuth {
+	return NewNonceAuthWithGrace(duration, 0)
+}
+
+// NewNonceAuthWithGrace is same as NewNonceAuth, but previous nonce is
+// still accepted for grace after its expiration, so requests that were
+// in-flight during rotation are not rejected with 438 (Stale Nonce).
+func NewNonceAuthWithGrace(duration, grace time.Duration) *NonceAuth {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
 	return &NonceAuth{
 		nonces:   make([]nonce, 0, 100),
 		duration: duration,
+		grace:    grace,
+		mac:      hmac.New(sha256.New, key),
 	}
 }
 
@@ -28,6 +46,9 @@ type nonce struct {
 	tuple      turn.FiveTuple
 	value      stun.Nonce
 	validUntil time.Time
+
+	prev           stun.Nonce // previous value, accepted until prevValidUntil
+	prevValidUntil time.Time
 }
 
 func (n *nonce) valid(t time.Time) bool {
@@ -37,8 +58,37 @@ func (n *nonce) valid(t time.Time) bool {
 // NonceAuth is nonce check and rotate implementation.
 type NonceAuth struct {
 	duration time.Duration
+	grace    time.Duration // previous nonce is accepted after rotation
 	mux      sync.Mutex
 	nonces   []nonce
+	mac      hash.Hash // guarded by mux
+	stats    NonceStats
+}
+
+// NonceStats contains nonce manager statistics.
+type NonceStats struct {
+	Issued    uint64 // total issued nonces, including rotated ones
+	Validated uint64 // total checks of valid nonces
+	Stale     uint64 // total checks of non-blank nonces that were rejected as stale
+	Active    int    // currently tracked nonces
+}
+
+// Stats returns current statistics.
+func (n *NonceAuth) Stats() NonceStats {
+	n.mux.Lock()
+	s := n.stats
+	s.Active = len(n.nonces)
+	n.mux.Unlock()
+	return s
+}
+
+// stale counts rejection of value and returns ErrStaleNonce.
+func (n *NonceAuth) stale(value stun.Nonce) error {
+	if len(value) > 0 {
+		// Blank nonce is initial request, not a rejection.
+		n.stats.Stale++
+	}
+	return ErrStaleNonce
 }
 
 var (
@@ -46,15 +96,49 @@ var (
 	ErrStaleNonce = errors.New("stale nonce")
 )
 
-func newNonce() stun.Nonce {
-	buf := make([]byte, 12)
+const (
+	nonceRandomSize = 12
+	nonceMACSize    = 8
+)
+
+// sum returns truncated MAC of random nonce part and tuple.
+func (n *NonceAuth) sum(tuple turn.FiveTuple, random []byte) []byte {
+	buf := make([]byte, 0, 2*(net.IPv6len+2)+1)
+	buf = append(buf, byte(tuple.Proto))
+	for _, a := range []turn.Addr{tuple.Client, tuple.Server} {
+		buf = append(buf, a.IP.To16()...)
+		buf = append(buf, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(a.Port))
+	}
+	n.mac.Reset()
+	n.mac.Write(random)
+	n.mac.Write(buf)
+	return n.mac.Sum(nil)[:nonceMACSize]
+}
+
+// newNonce returns new random nonce that is tied to tuple.
+func (n *NonceAuth) newNonce(tuple turn.FiveTuple) stun.Nonce {
+	buf := make([]byte, nonceRandomSize, nonceRandomSize+nonceMACSize)
 	if _, err := rand.Read(buf); err != nil {
 		panic(err)
 	}
-	v := make([]byte, 24)
+	buf = append(buf, n.sum(tuple, buf)...)
+	v := make([]byte, hex.EncodedLen(len(buf)))
 	return v[:hex.Encode(v, buf)]
 }
 
+// issuedFor reports whether value was issued for tuple.
+func (n *NonceAuth) issuedFor(tuple turn.FiveTuple, value stun.Nonce) bool {
+	buf := make([]byte, hex.DecodedLen(len(value)))
+	if _, err := hex.Decode(buf, value); err != nil {
+		return false
+	}
+	if len(buf) != nonceRandomSize+nonceMACSize {
+		return false
+	}
+	return hmac.Equal(buf[nonceRandomSize:], n.sum(tuple, buf[:nonceRandomSize]))
+}
+
 // Check implements NonceManager.
 func (n *NonceAuth) Check(tuple turn.FiveTuple, value stun.Nonce, at time.Time) (stun.Nonce, error) {
 	n.mux.Lock()
@@ -65,27 +149,38 @@ func (n *NonceAuth) Check(tuple turn.FiveTuple, value stun.Nonce, at time.Time)
 		}
 		// Found nonce.
 		current := n.nonces[i]
-		if current.valid(at) {
-			// Current nonce is valid.
-			if !bytes.Equal(current.value, value) {
-				// Returning ErrStaleNonce with correct nonce.
-				return current.value, ErrStaleNonce
+		if !current.valid(at) {
+			// Rotating, keeping expired value for grace window.
+			current.prev, current.prevValidUntil = nil, time.Time{}
+			if n.grace > 0 {
+				current.prev = current.value
+				current.prevValidUntil = current.validUntil.Add(n.grace)
 			}
+			current.value = n.newNonce(tuple)
+			current.validUntil = at.Add(n.duration)
+			n.nonces[i] = current
+			n.stats.Issued++
+		}
+		if bytes.Equal(current.value, value) && n.issuedFor(tuple, value) {
+			n.stats.Validated++
 			return current.value, nil
 		}
-		// Rotating.
-		current.value = newNonce()
-		current.validUntil = at.Add(n.duration)
-		n.nonces[i] = current
-		return current.value, ErrStaleNonce
+		if current.prevValidUntil.After(at) && bytes.Equal(current.prev, value) {
+			// Previous value was issued for tuple, so no need to check MAC.
+			n.stats.Validated++
+			return current.value, nil
+		}
+		// Returning ErrStaleNonce with correct nonce.
+		return current.value, n.stale(value)
 	}
 	current := nonce{
 		tuple: tuple,
-		value: newNonce(),
+		value: n.newNonce(tuple),
 	}
 	if n.duration != 0 {
 		current.validUntil = at.Add(n.duration)
 	}
 	n.nonces = append(n.nonces, current)
-	return current.value, ErrStaleNonce
+	n.stats.Issued++
+	return current.value, n.stale(value)
 }
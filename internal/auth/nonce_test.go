@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"bytes"
 	"net"
 	"testing"
 	"time"
@@ -51,3 +52,113 @@ func TestNonceAuth_Check(t *testing.T) {
 		t.Error(checkErr)
 	}
 }
+
+func TestNonceAuth_CheckGrace(t *testing.T) {
+	a := NewNonceAuthWithGrace(time.Minute, time.Second*5)
+	now := time.Now()
+	tuple := turn.FiveTuple{
+		Server: turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 1001},
+		Client: turn.Addr{IP: net.IPv4(127, 0, 0, 2), Port: 2001},
+		Proto:  turn.ProtoUDP,
+	}
+	old, err := a.Check(tuple, nil, now)
+	if err != ErrStaleNonce {
+		t.Fatal(err)
+	}
+	// In-flight request with old nonce triggers rotation, but is accepted.
+	rotated, err := a.Check(tuple, old, now.Add(time.Minute+time.Second))
+	if err != nil {
+		t.Fatalf("old nonce should be accepted within grace: %v", err)
+	}
+	if bytes.Equal(rotated, old) {
+		t.Fatal("nonce should be rotated")
+	}
+	if _, err = a.Check(tuple, old, now.Add(time.Minute+time.Second*4)); err != nil {
+		t.Errorf("old nonce should be accepted within grace: %v", err)
+	}
+	if _, err = a.Check(tuple, rotated, now.Add(time.Minute+time.Second*4)); err != nil {
+		t.Error(err)
+	}
+	if _, err = a.Check(tuple, old, now.Add(time.Minute+time.Second*5)); err != ErrStaleNonce {
+		t.Errorf("old nonce should be stale after grace, got %v", err)
+	}
+	if _, err = a.Check(tuple, stun.NewNonce("bad"), now.Add(time.Minute+time.Second)); err != ErrStaleNonce {
+		t.Errorf("unknown nonce should be stale, got %v", err)
+	}
+	// Rotating again, only last previous nonce is kept.
+	if _, err = a.Check(tuple, old, now.Add(time.Minute*2+time.Second*2)); err != ErrStaleNonce {
+		t.Errorf("nonce before previous should be stale, got %v", err)
+	}
+	if _, err = a.Check(tuple, rotated, now.Add(time.Minute*2+time.Second*3)); err != nil {
+		t.Errorf("previous nonce should be accepted within grace: %v", err)
+	}
+}
+
+func TestNonceAuth_CheckOtherTuple(t *testing.T) {
+	a := NewNonceAuth(0)
+	now := time.Now()
+	tupleA := turn.FiveTuple{
+		Server: turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 1001},
+		Client: turn.Addr{IP: net.IPv4(127, 0, 0, 2), Port: 2001},
+		Proto:  turn.ProtoUDP,
+	}
+	tupleB := tupleA
+	tupleB.Client.Port = 2002
+	nonceA, err := a.Check(tupleA, nil, now)
+	if err != ErrStaleNonce {
+		t.Fatal(err)
+	}
+	if !a.issuedFor(tupleA, nonceA) {
+		t.Error("nonce should be issued for A")
+	}
+	if a.issuedFor(tupleB, nonceA) {
+		t.Error("nonce should not be issued for B")
+	}
+	if _, err = a.Check(tupleB, nil, now); err != ErrStaleNonce {
+		t.Fatal(err)
+	}
+	nonceB, err := a.Check(tupleB, nonceA, now)
+	if err != ErrStaleNonce {
+		t.Errorf("reused nonce should be stale, got %v", err)
+	}
+	if bytes.Equal(nonceA, nonceB) {
+		t.Error("nonce for B should differ")
+	}
+	if _, err = a.Check(tupleA, nonceA, now); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNonceAuth_Stats(t *testing.T) {
+	a := NewNonceAuth(time.Minute)
+	now := time.Now()
+	tuple := turn.FiveTuple{
+		Server: turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 1001},
+		Client: turn.Addr{IP: net.IPv4(127, 0, 0, 2), Port: 2001},
+		Proto:  turn.ProtoUDP,
+	}
+	// Initial request without nonce is not stale.
+	n, err := a.Check(tuple, nil, now)
+	if err != ErrStaleNonce {
+		t.Fatal(err)
+	}
+	if _, err = a.Check(tuple, n, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Check(tuple, stun.NewNonce("bad"), now); err != ErrStaleNonce {
+		t.Fatal(err)
+	}
+	// Rotating.
+	if _, err = a.Check(tuple, n, now.Add(time.Minute*2)); err != ErrStaleNonce {
+		t.Fatal(err)
+	}
+	expected := NonceStats{
+		Issued:    2,
+		Validated: 1,
+		Stale:     2,
+		Active:    1,
+	}
+	if s := a.Stats(); s != expected {
+		t.Errorf("%+v (got) != %+v (expected)", s, expected)
+	}
+}
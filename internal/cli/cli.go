@@ -1,18 +1,26 @@
 package cli
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
+	"time"
 
 	"github.com/mitchellh/go-homedir"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/yaml.v2"
+
+	"gortc.io/gortcd/internal/auth"
 )
 
 // getZapConfig decodes zap logging configuration from
@@ -55,27 +63,18 @@ func getZapConfig(v *viper.Viper) (zap.Config, error) {
 		// configuration.
 		d = zap.NewDevelopmentConfig()
 	}
-	if v.ConfigFileUsed() == "" {
+	if v.ConfigFileUsed() == "" && !isConfigURL(cfgFile) {
 		return d, nil
 	}
 
 	// Parsing yaml directly.
 	raw := &cfgWrapper{}
 	raw.Server.Log = d
-	f, openErr := os.Open(v.ConfigFileUsed())
-	if openErr != nil {
-		return d, openErr
-	}
-	defer func() {
-		if closeErr := f.Close(); closeErr != nil {
-			log.Println("failed to close config file:", closeErr)
-		}
-	}()
-	buf, readErr := ioutil.ReadAll(f)
+	config, readErr := readConfigContent(v)
 	if readErr != nil {
 		return d, readErr
 	}
-	return raw.Server.Log, yaml.Unmarshal(buf, &raw)
+	return raw.Server.Log, yaml.Unmarshal([]byte(config), &raw)
 }
 
 func getLogger(v *viper.Viper) *zap.Logger {
@@ -97,7 +96,11 @@ func mustBind(err error) {
 }
 
 // TODO: Remove global state.
-var cfgFile string
+var (
+	cfgFile string
+	// cfgPoll is poll interval of remote config.
+	cfgPoll time.Duration
+)
 
 func initConfigSnap(v *viper.Viper) {
 	var (
@@ -147,10 +150,16 @@ func initConfigCommon(v *viper.Viper) {
 
 func initConfig(v *viper.Viper) {
 	// Don't forget to read config either from cfgFile or from home directory!
-	if cfgFile != "" {
+	switch {
+	case isConfigURL(cfgFile):
+		// Remote config is fetched by readInConfig.
+		v.SetConfigType(configURLType(cfgFile))
+	case strings.Contains(cfgFile, "://"):
+		log.Fatalln("unsupported config url, only http, https, consul and etcd are supported:", cfgFile)
+	case cfgFile != "":
 		// Use config file from the flag.
 		v.SetConfigFile(cfgFile)
-	} else {
+	default:
 		if os.Getenv("SNAP_NAME") != "" {
 			initConfigSnap(v)
 		} else {
@@ -159,7 +168,7 @@ func initConfig(v *viper.Viper) {
 		v.SetConfigName("gortcd")
 		v.SetConfigType("yaml")
 	}
-	cfgErr := v.ReadInConfig()
+	cfgErr := readInConfig(v)
 	if _, ok := cfgErr.(viper.ConfigFileNotFoundError); ok {
 		cfgErr = v.ReadConfig(strings.NewReader(defaultConfigFileContent))
 	}
@@ -168,19 +177,195 @@ func initConfig(v *viper.Viper) {
 	}
 }
 
+// envRef matches ${VAR} reference to environment variable.
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} references in config with values returned
+// by lookup, failing if any referenced variable is not set. Values are
+// escaped, see escapeEnvValue. Lines that are comments are left intact,
+// so examples can be commented out.
+func expandEnv(config string, lookup func(string) (string, bool)) (string, error) {
+	lines := strings.SplitAfter(config, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		var (
+			b    strings.Builder
+			last int
+		)
+		for _, m := range envRef.FindAllStringSubmatchIndex(line, -1) {
+			name := line[m[2]:m[3]]
+			value, ok := lookup(name)
+			if !ok {
+				return "", fmt.Errorf("line %d: environment variable %s is not set", i+1, name)
+			}
+			escaped, err := escapeEnvValue(line, m[0], m[1], value)
+			if err != nil {
+				return "", fmt.Errorf("line %d: environment variable %s: %v", i+1, name, err)
+			}
+			b.WriteString(line[last:m[0]])
+			b.WriteString(escaped)
+			last = m[1]
+		}
+		b.WriteString(line[last:])
+		lines[i] = b.String()
+	}
+	return strings.Join(lines, ""), nil
+}
+
+// escapeEnvValue escapes value of line[start:end] reference, so value
+// can't change structure of config, e.g. start comment or mapping. Value
+// is escaped in double-quoted strings and single-quoted ones; in plain
+// scalar it is quoted if needed, which requires reference to be whole
+// scalar.
+func escapeEnvValue(line string, start, end int, value string) (string, error) {
+	switch quoteAt(line, start) {
+	case '"':
+		// JSON escapes are valid in YAML double-quoted scalars.
+		b, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		return string(b[1 : len(b)-1]), nil
+	case '\'':
+		if strings.ContainsAny(value, "\r\n") {
+			return "", errors.New("line break can't be escaped in single-quoted string, use double quotes")
+		}
+		return strings.Replace(value, "'", "''", -1), nil
+	}
+	if isPlainSafe(value) {
+		return value, nil
+	}
+	var (
+		before = strings.TrimSpace(line[:start])
+		after  = strings.TrimSpace(line[end:])
+	)
+	whole := (strings.HasSuffix(before, ":") || before == "-" || strings.HasSuffix(before, " -")) &&
+		(after == "" || strings.HasPrefix(after, "#"))
+	if !whole {
+		return "", errors.New("value should be quoted, e.g. \"${VAR}\"")
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// quoteAt returns quote character of string that contains line[pos], or
+// zero if it is not in quoted string.
+func quoteAt(line string, pos int) byte {
+	var quote byte
+	for i := 0; i < pos; i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++ // escaped character
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\'') &&
+			(i == 0 || strings.IndexByte(" \t[{,", line[i-1]) >= 0):
+			// Quotes start quoted scalar only at its beginning.
+			quote = c
+		}
+	}
+	return quote
+}
+
+// isPlainSafe reports whether value can be inserted into plain scalar
+// as is, being parsed as same value.
+func isPlainSafe(value string) bool {
+	if value == "" {
+		return true
+	}
+	if strings.ContainsAny(value, "\r\n\t,[]{}") ||
+		strings.Contains(value, ": ") || strings.Contains(value, " #") ||
+		strings.HasSuffix(value, ":") ||
+		value != strings.TrimSpace(value) {
+		return false
+	}
+	// Indicators that start special node.
+	return strings.IndexByte("-?:#&*!|>'\"%@`", value[0]) < 0
+}
+
+// readInConfig reads config file like v.ReadInConfig does, but expands
+// ${VAR} references to environment variables. Remote config is fetched
+// if config path is url.
+func readInConfig(v *viper.Viper) error {
+	config, err := readConfigContent(v)
+	if err != nil {
+		return err
+	}
+	return v.ReadConfig(strings.NewReader(config))
+}
+
+// readConfigContent returns config content with expanded references to
+// environment variables.
+func readConfigContent(v *viper.Viper) (string, error) {
+	var (
+		buf  []byte
+		err  error
+		name = cfgFile
+	)
+	if isConfigURL(cfgFile) {
+		if buf, err = fetchConfig(cfgFile); err != nil {
+			return "", fmt.Errorf("failed to fetch config: %v", err)
+		}
+	} else {
+		// Locating config file, path is available via ConfigFileUsed after.
+		if err = v.ReadInConfig(); err != nil {
+			return "", err
+		}
+		name = v.ConfigFileUsed()
+		if buf, err = ioutil.ReadFile(name); err != nil {
+			return "", err
+		}
+	}
+	config, err := expandEnv(string(buf), os.LookupEnv)
+	if err != nil {
+		return "", fmt.Errorf("failed to expand %s: %v", name, err)
+	}
+	return config, nil
+}
+
 func initViper(v *viper.Viper) {
 	v.SetDefault("server.workers", 100)
 	v.SetDefault("auth.stun", false)
+	v.SetDefault("auth.key_cache_size", auth.DefaultKeyCacheSize)
 	v.SetDefault("version", "1")
 	v.SetDefault("server.reuseport", true)
+	v.SetDefault("server.fingerprint", true)
+	v.SetDefault("server.prefer_channeldata", true)
 	v.SetDefault(keyPrometheusActive, true)
 }
 
+// Build information that is set from main package.
+var (
+	Version = "dev"
+	Commit  = "none"
+)
+
+// newBuildInfo returns gauge with build information labels.
+func newBuildInfo() prometheus.Gauge {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gortcd_build_info",
+		Help: "gortcd build information",
+		ConstLabels: prometheus.Labels{
+			"version":   Version,
+			"commit":    Commit,
+			"goversion": runtime.Version(),
+		},
+	})
+	g.Set(1)
+	return g
+}
+
 // Execute starts root command.
 func Execute() {
 	v := viper.GetViper()
 	initViper(v)
-	rootCmd := getRoot(v, ListenUDPAndServe)
+	rootCmd := getRoot(v, ListenAndServe)
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -0,0 +1,106 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestExpandEnv(t *testing.T) {
+	env := map[string]string{
+		"TURN_REALM": "example.org",
+		"EMPTY":      "",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	for _, tc := range []struct {
+		name, in, out string
+	}{
+		{name: "Plain", in: "realm: gortc.io\n", out: "realm: gortc.io\n"},
+		{name: "Value", in: "realm: ${TURN_REALM}\n", out: "realm: example.org\n"},
+		{name: "Empty", in: "realm: \"${EMPTY}\"", out: "realm: \"\""},
+		{name: "Dollar", in: "password: pa$$word\n", out: "password: pa$$word\n"},
+		{name: "Comment", in: "  # realm: ${UNSET}\nrealm: ${TURN_REALM}", out: "  # realm: ${UNSET}\nrealm: example.org"},
+		{name: "Multiple", in: "key: ${TURN_REALM}:${TURN_REALM}\n", out: "key: example.org:example.org\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := expandEnv(tc.in, lookup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != tc.out {
+				t.Errorf("%q (got) != %q (expected)", out, tc.out)
+			}
+		})
+	}
+	t.Run("Escaped", func(t *testing.T) {
+		// Values can't change structure of config.
+		for _, value := range []string{
+			"pa#ss",
+			"pa #ss",
+			"key: value",
+			"multi\nline",
+			"with \"double\" and 'single' quotes",
+			"back\\slash",
+			"- item",
+			"[a, b]",
+			" spaces ",
+			"",
+		} {
+			lookup := func(string) (string, bool) { return value, true }
+			for _, in := range []string{
+				"secret: ${SECRET}\nrealm: gortc.io\n",
+				"secret: ${SECRET} # comment\nrealm: gortc.io\n",
+				"secret: \"${SECRET}\"\nrealm: gortc.io\n",
+				"secret: \"a ${SECRET} b\"\nrealm: gortc.io\n",
+				"secret: '${SECRET}'\nrealm: gortc.io\n",
+				"secret:\n  - ${SECRET}\nrealm: gortc.io\n",
+			} {
+				out, err := expandEnv(in, lookup)
+				if err != nil {
+					if strings.Contains(in, "'") && strings.Contains(value, "\n") {
+						// Not representable in single-quoted string.
+						continue
+					}
+					t.Errorf("%q with %q: %v", in, value, err)
+					continue
+				}
+				var c map[string]interface{}
+				if err = yaml.Unmarshal([]byte(out), &c); err != nil {
+					t.Errorf("%q with %q: %v", in, value, err)
+					continue
+				}
+				expected := value
+				if strings.Contains(in, "a ${SECRET} b") {
+					expected = "a " + value + " b"
+				}
+				got := c["secret"]
+				if list, ok := got.([]interface{}); ok && len(list) == 1 {
+					got = list[0]
+				}
+				if got == nil {
+					got = ""
+				}
+				if got != expected || c["realm"] != "gortc.io" {
+					t.Errorf("%q with %q: unexpected config %q", in, value, out)
+				}
+			}
+		}
+	})
+	t.Run("NotQuoted", func(t *testing.T) {
+		lookup := func(string) (string, bool) { return "a # b", true }
+		if _, err := expandEnv("secret: prefix-${SECRET}\n", lookup); err == nil {
+			t.Error("should fail")
+		}
+	})
+	t.Run("Unset", func(t *testing.T) {
+		if _, err := expandEnv("realm: gortc.io\nsecret: ${UNSET}\n", lookup); err == nil {
+			t.Error("should fail")
+		} else if err.Error() != "line 2: environment variable UNSET is not set" {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
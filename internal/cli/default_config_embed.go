@@ -4,6 +4,13 @@ const defaultConfigFileContent = `---
 # The only valid version is currently 1, but there are no backward
 # compatibility until gortcd reached v1.0.0. After that, config file
 # will be versioned.
+#
+# Values can reference environment variables as ${VAR}, e.g.
+# realm: ${TURN_REALM}; config is not loaded if any referenced
+# variable is not set. References in comment lines are ignored.
+# Values are escaped, so they can't change structure of config; if
+# value needs quoting (e.g. contains "#" or ": "), reference should
+# be whole value or be quoted, e.g. secret: "${TURN_SECRET}".
 version: "1"
 
 server:
@@ -12,39 +19,283 @@ server:
     level: "info"
     disableCaller: true
     disableStacktrace: true
+    # log hex of received and sent packets, requires "debug"
+    # level; very verbose and can expose credentials, so use
+    # only for protocol debugging
+    # dump: false
   # use REUSEPORT sockets if available, dramatically
   # improves the performance on multi-threaded systems.
+  # All sockets are bound to listener address, so clients
+  # always see same source address of responses and relayed data.
   reuseport: true
+  # SO_RCVBUF and SO_SNDBUF of listener and relay sockets in bytes,
+  # e.g. to avoid drops under high packet rate; OS defaults are used
+  # if not set. OS can clamp requested sizes (see net.core.rmem_max
+  # and net.core.wmem_max on linux), effective ones are logged.
+  # Not reloadable.
+  # socket:
+  #   rcvbuf: 4194304
+  #   sndbuf: 4194304
   # maximum count of concurrent workers that process request,
   # use to limit memory consumption.
   workers: 100
+  # when all workers are busy, reader retries to pass packet
+  # to worker "worker_attempts" times, sleeping "worker_backoff"
+  # between attempts, and then drops it; set attempts to 1 to
+  # drop packets immediately without blocking the reader
+  # worker_attempts: 7
+  # worker_backoff: 300ms
+  # listen addresses, UDP by default; "net" can be set to:
+  #   tcp   STUN and TCP allocations (RFC 6062) over TCP
+  #   tls   same over TLS (TURNS), requires server.tls
+  #   quic  STUN and TURN over QUIC datagrams (RFC 9221) with
+  #         "stun.turn" ALPN, experimental, requires server.tls
+  #         and build with "quic" tag
+  #   ws    STUN and TURN over WebSocket binary messages, e.g. for
+  #         browsers behind HTTP proxies
+  #   wss   same over secure WebSocket, requires server.tls
+  # network can be also set as scheme, e.g. "wss://0.0.0.0:443"
   listen:
     - 0.0.0.0:3478
+  # - addr: 0.0.0.0:3478
+  #   net: tcp
+  #   # overrides server.software for this listener
+  #   software: "gortcd-node-1"
+  #   # used in "addr" label of metrics instead of address, e.g.
+  #   # to aggregate listeners on all interfaces; metrics of
+  #   # listeners with same name are summed, not reloadable
+  #   name: public
+  #   # serve only listed services, "stun" (Binding requests) or
+  #   # "turn" (allocations), e.g. for public STUN endpoint; requests
+  #   # for other services are rejected with 400 (Bad Request)
+  #   services: [stun]
+  # certificates of listeners that require TLS, "tls", "wss" and
+  # "quic" ones; reloaded certificates are used for new "tls" and
+  # "wss" connections, "quic" listeners keep ones loaded on start
+  # tls:
+  #   # default certificate
+  #   cert: /etc/gortcd/cert.pem
+  #   key: /etc/gortcd/key.pem
+  #   # directory of "host.crt" and "host.key" pairs, certificate is
+  #   # selected by server name (SNI) of client, falling back to
+  #   # default one, e.g. to serve TURNS for many hostnames
+  #   sni_dir: /etc/gortcd/certs
+  # relayed transport addresses are allocated on listener
+  # address by default; set to relay media via other local
+  # interface, e.g. on dual-homed hosts
+  # relay:
+  #   address: 203.0.113.10
+  #   # public address that is advertised in RELAYED-ADDRESS
+  #   # instead of local one, e.g. when running behind 1:1 NAT
+  #   external_ip: 198.51.100.10
+  #   # local IPv6 address for dual allocations, that have both
+  #   # IPv4 and IPv6 relayed addresses and are requested with
+  #   # ADDITIONAL-ADDRESS-FAMILY (RFC 8656); data to IPv6 peers
+  #   # is relayed via IPv6 one. Dual allocations are rejected
+  #   # with 440 (Address Family not Supported) if not set, single
+  #   # ones are not affected. Not compatible with "pooled"
+  #   # allocator; not reloadable
+  #   address6: "2001:db8::10"
+  #   # DSCP value in [0, 63] of relayed packets, e.g. 46 (EF) for
+  #   # QoS-managed networks; not set by default, linux only,
+  #   # not reloadable
+  #   dscp: 46
+  #   # permission (with its channel bindings) is removed after this
+  #   # count of consecutive failed writes to peer, e.g. when peer
+  #   # network is down, instead of waiting for its expiration;
+  #   # disabled if zero or not set, not reloadable
+  #   max_write_failures: 10
+  #   # count of goroutines that read relay sockets of all
+  #   # allocations via epoll instead of goroutine per allocation,
+  #   # lowering memory and scheduling overhead of many mostly idle
+  #   # allocations; goroutine per allocation if zero or not set,
+  #   # linux only, not reloadable
+  #   readers: 4
+  #   # REQUESTED-TRANSPORT protocols of allowed allocations, "udp"
+  #   # or "tcp"; others are rejected with 442 (Unsupported
+  #   # Transport Protocol). Only "udp" is allowed if not set, set to
+  #   # [] to reject all allocations. TCP allocations (RFC 6062) are
+  #   # served only by "tcp" listeners, UDP ones by others
+  #   allowed_transports: [udp]
+  #   # "listener" relays via listener (or relay "address") only
+  #   # (default); "round_robin" and "random" select relay address of
+  #   # each allocation from "pool", e.g. to spread relayed traffic
+  #   # across multiple NICs or public IPs. Pool is not compatible
+  #   # with "external_ip" and "pooled" allocator; not reloadable
+  #   strategy: round_robin
+  #   pool:
+  #     - 203.0.113.10
+  #     - 203.0.113.11
+  #   # "system" allocates relay ports on demand (default), "pooled"
+  #   # pre-allocates all ports of [min_port, max_port] range on
+  #   # relay "address" on start, lowering allocation latency and
+  #   # bounding relay ports; not reloadable
+  #   allocator: pooled
+  #   min_port: 49152
+  #   max_port: 65535
+  # 1:1 "private->public" mapping of observed client IPs that is
+  # applied to XOR-MAPPED-ADDRESS of Binding responses, e.g. when
+  # server is behind asymmetric NAT; port is kept. Unlike the
+  # relay "external_ip", it does not affect RELAYED-ADDRESS
+  # nat:
+  #   map:
+  #     - 10.0.0.5->203.0.113.5
   # default realm
   realm: gortc.io
+  # realm overrides for listeners, "0.0.0.0" matches any
+  # listener on port; credentials from other realms are
+  # also accepted and their realm is echoed back
+  # realms:
+  #   - listen: 10.0.0.1:3478
+  #     realm: example.com
   # the SOFTWARE attribute value;
   # not sending attribute if not set
   software: gortcd
   # verify the FINGERPRINT attribute
   check_fingerprint: true
+  # add the FINGERPRINT attribute to responses; it is optional
+  # for responses and some legacy clients fail to parse it
+  fingerprint: true
+  # compatibility workarounds for clients that fail to parse valid
+  # responses; first quirk with "software" that is prefix of SOFTWARE
+  # attribute of request is applied, disabled if not set
+  # quirks:
+  #   - software: "legacy-client"
+  #     # don't add FINGERPRINT to responses
+  #     no_fingerprint: true
+  #     # don't add RESPONSE-ORIGIN to Binding responses
+  #     no_response_origin: true
+  #     # add SOFTWARE after other attributes
+  #     software_last: true
+  # allocation lifetime bounds; the "default" is used when client
+  # does not request lifetime explicitly, requested lifetime is
+  # limited by "max"; new allocations are granted at least the
+  # "default" one.
+  lifetime:
+    default: 10m
+    max: 1h
+  # maximum count of allocations, no limit if zero or not set
+  # max_allocations: 10000
+  # when max_allocations is reached, clients are redirected to
+  # alternate servers via 300 (Try Alternate) in round-robin
+  # order, otherwise 508 (Insufficient Capacity) is returned
+  # alternate:
+  #   - 10.0.0.2:3478
+  #   - 10.0.0.3:3478
+  # secondary (alternate IP and port) address of server that is
+  # reported to legacy RFC 3489 clients via CHANGED-ADDRESS in
+  # Binding responses; not reported if not set
+  # rfc5780:
+  #   secondary: 10.0.0.4:3479
+  # maximum count of permissions per allocation, CreatePermission and
+  # ChannelBind requests for new peers are rejected with 508 (Insufficient
+  # Capacity) when reached; no limit if zero or not set
+  # max_permissions_per_allocation: 100
+  # maximum count of channel bindings per allocation, ChannelBind requests
+  # for new channels are rejected with 508 (Insufficient Capacity) when
+  # reached; no limit if zero or not set
+  # max_channels: 100
+  # maximum DATA length of Send indications, larger ones are
+  # dropped, e.g. to avoid relaying datagrams that exceed path
+  # MTU; no limit if zero or not set
+  # max_indication_size: 1200
+  # drop received datagrams that are larger than specified size,
+  # e.g. malformed probes; counted in gortcd_oversized_total, no
+  # limit if zero or not set
+  # max_request_size: 1500
+  # remove allocations that relayed no data for specified duration
+  # even if their lifetime is not expired, disabled if not set
+  # idle_timeout: 5m
+  # rate of pruning expired allocations, permissions and rate
+  # limiter buckets, see gortcd_prune_duration_seconds metric;
+  # 1s if not set, not reloadable
+  # collect_rate: 1s
+  # add MAPPED-ADDRESS and RESPONSE-ORIGIN to Allocate success
+  # responses, helping clients that use same socket for STUN
+  # and TURN to discover reflexive address
+  allocate_mapped: false
+  # relay peer data via ChannelData if channel is bound; set to
+  # false to always use Data indications, e.g. for clients that
+  # fail to process ChannelData messages
+  prefer_channeldata: true
+  # EVEN-PORT is not supported and is ignored by default; set to
+  # reject Allocate requests with it via 420 (Unknown Attribute),
+  # so clients that expect port pairs can fall back
+  # reject_even_port: true
+  # log destination and length of data that clients send to peers
+  # instead of relaying it, e.g. to audit what suspicious client
+  # would relay; allocations work as usual, but peers receive
+  # nothing. Never enable for production traffic. Not reloadable
+  # dry_run: false
+  # rate limiting per source IP, disabled if not set
+  # ratelimit:
+  #   # maximum Binding requests per second; packets over the
+  #   # limit are dropped, reducing reflection attack impact
+  #   binding_pps: 10
+  #   # share single limit between all addresses of network with
+  #   # IPv4 (or IPv6 for "prefix_len6") prefix of given length, so
+  #   # abuser can't evade limit by using many addresses of subnet;
+  #   # limit is per address if not set
+  #   prefix_len: 24
+  #   prefix_len6: 64
+  # post allocation start and stop events as JSON to url,
+  # events are dropped if receiver can't keep up
+  # webhook:
+  #   url: "http://localhost:8080/events"
 
   # export pprof metrics
   # pprof: "localhost:3256"
   # export prometheus metrics
   # prometheus:
     # addr: "localhost:3255"
+    # disable or enable metrics collection overhead; reloadable,
+    # e.g. to collect metrics only while investigating
+    # active: true
 
-# Management API.
+# Management API: "/healthz", "/reload" and "POST /drain", that
+# rejects new allocations (or redirects to server.alternate) until
+# restart, keeping existing ones; "/healthz" reports 503 while draining.
 api:
+  # listening on localhost if host is not set
   addr: "localhost:3257"
+  # require "Authorization: Bearer <token>" header,
+  # strongly recommended if api is not on loopback
+  # token: "secret"
+  # origins that are allowed to call api from browser, e.g. from
+  # dashboard; "*" allows any origin, token is still required.
+  # No CORS headers are sent if not set
+  # cors:
+  #   origins: ["https://dashboard.example.com"]
 
 auth:
   # if true, no credentials are checked
   public: false
+  # maximum count of cached long-term keys of credentials with "*"
+  # realm, least recently used key is evicted; cache hits and misses
+  # are exported as gortcd_auth_key_cache_{hits,misses}_total.
+  # No cache if zero
+  key_cache_size: 1024
 
   nonce:
     static: false
-    timeout: 600s
+    # nonce rotation period; 438 (Stale Nonce) is returned
+    # after expiration, never rotate if zero or not set
+    duration: 0s
+    # previous nonce is still accepted for this period after its
+    # expiration, so requests that were in-flight during rotation
+    # are not rejected with 438; disabled if zero or not set
+    grace: 0s
+  # per-realm settings, keyed by realm of credential that was used
+  # for authentication (or advertised realm if auth is public);
+  # 486 (Allocation Quota Reached) is returned if there are already
+  # "quota" allocations in realm, no limit if zero or not set
+  # realms:
+  #   example.com:
+  #     quota: 100
+  #     # overrides server.software (and listener "software") for
+  #     # realm, e.g. for white-labeled deployments; set to "" to
+  #     # not send SOFTWARE for realm
+  #     software: "Example TURN"
 # Put here valid credentials.
 # So, if you are passing to RTCPeerConnection something like this:
 #  {
@@ -56,8 +307,27 @@ auth:
 #  static:
 #    - username: webrtc
 #      password: turnpassword
+# Or, to avoid storing plaintext password, use pre-computed key
+# that can be obtained via "gortcd key" command:
+#    - username: webrtc
+#      key: 0x...
+# Credential with "*" realm matches any realm, e.g. for service
+# account that is shared between realms; it requires password,
+# as key depends on realm, and credentials for exact realm are
+# matched first. Realm is chosen by client, so allocations of such
+# credential are charged to advertised realm (server.realm or
+# listener "realm") in per-realm quotas and software:
+#    - username: service
+#      realm: "*"
+#      password: secret
+# Keys of such credentials are derived on first request for each
+# realm and then cached, see auth.key_cache_size.
 
 filter:
+  # Rules are evaluated in order and first matching rule wins; matches of
+  # peer and client rules are counted in gortcd_filter_hits_total by
+  # rule subnet and action ("default" for default action), counters are
+  # reset on reload.
   # Rules for filtering peer addresses (the target address of relayed data).
   # If address is filtered, the client will get 403 (Forbidden) error during
   # STUN transaction.
@@ -66,7 +336,7 @@ filter:
     action: allow
   # Put here your filtering rules.
   #  rules:
-  #    - action: deny # can be "allow", "deny", or "pass" (no-op).
+  #    - action: deny # can be "allow", "deny", "ignore", "reject" or "pass" (no-op).
   #      net: 127.0.0.1/32 # should be CIDR
   # E.g. to allow only two networks, use following:
   # peer:
@@ -78,8 +348,36 @@ filter:
   #       action: allow
   # Attempts to relay data to address that is not in those networks
   # will result in 403 error.
+  # Rule can match addresses of host name instead of subnet, e.g. to
+  # relay only to own media servers with changing addresses:
+  # peer:
+  #   action: deny
+  #   rules:
+  #     - fqdn: media.example.com
+  #       action: allow
+  #       ttl: 1m # re-resolution interval, 1m by default
+  # Host is resolved on config load (failure is config error) and then
+  # re-resolved in background every ttl, previous addresses are used
+  # until resolution succeeds. Such rules trust DNS: anyone who controls
+  # the zone or can spoof unauthenticated responses can point the name
+  # to any address, including internal ones (DNS rebinding), so put
+  # deny rules for private and loopback networks before fqdn rules.
+  # The "deny" action silently drops packets from clients, but rejects
+  # requests to peers with 403 error. Use "ignore" to always drop silently
+  # or "reject" to always respond with 403 error.
 
   client:
     # same as "peer" section, but for client addresses.
     action: allow
+
+  # Rules for filtering authenticated usernames of Allocate requests.
+  # If username is filtered, the client will get 403 (Forbidden) error.
+  users:
+    action: allow
+  # E.g. to block compromised credentials:
+  # users:
+  #   action: allow
+  #   rules:
+  #     - username: compromised
+  #       action: deny
 `
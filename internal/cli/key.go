@@ -1,9 +1,14 @@
 package cli
 
 import (
+	"bufio"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -11,6 +16,10 @@ import (
 	"gortc.io/stun"
 )
 
+func getIntegrityHex(username, realm, password string) string {
+	return hex.EncodeToString(stun.NewLongTermIntegrity(username, realm, password))
+}
+
 func getIntegrityHexFromFlags(f *pflag.FlagSet) string {
 	u, err := f.GetString("user")
 	if err != nil {
@@ -24,7 +33,109 @@ func getIntegrityHexFromFlags(f *pflag.FlagSet) string {
 	if err != nil {
 		log.Fatal("failed to get password")
 	}
-	return hex.EncodeToString(stun.NewLongTermIntegrity(u, r, p))
+	return getIntegrityHex(u, r, p)
+}
+
+// keyEntry is long-term key with its credential, as printed in json mode.
+type keyEntry struct {
+	Username string `json:"username"`
+	Realm    string `json:"realm"`
+	Key      string `json:"key"` // same format as auth.static key
+}
+
+// readKeyEntries reads username:realm:password triples, one per line,
+// skipping blank lines and comments, and derives keys for them. Fields are
+// separated by delim, so usernames of TURN REST API that contain colons
+// can be read with other delimiter. Fields are not trimmed, and comment
+// starts with "#" that is followed by whitespace or line end, so
+// usernames that start with "#" can be read.
+func readKeyEntries(r io.Reader, delim string) ([]keyEntry, error) {
+	var (
+		entries []keyEntry
+		line    int
+	)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line++
+		// Only line ending is removed, as password can have spaces.
+		text := strings.TrimSuffix(s.Text(), "\r")
+		if isKeyComment(text) {
+			continue
+		}
+		// Password is last, so it can contain colons.
+		parts := strings.SplitN(text, delim, 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("line %d: expected username%srealm%[2]spassword", line, delim)
+		}
+		entries = append(entries, keyEntry{
+			Username: parts[0],
+			Realm:    parts[1],
+			Key:      "0x" + getIntegrityHex(parts[0], parts[1], parts[2]),
+		})
+	}
+	return entries, s.Err()
+}
+
+// isKeyComment reports whether line of readKeyEntries input is blank or
+// comment.
+func isKeyComment(line string) bool {
+	line = strings.TrimLeft(line, " \t")
+	if line == "" || line == "#" {
+		return true
+	}
+	return strings.HasPrefix(line, "# ") || strings.HasPrefix(line, "#\t")
+}
+
+// writeKeyEntries writes keys to w, either as plain keys or as json objects,
+// one per line.
+func writeKeyEntries(w io.Writer, entries []keyEntry, asJSON bool) error {
+	e := json.NewEncoder(w)
+	for _, k := range entries {
+		if asJSON {
+			if err := e.Encode(k); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := fmt.Fprintln(w, k.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runKey(cmd *cobra.Command) error {
+	f := cmd.Flags()
+	asJSON, err := f.GetBool("json")
+	if err != nil {
+		return err
+	}
+	batch, err := f.GetBool("batch")
+	if err != nil {
+		return err
+	}
+	delim, err := f.GetString("delimiter")
+	if err != nil {
+		return err
+	}
+	if delim == "" {
+		return errors.New("delimiter should not be empty")
+	}
+	var entries []keyEntry
+	if batch {
+		if entries, err = readKeyEntries(cmd.InOrStdin(), delim); err != nil {
+			return err
+		}
+	} else {
+		u, _ := f.GetString("user")
+		r, _ := f.GetString("realm")
+		entries = append(entries, keyEntry{
+			Username: u,
+			Realm:    r,
+			Key:      "0x" + getIntegrityHexFromFlags(f),
+		})
+	}
+	return writeKeyEntries(cmd.OutOrStdout(), entries, asJSON)
 }
 
 func getKeyCmd() *cobra.Command {
@@ -32,12 +143,17 @@ func getKeyCmd() *cobra.Command {
 		Use:   "key",
 		Short: "generate long-term integrity key",
 		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Printf("0x%s\n", getIntegrityHexFromFlags(cmd.Flags()))
+			if err := runKey(cmd); err != nil {
+				log.Fatalln("failed to generate key:", err)
+			}
 		},
 	}
 	cmd.Flags().StringP("user", "u", "", "username")
 	cmd.Flags().StringP("password", "p", "", "password")
 	cmd.Flags().StringP("realm", "r", "", "realm")
+	cmd.Flags().Bool("json", false, "print {username, realm, key} json objects")
+	cmd.Flags().Bool("batch", false, "read username:realm:password lines from stdin")
+	cmd.Flags().String("delimiter", ":", "field delimiter of batch lines, e.g. for usernames with colons")
 
 	return cmd
 }
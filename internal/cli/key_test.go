@@ -1,6 +1,8 @@
 package cli
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -13,3 +15,63 @@ func TestGetKey(t *testing.T) {
 		t.Errorf("bad integrity %s", h)
 	}
 }
+
+func TestKeyBatch(t *testing.T) {
+	in := strings.NewReader("# comment\nuser:realm:secret\n\nfoo:realm:pass:with:colons\n")
+	entries, err := readKeyEntries(in, ":")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	if entries[0].Key != "0xfb6cb9e166c6c764ff2bdea12175a8aa" {
+		t.Errorf("bad key %s", entries[0].Key)
+	}
+	if entries[1].Key != "0x"+getIntegrityHex("foo", "realm", "pass:with:colons") {
+		t.Errorf("bad key %s", entries[1].Key)
+	}
+	buf := new(bytes.Buffer)
+	if err = writeKeyEntries(buf, entries[:1], true); err != nil {
+		t.Fatal(err)
+	}
+	const expected = `{"username":"user","realm":"realm","key":"0xfb6cb9e166c6c764ff2bdea12175a8aa"}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected output %q", buf)
+	}
+	t.Run("Malformed", func(t *testing.T) {
+		if _, err := readKeyEntries(strings.NewReader("user:realm\n"), ":"); err == nil {
+			t.Error("should error")
+		}
+	})
+	t.Run("Verbatim", func(t *testing.T) {
+		in := strings.NewReader("  # comment\r\n#\n#user:realm: secret \r\n")
+		entries, err := readKeyEntries(in, ":")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Username != "#user" {
+			t.Fatalf("unexpected entries: %+v", entries)
+		}
+		if entries[0].Key != "0x"+getIntegrityHex("#user", "realm", " secret ") {
+			t.Errorf("bad key %s", entries[0].Key)
+		}
+	})
+	t.Run("Delimiter", func(t *testing.T) {
+		// TURN REST API username is "timestamp:userid".
+		in := strings.NewReader("1577836800:alice\trealm\tsecret\n")
+		entries, err := readKeyEntries(in, "\t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Username != "1577836800:alice" || entries[0].Realm != "realm" {
+			t.Fatalf("unexpected entries: %+v", entries)
+		}
+		if entries[0].Key != "0x"+getIntegrityHex("1577836800:alice", "realm", "secret") {
+			t.Errorf("bad key %s", entries[0].Key)
+		}
+		if _, err := readKeyEntries(strings.NewReader("1577836800:alice:realm:secret\n"), "\t"); err == nil {
+			t.Error("should error")
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"gortc.io/gortcd/internal/auth"
+	"gortc.io/gortcd/internal/server"
+)
+
+// ReadConfig reads configuration in gortcd.yml format from r, expanding
+// references to environment variables. Defaults are used if r is nil.
+func ReadConfig(r io.Reader) (*viper.Viper, error) {
+	v := viper.New()
+	initViper(v)
+	v.SetConfigType("yaml")
+	if r == nil {
+		r = strings.NewReader(defaultConfigFileContent)
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	config, err := expandEnv(string(buf), os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	if err = v.ReadConfig(strings.NewReader(config)); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// ServerOptions returns server options that are configured by v, as for
+// listeners of gortcd command, including credentials, relay port
+// allocator and certificate. Conn, Listener, Registry and Events are not
+// set.
+func ServerOptions(v *viper.Viper, l *zap.Logger) (server.Options, error) {
+	o := server.Options{Log: l}
+	realm := v.GetString("server.realm") // default realm
+	staticCredentials, err := parseStaticCredentials(v, l, realm)
+	if err != nil {
+		return o, err
+	}
+	l.Info("parsed credentials", zap.Int("n", len(staticCredentials)))
+	l.Info("realm", zap.String("k", realm))
+	if o.PortAllocator, err = getPortAllocator(v, l); err != nil {
+		return o, fmt.Errorf("failed to initialize relay allocator: %v", err)
+	}
+	if o.RelayReaders, err = getRelayReaders(v, l); err != nil {
+		return o, fmt.Errorf("failed to initialize relay readers: %v", err)
+	}
+	if o.TLS, err = getTLSConfig(v, l); err != nil {
+		return o, fmt.Errorf("failed to load certificate: %v", err)
+	}
+	if v.GetBool("auth.public") {
+		l.Warn("auth is public")
+	} else {
+		cacheSize := v.GetInt("auth.key_cache_size")
+		if cacheSize < 0 {
+			return o, fmt.Errorf("invalid auth.key_cache_size %d", cacheSize)
+		}
+		o.Auth = auth.NewStaticWithCache(staticCredentials, cacheSize)
+	}
+	if err = parseOptions(v, l, &o); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+// ReloadOptions returns options that are configured by v on reload,
+// keeping logger, metrics, events, relay port allocator and readers of
+// current.
+// Certificates are loaded again, e.g. to pick up ones that are added to
+// server.tls.sni_dir.
+func ReloadOptions(v *viper.Viper, l *zap.Logger, current server.Options) (server.Options, error) {
+	o := server.Options{
+		Log:      l,
+		Registry: current.Registry,
+		Events:   current.Events,
+		// Pool is bound once on start, not reloadable.
+		PortAllocator: current.PortAllocator,
+		RelayReaders:  current.RelayReaders,
+	}
+	var err error
+	if o.TLS, err = getTLSConfig(v, l); err != nil {
+		return o, fmt.Errorf("failed to load certificate: %v", err)
+	}
+	if err = parseOptions(v, l, &o); err != nil {
+		return o, err
+	}
+	return o, nil
+}
@@ -0,0 +1,72 @@
+//go:build quic
+// +build quic
+
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+
+	"gortc.io/gortcd/internal/dgram"
+)
+
+// quicIdleTimeout is maximum duration without packets after which QUIC
+// connection is closed, same as for stream connections.
+const quicIdleTimeout = time.Minute * 5
+
+// quicProtocols are ALPN identifiers of STUN usages, RFC 7443.
+var quicProtocols = []string{"stun.turn", "stun.nat-discovery"}
+
+// quicSession is dgram.Session over datagrams of QUIC connection.
+type quicSession struct {
+	conn quic.Connection
+}
+
+func (s *quicSession) ReadMessage() ([]byte, error) {
+	return s.conn.ReceiveDatagram(context.Background())
+}
+
+func (s *quicSession) WriteMessage(b []byte) error { return s.conn.SendDatagram(b) }
+
+func (s *quicSession) Close() error { return s.conn.CloseWithError(0, "") }
+
+// listenQUIC listens on laddr for QUIC connections with datagrams and
+// returns connection that reads and writes datagrams of all of them.
+func listenQUIC(log *zap.Logger, laddr string, tlsConfig *tls.Config) (net.PacketConn, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = quicProtocols
+	ln, err := quic.ListenAddr(laddr, tlsConfig, &quic.Config{
+		EnableDatagrams: true,
+		MaxIdleTimeout:  quicIdleTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	a := ln.Addr().(*net.UDPAddr)
+	c := dgram.New(&dgram.Addr{Net: "quic", IP: a.IP, Port: a.Port}, ln)
+	go func() {
+		for {
+			conn, acceptErr := ln.Accept(context.Background())
+			if acceptErr != nil {
+				if !errors.Is(acceptErr, quic.ErrServerClosed) {
+					log.Error("failed to accept", zap.Error(acceptErr))
+				}
+				return
+			}
+			remote, ok := conn.RemoteAddr().(*net.UDPAddr)
+			if !ok || !conn.ConnectionState().SupportsDatagrams {
+				log.Debug("rejecting connection without datagrams", zap.Stringer("addr", conn.RemoteAddr()))
+				_ = conn.CloseWithError(0, "datagrams are required")
+				continue
+			}
+			c.Add(remote, &quicSession{conn: conn})
+		}
+	}()
+	return c, nil
+}
@@ -0,0 +1,18 @@
+//go:build !quic
+// +build !quic
+
+package cli
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"go.uber.org/zap"
+)
+
+var errQUICDisabled = errors.New("quic is not supported by this build, use -tags quic")
+
+func listenQUIC(log *zap.Logger, laddr string, tlsConfig *tls.Config) (net.PacketConn, error) {
+	return nil, errQUICDisabled
+}
@@ -0,0 +1,82 @@
+//go:build quic
+// +build quic
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+)
+
+func TestListenQUIC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gortcd_quic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	certFile, keyFile := writeCertificate(t, dir, "gortcd", "localhost")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := listenQUIC(zap.NewNop(), "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if closeErr := c.Close(); closeErr != nil {
+			t.Error(closeErr)
+		}
+	}()
+	if c.LocalAddr().Network() != "quic" {
+		t.Errorf("unexpected network %q", c.LocalAddr().Network())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	client, err := quic.DialAddr(ctx, c.LocalAddr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"stun.turn"},
+	}, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = client.CloseWithError(0, "")
+	}()
+	if err = client.SendDatagram([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	n, addr, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], []byte("request")) {
+		t.Errorf("unexpected request %q", buf[:n])
+	}
+	// Client is bound to wildcard address, so comparing only ports.
+	if addr.(*net.UDPAddr).Port != client.LocalAddr().(*net.UDPAddr).Port {
+		t.Errorf("unexpected addr %s, expected %s", addr, client.LocalAddr())
+	}
+	if _, err = c.WriteTo([]byte("response"), addr); err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.ReceiveDatagram(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, []byte("response")) {
+		t.Errorf("unexpected response %q", response)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"reflect"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -12,8 +13,62 @@ import (
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+
+	"gortc.io/gortcd/internal/server"
 )
 
+// reloadableOptions maps config keys to reloadable server options,
+// see server.Updater.
+var reloadableOptions = []struct {
+	key string
+	get func(o server.Options) interface{}
+}{
+	{"server.realm", func(o server.Options) interface{} { return o.Realm }},
+	{"server.software", func(o server.Options) interface{} { return o.Software }},
+	{"server.realms", func(o server.Options) interface{} { return o.ListenerRealms }},
+	{"server.listen.software", func(o server.Options) interface{} { return o.ListenerSoftware }},
+	{"auth.stun", func(o server.Options) interface{} { return o.AuthForSTUN }},
+	{"server.ratelimit.binding_pps", func(o server.Options) interface{} { return o.BindingRateLimit }},
+	{"server.ratelimit.prefix_len", func(o server.Options) interface{} { return o.RateLimitPrefix }},
+	{"server.ratelimit.prefix_len6", func(o server.Options) interface{} { return o.RateLimitPrefix6 }},
+	{"server.allocate_mapped", func(o server.Options) interface{} { return o.AllocateMapped }},
+	{"server.fingerprint", func(o server.Options) interface{} { return o.DisableFingerprint }},
+	{"server.prefer_channeldata", func(o server.Options) interface{} { return o.DataIndications }},
+	{"server.reject_even_port", func(o server.Options) interface{} { return o.RejectEvenPort }},
+	{"server.relay.allowed_transports", func(o server.Options) interface{} { return o.AllowedTransports }},
+	{"server.log.dump", func(o server.Options) interface{} { return o.DumpPackets }},
+	{"server.worker_attempts", func(o server.Options) interface{} { return o.WorkerAttempts }},
+	{"server.worker_backoff", func(o server.Options) interface{} { return o.WorkerBackoff }},
+	{"filter.peer", func(o server.Options) interface{} { return o.PeerRule }},
+	{"filter.client", func(o server.Options) interface{} { return o.ClientRule }},
+	{"filter.users", func(o server.Options) interface{} { return o.UserRule }},
+	{"server.debug.collect", func(o server.Options) interface{} { return o.DebugCollect }},
+	{keyPrometheusActive, func(o server.Options) interface{} { return o.MetricsEnabled }},
+	{"server.lifetime.default", func(o server.Options) interface{} { return o.DefaultLifetime }},
+	{"server.lifetime.max", func(o server.Options) interface{} { return o.MaxLifetime }},
+	{"server.alternate", func(o server.Options) interface{} { return o.AlternateServers }},
+	{"auth.realms", func(o server.Options) interface{} { return o.RealmQuotas }},
+	{"auth.realms.software", func(o server.Options) interface{} { return o.RealmSoftware }},
+	{"server.max_indication_size", func(o server.Options) interface{} { return o.MaxIndicationSize }},
+	{"server.max_request_size", func(o server.Options) interface{} { return o.MaxRequestSize }},
+	{"server.rfc5780.secondary", func(o server.Options) interface{} { return o.SecondaryAddr }},
+	{"server.relay.external_ip", func(o server.Options) interface{} { return o.RelayExternalIP }},
+	{"server.nat.map", func(o server.Options) interface{} { return o.NATMap }},
+	{"server.quirks", func(o server.Options) interface{} { return o.Quirks }},
+}
+
+// diffOptions returns config keys of reloadable options that differ
+// between old and new.
+func diffOptions(old, new server.Options) []string {
+	changed := make([]string, 0)
+	for _, r := range reloadableOptions {
+		if !reflect.DeepEqual(r.get(old), r.get(new)) {
+			changed = append(changed, r.key)
+		}
+	}
+	return changed
+}
+
 func execReload(v *viper.Viper, f *pflag.FlagSet, stdout io.Writer) {
 	logCfg, logErr := getZapConfig(v)
 	if logErr != nil {
@@ -45,11 +100,18 @@ func execReload(v *viper.Viper, f *pflag.FlagSet, stdout io.Writer) {
 		l.Fatal("no api.addr config set")
 	}
 	u := "http://" + apiAddr + "/reload"
-	res, httpErr := http.Get(u) // #nosec
+	req, reqErr := http.NewRequest(http.MethodGet, u, nil)
+	if reqErr != nil {
+		l.Fatalw("failed to create http request", "err", reqErr)
+	}
+	if token := v.GetString("api.token"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, httpErr := http.DefaultClient.Do(req) // #nosec
 	if httpErr != nil {
 		l.Fatalw("failed to perform http request", "err", httpErr)
 	}
-	if res.StatusCode != http.StatusOK {
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusAccepted {
 		l.Fatalw("unexpected status code", "code", res.StatusCode, "status", res.Status)
 	}
 	body := new(bytes.Buffer)
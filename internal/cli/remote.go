@@ -0,0 +1,170 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	_ "github.com/spf13/viper/remote" // consul and etcd providers
+	"go.uber.org/zap"
+)
+
+// maxRemoteConfigSize limits size of config that is fetched by url.
+const maxRemoteConfigSize = 1 << 20
+
+var remoteConfigClient = &http.Client{Timeout: time.Second * 10}
+
+// remoteProviders are schemes of config urls that are read from key of
+// key-value store via viper remote providers.
+var remoteProviders = map[string]bool{
+	"consul": true,
+	"etcd":   true,
+}
+
+// isHTTPURL reports whether config path is http(s) url.
+func isHTTPURL(p string) bool {
+	return strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://")
+}
+
+// isConfigURL reports whether config path is url of remote config, i.e.
+// http(s) url or consul:// or etcd:// key.
+func isConfigURL(p string) bool {
+	if isHTTPURL(p) {
+		return true
+	}
+	i := strings.Index(p, "://")
+	return i > 0 && remoteProviders[p[:i]]
+}
+
+// remoteProvider implements viper.RemoteProvider for key of consul or
+// etcd (v2 keys API) that is set by scheme://host:port/key url.
+type remoteProvider struct {
+	provider string
+	endpoint string
+	path     string
+}
+
+func (p remoteProvider) Provider() string      { return p.provider }
+func (p remoteProvider) Endpoint() string      { return p.endpoint }
+func (p remoteProvider) Path() string          { return p.path }
+func (p remoteProvider) SecretKeyring() string { return "" }
+
+// parseRemoteProvider returns remote provider of consul:// or etcd://
+// config url.
+func parseRemoteProvider(rawURL string) (remoteProvider, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return remoteProvider{}, err
+	}
+	if !remoteProviders[u.Scheme] {
+		return remoteProvider{}, fmt.Errorf("unsupported config url scheme %q", u.Scheme)
+	}
+	if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return remoteProvider{}, fmt.Errorf("config url %q should be %s://host:port/key", rawURL, u.Scheme)
+	}
+	p := remoteProvider{
+		provider: u.Scheme,
+		endpoint: u.Host,
+		path:     u.Path,
+	}
+	switch u.Scheme {
+	case "consul":
+		// Consul keys are relative.
+		p.path = strings.TrimPrefix(u.Path, "/")
+	case "etcd":
+		// Endpoints of etcd client are urls.
+		p.endpoint = "http://" + u.Host
+	}
+	return p, nil
+}
+
+// configURLType returns config type of remote config by url path
+// extension, defaulting to yaml.
+func configURLType(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "yaml"
+	}
+	switch ext := strings.TrimPrefix(path.Ext(u.Path), "."); ext {
+	case "json", "toml", "yaml", "yml":
+		return ext
+	default:
+		return "yaml"
+	}
+}
+
+// fetchConfig returns content of remote config, that is fetched via
+// http(s) or read from consul or etcd key.
+func fetchConfig(rawURL string) ([]byte, error) {
+	if !isHTTPURL(rawURL) {
+		p, err := parseRemoteProvider(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		r, err := viper.RemoteConfig.Get(p)
+		if err != nil {
+			return nil, err
+		}
+		return readConfigBody(r)
+	}
+	res, err := remoteConfigClient.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q", res.Status)
+	}
+	return readConfigBody(res.Body)
+}
+
+// readConfigBody reads remote config from r, limiting its size.
+func readConfigBody(r io.Reader) ([]byte, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, maxRemoteConfigSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > maxRemoteConfigSize {
+		return nil, fmt.Errorf("config is larger than %d bytes", maxRemoteConfigSize)
+	}
+	return buf, nil
+}
+
+// watchConfigURL polls remote config every interval, calling notify
+// when its content is changed, until done is closed.
+func watchConfigURL(l *zap.Logger, rawURL string, interval time.Duration, notify func(), done <-chan struct{}) {
+	var last []byte
+	if buf, err := fetchConfig(rawURL); err == nil {
+		h := sha256.Sum256(buf)
+		last = h[:]
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		buf, err := fetchConfig(rawURL)
+		if err != nil {
+			l.Warn("failed to fetch config", zap.String("url", rawURL), zap.Error(err))
+			continue
+		}
+		h := sha256.Sum256(buf)
+		if bytes.Equal(h[:], last) {
+			continue
+		}
+		last = h[:]
+		l.Info("config changed", zap.String("url", rawURL))
+		notify()
+	}
+}
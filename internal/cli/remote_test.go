@@ -0,0 +1,175 @@
+package cli
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestConfigURL(t *testing.T) {
+	for _, tc := range []struct {
+		url   string
+		isURL bool
+		typ   string
+	}{
+		{url: "https://example.com/gortcd.yml", isURL: true, typ: "yml"},
+		{url: "http://example.com/gortcd.json?v=1", isURL: true, typ: "json"},
+		{url: "https://example.com/config", isURL: true, typ: "yaml"},
+		{url: "/etc/gortcd/gortcd.yml", isURL: false, typ: "yml"},
+		{url: "consul://localhost:8500/gortcd", isURL: true, typ: "yaml"},
+		{url: "etcd://localhost:2379/config/gortcd.json", isURL: true, typ: "json"},
+		{url: "ftp://example.com/gortcd.yml", isURL: false, typ: "yml"},
+	} {
+		if got := isConfigURL(tc.url); got != tc.isURL {
+			t.Errorf("isConfigURL(%q) = %v", tc.url, got)
+		}
+		if got := configURLType(tc.url); got != tc.typ {
+			t.Errorf("configURLType(%q) = %q", tc.url, got)
+		}
+	}
+}
+
+func TestFetchConfig(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gortcd.yml":
+			w.Write([]byte("server:\n  realm: example.org\n"))
+		case "/large.yml":
+			w.Write([]byte(strings.Repeat("#", maxRemoteConfigSize+1)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+	buf, err := fetchConfig(s.URL + "/gortcd.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "server:\n  realm: example.org\n" {
+		t.Errorf("unexpected config %q", buf)
+	}
+	if _, err = fetchConfig(s.URL + "/missing.yml"); err == nil {
+		t.Error("should fail on 404")
+	}
+	if _, err = fetchConfig(s.URL + "/large.yml"); err == nil {
+		t.Error("should fail on large config")
+	}
+}
+
+func TestParseRemoteProvider(t *testing.T) {
+	for _, tc := range []struct {
+		url string
+		p   remoteProvider
+	}{
+		{url: "consul://localhost:8500/gortcd", p: remoteProvider{
+			provider: "consul", endpoint: "localhost:8500", path: "gortcd",
+		}},
+		{url: "etcd://10.0.0.1:2379/config/gortcd.yml", p: remoteProvider{
+			provider: "etcd", endpoint: "http://10.0.0.1:2379", path: "/config/gortcd.yml",
+		}},
+	} {
+		p, err := parseRemoteProvider(tc.url)
+		if err != nil {
+			t.Errorf("parseRemoteProvider(%q): %v", tc.url, err)
+			continue
+		}
+		if p != tc.p {
+			t.Errorf("parseRemoteProvider(%q) = %+v", tc.url, p)
+		}
+	}
+	for _, bad := range []string{
+		"consul://localhost:8500",
+		"consul:///gortcd",
+		"ftp://example.com/gortcd.yml",
+	} {
+		if _, err := parseRemoteProvider(bad); err == nil {
+			t.Errorf("parseRemoteProvider(%q) should fail", bad)
+		}
+	}
+}
+
+func TestFetchConfig_KV(t *testing.T) {
+	const config = "server:\n  realm: example.org\n"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/kv/gortcd":
+			// Consul KV API.
+			w.Header().Set("X-Consul-Index", "1")
+			json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"Key": "gortcd", "Value": []byte(config)},
+			})
+		case "/v2/keys/config/gortcd.yml":
+			// etcd v2 keys API.
+			w.Header().Set("X-Etcd-Index", "1")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"action": "get",
+				"node": map[string]interface{}{
+					"key": "/config/gortcd.yml", "value": config,
+				},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "http://")
+	for _, u := range []string{
+		"consul://" + host + "/gortcd",
+		"etcd://" + host + "/config/gortcd.yml",
+	} {
+		buf, err := fetchConfig(u)
+		if err != nil {
+			t.Errorf("fetchConfig(%q): %v", u, err)
+			continue
+		}
+		if string(buf) != config {
+			t.Errorf("unexpected config %q", buf)
+		}
+	}
+	if _, err := fetchConfig("consul://" + host + "/missing"); err == nil {
+		t.Error("should fail on missing key")
+	}
+}
+
+func TestWatchConfigURL(t *testing.T) {
+	var version int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&version) == 0 {
+			w.Write([]byte("server:\n  realm: a.org\n"))
+			return
+		}
+		w.Write([]byte("server:\n  realm: b.org\n"))
+	}))
+	defer s.Close()
+	var (
+		done     = make(chan struct{})
+		stopped  = make(chan struct{})
+		notified = make(chan struct{}, 10)
+	)
+	go func() {
+		watchConfigURL(zap.NewNop(), s.URL, time.Millisecond*5, func() { notified <- struct{}{} }, done)
+		close(stopped)
+	}()
+	select {
+	case <-notified:
+		t.Fatal("should not notify if config is not changed")
+	case <-time.After(time.Millisecond * 50):
+	}
+	atomic.StoreInt32(&version, 1)
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("should notify on change")
+	}
+	close(done)
+	<-stopped
+	if len(notified) != 0 {
+		t.Error("should notify only once per change")
+	}
+}
@@ -2,10 +2,10 @@
 package cli
 
 import (
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"net/http/pprof"
@@ -13,6 +13,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/libp2p/go-reuseport"
 	"github.com/prometheus/client_golang/prometheus"
@@ -23,12 +24,15 @@ import (
 
 	"gortc.io/stun"
 
+	"gortc.io/gortcd/internal/allocator"
 	"gortc.io/gortcd/internal/auth"
 	"gortc.io/gortcd/internal/filter"
 	"gortc.io/gortcd/internal/manage"
 	"gortc.io/gortcd/internal/reload"
 	"gortc.io/gortcd/internal/server"
+	"gortc.io/gortcd/internal/webhook"
 	"gortc.io/ice"
+	"gortc.io/turn"
 )
 
 // ListenUDPAndServe listens on laddr and process incoming packets.
@@ -66,6 +70,126 @@ func ListenUDPAndServe(log *zap.Logger, serverNet, laddr string, u *server.Updat
 	return s.Serve()
 }
 
+// ListenTCPAndServe listens on laddr and serves STUN and TCP allocations
+// of TURN over TCP.
+func ListenTCPAndServe(log *zap.Logger, serverNet, laddr string, u *server.Updater) error {
+	l, err := net.Listen(serverNet, laddr)
+	if err != nil {
+		return err
+	}
+	opt := u.Get()
+	opt.Listener = l
+	s, err := server.New(opt)
+	if err != nil {
+		return err
+	}
+	u.Subscribe(s)
+	return s.Serve()
+}
+
+// reloadableTLS returns configuration that selects certificate from
+// current options of u, so reloaded certificates are used for new
+// connections.
+func reloadableTLS(u *server.Updater) *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return u.Get().TLS, nil
+		},
+	}
+}
+
+// ListenTLSAndServe listens on laddr and serves STUN and TCP allocations
+// of TURN over TLS. Certificate is selected by SNI from current options,
+// so reloaded certificates are used for new connections.
+func ListenTLSAndServe(log *zap.Logger, laddr string, u *server.Updater) error {
+	opt := u.Get()
+	if opt.TLS == nil {
+		return errors.New("server.tls is required for tls")
+	}
+	l, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return err
+	}
+	opt.Listener = tls.NewListener(l, reloadableTLS(u))
+	opt.ListenerNetwork = "tls"
+	s, err := server.New(opt)
+	if err != nil {
+		return err
+	}
+	u.Subscribe(s)
+	return s.Serve()
+}
+
+// ListenQUICAndServe listens on laddr and serves STUN and TURN over
+// QUIC datagrams, experimental. Requires certificate and build with
+// "quic" tag.
+func ListenQUICAndServe(log *zap.Logger, laddr string, u *server.Updater) error {
+	opt := u.Get()
+	if opt.TLS == nil {
+		return errors.New("server.tls.cert and server.tls.key are required for quic")
+	}
+	c, err := listenQUIC(log, laddr, opt.TLS)
+	if err != nil {
+		return err
+	}
+	opt.Conn = c
+	// Datagrams of all QUIC connections are read from single socket.
+	opt.ReusePort = false
+	s, err := server.New(opt)
+	if err != nil {
+		return err
+	}
+	u.Subscribe(s)
+	return s.Serve()
+}
+
+// ListenWebSocketAndServe listens on laddr and serves STUN and TURN over
+// WebSocket binary messages, e.g. for browser applications behind HTTP
+// proxies. Secure WebSocket is served if serverNet is "wss", that
+// requires certificate.
+func ListenWebSocketAndServe(log *zap.Logger, serverNet, laddr string, u *server.Updater) error {
+	opt := u.Get()
+	var tlsConfig *tls.Config
+	if serverNet == "wss" {
+		if opt.TLS == nil {
+			return errors.New("server.tls is required for wss")
+		}
+		tlsConfig = reloadableTLS(u)
+	}
+	c, err := listenWebSocket(log, serverNet, laddr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	opt.Conn = c
+	// Messages of all WebSocket connections are read from single listener.
+	opt.ReusePort = false
+	s, err := server.New(opt)
+	if err != nil {
+		return err
+	}
+	u.Subscribe(s)
+	return s.Serve()
+}
+
+// ListenAndServe listens on laddr via serverNet, that is "udp", "tcp",
+// "tls", "quic", "ws" or "wss".
+func ListenAndServe(log *zap.Logger, serverNet, laddr string, u *server.Updater) error {
+	switch serverNet {
+	case "udp":
+		return ListenUDPAndServe(log, serverNet, laddr, u)
+	case "tcp":
+		return ListenTCPAndServe(log, serverNet, laddr, u)
+	case "tls":
+		return ListenTLSAndServe(log, laddr, u)
+	case "quic":
+		return ListenQUICAndServe(log, laddr, u)
+	case "ws", "wss":
+		return ListenWebSocketAndServe(log, serverNet, laddr, u)
+	default:
+		return fmt.Errorf("unsupported network %q", serverNet)
+	}
+}
+
 func normalize(address string) string {
 	if address == "" {
 		address = "0.0.0.0"
@@ -76,6 +200,144 @@ func normalize(address string) string {
 	return address
 }
 
+// listenElem is element of server.listen that is either address string
+// or mapping with address, network and optional overrides.
+type listenElem struct {
+	Addr     string
+	Net      string
+	Software string
+	Name     string         // used in metrics labels instead of address
+	Services server.Service // all if zero
+}
+
+// parseServices parses list of services, e.g. [stun, turn].
+func parseServices(raw interface{}) (server.Service, error) {
+	list, ok := raw.([]interface{})
+	if !ok {
+		return 0, fmt.Errorf("unexpected services value %v", raw)
+	}
+	var services server.Service
+	for _, item := range list {
+		switch name := fmt.Sprint(item); strings.ToLower(name) {
+		case "stun":
+			services |= server.ServiceSTUN
+		case "turn":
+			services |= server.ServiceTURN
+		default:
+			return 0, fmt.Errorf("unknown service %q", name)
+		}
+	}
+	if services == 0 {
+		return 0, errors.New("no services")
+	}
+	return services, nil
+}
+
+func parseListenElem(raw interface{}) (listenElem, error) {
+	var m map[string]interface{}
+	switch raw := raw.(type) {
+	case string:
+		return listenElem{Addr: raw}, nil
+	case map[string]interface{}:
+		m = raw
+	case map[interface{}]interface{}:
+		m = make(map[string]interface{}, len(raw))
+		for k, v := range raw {
+			m[fmt.Sprint(k)] = v
+		}
+	default:
+		return listenElem{}, fmt.Errorf("unexpected listen element %v", raw)
+	}
+	var e listenElem
+	for k, v := range m {
+		if k == "services" {
+			services, err := parseServices(v)
+			if err != nil {
+				return e, err
+			}
+			e.Services = services
+			continue
+		}
+		value, ok := v.(string)
+		if !ok {
+			return e, fmt.Errorf("unexpected value of %q: %v", k, v)
+		}
+		switch k {
+		case "addr":
+			e.Addr = value
+		case "net":
+			e.Net = value
+		case "software":
+			e.Software = value
+		case "name":
+			e.Name = value
+		default:
+			return e, fmt.Errorf("unknown listen key %q", k)
+		}
+	}
+	return e, nil
+}
+
+func parseListen(v *viper.Viper) ([]listenElem, error) {
+	var raw []interface{}
+	switch value := v.Get("server.listen").(type) {
+	case nil:
+		// No listeners.
+	case string:
+		raw = append(raw, value)
+	case []string:
+		for _, addr := range value {
+			raw = append(raw, addr)
+		}
+	case []interface{}:
+		raw = value
+	default:
+		return nil, fmt.Errorf("unexpected server.listen value %v", value)
+	}
+	elems := make([]listenElem, 0, len(raw))
+	for _, r := range raw {
+		e, err := parseListenElem(r)
+		if err != nil {
+			return nil, err
+		}
+		if i := strings.Index(e.Addr, "://"); i >= 0 {
+			// Network as scheme, e.g. quic://0.0.0.0:3478.
+			scheme := e.Addr[:i]
+			if e.Net != "" && e.Net != scheme {
+				return nil, fmt.Errorf("network %q conflicts with %s", e.Net, e.Addr)
+			}
+			e.Net, e.Addr = scheme, e.Addr[i+len("://"):]
+		}
+		switch e.Net {
+		case "":
+			e.Net = "udp"
+		case "udp", "tcp", "tls", "quic", "ws", "wss":
+			// Supported.
+		default:
+			return nil, fmt.Errorf("unsupported network %q for %s", e.Net, e.Addr)
+		}
+		elems = append(elems, e)
+	}
+	return elems, nil
+}
+
+type listenerRealmElem struct {
+	Listen string `mapstructure:"listen"`
+	Realm  string `mapstructure:"realm"`
+}
+
+type authRealmElem struct {
+	Quota    int     `mapstructure:"quota"`    // maximum allocations, no limit if zero
+	Software *string `mapstructure:"software"` // overrides server.software, if set
+}
+
+type quirkElem struct {
+	Software         string `mapstructure:"software"` // prefix of client SOFTWARE
+	NoFingerprint    bool   `mapstructure:"no_fingerprint"`
+	NoResponseOrigin bool   `mapstructure:"no_response_origin"`
+	SoftwareLast     bool   `mapstructure:"software_last"`
+}
+
 type staticCredElem struct {
 	Username string `mapstructure:"username"`
 	Password string `mapstructure:"password"`
@@ -86,8 +348,10 @@ type staticCredElem struct {
 func parseFilteringRules(v *viper.Viper, parentLogger *zap.Logger, key string) (*filter.List, error) {
 	l := parentLogger.Named(key)
 	type rawRuleItem struct {
-		Net    string `mapstructure:"net"`
-		Action string `mapstructure:"action"`
+		Net    string        `mapstructure:"net"`
+		FQDN   string        `mapstructure:"fqdn"`
+		TTL    time.Duration `mapstructure:"ttl"` // re-resolution interval of fqdn
+		Action string        `mapstructure:"action"`
 	}
 	var rawRules []rawRuleItem
 	if keyErr := v.UnmarshalKey("filter."+key+".rules", &rawRules); keyErr != nil {
@@ -96,19 +360,28 @@ func parseFilteringRules(v *viper.Viper, parentLogger *zap.Logger, key string) (
 	}
 	var rules []filter.Rule
 	for _, rawRule := range rawRules {
-		var (
-			action filter.Action
-		)
-		switch strings.ToLower(rawRule.Action) {
-		case "allow":
-			action = filter.Allow
-		case "drop", "forbid", "deny", "block":
-			action = filter.Deny
-		case "pass", "none", "":
-			action = filter.Pass
-		default:
+		action, actionErr := parseRuleAction(rawRule.Action)
+		if actionErr != nil {
 			l.Error("failed to parse action", zap.String("action", rawRule.Action))
-			return nil, fmt.Errorf("unknown action %s", rawRule.Action)
+			return nil, actionErr
+		}
+		if (rawRule.Net == "") == (rawRule.FQDN == "") {
+			return nil, errors.New("rule should have either net or fqdn")
+		}
+		if rawRule.FQDN != "" {
+			rule, ruleErr := filter.FQDNRule(action, rawRule.FQDN, rawRule.TTL, nil)
+			if ruleErr != nil {
+				l.Error("failed to resolve fqdn",
+					zap.Error(ruleErr), zap.String("fqdn", rawRule.FQDN),
+				)
+				return nil, ruleErr
+			}
+			l.Info("added rule",
+				zap.Stringer("action", action),
+				zap.String("fqdn", rawRule.FQDN),
+			)
+			rules = append(rules, rule)
+			continue
 		}
 		rule, ruleErr := filter.StaticNetRule(action, rawRule.Net)
 		if ruleErr != nil {
@@ -123,32 +396,450 @@ func parseFilteringRules(v *viper.Viper, parentLogger *zap.Logger, key string) (
 		)
 		rules = append(rules, rule)
 	}
-	defaultAction := filter.Allow
-	switch strings.ToLower(v.GetString("filter." + key + ".action")) {
+	defaultAction, actionErr := parseDefaultAction(v.GetString("filter." + key + ".action"))
+	if actionErr != nil {
+		return nil, actionErr
+	}
+	l.Info("default action set", zap.Stringer("action", defaultAction))
+	f := filter.NewFilter(defaultAction, rules...)
+	return f, nil
+}
+
+// parseUserFilteringRules parses "filter.users" username allow/deny list.
+func parseUserFilteringRules(v *viper.Viper, parentLogger *zap.Logger) (*filter.UserList, error) {
+	l := parentLogger.Named("users")
+	type rawRuleItem struct {
+		Username string `mapstructure:"username"`
+		Action   string `mapstructure:"action"`
+	}
+	var rawRules []rawRuleItem
+	if keyErr := v.UnmarshalKey("filter.users.rules", &rawRules); keyErr != nil {
+		l.Error("failed to parse rules", zap.Error(keyErr))
+		return nil, keyErr
+	}
+	var rules []filter.UserRule
+	for _, rawRule := range rawRules {
+		action, actionErr := parseRuleAction(rawRule.Action)
+		if actionErr != nil {
+			l.Error("failed to parse action", zap.String("action", rawRule.Action))
+			return nil, actionErr
+		}
+		if rawRule.Username == "" {
+			return nil, errors.New("blank username in rule")
+		}
+		l.Info("added rule",
+			zap.Stringer("action", action),
+			zap.String("username", rawRule.Username),
+		)
+		rules = append(rules, filter.StaticUserRule(action, rawRule.Username))
+	}
+	defaultAction, actionErr := parseDefaultAction(v.GetString("filter.users.action"))
+	if actionErr != nil {
+		return nil, actionErr
+	}
+	l.Info("default action set", zap.Stringer("action", defaultAction))
+	return filter.NewUserFilter(defaultAction, rules...), nil
+}
+
+// parseRuleAction parses filtering rule action.
+//
+// The "drop" word is kept as alias for filter.Deny for compatibility, so
+// explicit silent drop is "ignore".
+func parseRuleAction(s string) (filter.Action, error) {
+	switch strings.ToLower(s) {
+	case "allow":
+		return filter.Allow, nil
+	case "drop", "forbid", "deny", "block":
+		return filter.Deny, nil
+	case "ignore", "silent":
+		return filter.Drop, nil
+	case "reject":
+		return filter.Reject, nil
+	case "pass", "none", "":
+		return filter.Pass, nil
+	default:
+		return filter.Pass, fmt.Errorf("unknown action %s", s)
+	}
+}
+
+func parseDefaultAction(s string) (filter.Action, error) {
+	switch strings.ToLower(s) {
 	case "allow", "":
-		// Same as default.
+		return filter.Allow, nil
 	case "drop", "forbid", "deny", "block":
-		defaultAction = filter.Deny
+		return filter.Deny, nil
+	case "ignore", "silent":
+		return filter.Drop, nil
+	case "reject":
+		return filter.Reject, nil
 	case "pass", "none":
-		return nil, errors.New("default action cannot be pass")
+		return filter.Pass, errors.New("default action cannot be pass")
 	default:
-		return nil, errors.New("unknown default action")
+		return filter.Pass, errors.New("unknown default action")
 	}
-	l.Info("default action set", zap.Stringer("action", defaultAction))
-	f := filter.NewFilter(defaultAction, rules...)
-	return f, nil
+}
+
+// parseNATMapping parses "private->public" IP mapping.
+func parseNATMapping(raw string) (server.NATMapping, error) {
+	parts := strings.Split(raw, "->")
+	if len(parts) != 2 {
+		return server.NATMapping{}, fmt.Errorf("expected private->public, got %q", raw)
+	}
+	m := server.NATMapping{
+		Private: net.ParseIP(strings.TrimSpace(parts[0])),
+		Public:  net.ParseIP(strings.TrimSpace(parts[1])),
+	}
+	if m.Private == nil || m.Public == nil {
+		return m, fmt.Errorf("bad ip in %q", raw)
+	}
+	if (m.Private.To4() == nil) != (m.Public.To4() == nil) {
+		return m, fmt.Errorf("address family mismatch in %q", raw)
+	}
+	return m, nil
 }
 
 const keyPrometheusActive = "server.prometheus.active"
 
+// getPortAllocator returns relay port allocator that is configured by
+// server.relay.allocator, nil means default on-demand allocator.
+func getPortAllocator(v *viper.Viper, l *zap.Logger) (allocator.NetPortAllocator, error) {
+	switch kind := v.GetString("server.relay.allocator"); kind {
+	case "", "system":
+		return nil, nil
+	case "pooled":
+		relay := v.GetString("server.relay.address")
+		if relay == "" {
+			return nil, errors.New("pooled relay allocator requires server.relay.address")
+		}
+		ip := net.ParseIP(relay)
+		if ip == nil {
+			return nil, fmt.Errorf("bad relay address %q", relay)
+		}
+		minPort, maxPort := v.GetInt("server.relay.min_port"), v.GetInt("server.relay.max_port")
+		if minPort <= 0 || maxPort > 65535 || minPort > maxPort {
+			return nil, fmt.Errorf("bad relay port range %d-%d", minPort, maxPort)
+		}
+		l.Info("pre-allocating relay ports",
+			zap.Stringer("ip", ip), zap.Int("min", minPort), zap.Int("max", maxPort),
+		)
+		pool, err := allocator.NewSystemPortPooledAllocator(l.Named("pool"), ip, minPort, maxPort)
+		if err != nil {
+			return nil, err
+		}
+		return pool, nil
+	default:
+		return nil, fmt.Errorf("unknown relay allocator %q", kind)
+	}
+}
+
+// getRelayReaders returns pool of server.relay.readers goroutines that
+// read relay sockets, nil means goroutine per allocation.
+func getRelayReaders(v *viper.Viper, l *zap.Logger) (*allocator.ReaderPool, error) {
+	n := v.GetInt("server.relay.readers")
+	if n < 0 {
+		return nil, errors.New("relay readers cannot be negative")
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	pool, err := allocator.NewReaderPool(l.Named("readers"), n)
+	if err == allocator.ErrReadersNotSupported {
+		l.Warn("relay reader pool is not supported on platform, ignoring server.relay.readers")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.Info("reading relay sockets via pool", zap.Int("readers", n))
+	return pool, nil
+}
+
+// protoTCP is REQUESTED-TRANSPORT protocol number of TCP.
+const protoTCP turn.Protocol = 6
+
 func parseOptions(v *viper.Viper, l *zap.Logger, o *server.Options) error {
 	o.Realm = v.GetString("server.realm")
 	o.Workers = v.GetInt("server.workers")
+	o.WorkerAttempts = v.GetInt("server.worker_attempts")
+	o.WorkerBackoff = v.GetDuration("server.worker_backoff")
 	o.AuthForSTUN = v.GetBool("auth.stun")
 	o.Software = v.GetString("server.software")
 	o.ReusePort = v.GetBool("server.reuseport")
 	o.DebugCollect = v.GetBool("server.debug.collect")
 	o.MetricsEnabled = v.GetBool(keyPrometheusActive)
+	o.DefaultLifetime = v.GetDuration("server.lifetime.default")
+	o.MaxLifetime = v.GetDuration("server.lifetime.max")
+	if o.DefaultLifetime < 0 || o.MaxLifetime < 0 {
+		return errors.New("allocation lifetime cannot be negative")
+	}
+	o.MaxAllocations = v.GetInt("server.max_allocations")
+	o.MaxPermissions = v.GetInt("server.max_permissions_per_allocation")
+	o.MaxChannels = v.GetInt("server.max_channels")
+	o.MaxIndicationSize = v.GetInt("server.max_indication_size")
+	if o.MaxIndicationSize < 0 {
+		return errors.New("maximum indication size cannot be negative")
+	}
+	o.MaxRequestSize = v.GetInt("server.max_request_size")
+	if o.MaxRequestSize < 0 {
+		return errors.New("maximum request size cannot be negative")
+	}
+	o.SocketBuffers.Read = v.GetInt("server.socket.rcvbuf")
+	o.SocketBuffers.Write = v.GetInt("server.socket.sndbuf")
+	if o.SocketBuffers.Read < 0 || o.SocketBuffers.Write < 0 {
+		return errors.New("socket buffer size cannot be negative")
+	}
+	o.IdleTimeout = v.GetDuration("server.idle_timeout")
+	o.CollectRate = v.GetDuration("server.collect_rate")
+	if o.CollectRate < 0 {
+		return errors.New("collect rate cannot be negative")
+	}
+	if relay := v.GetString("server.relay.address"); relay != "" {
+		if o.RelayIP = net.ParseIP(relay); o.RelayIP == nil {
+			l.Error("failed to parse relay address", zap.String("addr", relay))
+			return fmt.Errorf("bad relay address %q", relay)
+		}
+		l.Info("relaying via", zap.Stringer("ip", o.RelayIP))
+	}
+	if relay := v.GetString("server.relay.address6"); relay != "" {
+		if o.RelayIP6 = net.ParseIP(relay); o.RelayIP6 == nil || o.RelayIP6.To4() != nil {
+			l.Error("failed to parse IPv6 relay address", zap.String("addr", relay))
+			return fmt.Errorf("bad IPv6 relay address %q", relay)
+		}
+		if v.GetString("server.relay.allocator") == "pooled" {
+			// Pool is bound to single IPv4 address.
+			return errors.New("pooled relay allocator can't be used with server.relay.address6")
+		}
+		l.Info("relaying IPv6 of dual allocations via", zap.Stringer("ip", o.RelayIP6))
+	}
+	o.RelayDSCP = v.GetInt("server.relay.dscp")
+	if o.RelayDSCP < 0 || o.RelayDSCP > allocator.MaxDSCP {
+		return fmt.Errorf("bad relay dscp %d, should be in [0, %d]", o.RelayDSCP, allocator.MaxDSCP)
+	}
+	if o.RelayDSCP != 0 && !allocator.DSCPSupported {
+		l.Warn("DSCP marking is not supported on platform, ignoring server.relay.dscp")
+	}
+	o.MaxWriteFailures = v.GetInt("server.relay.max_write_failures")
+	if o.MaxWriteFailures < 0 {
+		return errors.New("relay max_write_failures cannot be negative")
+	}
+	if external := v.GetString("server.relay.external_ip"); external != "" {
+		o.RelayExternalIP = net.ParseIP(external)
+		if o.RelayExternalIP == nil || o.RelayExternalIP.IsUnspecified() {
+			l.Error("failed to parse external relay address", zap.String("addr", external))
+			return fmt.Errorf("bad external relay address %q", external)
+		}
+		l.Info("advertising relayed addresses via", zap.Stringer("ip", o.RelayExternalIP))
+	}
+	switch strategy := v.GetString("server.relay.strategy"); strategy {
+	case "", "listener":
+		o.RelayStrategy = allocator.RelayListener
+	case "round_robin":
+		o.RelayStrategy = allocator.RelayRoundRobin
+	case "random":
+		o.RelayStrategy = allocator.RelayRandom
+	default:
+		return fmt.Errorf("unknown relay strategy %q", strategy)
+	}
+	for _, raw := range v.GetStringSlice("server.relay.pool") {
+		ip := net.ParseIP(raw)
+		if ip == nil {
+			l.Error("failed to parse relay pool address", zap.String("addr", raw))
+			return fmt.Errorf("bad relay pool address %q", raw)
+		}
+		o.RelayPool = append(o.RelayPool, ip)
+	}
+	switch {
+	case o.RelayStrategy == allocator.RelayListener:
+		if len(o.RelayPool) > 0 {
+			l.Warn("relay pool is ignored for listener strategy")
+		}
+	case len(o.RelayPool) == 0:
+		return fmt.Errorf("relay strategy %s requires server.relay.pool", o.RelayStrategy)
+	case o.RelayExternalIP != nil:
+		// Single external address can't be advertised for multiple
+		// local ones.
+		return errors.New("server.relay.external_ip can't be used with relay pool")
+	case v.GetString("server.relay.allocator") == "pooled":
+		return errors.New("pooled relay allocator can't be used with relay pool")
+	default:
+		l.Info("relaying via pool",
+			zap.Stringer("strategy", o.RelayStrategy), zap.Int("n", len(o.RelayPool)),
+		)
+	}
+	for _, raw := range v.GetStringSlice("server.nat.map") {
+		m, mapErr := parseNATMapping(raw)
+		if mapErr != nil {
+			l.Error("failed to parse nat mapping", zap.String("mapping", raw), zap.Error(mapErr))
+			return mapErr
+		}
+		o.NATMap = append(o.NATMap, m)
+	}
+	if len(o.NATMap) > 0 {
+		l.Info("nat mappings configured", zap.Int("n", len(o.NATMap)))
+	}
+	if v.IsSet("server.relay.allowed_transports") {
+		o.AllowedTransports = make([]turn.Protocol, 0, 2)
+		for _, name := range v.GetStringSlice("server.relay.allowed_transports") {
+			switch name {
+			case "udp":
+				o.AllowedTransports = append(o.AllowedTransports, turn.ProtoUDP)
+			case "tcp":
+				// Served by stream listeners, see RFC 6062.
+				o.AllowedTransports = append(o.AllowedTransports, protoTCP)
+			default:
+				return fmt.Errorf("unknown relay transport %q", name)
+			}
+		}
+	}
+	if o.DryRun = v.GetBool("server.dry_run"); o.DryRun {
+		l.Warn("dry run, data from clients is logged and not relayed to peers")
+	}
+	o.AllocateMapped = v.GetBool("server.allocate_mapped")
+	o.DataIndications = !v.GetBool("server.prefer_channeldata")
+	o.RejectEvenPort = v.GetBool("server.reject_even_port")
+	o.DisableFingerprint = !v.GetBool("server.fingerprint")
+	if o.DumpPackets = v.GetBool("server.log.dump"); o.DumpPackets {
+		l.Warn("dumping packets, logs can contain credentials")
+	}
+	o.BindingRateLimit = v.GetInt("server.ratelimit.binding_pps")
+	if o.BindingRateLimit < 0 {
+		return errors.New("rate limit cannot be negative")
+	}
+	o.RateLimitPrefix = v.GetInt("server.ratelimit.prefix_len")
+	if o.RateLimitPrefix < 0 || o.RateLimitPrefix > 8*net.IPv4len {
+		return fmt.Errorf("bad rate limit prefix length %d", o.RateLimitPrefix)
+	}
+	o.RateLimitPrefix6 = v.GetInt("server.ratelimit.prefix_len6")
+	if o.RateLimitPrefix6 < 0 || o.RateLimitPrefix6 > 8*net.IPv6len {
+		return fmt.Errorf("bad IPv6 rate limit prefix length %d", o.RateLimitPrefix6)
+	}
+	var authRealms map[string]authRealmElem
+	if keyErr := v.UnmarshalKey("auth.realms", &authRealms); keyErr != nil {
+		l.Error("failed to parse auth.realms", zap.Error(keyErr))
+		return keyErr
+	}
+	for realm, r := range authRealms {
+		if r.Quota < 0 {
+			return fmt.Errorf("quota of realm %q cannot be negative", realm)
+		}
+		if r.Software != nil {
+			if o.RealmSoftware == nil {
+				o.RealmSoftware = make(map[string]string)
+			}
+			o.RealmSoftware[realm] = *r.Software
+		}
+		if r.Quota == 0 {
+			continue
+		}
+		if o.RealmQuotas == nil {
+			o.RealmQuotas = make(map[string]int)
+		}
+		o.RealmQuotas[realm] = r.Quota
+		l.Info("realm quota", zap.String("realm", realm), zap.Int("quota", r.Quota))
+	}
+	var quirks []quirkElem
+	if keyErr := v.UnmarshalKey("server.quirks", &quirks); keyErr != nil {
+		l.Error("failed to parse server.quirks", zap.Error(keyErr))
+		return keyErr
+	}
+	for _, q := range quirks {
+		if q.Software == "" {
+			return errors.New("quirk software cannot be empty")
+		}
+		o.Quirks = append(o.Quirks, server.Quirk{
+			Software:         q.Software,
+			NoFingerprint:    q.NoFingerprint,
+			NoResponseOrigin: q.NoResponseOrigin,
+			SoftwareLast:     q.SoftwareLast,
+		})
+		l.Info("client quirk", zap.String("software", q.Software))
+	}
+	o.NonceDuration = v.GetDuration("auth.nonce.duration")
+	if o.NonceDuration < 0 {
+		return errors.New("nonce duration cannot be negative")
+	}
+	o.NonceGrace = v.GetDuration("auth.nonce.grace")
+	if o.NonceGrace < 0 {
+		return errors.New("nonce grace cannot be negative")
+	}
+	for _, addr := range v.GetStringSlice("server.alternate") {
+		a, resolveErr := net.ResolveUDPAddr("udp", normalize(addr))
+		if resolveErr != nil {
+			l.Error("failed to parse alternate server", zap.String("addr", addr), zap.Error(resolveErr))
+			return resolveErr
+		}
+		o.AlternateServers = append(o.AlternateServers, turn.Addr{IP: a.IP, Port: a.Port})
+	}
+	if len(o.AlternateServers) > 0 {
+		l.Info("alternate servers configured", zap.Int("n", len(o.AlternateServers)))
+	}
+	if secondary := v.GetString("server.rfc5780.secondary"); secondary != "" {
+		a, resolveErr := net.ResolveUDPAddr("udp", normalize(secondary))
+		if resolveErr != nil {
+			l.Error("failed to parse secondary address", zap.String("addr", secondary), zap.Error(resolveErr))
+			return resolveErr
+		}
+		o.SecondaryAddr = turn.Addr{IP: a.IP, Port: a.Port}
+		l.Info("secondary address configured", zap.Stringer("addr", o.SecondaryAddr))
+	}
+	listenElems, listenErr := parseListen(v)
+	if listenErr != nil {
+		l.Error("failed to parse listeners", zap.Error(listenErr))
+		return listenErr
+	}
+	for _, e := range listenElems {
+		if e.Software == "" && e.Services == 0 && e.Name == "" {
+			continue
+		}
+		a, resolveErr := net.ResolveUDPAddr("udp", normalize(e.Addr))
+		if resolveErr != nil {
+			l.Error("failed to parse listener", zap.String("addr", e.Addr), zap.Error(resolveErr))
+			return resolveErr
+		}
+		addr := turn.Addr{IP: a.IP, Port: a.Port}
+		if e.Software != "" {
+			o.ListenerSoftware = append(o.ListenerSoftware, server.ListenerSoftware{
+				Addr:     addr,
+				Software: e.Software,
+			})
+			l.Info("software for listener", zap.String("addr", e.Addr), zap.String("software", e.Software))
+		}
+		if e.Name != "" {
+			o.ListenerNames = append(o.ListenerNames, server.ListenerName{
+				Addr: addr,
+				Name: e.Name,
+			})
+			l.Info("name for listener", zap.String("addr", e.Addr), zap.String("name", e.Name))
+		}
+		if e.Services != 0 {
+			o.ListenerServices = append(o.ListenerServices, server.ListenerServices{
+				Addr:     addr,
+				Services: e.Services,
+			})
+			l.Info("services for listener",
+				zap.String("addr", e.Addr),
+				zap.Bool("stun", e.Services&server.ServiceSTUN != 0),
+				zap.Bool("turn", e.Services&server.ServiceTURN != 0),
+			)
+		}
+	}
+	var rawRealms []listenerRealmElem
+	if keyErr := v.UnmarshalKey("server.realms", &rawRealms); keyErr != nil {
+		l.Error("failed to parse realms", zap.Error(keyErr))
+		return keyErr
+	}
+	for _, r := range rawRealms {
+		a, resolveErr := net.ResolveUDPAddr("udp", normalize(r.Listen))
+		if resolveErr != nil {
+			l.Error("failed to parse realm listener", zap.String("addr", r.Listen), zap.Error(resolveErr))
+			return resolveErr
+		}
+		o.ListenerRealms = append(o.ListenerRealms, server.ListenerRealm{
+			Addr:  turn.Addr{IP: a.IP, Port: a.Port},
+			Realm: r.Realm,
+		})
+		l.Info("realm for listener", zap.String("addr", r.Listen), zap.String("realm", r.Realm))
+	}
 	filterLog := l.Named("filter")
 	var parseErr error
 	if o.PeerRule, parseErr = parseFilteringRules(v, filterLog, "peer"); parseErr != nil {
@@ -159,43 +850,66 @@ func parseOptions(v *viper.Viper, l *zap.Logger, o *server.Options) error {
 		l.Error("failed to parse client rules", zap.Error(parseErr))
 		return parseErr
 	}
+	if o.UserRule, parseErr = parseUserFilteringRules(v, filterLog); parseErr != nil {
+		l.Error("failed to parse user rules", zap.Error(parseErr))
+		return parseErr
+	}
 	if o.Software != "" {
 		l.Info("will be sending SOFTWARE attribute", zap.String("software", o.Software))
 	}
 	return nil
 }
 
-func parseStaticCredentials(v *viper.Viper, l *zap.Logger, realm string) []auth.StaticCredential {
+func parseStaticCredentials(v *viper.Viper, l *zap.Logger, realm string) ([]auth.StaticCredential, error) {
 	// Parsing static credentials.
 	var staticCredentials []auth.StaticCredential
 	var rawCredentials []staticCredElem
 	if keyErr := v.UnmarshalKey("auth.static", &rawCredentials); keyErr != nil {
-		l.Fatal("failed to parse auth.static config", zap.Error(keyErr))
+		return nil, fmt.Errorf("failed to parse auth.static: %v", keyErr)
 	}
 	for _, cred := range rawCredentials {
 		var a auth.StaticCredential
 		if cred.Realm == "" {
 			cred.Realm = realm
 		}
-		if strings.HasPrefix(cred.Key, "0x") {
-			key, decodeErr := hex.DecodeString(cred.Key[2:])
+		if cred.Realm == auth.AnyRealm && cred.Password == "" {
+			// Long-term key is derived from realm, so it can't match any.
+			l.Error("credential with wildcard realm requires password, skipping",
+				zap.String("username", cred.Username),
+			)
+			continue
+		}
+		if cred.Key != "" && cred.Realm != auth.AnyRealm {
+			// Key is authoritative, so skipping credential if it is invalid
+			// instead of falling back to password.
+			key, decodeErr := hex.DecodeString(strings.TrimPrefix(cred.Key, "0x"))
 			if decodeErr != nil {
-				l.Error("failed to parse credential",
-					zap.String("cred", fmt.Sprintf("%+v", cred)),
+				l.Error("failed to parse credential key, skipping",
+					zap.String("username", cred.Username),
+					zap.String("realm", cred.Realm),
 					zap.Error(decodeErr),
 				)
+				continue
 			}
 			a.Key = key
+		} else if cred.Password == "" {
+			l.Warn("no key or password for credential, skipping",
+				zap.String("username", cred.Username),
+				zap.String("realm", cred.Realm),
+			)
+			continue
 		}
 		a.Username = cred.Username
 		a.Password = cred.Password
 		a.Realm = cred.Realm
 		staticCredentials = append(staticCredentials, a)
 	}
-	return staticCredentials
+	return staticCredentials, nil
 }
 
-func getListeners(v *viper.Viper, l *zap.Logger) []listener {
+// getListeners starts services that are shared by listeners and returns
+// listeners to serve; remote config is watched until done is closed.
+func getListeners(v *viper.Viper, l *zap.Logger, done <-chan struct{}) []listener {
 	if cfgPath := v.ConfigFileUsed(); len(cfgPath) > 0 {
 		l.Info("config file used", zap.String("path", v.ConfigFileUsed()))
 	} else {
@@ -205,6 +919,10 @@ func getListeners(v *viper.Viper, l *zap.Logger) []listener {
 		l.Fatal("unsupported config file version", zap.String("v", v.GetString("version")))
 	}
 	reg := prometheus.NewPedanticRegistry()
+	if regErr := reg.Register(newBuildInfo()); regErr != nil {
+		l.Error("failed to register build info", zap.Error(regErr))
+	}
+	l.Info("build", zap.String("version", Version), zap.String("commit", Commit))
 	if prometheusAddr := v.GetString("server.prometheus.addr"); prometheusAddr != "" {
 		l.Warn("running prometheus metrics", zap.String("addr", prometheusAddr))
 		go func() {
@@ -242,46 +960,70 @@ func getListeners(v *viper.Viper, l *zap.Logger) []listener {
 			}
 		}()
 	}
-	realm := v.GetString("server.realm") // default realm
-	staticCredentials := parseStaticCredentials(v, l, realm)
-	l.Info("parsed credentials", zap.Int("n", len(staticCredentials)))
-	l.Info("realm", zap.String("k", realm))
-	o := server.Options{
-		Log:      l,
-		Registry: reg,
+	o, optErr := ServerOptions(v, l)
+	if optErr != nil {
+		l.Fatal("failed to parse", zap.Error(optErr))
 	}
-	if v.GetBool("auth.public") {
-		l.Warn("auth is public")
-	} else {
-		o.Auth = auth.NewStatic(staticCredentials)
-	}
-	if parseErr := parseOptions(v, l, &o); parseErr != nil {
-		l.Fatal("failed to parse", zap.Error(parseErr))
+	o.Registry = reg
+	if hookURL := v.GetString("server.webhook.url"); hookURL != "" {
+		l.Info("posting allocation events", zap.String("url", hookURL))
+		h := webhook.New(webhook.Options{
+			URL: hookURL,
+			Log: l.Named("webhook"),
+		})
+		if regErr := reg.Register(h); regErr != nil {
+			l.Error("failed to register webhook metrics", zap.Error(regErr))
+		}
+		o.Events = h
 	}
 	u := server.NewUpdater(o)
 	n := reload.NewNotifier(l.Named("reload"))
+	reloads := new(manage.ReloadLog)
+	if isConfigURL(cfgFile) && cfgPoll > 0 {
+		l.Info("watching remote config", zap.String("url", cfgFile), zap.Duration("interval", cfgPoll))
+		go watchConfigURL(l.Named("config"), cfgFile, cfgPoll, n.Notify, done)
+	}
 	go func() {
 		for range n.C {
 			l.Info("trying to update config")
-			if readErr := v.ReadInConfig(); readErr != nil {
+			if readErr := readInConfig(v); readErr != nil {
 				l.Error("failed to read config", zap.Error(readErr))
+				reloads.Publish(manage.ReloadResult{Time: time.Now(), Error: readErr.Error()})
 				continue
 			}
 			l.Info("config read", zap.String("path", v.ConfigFileUsed()))
-			newOptions := server.Options{
-				Log:      l,
-				Registry: reg,
-			}
-			if parseErr := parseOptions(v, l, &newOptions); parseErr != nil {
+			newOptions, parseErr := ReloadOptions(v, l, o)
+			if parseErr != nil {
 				l.Error("failed to parse config", zap.Error(parseErr))
+				reloads.Publish(manage.ReloadResult{Time: time.Now(), Error: parseErr.Error()})
 				continue
 			}
+			changed := diffOptions(u.Get(), newOptions)
 			u.Set(newOptions)
-			l.Info("config updated")
+			l.Info("config updated", zap.Strings("changed", changed))
+			reloads.Publish(manage.ReloadResult{Time: time.Now(), Changed: changed})
 		}
 	}()
 	if apiAddr := v.GetString("api.addr"); apiAddr != "" {
-		m := manage.NewManager(l.Named("api"), n)
+		if strings.HasPrefix(apiAddr, ":") {
+			// Binding to localhost only if host is not set explicitly.
+			apiAddr = "localhost" + apiAddr
+		}
+		apiToken := v.GetString("api.token")
+		if apiToken == "" && !isLoopback(apiAddr) {
+			l.Warn("api is listening on non-loopback address without token", zap.String("addr", apiAddr))
+		}
+		m := manage.NewManager(manage.Options{
+			Log:         l.Named("api"),
+			Notifier:    n,
+			Health:      u,
+			Drainer:     u,
+			Reloads:     reloads,
+			Token:       apiToken,
+			Version:     Version,
+			Commit:      Commit,
+			CORSOrigins: v.GetStringSlice("api.cors.origins"),
+		})
 		l.Info("api listening", zap.String("addr", apiAddr))
 		go func() {
 			if listenErr := http.ListenAndServe(apiAddr, m); listenErr != nil {
@@ -292,17 +1034,29 @@ func getListeners(v *viper.Viper, l *zap.Logger) []listener {
 			}
 		}()
 	}
+	toListen, listenErr := getListenAddrs(v, l, u)
+	if listenErr != nil {
+		l.Fatal("failed to parse listeners", zap.Error(listenErr))
+	}
+	return toListen
+}
 
+// getListenAddrs resolves listeners from server.listen config key.
+func getListenAddrs(v *viper.Viper, l *zap.Logger, u *server.Updater) ([]listener, error) {
+	elems, parseErr := parseListen(v)
+	if parseErr != nil {
+		return nil, parseErr
+	}
 	var toListen []listener
-	for _, addr := range v.GetStringSlice("server.listen") {
-		l.Info("got addr", zap.String("addr", addr))
-		normalized := normalize(addr)
+	for _, e := range elems {
+		l.Info("got addr", zap.String("addr", e.Addr), zap.String("net", e.Net))
+		normalized := normalize(e.Addr)
 		if strings.HasPrefix(normalized, "0.0.0.0") {
 			l.Warn("running on all interfaces")
 			l.Warn("picking addr from ICE")
 			addrs, iceErr := ice.Gather()
 			if iceErr != nil {
-				log.Fatal(iceErr)
+				return nil, iceErr
 			}
 			for _, a := range addrs {
 				l.Warn("got", zap.Stringer("a", a))
@@ -319,20 +1073,53 @@ func getListeners(v *viper.Viper, l *zap.Logger) []listener {
 				toListen = append(toListen, listener{
 					fromAny: true,
 					adrr:    strings.Replace(normalized, "0.0.0.0", a.IP.String(), -1),
-					net:     "udp",
+					net:     e.Net,
 					u:       u,
 				})
 			}
 		} else {
 			toListen = append(toListen, listener{
-				net:  "udp",
+				net:  e.Net,
 				adrr: normalized,
 				u:    u,
 			})
 		}
 	}
+	return dedupListeners(l, toListen), nil
+}
 
-	return toListen
+// dedupListeners removes listeners with same network and address, e.g.
+// gathered from 0.0.0.0 and also listed explicitly, keeping order.
+func dedupListeners(l *zap.Logger, listeners []listener) []listener {
+	seen := make(map[string]int, len(listeners))
+	result := listeners[:0]
+	for _, ln := range listeners {
+		i, dup := seen[ln.key()]
+		if !dup {
+			seen[ln.key()] = len(result)
+			result = append(result, ln)
+			continue
+		}
+		l.Warn("dropping duplicate listener", zap.String("addr", ln.key()))
+		if !ln.fromAny {
+			// Explicit listener should not tolerate listen errors.
+			result[i].fromAny = false
+		}
+	}
+	return result
+}
+
+// isLoopback reports whether addr host is localhost or loopback ip.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 func protocolNotSupported(err error) bool {
@@ -350,26 +1137,98 @@ func protocolNotSupported(err error) bool {
 	return false
 }
 
+// diffListeners returns listeners from next that are not running
+// and running listeners that are missing in next.
+func diffListeners(running map[string]listener, next []listener) (start, stop []listener) {
+	nextKeys := make(map[string]bool, len(next))
+	for _, ln := range next {
+		nextKeys[ln.key()] = true
+		if _, ok := running[ln.key()]; !ok {
+			start = append(start, ln)
+		}
+	}
+	for k, ln := range running {
+		if !nextKeys[k] {
+			stop = append(stop, ln)
+		}
+	}
+	return start, stop
+}
+
 func runRoot(v *viper.Viper, listenFunc func(log *zap.Logger, serverNet, laddr string, u *server.Updater) error) {
 	l := getLogger(v)
 	wg := new(sync.WaitGroup)
-	listeners := getListeners(v, l)
+	done := make(chan struct{})
+	defer close(done)
+	listeners := getListeners(v, l, done)
+	serve := func(ln listener) {
+		defer wg.Done()
+		lg := l.With(zap.String("addr", ln.adrr), zap.String("network", ln.net))
+		lg.Info("gortc/gortcd listening")
+		if err := listenFunc(lg, ln.net, ln.adrr, ln.u); err != nil {
+			if ln.fromAny && protocolNotSupported(err) {
+				// See https://gortc.io/gortcd/issues/32
+				// Should be ok to make it non configurable.
+				lg.Warn("failed to listen", zap.Error(err))
+			} else {
+				lg.Fatal("failed to listen", zap.Error(err))
+			}
+		}
+	}
+	running := make(map[string]listener, len(listeners))
 	wg.Add(len(listeners))
 	for _, lr := range listeners {
-		go func(ln listener) {
-			defer wg.Done()
-			lg := l.With(zap.String("addr", ln.adrr), zap.String("network", "udp"))
-			lg.Info("gortc/gortcd listening")
-			if err := listenFunc(lg, ln.net, ln.adrr, ln.u); err != nil {
-				if ln.fromAny && protocolNotSupported(err) {
-					// See https://gortc.io/gortcd/issues/32
-					// Should be ok to make it non configurable.
-					lg.Warn("failed to listen", zap.Error(err))
-				} else {
-					lg.Fatal("failed to listen", zap.Error(err))
+		running[lr.key()] = lr
+		go serve(lr)
+	}
+	if len(listeners) > 0 {
+		// Listeners share single updater, so allocations and options of
+		// listeners that are left intact are preserved on rebind.
+		u := listeners[0].u
+		n := reload.NewRebindNotifier(l.Named("rebind"))
+		go func() {
+			for range n.C {
+				l.Info("trying to rebind listeners")
+				if readErr := readInConfig(v); readErr != nil {
+					l.Error("failed to read config", zap.Error(readErr))
+					continue
 				}
+				next, listenErr := getListenAddrs(v, l, u)
+				if listenErr != nil {
+					l.Error("failed to parse listeners", zap.Error(listenErr))
+					continue
+				}
+				if len(next) == 0 {
+					l.Error("no listeners in config, ignoring rebind")
+					continue
+				}
+				start, stop := diffListeners(running, next)
+				// Starting new listeners before stopping old ones, so wait
+				// group counter never drops to zero during rebind.
+				wg.Add(len(start))
+				for _, ln := range start {
+					running[ln.key()] = ln
+					go serve(ln)
+				}
+				for _, ln := range stop {
+					// Resolving as UDP just to get ip and port.
+					a, resolveErr := net.ResolveUDPAddr("udp", ln.adrr)
+					if resolveErr != nil {
+						l.Error("failed to resolve listener", zap.String("addr", ln.adrr), zap.Error(resolveErr))
+						continue
+					}
+					if _, stopErr := u.Stop(ln.net, turn.Addr{IP: a.IP, Port: a.Port}); stopErr != nil {
+						l.Error("failed to stop listener", zap.String("addr", ln.adrr), zap.Error(stopErr))
+					} else {
+						l.Info("stopped listening", zap.String("addr", ln.adrr))
+					}
+					delete(running, ln.key())
+				}
+				l.Info("listeners rebound",
+					zap.Int("started", len(start)), zap.Int("stopped", len(stop)),
+				)
 			}
-		}(lr)
+		}()
 	}
 	wg.Wait()
 }
@@ -382,7 +1241,9 @@ func getRoot(v *viper.Viper, listenFunc func(log *zap.Logger, serverNet, laddr s
 		Run:              func(cmd *cobra.Command, args []string) { runRoot(v, listenFunc) },
 	}
 
-	cmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/gortcd.yml)")
+	cmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file, http(s) url or consul:// or etcd:// key url (default is $HOME/gortcd.yml)")
+	cmd.PersistentFlags().DurationVar(&cfgPoll, "config-poll", time.Minute,
+		"poll interval of config url, config is reloaded on change; zero disables polling")
 	cmd.Flags().StringSliceP("listen", "l", []string{"0.0.0.0:3478"}, "listen address")
 	cmd.Flags().String("pprof", "", "pprof address if specified")
 	cmd.Flags().String("cpuprofile", "", "write cpu profile")
@@ -403,3 +1264,6 @@ type listener struct {
 	u       *server.Updater
 	fromAny bool // as part of 0.0.0.0
 }
+
+// key uniquely identifies listener.
+func (ln listener) key() string { return ln.net + "://" + ln.adrr }
@@ -6,16 +6,20 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"reflect"
 	"sync"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest/observer"
 
+	"gortc.io/gortcd/internal/filter"
 	"gortc.io/gortcd/internal/server"
+	"gortc.io/turn"
 )
 
 func getViper() *viper.Viper {
@@ -39,6 +43,29 @@ func TestParseFiltering(t *testing.T) {
 	if rules == nil {
 		t.Error(err)
 	}
+	t.Run("FQDN", func(t *testing.T) {
+		v := getViper()
+		v.Set("filter.key.rules", []map[string]string{
+			{"fqdn": "localhost", "ttl": "30s", "action": "allow"},
+		})
+		v.Set("filter.key.action", "deny")
+		rules, err := parseFilteringRules(v, zap.NewNop(), "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a := rules.Action(turn.Addr{IP: net.IPv4(127, 0, 0, 1)}); a != filter.Allow {
+			t.Errorf("unexpected action %s", a)
+		}
+	})
+	t.Run("NetAndFQDN", func(t *testing.T) {
+		v := getViper()
+		v.Set("filter.key.rules", []map[string]string{
+			{"net": "10.0.0.0/24", "fqdn": "localhost", "action": "allow"},
+		})
+		if _, err := parseFilteringRules(v, zap.NewNop(), "key"); err == nil {
+			t.Error("should error")
+		}
+	})
 }
 
 func TestConfig(t *testing.T) {
@@ -66,7 +93,10 @@ func TestParseStaticCredentials(t *testing.T) {
 		{"username": "user", "password": "secret"},
 		{"username": "foo", "key": "0x0F"},
 	})
-	creds := parseStaticCredentials(v, zap.NewNop(), "realm")
+	creds, err := parseStaticCredentials(v, zap.NewNop(), "realm")
+	if err != nil {
+		t.Fatal(err)
+	}
 	if len(creds) == 0 {
 		t.Fatal("failed to parse")
 	}
@@ -84,6 +114,25 @@ func TestParseStaticCredentials(t *testing.T) {
 	}
 }
 
+func TestParseStaticCredentialsInvalid(t *testing.T) {
+	v := getViper()
+	v.Set("auth.static", []map[string]string{
+		{"username": "bad", "key": "0xZZ", "password": ""},
+		{"username": "empty"},
+		{"username": "noprefix", "key": "0F"},
+	})
+	creds, err := parseStaticCredentials(v, zap.NewNop(), "realm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 1 {
+		t.Fatalf("unexpected count %d", len(creds))
+	}
+	if creds[0].Username != "noprefix" || creds[0].Key[0] != 0x0F {
+		t.Errorf("bad credential %+v", creds[0])
+	}
+}
+
 func TestSnap(t *testing.T) {
 	v := getViper()
 	name, err := ioutil.TempDir("", "gortcd_snap")
@@ -132,7 +181,9 @@ func TestGetListeners(t *testing.T) {
 
 	core, logs := observer.New(zap.DebugLevel)
 	l := zap.New(core)
-	listeners := getListeners(v, l)
+	done := make(chan struct{})
+	defer close(done)
+	listeners := getListeners(v, l, done)
 	if len(listeners) == 0 {
 		t.Error("no listeners")
 	}
@@ -251,3 +302,231 @@ func TestProtocolNotSupported(t *testing.T) {
 		t.Errorf("result for %v should be true", err)
 	}
 }
+
+func TestBuildInfo(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(newBuildInfo()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.Gather(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDiffListeners(t *testing.T) {
+	running := make(map[string]listener)
+	for _, ln := range []listener{
+		{net: "udp", adrr: "127.0.0.1:3478"},
+		{net: "udp", adrr: "127.0.0.1:3479"},
+	} {
+		running[ln.key()] = ln
+	}
+	start, stop := diffListeners(running, []listener{
+		{net: "udp", adrr: "127.0.0.1:3478"},
+		{net: "udp", adrr: "127.0.0.1:3480"},
+		{net: "tcp", adrr: "127.0.0.1:3478"},
+	})
+	if len(start) != 2 || start[0].adrr != "127.0.0.1:3480" || start[1].net != "tcp" {
+		t.Errorf("unexpected start %+v", start)
+	}
+	if len(stop) != 1 || stop[0].adrr != "127.0.0.1:3479" {
+		t.Errorf("unexpected stop %+v", stop)
+	}
+	start, stop = diffListeners(running, []listener{
+		{net: "udp", adrr: "127.0.0.1:3478"},
+		{net: "udp", adrr: "127.0.0.1:3479"},
+	})
+	if len(start) != 0 || len(stop) != 0 {
+		t.Errorf("unexpected changes: start %+v, stop %+v", start, stop)
+	}
+}
+
+func TestDedupListeners(t *testing.T) {
+	v := getViper()
+	v.Set("server.listen", []interface{}{
+		"127.0.0.1:3478",
+		"127.0.0.1:3479",
+		map[string]interface{}{"addr": "127.0.0.1:3478", "net": "udp"},
+		map[string]interface{}{"addr": "127.0.0.1:3478", "net": "tcp"},
+	})
+	listeners, err := getListenAddrs(v, zap.NewNop(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, ln := range listeners {
+		keys = append(keys, ln.key())
+	}
+	expected := []string{"udp://127.0.0.1:3478", "udp://127.0.0.1:3479", "tcp://127.0.0.1:3478"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("unexpected listeners %v", keys)
+	}
+	listeners = dedupListeners(zap.NewNop(), []listener{
+		{net: "udp", adrr: "10.0.0.1:3478", fromAny: true},
+		{net: "udp", adrr: "10.0.0.1:3478"},
+	})
+	if len(listeners) != 1 || listeners[0].fromAny {
+		t.Errorf("explicit listener should win: %+v", listeners)
+	}
+}
+
+func TestParseListen(t *testing.T) {
+	v := getViper()
+	v.Set("server.listen", []interface{}{
+		"127.0.0.1:3478",
+		map[interface{}]interface{}{"addr": "127.0.0.1:3478", "net": "tcp"},
+		map[string]interface{}{"addr": "127.0.0.1:3479", "software": "node-1"},
+		map[string]interface{}{"addr": "127.0.0.1:3480", "services": []interface{}{"stun"}},
+		map[string]interface{}{"addr": "0.0.0.0:3481", "name": "public"},
+		"quic://127.0.0.1:3482",
+		map[string]interface{}{"addr": "127.0.0.1:3483", "net": "quic"},
+		"tls://127.0.0.1:5349",
+		"wss://127.0.0.1:443",
+	})
+	elems, err := parseListen(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []listenElem{
+		{Addr: "127.0.0.1:3478", Net: "udp"},
+		{Addr: "127.0.0.1:3478", Net: "tcp"},
+		{Addr: "127.0.0.1:3479", Net: "udp", Software: "node-1"},
+		{Addr: "127.0.0.1:3480", Net: "udp", Services: server.ServiceSTUN},
+		{Addr: "0.0.0.0:3481", Net: "udp", Name: "public"},
+		{Addr: "127.0.0.1:3482", Net: "quic"},
+		{Addr: "127.0.0.1:3483", Net: "quic"},
+		{Addr: "127.0.0.1:5349", Net: "tls"},
+		{Addr: "127.0.0.1:443", Net: "wss"},
+	}
+	if len(elems) != len(expected) {
+		t.Fatalf("unexpected elements %+v", elems)
+	}
+	for i := range expected {
+		if elems[i] != expected[i] {
+			t.Errorf("elems[%d]: %+v (got) != %+v (expected)", i, elems[i], expected[i])
+		}
+	}
+	v.Set("server.listen", []interface{}{
+		map[string]interface{}{"addr": "127.0.0.1:3478", "net": "sctp"},
+	})
+	if _, err = parseListen(v); err == nil {
+		t.Error("should error on unsupported network")
+	}
+	v.Set("server.listen", []interface{}{
+		map[string]interface{}{"addr": "quic://127.0.0.1:3478", "net": "tcp"},
+	})
+	if _, err = parseListen(v); err == nil {
+		t.Error("should error on conflicting network")
+	}
+	v.Set("server.listen", []interface{}{
+		map[string]interface{}{"addr": "127.0.0.1:3478", "services": []interface{}{"ftp"}},
+	})
+	if _, err = parseListen(v); err == nil {
+		t.Error("should error on unknown service")
+	}
+}
+
+func TestParseUserFiltering(t *testing.T) {
+	v := getViper()
+	v.Set("filter.users.rules", []map[string]string{
+		{"username": "eve", "action": "deny"},
+		{"username": "bob", "action": "allow"},
+	})
+	v.Set("filter.users.action", "allow")
+	rules, err := parseUserFilteringRules(v, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules.Action("eve") != filter.Deny {
+		t.Error("eve should be denied")
+	}
+	if rules.Action("alice") != filter.Allow {
+		t.Error("alice should be allowed")
+	}
+	t.Run("BlankUsername", func(t *testing.T) {
+		v := getViper()
+		v.Set("filter.users.rules", []map[string]string{
+			{"action": "deny"},
+		})
+		if _, err := parseUserFilteringRules(v, zap.NewNop()); err == nil {
+			t.Error("should error")
+		}
+	})
+}
+
+func TestParseRuleAction(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		action filter.Action
+	}{
+		{"allow", filter.Allow},
+		{"drop", filter.Deny},
+		{"deny", filter.Deny},
+		{"ignore", filter.Drop},
+		{"reject", filter.Reject},
+		{"", filter.Pass},
+	} {
+		a, err := parseRuleAction(tc.in)
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+		}
+		if a != tc.action {
+			t.Errorf("%q: %s (got) != %s (expected)", tc.in, a, tc.action)
+		}
+	}
+	if _, err := parseRuleAction("bad"); err == nil {
+		t.Error("should error")
+	}
+	if _, err := parseDefaultAction("pass"); err == nil {
+		t.Error("should error")
+	}
+}
+
+func TestDiffOptions(t *testing.T) {
+	peerRule := func(subnet string) filter.Rule {
+		r, err := filter.AllowNet(subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filter.NewFilter(filter.Deny, r)
+	}
+	old := server.Options{
+		Realm:       "realm",
+		MaxLifetime: time.Hour,
+		PeerRule:    peerRule("10.0.0.0/8"),
+		Workers:     10,
+	}
+	same := old
+	same.PeerRule = peerRule("10.0.0.0/8")
+	if changed := diffOptions(old, same); len(changed) != 0 {
+		t.Errorf("unexpected changes: %v", changed)
+	}
+	next := old
+	next.Realm = "other"
+	next.PeerRule = peerRule("192.168.0.0/16")
+	next.Workers = 20 // not reloadable
+	changed := diffOptions(old, next)
+	if len(changed) != 2 || changed[0] != "server.realm" || changed[1] != "filter.peer" {
+		t.Errorf("unexpected changes: %v", changed)
+	}
+}
+
+func TestParseNATMapping(t *testing.T) {
+	m, err := parseNATMapping("10.0.0.5 -> 203.0.113.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Private.Equal(net.IPv4(10, 0, 0, 5)) || !m.Public.Equal(net.IPv4(203, 0, 113, 5)) {
+		t.Errorf("unexpected mapping %+v", m)
+	}
+	for _, raw := range []string{
+		"10.0.0.5",
+		"10.0.0.5->",
+		"10.0.0.5->bad",
+		"10.0.0.5->2001:db8::1",
+	} {
+		if _, err := parseNATMapping(raw); err == nil {
+			t.Errorf("%q: should error", raw)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// getTLSConfig returns configuration with certificate from
+// server.tls.cert and server.tls.key files and certificates from
+// server.tls.sni_dir, or nil if they are not set.
+func getTLSConfig(v *viper.Viper, l *zap.Logger) (*tls.Config, error) {
+	var (
+		certFile = v.GetString("server.tls.cert")
+		keyFile  = v.GetString("server.tls.key")
+		sniDir   = v.GetString("server.tls.sni_dir")
+	)
+	if certFile == "" && keyFile == "" && sniDir == "" {
+		return nil, nil
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("both server.tls.cert and server.tls.key should be set")
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		l.Info("loaded certificate", zap.String("cert", certFile))
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if sniDir != "" {
+		certs, err := loadSNICertificates(sniDir)
+		if err != nil {
+			return nil, err
+		}
+		l.Info("loaded sni certificates", zap.String("dir", sniDir), zap.Int("n", len(certs)))
+		cfg.GetCertificate = certs.get
+	}
+	return cfg, nil
+}
+
+// sniCertificates are certificates by lower-case server name.
+type sniCertificates map[string]*tls.Certificate
+
+// loadSNICertificates loads host.crt and host.key pairs from dir, where
+// host is server name that certificate is selected for.
+func loadSNICertificates(dir string) (sniCertificates, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	certs := make(sniCertificates)
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".crt" {
+			continue
+		}
+		host := strings.TrimSuffix(f.Name(), ".crt")
+		cert, err := tls.LoadX509KeyPair(
+			filepath.Join(dir, host+".crt"), filepath.Join(dir, host+".key"),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificate for %q: %v", host, err)
+		}
+		certs[strings.ToLower(host)] = &cert
+	}
+	return certs, nil
+}
+
+// get implements tls.Config.GetCertificate. Certificates of config are
+// used if there is no certificate for requested server name.
+func (c sniCertificates) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c[strings.ToLower(hello.ServerName)], nil
+}
@@ -0,0 +1,167 @@
+package cli
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// writeCertificate writes self-signed certificate for host to dir as
+// name.crt and name.key files, returning their paths.
+func writeCertificate(t *testing.T, dir, name, host string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestGetTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gortcd_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	certFile, keyFile := writeCertificate(t, dir, "gortcd", "localhost")
+	v := getViper()
+	cfg, err := getTLSConfig(v, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg != nil {
+		t.Error("config should be nil without certificate")
+	}
+	v.Set("server.tls.cert", certFile)
+	if _, err = getTLSConfig(v, zap.NewNop()); err == nil {
+		t.Error("should error without key")
+	}
+	v.Set("server.tls.key", keyFile)
+	if cfg, err = getTLSConfig(v, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Certificates) != 1 {
+		t.Errorf("unexpected certificates %d", len(cfg.Certificates))
+	}
+	v.Set("server.tls.key", certFile)
+	if _, err = getTLSConfig(v, zap.NewNop()); err == nil {
+		t.Error("should error on bad key")
+	}
+}
+
+// handshakeName returns DNS name of certificate that cfg serves for
+// server name.
+func handshakeName(t *testing.T, cfg *tls.Config, serverName string) string {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	go func() {
+		_ = tls.Server(serverConn, cfg).Handshake()
+	}()
+	c := tls.Client(clientConn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true, // self-signed
+	})
+	if err := c.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return c.ConnectionState().PeerCertificates[0].DNSNames[0]
+}
+
+func TestGetTLSConfig_SNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gortcd_sni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	sniDir := filepath.Join(dir, "sni")
+	if err = os.Mkdir(sniDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeCertificate(t, dir, "default", "default.example.com")
+	writeCertificate(t, sniDir, "a.example.com", "a.example.com")
+	v := getViper()
+	v.Set("server.tls.sni_dir", sniDir)
+	cfg, err := getTLSConfig(v, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := handshakeName(t, cfg, "A.example.com"); name != "a.example.com" {
+		t.Errorf("unexpected certificate %q", name)
+	}
+	v.Set("server.tls.cert", certFile)
+	v.Set("server.tls.key", keyFile)
+	if cfg, err = getTLSConfig(v, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	if name := handshakeName(t, cfg, "b.example.com"); name != "default.example.com" {
+		t.Errorf("unexpected certificate %q", name)
+	}
+	t.Run("Reload", func(t *testing.T) {
+		writeCertificate(t, sniDir, "b.example.com", "b.example.com")
+		cfg, err := getTLSConfig(v, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := handshakeName(t, cfg, "b.example.com"); name != "b.example.com" {
+			t.Errorf("unexpected certificate %q", name)
+		}
+	})
+	t.Run("MissingKey", func(t *testing.T) {
+		if err := os.Remove(filepath.Join(sniDir, "a.example.com.key")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := getTLSConfig(v, zap.NewNop()); err == nil {
+			t.Error("should error on missing key")
+		}
+	})
+	t.Run("MissingDir", func(t *testing.T) {
+		v.Set("server.tls.sni_dir", filepath.Join(dir, "missing"))
+		if _, err := getTLSConfig(v, zap.NewNop()); err == nil {
+			t.Error("should error on missing directory")
+		}
+	})
+}
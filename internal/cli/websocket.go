@@ -0,0 +1,106 @@
+package cli
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"gortc.io/gortcd/internal/dgram"
+)
+
+const (
+	// wsIdleTimeout is maximum duration between messages after which
+	// WebSocket connection is closed, same as for stream connections.
+	wsIdleTimeout = time.Minute * 5
+	// wsWriteTimeout bounds writes, so stalled client can't block relay.
+	wsWriteTimeout = time.Second
+	// wsReadLimit is maximum size of message, that is enough for
+	// ChannelData with maximum length.
+	wsReadLimit = 4 + 65535
+	// wsHandshakeTimeout bounds reading of HTTP upgrade request.
+	wsHandshakeTimeout = time.Second * 10
+)
+
+// wsSession is dgram.Session over WebSocket connection, where each binary
+// message carries single STUN or ChannelData message. Text messages are
+// ignored.
+type wsSession struct {
+	conn *websocket.Conn
+	mux  sync.Mutex // serializes writes
+}
+
+func (s *wsSession) ReadMessage() ([]byte, error) {
+	for {
+		if err := s.conn.SetReadDeadline(time.Now().Add(wsIdleTimeout)); err != nil {
+			return nil, err
+		}
+		t, b, err := s.conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if t == websocket.BinaryMessage {
+			return b, nil
+		}
+	}
+}
+
+func (s *wsSession) WriteMessage(b []byte) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err := s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout)); err != nil {
+		return err
+	}
+	return s.conn.WriteMessage(websocket.BinaryMessage, b)
+}
+
+func (s *wsSession) Close() error { return s.conn.Close() }
+
+// listenWebSocket listens on laddr for HTTP requests that are upgraded to
+// WebSocket, over TLS if tlsConfig is set, and returns connection that
+// reads and writes messages of all of them.
+func listenWebSocket(log *zap.Logger, network, laddr string, tlsConfig *tls.Config) (net.PacketConn, error) {
+	ln, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	a := ln.Addr().(*net.TCPAddr)
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	upgrader := websocket.Upgrader{
+		HandshakeTimeout: wsHandshakeTimeout,
+		// Requests are authenticated by TURN credentials, not by
+		// cookies, so browser applications of any origin are allowed.
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	srv := &http.Server{
+		ReadHeaderTimeout: wsHandshakeTimeout,
+	}
+	c := dgram.New(&dgram.Addr{Net: network, IP: a.IP, Port: a.Port}, srv)
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, upgradeErr := upgrader.Upgrade(w, r, nil)
+		if upgradeErr != nil {
+			// Error response is already sent by upgrader.
+			log.Debug("failed to upgrade", zap.String("addr", r.RemoteAddr), zap.Error(upgradeErr))
+			return
+		}
+		remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			_ = conn.Close()
+			return
+		}
+		conn.SetReadLimit(wsReadLimit)
+		c.Add(&net.UDPAddr{IP: remote.IP, Port: remote.Port}, &wsSession{conn: conn})
+	})
+	go func() {
+		if serveErr := srv.Serve(ln); serveErr != http.ErrServerClosed {
+			log.Error("failed to serve", zap.Error(serveErr))
+		}
+	}()
+	return c, nil
+}
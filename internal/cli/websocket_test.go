@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+func TestListenWebSocket(t *testing.T) {
+	c, err := listenWebSocket(zap.NewNop(), "ws", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if closeErr := c.Close(); closeErr != nil {
+			t.Error(closeErr)
+		}
+	}()
+	if c.LocalAddr().Network() != "ws" {
+		t.Errorf("unexpected network %q", c.LocalAddr().Network())
+	}
+	client, _, err := websocket.DefaultDialer.Dial("ws://"+c.LocalAddr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err = client.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatal(err)
+	}
+	// Text messages are ignored.
+	if err = client.WriteMessage(websocket.TextMessage, []byte("text")); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.WriteMessage(websocket.BinaryMessage, []byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	n, addr, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], []byte("request")) {
+		t.Errorf("unexpected message %q", buf[:n])
+	}
+	if local := client.LocalAddr().(*net.TCPAddr); addr.(*net.UDPAddr).Port != local.Port {
+		t.Errorf("unexpected addr %s", addr)
+	}
+	if _, err = c.WriteTo([]byte("response"), addr); err != nil {
+		t.Fatal(err)
+	}
+	typ, b, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != websocket.BinaryMessage || !bytes.Equal(b, []byte("response")) {
+		t.Errorf("unexpected message %d %q", typ, b)
+	}
+}
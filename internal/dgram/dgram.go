@@ -0,0 +1,210 @@
+// Package dgram implements net.PacketConn over message-oriented sessions,
+// like QUIC connections with datagrams (RFC 9221) or WebSocket connections,
+// so they can be served by the same code as plain UDP.
+//
+// Each message carries exactly one STUN message or ChannelData message,
+// like UDP datagram does, so ChannelData is not padded.
+package dgram
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// queueSize is maximum count of received messages that are not read yet,
+// after that sessions are blocked until ReadFrom.
+const queueSize = 128
+
+var (
+	// ErrNoSession means that there is no session with remote address.
+	ErrNoSession = errors.New("no session for address")
+
+	// errClosed has same text as net package error, so it is handled as
+	// "use of closed network connection".
+	errClosed = errors.New("use of closed network connection")
+)
+
+// Session is message-oriented connection with single remote peer.
+type Session interface {
+	// ReadMessage blocks until next message is received, returning
+	// slice that is not reused by session.
+	ReadMessage() ([]byte, error)
+	// WriteMessage sends b as single message. It can be called
+	// concurrently and must not retain b.
+	WriteMessage(b []byte) error
+	Close() error
+}
+
+// Addr is local address of Conn with network name of transport,
+// e.g. "quic" or "ws".
+type Addr struct {
+	Net  string
+	IP   net.IP
+	Port int
+}
+
+// Network returns transport name.
+func (a *Addr) Network() string { return a.Net }
+
+func (a *Addr) String() string {
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+}
+
+type message struct {
+	b    []byte
+	addr *net.UDPAddr
+}
+
+// Conn is net.PacketConn that reads messages from all added sessions and
+// writes messages to session by remote address. Remote addresses are
+// *net.UDPAddr, so clients are handled like UDP ones.
+//
+// Deadlines are not supported.
+type Conn struct {
+	local    *Addr
+	listener io.Closer
+	messages chan message
+	close    chan struct{}
+	once     sync.Once
+	wg       sync.WaitGroup
+
+	mux      sync.Mutex
+	sessions map[string]Session
+}
+
+// New initializes and returns new Conn with local address. Listener that
+// accepts sessions is closed on Close, if not nil.
+func New(local *Addr, listener io.Closer) *Conn {
+	return &Conn{
+		local:    local,
+		listener: listener,
+		messages: make(chan message, queueSize),
+		close:    make(chan struct{}),
+		sessions: make(map[string]Session),
+	}
+}
+
+// Add starts reading messages from s until error, after that s is closed
+// and removed. Session that replaces existing one with same address
+// closes it.
+func (c *Conn) Add(addr *net.UDPAddr, s Session) {
+	key := addr.String()
+	c.mux.Lock()
+	select {
+	case <-c.close:
+		c.mux.Unlock()
+		_ = s.Close()
+		return
+	default:
+	}
+	if old, ok := c.sessions[key]; ok {
+		_ = old.Close()
+	}
+	c.sessions[key] = s
+	c.wg.Add(1)
+	c.mux.Unlock()
+	go c.read(key, addr, s)
+}
+
+func (c *Conn) read(key string, addr *net.UDPAddr, s Session) {
+	defer c.wg.Done()
+	defer c.remove(key, s)
+	for {
+		b, err := s.ReadMessage()
+		if err != nil {
+			return
+		}
+		select {
+		case c.messages <- message{b: b, addr: addr}:
+		case <-c.close:
+			return
+		}
+	}
+}
+
+func (c *Conn) remove(key string, s Session) {
+	c.mux.Lock()
+	if c.sessions[key] == s {
+		delete(c.sessions, key)
+	}
+	c.mux.Unlock()
+	_ = s.Close()
+}
+
+// Sessions returns count of active sessions.
+func (c *Conn) Sessions() int {
+	c.mux.Lock()
+	n := len(c.sessions)
+	c.mux.Unlock()
+	return n
+}
+
+// ReadFrom reads next message from any session, truncating it to len(b).
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case m := <-c.messages:
+		return copy(b, m.b), m.addr, nil
+	case <-c.close:
+		return 0, nil, &net.OpError{Op: "read", Net: c.local.Net, Addr: c.local, Err: errClosed}
+	}
+}
+
+// WriteTo writes b as single message to session of addr.
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mux.Lock()
+	s, ok := c.sessions[addr.String()]
+	c.mux.Unlock()
+	if !ok {
+		select {
+		case <-c.close:
+			return 0, &net.OpError{Op: "write", Net: c.local.Net, Addr: addr, Err: errClosed}
+		default:
+			return 0, ErrNoSession
+		}
+	}
+	if err := s.WriteMessage(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes listener and all sessions and waits for their readers.
+func (c *Conn) Close() error {
+	var (
+		closed bool
+		err    error
+	)
+	c.once.Do(func() {
+		if c.listener != nil {
+			err = c.listener.Close()
+		}
+		c.mux.Lock()
+		close(c.close)
+		for _, s := range c.sessions {
+			_ = s.Close()
+		}
+		c.mux.Unlock()
+		closed = true
+	})
+	if !closed {
+		return &net.OpError{Op: "close", Net: c.local.Net, Addr: c.local, Err: errClosed}
+	}
+	c.wg.Wait()
+	return err
+}
+
+// LocalAddr returns *Addr of Conn.
+func (c *Conn) LocalAddr() net.Addr { return c.local }
+
+// SetDeadline is no-op.
+func (c *Conn) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline is no-op.
+func (c *Conn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline is no-op, sessions are responsible for write timeouts.
+func (c *Conn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,116 @@
+package dgram
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+// pipeSession is Session that reads from in and writes to out.
+type pipeSession struct {
+	in     chan []byte
+	out    chan []byte
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newPipeSession() *pipeSession {
+	return &pipeSession{
+		in:     make(chan []byte, 10),
+		out:    make(chan []byte, 10),
+		closed: make(chan struct{}),
+	}
+}
+
+func (s *pipeSession) ReadMessage() ([]byte, error) {
+	select {
+	case b := <-s.in:
+		return b, nil
+	case <-s.closed:
+		return nil, errors.New("closed")
+	}
+}
+
+func (s *pipeSession) WriteMessage(b []byte) error {
+	s.out <- append([]byte{}, b...)
+	return nil
+}
+
+func (s *pipeSession) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+func TestConn(t *testing.T) {
+	c := New(&Addr{Net: "test", IP: net.IPv4(127, 0, 0, 1), Port: 3478}, nil)
+	if c.LocalAddr().Network() != "test" || c.LocalAddr().String() != "127.0.0.1:3478" {
+		t.Errorf("unexpected local addr %s", c.LocalAddr())
+	}
+	var (
+		first       = newPipeSession()
+		second      = newPipeSession()
+		firstAddr   = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+		secondAddr  = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+		buf         = make([]byte, 10)
+		readMessage = func(expected *net.UDPAddr) []byte {
+			t.Helper()
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.String() != expected.String() {
+				t.Errorf("unexpected addr %s", addr)
+			}
+			return buf[:n]
+		}
+	)
+	c.Add(firstAddr, first)
+	c.Add(secondAddr, second)
+	if c.Sessions() != 2 {
+		t.Errorf("unexpected sessions count %d", c.Sessions())
+	}
+	first.in <- []byte("first")
+	if b := readMessage(firstAddr); !bytes.Equal(b, []byte("first")) {
+		t.Errorf("unexpected message %q", b)
+	}
+	second.in <- []byte("too long second")
+	if n := len(readMessage(secondAddr)); n != len(buf) {
+		t.Errorf("message should be truncated, got %d", n)
+	}
+	if _, err := c.WriteTo([]byte("response"), secondAddr); err != nil {
+		t.Fatal(err)
+	}
+	if b := <-second.out; !bytes.Equal(b, []byte("response")) {
+		t.Errorf("unexpected response %q", b)
+	}
+	if _, err := c.WriteTo([]byte("response"), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3)}); err != ErrNoSession {
+		t.Errorf("unexpected error: %v", err)
+	}
+	t.Run("Replace", func(t *testing.T) {
+		replaced := newPipeSession()
+		c.Add(firstAddr, replaced)
+		<-first.closed
+		replaced.in <- []byte("replaced")
+		if b := readMessage(firstAddr); !bytes.Equal(b, []byte("replaced")) {
+			t.Errorf("unexpected message %q", b)
+		}
+	})
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-second.closed
+	if c.Sessions() != 0 {
+		t.Errorf("sessions should be removed, got %d", c.Sessions())
+	}
+	if _, _, err := c.ReadFrom(buf); err == nil || err.Error() != "read test 127.0.0.1:3478: use of closed network connection" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := c.Close(); err == nil {
+		t.Error("second close should fail")
+	}
+	closed := newPipeSession()
+	c.Add(firstAddr, closed)
+	<-closed.closed
+}
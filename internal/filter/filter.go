@@ -2,7 +2,10 @@
 package filter
 
 import (
+	"fmt"
 	"net"
+	"strconv"
+	"sync/atomic"
 
 	"gortc.io/turn"
 )
@@ -11,9 +14,11 @@ import (
 type Action byte
 
 var actionToStr = map[Action]string{
-	Pass:  "pass",
-	Allow: "allow",
-	Deny:  "deny",
+	Pass:   "pass",
+	Allow:  "allow",
+	Deny:   "deny",
+	Drop:   "drop",
+	Reject: "reject",
 }
 
 func (a Action) String() string {
@@ -21,10 +26,16 @@ func (a Action) String() string {
 }
 
 // Possible action list.
+//
+// Deny is handled in context-specific way: packets from denied clients
+// are silently dropped, while requests to denied peers are rejected with
+// 403 (Forbidden). Drop and Reject override that behavior explicitly.
 const (
 	Pass Action = iota
 	Allow
 	Deny
+	Drop   // silently ignore
+	Reject // respond with 403 (Forbidden) error
 )
 
 type subnetRule struct {
@@ -40,6 +51,8 @@ func (r subnetRule) Action(addr turn.Addr) Action {
 	return Pass
 }
 
+func (r subnetRule) String() string { return r.net.String() }
+
 // AllowNet allows any address from subnet.
 func AllowNet(subnet string) (Rule, error) {
 	return StaticNetRule(Allow, subnet)
@@ -76,23 +89,125 @@ type Rule interface {
 type List struct {
 	action Action
 	rules  []Rule
+	// hits are match counts by action of each rule, last one is for
+	// default action.
+	hits []ruleHits
+}
+
+// ruleHits is match count of rule by returned action.
+type ruleHits [Reject + 1]uint64
+
+func (h *ruleHits) inc(a Action) {
+	if int(a) < len(h) {
+		atomic.AddUint64(&h[a], 1)
+	}
 }
 
 // Action implements Rule.
 //
 // Returns first matched rule from list or default action if none found.
-// Matched is rule that returned Allow or Deny action (not "Pass").
+// Matched is rule that returned Allow or Deny action (not "Pass"), rules
+// after it are not evaluated.
 func (f *List) Action(addr turn.Addr) Action {
 	for i := range f.rules {
 		a := f.rules[i].Action(addr)
 		if a == Pass {
 			continue
 		}
+		f.hits[i].inc(a)
 		return a
 	}
+	f.hits[len(f.rules)].inc(f.action)
 	return f.action
 }
 
+// RuleHits is match count of rule with returned action.
+type RuleHits struct {
+	Rule   string // rule subnet, index in list or "default"
+	Action Action
+	Hits   uint64
+}
+
+// DefaultRule is RuleHits.Rule of default action.
+const DefaultRule = "default"
+
+// Hits returns non-zero match counts of rules and default action.
+func (f *List) Hits() []RuleHits {
+	var hits []RuleHits
+	for i := range f.hits {
+		name := DefaultRule
+		if i < len(f.rules) {
+			name = strconv.Itoa(i)
+			if s, ok := f.rules[i].(fmt.Stringer); ok {
+				name = s.String()
+			}
+		}
+		for a := range f.hits[i] {
+			if n := atomic.LoadUint64(&f.hits[i][a]); n > 0 {
+				hits = append(hits, RuleHits{Rule: name, Action: Action(a), Hits: n})
+			}
+		}
+	}
+	return hits
+}
+
 // NewFilter initializes and returns new List with provided default action
 // and rule list.
-func NewFilter(action Action, rules ...Rule) *List { return &List{rules: rules, action: action} }
+func NewFilter(action Action, rules ...Rule) *List {
+	return &List{rules: rules, action: action, hits: make([]ruleHits, len(rules)+1)}
+}
+
+// UserRule represents filtering rule for authenticated usernames.
+type UserRule interface {
+	Action(username string) Action
+}
+
+type staticUserRule struct {
+	action   Action
+	username string
+}
+
+func (r staticUserRule) Action(username string) Action {
+	if r.username == username {
+		return r.action
+	}
+	return Pass
+}
+
+// StaticUserRule returns static rule that will apply action to username.
+func StaticUserRule(action Action, username string) UserRule {
+	return staticUserRule{action: action, username: username}
+}
+
+type allowAllUsers struct{}
+
+func (allowAllUsers) Action(username string) Action { return Allow }
+
+// AllowAllUsers is UserRule that always returns Allow.
+var AllowAllUsers UserRule = allowAllUsers{}
+
+// UserList is list of username rules with default action.
+type UserList struct {
+	action Action
+	rules  []UserRule
+}
+
+// Action implements UserRule.
+//
+// Returns first matched rule from list or default action if none found.
+func (f *UserList) Action(username string) Action {
+	for i := range f.rules {
+		a := f.rules[i].Action(username)
+		if a == Pass {
+			continue
+		}
+		return a
+	}
+	return f.action
+}
+
+// NewUserFilter initializes and returns new UserList with provided default
+// action and rule list.
+func NewUserFilter(action Action, rules ...UserRule) *UserList {
+	return &UserList{rules: rules, action: action}
+}
@@ -144,3 +144,76 @@ func TestFilter_Allowed(t *testing.T) {
 		})
 	}
 }
+
+// passRule always returns Pass.
+type passRule struct{}
+
+func (passRule) Action(addr turn.Addr) Action { return Pass }
+
+func TestList_Hits(t *testing.T) {
+	forbidNet, err := ForbidNet("192.168.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowLoopback, err := AllowNet("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := NewFilter(Allow, passRule{}, forbidNet, allowLoopback)
+	if hits := filter.Hits(); len(hits) != 0 {
+		t.Fatalf("unexpected hits: %v", hits)
+	}
+	for _, ip := range []net.IP{
+		net.IPv4(192, 168, 0, 1),
+		net.IPv4(192, 168, 0, 2),
+		net.IPv4(127, 0, 0, 1),
+		net.IPv4(10, 0, 0, 1),
+	} {
+		filter.Action(turn.Addr{IP: ip})
+	}
+	expected := []RuleHits{
+		{Rule: "192.168.0.0/24", Action: Deny, Hits: 2},
+		{Rule: "127.0.0.0/8", Action: Allow, Hits: 1},
+		{Rule: DefaultRule, Action: Allow, Hits: 1},
+	}
+	hits := filter.Hits()
+	if len(hits) != len(expected) {
+		t.Fatalf("unexpected hits: %v", hits)
+	}
+	for i := range expected {
+		if hits[i] != expected[i] {
+			t.Errorf("%d: unexpected %+v, expected %+v", i, hits[i], expected[i])
+		}
+	}
+	t.Run("Unnamed", func(t *testing.T) {
+		f := NewFilter(Deny, AllowAll)
+		f.Action(turn.Addr{})
+		if hits := f.Hits(); len(hits) != 1 || hits[0].Rule != "0" || hits[0].Action != Allow {
+			t.Errorf("unexpected hits: %v", hits)
+		}
+	})
+}
+
+func TestUserList_Action(t *testing.T) {
+	f := NewUserFilter(Allow,
+		StaticUserRule(Pass, "bob"),
+		StaticUserRule(Deny, "bob"),
+		StaticUserRule(Deny, "eve"),
+	)
+	for _, tc := range []struct {
+		username string
+		action   Action
+	}{
+		{"alice", Allow},
+		{"bob", Deny},
+		{"eve", Deny},
+		{"", Allow},
+	} {
+		if a := f.Action(tc.username); a != tc.action {
+			t.Errorf("%q: %s (got) != %s (expected)", tc.username, a, tc.action)
+		}
+	}
+	if AllowAllUsers.Action("eve") != Allow {
+		t.Error("should be allowed")
+	}
+}
@@ -0,0 +1,112 @@
+package filter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"gortc.io/turn"
+)
+
+// Resolver resolves host names to addresses, net.Resolver implements it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DefaultFQDNTTL is re-resolution interval of FQDN rule if not set. Go
+// resolver does not expose TTL of DNS records, so it is fixed.
+const DefaultFQDNTTL = time.Minute
+
+// fqdnResolveTimeout bounds single resolution of FQDN rule.
+const fqdnResolveTimeout = time.Second * 5
+
+var errNoAddrs = errors.New("no addresses")
+
+type fqdnRule struct {
+	action   Action
+	host     string
+	ttl      time.Duration
+	resolver Resolver
+	now      func() time.Time
+
+	ips       atomic.Value // []net.IP
+	expires   int64        // unix nanoseconds, atomic
+	resolving int32        // 1 if re-resolution is in progress, atomic
+}
+
+// Action returns action if addr is one of current addresses of host.
+//
+// Expired addresses are re-resolved in background, so lookups are never
+// blocked by DNS and previous addresses are used until resolution is done.
+func (r *fqdnRule) Action(addr turn.Addr) Action {
+	if atomic.LoadInt64(&r.expires) < r.now().UnixNano() && atomic.CompareAndSwapInt32(&r.resolving, 0, 1) {
+		go r.refresh()
+	}
+	for _, ip := range r.ips.Load().([]net.IP) {
+		if ip.Equal(addr.IP) {
+			return r.action
+		}
+	}
+	return Pass
+}
+
+func (r *fqdnRule) String() string { return r.host }
+
+// resolve updates addresses of host. Previous addresses are kept on error
+// and resolution is retried after ttl.
+func (r *fqdnRule) resolve() error {
+	ctx, cancel := context.WithTimeout(context.Background(), fqdnResolveTimeout)
+	defer cancel()
+	addrs, err := r.resolver.LookupIPAddr(ctx, r.host)
+	if err == nil && len(addrs) == 0 {
+		err = errNoAddrs
+	}
+	atomic.StoreInt64(&r.expires, r.now().Add(r.ttl).UnixNano())
+	if err != nil {
+		return err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i := range addrs {
+		ips[i] = addrs[i].IP
+	}
+	r.ips.Store(ips)
+	return nil
+}
+
+func (r *fqdnRule) refresh() {
+	defer atomic.StoreInt32(&r.resolving, 0)
+	_ = r.resolve() // using previous addresses on error
+}
+
+func newFQDNRule(action Action, host string, ttl time.Duration, resolver Resolver, now func() time.Time) (*fqdnRule, error) {
+	if ttl <= 0 {
+		ttl = DefaultFQDNTTL
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	r := &fqdnRule{
+		action:   action,
+		host:     host,
+		ttl:      ttl,
+		resolver: resolver,
+		now:      now,
+	}
+	if err := r.resolve(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// FQDNRule returns rule that applies action to addresses that host is
+// resolved to. Addresses are re-resolved every ttl (DefaultFQDNTTL if
+// zero) with resolver (net.DefaultResolver if nil), initial resolution
+// should succeed.
+//
+// Rule trusts DNS: anyone who controls or spoofs records of host can
+// point it to any address, e.g. to internal network (DNS rebinding).
+func FQDNRule(action Action, host string, ttl time.Duration, resolver Resolver) (Rule, error) {
+	return newFQDNRule(action, host, ttl, resolver, time.Now)
+}
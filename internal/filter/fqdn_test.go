@@ -0,0 +1,102 @@
+package filter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gortc.io/turn"
+)
+
+type fakeResolver struct {
+	mux   sync.Mutex
+	calls int
+	ips   []net.IP
+	err   error
+}
+
+func (f *fakeResolver) set(err error, ips ...net.IP) {
+	f.mux.Lock()
+	f.ips, f.err = ips, err
+	f.mux.Unlock()
+}
+
+func (f *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	addrs := make([]net.IPAddr, len(f.ips))
+	for i, ip := range f.ips {
+		addrs[i].IP = ip
+	}
+	return addrs, nil
+}
+
+func TestFQDNRule(t *testing.T) {
+	var (
+		first  = net.IPv4(203, 0, 113, 1)
+		second = net.IPv4(203, 0, 113, 2)
+		now    = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+		nowMux sync.Mutex
+	)
+	clock := func() time.Time {
+		nowMux.Lock()
+		defer nowMux.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		nowMux.Lock()
+		now = now.Add(d)
+		nowMux.Unlock()
+	}
+	resolver := &fakeResolver{ips: []net.IP{first}}
+	r, err := newFQDNRule(Allow, "media.example.com", time.Minute, resolver, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wait blocks until background re-resolution is done.
+	wait := func() {
+		for atomic.LoadInt32(&r.resolving) != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	check := func(ip net.IP, expected Action) {
+		t.Helper()
+		if a := r.Action(turn.Addr{IP: ip}); a != expected {
+			t.Errorf("%s: unexpected action %s, expected %s", ip, a, expected)
+		}
+	}
+	if r.String() != "media.example.com" {
+		t.Errorf("unexpected name %s", r)
+	}
+	check(first, Allow)
+	check(second, Pass)
+	resolver.set(nil, second)
+	advance(time.Second * 30)
+	check(second, Pass) // not expired yet
+	advance(time.Second * 31)
+	check(first, Allow) // previous addresses are used during resolution
+	wait()
+	check(first, Pass)
+	check(second, Allow)
+	resolver.set(errors.New("failed"))
+	advance(time.Minute * 2)
+	check(second, Allow)
+	wait()
+	check(second, Allow) // previous addresses are kept on error
+	if resolver.calls != 3 {
+		t.Errorf("unexpected resolutions count %d", resolver.calls)
+	}
+	t.Run("InitialError", func(t *testing.T) {
+		if _, err := FQDNRule(Allow, "media.example.com", 0, &fakeResolver{}); err == nil {
+			t.Error("should error")
+		}
+	})
+}
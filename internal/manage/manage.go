@@ -2,9 +2,14 @@
 package manage
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"runtime"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -14,10 +19,48 @@ type Notifier interface {
 	Notify()
 }
 
+// Health wraps server state that is reported by health check.
+type Health interface {
+	Allocations() int
+	Closing() bool
+}
+
+// Drainer wraps draining of server, e.g. for rolling deploys.
+type Drainer interface {
+	// Drain stops accepting new allocations, existing ones are kept.
+	Drain()
+	Draining() bool
+}
+
 // Manager handles http management endpoints.
 type Manager struct {
 	notifier Notifier
+	health   Health
+	drainer  Drainer
+	reloads  *ReloadLog
 	l        *zap.Logger
+	token    []byte
+	origins  []string // allowed CORS origins
+	version  string
+	commit   string
+	started  time.Time
+}
+
+// Options is set of options for Manager.
+type Options struct {
+	Log      *zap.Logger
+	Notifier Notifier
+	Health   Health  // optional
+	Drainer  Drainer // optional, enables drain endpoint
+	// Reloads is optional log of reload results, reload request waits for
+	// and reports the result if set.
+	Reloads *ReloadLog
+	Token   string // bearer token, no authentication if blank
+	Version string // reported by health check
+	Commit  string // reported by health check
+	// CORSOrigins are origins that are allowed to call endpoints from
+	// browser, "*" allows any origin; no CORS headers are sent if empty.
+	CORSOrigins []string
 }
 
 func (m Manager) fprintln(w io.Writer, a ...interface{}) {
@@ -26,19 +69,198 @@ func (m Manager) fprintln(w io.Writer, a ...interface{}) {
 	}
 }
 
+const bearerPrefix = "Bearer "
+
+// authorized reports whether request has valid bearer token.
+func (m Manager) authorized(r *http.Request) bool {
+	if len(m.token) == 0 {
+		return true
+	}
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, bearerPrefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(h[len(bearerPrefix):]), m.token) == 1
+}
+
+type healthStatus struct {
+	Status      string  `json:"status"`
+	Uptime      float64 `json:"uptime"` // seconds
+	Allocations int     `json:"allocations"`
+	Version     string  `json:"version,omitempty"`
+	Commit      string  `json:"commit,omitempty"`
+	GoVersion   string  `json:"go_version"`
+}
+
+// serveHealth handles health check request, responding with 503 if server
+// is shutting down or draining.
+func (m Manager) serveHealth(w http.ResponseWriter) {
+	h := healthStatus{
+		Status:    "ok",
+		Uptime:    time.Since(m.started).Seconds(),
+		Version:   m.version,
+		Commit:    m.commit,
+		GoVersion: runtime.Version(),
+	}
+	code := http.StatusOK
+	if m.health != nil {
+		h.Allocations = m.health.Allocations()
+		if m.health.Closing() {
+			h.Status = "closing"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	if code == http.StatusOK && m.drainer != nil && m.drainer.Draining() {
+		h.Status = "draining"
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(h); err != nil {
+		m.l.Warn("failed to write", zap.Error(err))
+	}
+}
+
+// reloadTimeout is maximum duration of waiting for reload result.
+const reloadTimeout = time.Second * 5
+
+// serveReload triggers reload and responds with its result, or with
+// 202 (Accepted) if reload is not done in reloadTimeout.
+func (m Manager) serveReload(w http.ResponseWriter) {
+	last := m.reloads.Last().ID
+	m.notifier.Notify()
+	r, ok := m.reloads.Wait(last, reloadTimeout)
+	if !ok {
+		w.WriteHeader(http.StatusAccepted)
+		m.fprintln(w, "server will be reloaded soon")
+		return
+	}
+	code := http.StatusOK
+	if r.Error != "" {
+		code = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(r); err != nil {
+		m.l.Warn("failed to write", zap.Error(err))
+	}
+}
+
+// allowedOrigin returns value of Access-Control-Allow-Origin header for
+// origin or blank string if origin is not allowed.
+func (m Manager) allowedOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, o := range m.origins {
+		if o == "*" || o == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+// cors sets CORS headers of response to r and reports whether r is
+// preflight request that is already handled.
+func (m Manager) cors(w http.ResponseWriter, r *http.Request) bool {
+	if len(m.origins) == 0 {
+		return false
+	}
+	// Response depends on Origin, so it should not be cached for others.
+	w.Header().Add("Vary", "Origin")
+	origin := m.allowedOrigin(r.Header.Get("Origin"))
+	if origin == "" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	// Preflight requests have no credentials, so handling them before
+	// authorization.
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	w.Header().Set("Access-Control-Max-Age", "600")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
 // ServeHTTP implements http.Handler.
 func (m Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.cors(w, r) {
+		return
+	}
+	if r.URL.Path == "/healthz" {
+		// Health check is used by load balancers and requires no token.
+		m.serveHealth(w)
+		return
+	}
+	if !m.authorized(r) {
+		m.l.Warn("unauthorized request", zap.String("path", r.URL.Path), zap.String("addr", r.RemoteAddr))
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		m.fprintln(w, "unauthorized")
+		return
+	}
 	switch r.URL.Path {
 	case "/reload":
 		m.l.Info("got reload request")
+		if m.reloads != nil {
+			m.serveReload(w)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		m.notifier.Notify()
 		m.fprintln(w, "server will be reloaded soon")
+	case "/drain":
+		if m.drainer == nil {
+			m.notFound(w)
+			return
+		}
+		m.serveDrain(w, r)
 	default:
-		w.WriteHeader(http.StatusNotFound)
-		m.fprintln(w, "management endpoint not found")
+		m.notFound(w)
+	}
+}
+
+func (m Manager) notFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	m.fprintln(w, "management endpoint not found")
+}
+
+// serveDrain stops accepting new allocations, so server can be rotated
+// after existing allocations are expired.
+func (m Manager) serveDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		m.fprintln(w, "drain requires POST")
+		return
 	}
+	m.l.Warn("got drain request, rejecting new allocations")
+	m.drainer.Drain()
+	w.WriteHeader(http.StatusOK)
+	m.fprintln(w, "server is draining")
 }
 
 // NewManager initializes and returns Manager.
-func NewManager(l *zap.Logger, n Notifier) Manager { return Manager{l: l, notifier: n} }
+func NewManager(o Options) Manager {
+	if o.Log == nil {
+		o.Log = zap.NewNop()
+	}
+	m := Manager{
+		l:        o.Log,
+		notifier: o.Notifier,
+		health:   o.Health,
+		reloads:  o.Reloads,
+		drainer:  o.Drainer,
+		version:  o.Version,
+		commit:   o.Commit,
+		origins:  o.CORSOrigins,
+		started:  time.Now(),
+	}
+	if o.Token != "" {
+		m.token = []byte(o.Token)
+	}
+	return m
+}
@@ -1,10 +1,14 @@
 package manage
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -24,7 +28,7 @@ func (errWriter) Write(p []byte) (n int, err error) {
 func TestManager_ErrorLogging(t *testing.T) {
 	notifier := notifierFunc(func() {})
 	core, logs := observer.New(zapcore.WarnLevel)
-	m := NewManager(zap.New(core), notifier)
+	m := NewManager(Options{Log: zap.New(core), Notifier: notifier})
 	m.fprintln(errWriter{}, "test")
 	if logs.Len() != 1 {
 		t.Error("unexpected log entry count")
@@ -36,7 +40,7 @@ func TestManager_ServeHTTP(t *testing.T) {
 	notifier := notifierFunc(func() {
 		notified = true
 	})
-	s := httptest.NewServer(NewManager(zap.NewNop(), notifier))
+	s := httptest.NewServer(NewManager(Options{Log: zap.NewNop(), Notifier: notifier}))
 	defer s.Close()
 	c := s.Client()
 	res, err := c.Get("http://" + s.Listener.Addr().String() + "/reload")
@@ -57,3 +61,315 @@ func TestManager_ServeHTTP(t *testing.T) {
 		t.Error("bad status")
 	}
 }
+
+func TestManager_Token(t *testing.T) {
+	notified := false
+	notifier := notifierFunc(func() {
+		notified = true
+	})
+	s := httptest.NewServer(NewManager(Options{
+		Log:      zap.NewNop(),
+		Notifier: notifier,
+		Token:    "secret",
+	}))
+	defer s.Close()
+	c := s.Client()
+	u := "http://" + s.Listener.Addr().String() + "/reload"
+	for _, h := range []string{"", "Bearer", "Bearer bad", "Basic secret", "secret"} {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h != "" {
+			req.Header.Set("Authorization", h)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%q: bad status %d", h, res.StatusCode)
+		}
+	}
+	if notified {
+		t.Error("should not be notified")
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("bad status %d", res.StatusCode)
+	}
+	if !notified {
+		t.Error("not notified")
+	}
+}
+
+type healthFunc func() (int, bool)
+
+func (f healthFunc) Allocations() int { n, _ := f(); return n }
+func (f healthFunc) Closing() bool    { _, closing := f(); return closing }
+
+func TestManager_Health(t *testing.T) {
+	var closing int32
+	s := httptest.NewServer(NewManager(Options{
+		Log:      zap.NewNop(),
+		Notifier: notifierFunc(func() {}),
+		Token:    "secret",
+		Version:  "v1.0.0",
+		Commit:   "abc",
+		Health: healthFunc(func() (int, bool) {
+			return 10, atomic.LoadInt32(&closing) == 1
+		}),
+	}))
+	defer s.Close()
+	c := s.Client()
+	get := func(t *testing.T) (int, healthStatus) {
+		t.Helper()
+		res, err := c.Get("http://" + s.Listener.Addr().String() + "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var h healthStatus
+		if err = json.NewDecoder(res.Body).Decode(&h); err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, h
+	}
+	t.Run("OK", func(t *testing.T) {
+		code, h := get(t)
+		if code != http.StatusOK {
+			t.Errorf("bad status %d", code)
+		}
+		if h.Allocations != 10 {
+			t.Errorf("bad allocations %d", h.Allocations)
+		}
+		if h.Version != "v1.0.0" || h.Commit != "abc" {
+			t.Errorf("bad version %q (%s)", h.Version, h.Commit)
+		}
+		if h.GoVersion != runtime.Version() {
+			t.Errorf("bad go version %q", h.GoVersion)
+		}
+	})
+	t.Run("Closing", func(t *testing.T) {
+		atomic.StoreInt32(&closing, 1)
+		if code, _ := get(t); code != http.StatusServiceUnavailable {
+			t.Errorf("bad status %d", code)
+		}
+	})
+}
+
+type testDrainer struct{ draining int32 }
+
+func (d *testDrainer) Drain()         { atomic.StoreInt32(&d.draining, 1) }
+func (d *testDrainer) Draining() bool { return atomic.LoadInt32(&d.draining) == 1 }
+
+func TestManager_Drain(t *testing.T) {
+	d := new(testDrainer)
+	s := httptest.NewServer(NewManager(Options{
+		Log:      zap.NewNop(),
+		Notifier: notifierFunc(func() {}),
+		Drainer:  d,
+	}))
+	defer s.Close()
+	c := s.Client()
+	base := "http://" + s.Listener.Addr().String()
+	res, err := c.Get(base + "/drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("bad status %d", res.StatusCode)
+	}
+	if d.Draining() {
+		t.Fatal("should not drain on GET")
+	}
+	if res, err = c.Get(base + "/healthz"); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("bad status %d", res.StatusCode)
+	}
+	if res, err = c.Post(base+"/drain", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("bad status %d", res.StatusCode)
+	}
+	if !d.Draining() {
+		t.Error("should drain")
+	}
+	if res, err = c.Get(base + "/healthz"); err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var h healthStatus
+	if err = json.NewDecoder(res.Body).Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusServiceUnavailable || h.Status != "draining" {
+		t.Errorf("bad status %d (%s)", res.StatusCode, h.Status)
+	}
+	t.Run("Disabled", func(t *testing.T) {
+		s := httptest.NewServer(NewManager(Options{Log: zap.NewNop(), Notifier: notifierFunc(func() {})}))
+		defer s.Close()
+		res, err := s.Client().Post("http://"+s.Listener.Addr().String()+"/drain", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("bad status %d", res.StatusCode)
+		}
+	})
+}
+
+func TestManager_ReloadResult(t *testing.T) {
+	reloads := new(ReloadLog)
+	fail := false
+	notifier := notifierFunc(func() {
+		r := ReloadResult{Time: time.Now(), Changed: []string{"server.realm"}}
+		if fail {
+			r.Error = "failed to parse config"
+		}
+		go reloads.Publish(r)
+	})
+	s := httptest.NewServer(NewManager(Options{
+		Log:      zap.NewNop(),
+		Notifier: notifier,
+		Reloads:  reloads,
+	}))
+	defer s.Close()
+	c := s.Client()
+	get := func(t *testing.T) (int, ReloadResult) {
+		t.Helper()
+		res, err := c.Get("http://" + s.Listener.Addr().String() + "/reload")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var r ReloadResult
+		if err = json.NewDecoder(res.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, r
+	}
+	t.Run("OK", func(t *testing.T) {
+		code, r := get(t)
+		if code != http.StatusOK {
+			t.Errorf("bad status %d", code)
+		}
+		if r.ID != 1 || len(r.Changed) != 1 || r.Changed[0] != "server.realm" {
+			t.Errorf("unexpected result %+v", r)
+		}
+	})
+	t.Run("Error", func(t *testing.T) {
+		fail = true
+		code, r := get(t)
+		if code != http.StatusInternalServerError {
+			t.Errorf("bad status %d", code)
+		}
+		if r.ID != 2 || r.Error == "" {
+			t.Errorf("unexpected result %+v", r)
+		}
+	})
+}
+
+func TestReloadLog_Wait(t *testing.T) {
+	l := new(ReloadLog)
+	if _, ok := l.Wait(0, time.Millisecond); ok {
+		t.Error("should timeout")
+	}
+	l.Publish(ReloadResult{})
+	r, ok := l.Wait(0, time.Millisecond)
+	if !ok || r.ID != 1 {
+		t.Errorf("unexpected result %+v", r)
+	}
+}
+
+func TestManager_CORS(t *testing.T) {
+	s := httptest.NewServer(NewManager(Options{
+		Log:         zap.NewNop(),
+		Notifier:    notifierFunc(func() {}),
+		Token:       "secret",
+		CORSOrigins: []string{"https://dashboard.example.com"},
+	}))
+	defer s.Close()
+	c := s.Client()
+	u := "http://" + s.Listener.Addr().String()
+	do := func(method, path, origin string, h http.Header) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, u+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range h {
+			req.Header[k] = v
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	t.Run("Preflight", func(t *testing.T) {
+		res := do(http.MethodOptions, "/reload", "https://dashboard.example.com", http.Header{
+			"Access-Control-Request-Method": {"POST"},
+		})
+		if res.StatusCode != http.StatusNoContent {
+			t.Errorf("bad status %d", res.StatusCode)
+		}
+		if got := res.Header.Get("Access-Control-Allow-Origin"); got != "https://dashboard.example.com" {
+			t.Errorf("unexpected origin %q", got)
+		}
+		if got := res.Header.Get("Access-Control-Allow-Headers"); got != "Authorization" {
+			t.Errorf("unexpected headers %q", got)
+		}
+	})
+	t.Run("Allowed", func(t *testing.T) {
+		res := do(http.MethodGet, "/healthz", "https://dashboard.example.com", nil)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("bad status %d", res.StatusCode)
+		}
+		if got := res.Header.Get("Access-Control-Allow-Origin"); got != "https://dashboard.example.com" {
+			t.Errorf("unexpected origin %q", got)
+		}
+	})
+	t.Run("Unauthorized", func(t *testing.T) {
+		res := do(http.MethodPost, "/reload", "https://dashboard.example.com", nil)
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("bad status %d", res.StatusCode)
+		}
+	})
+	t.Run("OtherOrigin", func(t *testing.T) {
+		res := do(http.MethodOptions, "/reload", "https://evil.example.com", http.Header{
+			"Access-Control-Request-Method": {"POST"},
+		})
+		if got := res.Header.Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("unexpected origin %q", got)
+		}
+		if res.StatusCode == http.StatusNoContent {
+			t.Error("preflight should not be handled")
+		}
+	})
+	t.Run("Disabled", func(t *testing.T) {
+		m := httptest.NewServer(NewManager(Options{Notifier: notifierFunc(func() {})}))
+		defer m.Close()
+		res, err := m.Client().Get("http://" + m.Listener.Addr().String() + "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Header["Access-Control-Allow-Origin"]) != 0 || len(res.Header["Vary"]) != 0 {
+			t.Errorf("unexpected headers %v", res.Header)
+		}
+	})
+}
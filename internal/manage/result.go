@@ -0,0 +1,67 @@
+package manage
+
+import (
+	"sync"
+	"time"
+)
+
+// ReloadResult is summary of configuration reload.
+type ReloadResult struct {
+	ID      uint64    `json:"id"`
+	Time    time.Time `json:"time"`
+	Changed []string  `json:"changed"`         // changed config keys
+	Error   string    `json:"error,omitempty"` // reload failed if set
+}
+
+// ReloadLog holds result of last reload and allows waiting for the next
+// one. Zero value is ready to use.
+type ReloadLog struct {
+	mux     sync.Mutex
+	last    ReloadResult
+	updated chan struct{} // closed on Publish
+}
+
+// Publish stores r as last reload result, assigning it next ID.
+func (l *ReloadLog) Publish(r ReloadResult) {
+	l.mux.Lock()
+	r.ID = l.last.ID + 1
+	l.last = r
+	if l.updated != nil {
+		close(l.updated)
+		l.updated = nil
+	}
+	l.mux.Unlock()
+}
+
+// Last returns last reload result, ID is zero if there were no reloads.
+func (l *ReloadLog) Last() ReloadResult {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.last
+}
+
+// Wait blocks until reload result with ID greater than after is published
+// or timeout is reached, returning false in later case.
+func (l *ReloadLog) Wait(after uint64, timeout time.Duration) (ReloadResult, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		l.mux.Lock()
+		if l.last.ID > after {
+			r := l.last
+			l.mux.Unlock()
+			return r, true
+		}
+		if l.updated == nil {
+			l.updated = make(chan struct{})
+		}
+		updated := l.updated
+		l.mux.Unlock()
+		select {
+		case <-updated:
+			// Checking again.
+		case <-timer.C:
+			return ReloadResult{}, false
+		}
+	}
+}
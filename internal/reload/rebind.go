@@ -0,0 +1,11 @@
+package reload
+
+import "go.uber.org/zap"
+
+// NewRebindNotifier initializes and returns new notifier for listeners
+// rebind requests.
+func NewRebindNotifier(l *zap.Logger) *Notifier {
+	n := &Notifier{log: l, C: make(chan struct{}, 1)}
+	n.subscribeRebind()
+	return n
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package reload
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func (n *Notifier) subscribeRebind() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		n.log.Info("subscribed to SIGHUP")
+		for range c {
+			n.Notify()
+		}
+	}()
+}
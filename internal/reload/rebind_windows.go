@@ -0,0 +1,6 @@
+package reload
+
+func (n *Notifier) subscribeRebind() {
+	// Not implemented.
+	n.log.Warn("signal-based rebind not supported on Windows")
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"gortc.io/stun"
+
+	"gortc.io/turn"
+)
+
+// alternateServer represents ALTERNATE-SERVER attribute, which is encoded
+// the same way as MAPPED-ADDRESS.
+//
+// See RFC 5389 Section 15.11.
+type alternateServer turn.Addr
+
+// AddTo adds ALTERNATE-SERVER to message.
+func (a *alternateServer) AddTo(m *stun.Message) error {
+	addr := stun.AlternateServer{IP: a.IP, Port: a.Port}
+	return addr.AddTo(m)
+}
+
+// GetFrom decodes ALTERNATE-SERVER from message.
+func (a *alternateServer) GetFrom(m *stun.Message) error {
+	var addr stun.AlternateServer
+	if err := addr.GetFrom(m); err != nil {
+		return err
+	}
+	a.IP = addr.IP
+	a.Port = addr.Port
+	return nil
+}
+
+func (a alternateServer) String() string { return turn.Addr(a).String() }
+
+// nextAlternate returns next alternate server from configured list in
+// round-robin order or false if list is empty.
+func (s *Server) nextAlternate(ctx *context) (alternateServer, bool) {
+	servers := ctx.cfg.alternateServers
+	if len(servers) == 0 {
+		return alternateServer{}, false
+	}
+	i := atomic.AddUint32(&s.alternateIdx, 1)
+	return alternateServer(servers[int(i%uint32(len(servers)))]), true
+}
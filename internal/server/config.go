@@ -1,41 +1,115 @@
 package server
 
 import (
+	"net"
 	"time"
 
 	"gortc.io/stun"
 
+	"gortc.io/gortcd/internal/dgram"
 	"gortc.io/gortcd/internal/filter"
+	"gortc.io/turn"
 )
 
 type config struct {
-	realm           stun.Realm
-	maxLifetime     time.Duration
-	defaultLifetime time.Duration
-	workers         int
-	authForSTUN     bool
-	debugCollect    bool
-	software        stun.Software
-	peerFilter      filter.Rule
-	clientFilter    filter.Rule
-	metrics         metrics
-	metricsEnabled  bool
+	realm            stun.Realm
+	maxLifetime      time.Duration
+	defaultLifetime  time.Duration
+	workers          int
+	authForSTUN      bool
+	debugCollect     bool
+	software         stun.Software
+	peerFilter       filter.Rule
+	clientFilter     filter.Rule
+	userFilter       filter.UserRule
+	metrics          metrics
+	metricsEnabled   bool
+	alternateServers []turn.Addr
+	secondary        turn.Addr
+	externalIP       net.IP
+	natMap           []NATMapping
+	realmQuotas      map[string]int
+	realmSoftware    map[string]stun.Software
+	maxIndication    int
+	maxRequest       int
+	bindingRateLimit int
+	rateLimitPrefix  int // IPv4 prefix length of rate limited network
+	rateLimitPrefix6 int // IPv6 prefix length of rate limited network
+	allocateMapped   bool
+	noFingerprint    bool
+	quirks           []Quirk
+	dataIndications  bool
+	rejectEvenPort   bool
+	transports       []turn.Protocol // allowed, only UDP if nil
+	dump             bool
+	workerAttempts   int
+	workerBackoff    time.Duration
 }
 
 var metricsNoop = noopMetrics{}
 
+// Allocation lifetime bounds as recommended in RFC 5766 Section 2.2.
+const (
+	defaultLifetime    = time.Minute * 10
+	defaultMaxLifetime = time.Hour
+)
+
+const (
+	defaultWorkerAttempts = 7
+	defaultWorkerBackoff  = time.Millisecond * 300
+)
+
 func (s *Server) newConfig(options Options) config {
 	cfg := config{
-		maxLifetime:     time.Hour,
-		defaultLifetime: time.Minute,
-		workers:         options.Workers,
-		authForSTUN:     options.AuthForSTUN,
-		software:        stun.NewSoftware(options.Software),
-		clientFilter:    options.ClientRule,
-		peerFilter:      options.PeerRule,
-		realm:           stun.NewRealm(options.Realm),
-		debugCollect:    options.DebugCollect,
-		metrics:         metricsNoop,
+		maxLifetime:      options.MaxLifetime,
+		defaultLifetime:  options.DefaultLifetime,
+		workers:          options.Workers,
+		authForSTUN:      options.AuthForSTUN,
+		software:         s.resolveSoftware(options),
+		clientFilter:     options.ClientRule,
+		peerFilter:       options.PeerRule,
+		userFilter:       options.UserRule,
+		realm:            s.resolveRealm(options),
+		debugCollect:     options.DebugCollect,
+		metrics:          metricsNoop,
+		alternateServers: options.AlternateServers,
+		secondary:        options.SecondaryAddr,
+		externalIP:       options.RelayExternalIP,
+		natMap:           options.NATMap,
+		realmQuotas:      options.RealmQuotas,
+		realmSoftware:    newRealmSoftware(options.RealmSoftware),
+		maxIndication:    options.MaxIndicationSize,
+		maxRequest:       options.MaxRequestSize,
+		bindingRateLimit: options.BindingRateLimit,
+		rateLimitPrefix:  options.RateLimitPrefix,
+		rateLimitPrefix6: options.RateLimitPrefix6,
+		allocateMapped:   options.AllocateMapped,
+		noFingerprint:    options.DisableFingerprint,
+		quirks:           options.Quirks,
+		transports:       options.AllowedTransports,
+		dataIndications:  options.DataIndications,
+		rejectEvenPort:   options.RejectEvenPort,
+		dump:             options.DumpPackets,
+		workerAttempts:   options.WorkerAttempts,
+		workerBackoff:    options.WorkerBackoff,
+	}
+	if cfg.maxLifetime == 0 {
+		cfg.maxLifetime = defaultMaxLifetime
+	}
+	if cfg.defaultLifetime == 0 {
+		cfg.defaultLifetime = defaultLifetime
+	}
+	if cfg.defaultLifetime > cfg.maxLifetime {
+		cfg.defaultLifetime = cfg.maxLifetime
+	}
+	if cfg.userFilter == nil {
+		cfg.userFilter = filter.AllowAllUsers
+	}
+	if cfg.workerAttempts <= 0 {
+		cfg.workerAttempts = defaultWorkerAttempts
+	}
+	if cfg.workerBackoff <= 0 {
+		cfg.workerBackoff = defaultWorkerBackoff
 	}
 	if options.MetricsEnabled {
 		cfg.metrics = s.promMetrics
@@ -43,6 +117,148 @@ func (s *Server) newConfig(options Options) config {
 	return cfg
 }
 
+// resolveRealm returns realm that should be advertised by server,
+// using first matching ListenerRealm or default Realm.
+func (s *Server) resolveRealm(options Options) stun.Realm {
+	for _, r := range options.ListenerRealms {
+		if r.match(s.addr) {
+			return stun.NewRealm(r.Realm)
+		}
+	}
+	return stun.NewRealm(options.Realm)
+}
+
+// allocationLifetime returns lifetime of new allocation for requested
+// one, that is clamped to [defaultLifetime, maxLifetime] as described in
+// RFC 5766 Section 6.2.
+func (c config) allocationLifetime(requested time.Duration) time.Duration {
+	if requested < c.defaultLifetime {
+		return c.defaultLifetime
+	}
+	if requested > c.maxLifetime {
+		return c.maxLifetime
+	}
+	return requested
+}
+
+// quirk returns first quirk that matches SOFTWARE of m, zero value if
+// there is no match or m has no SOFTWARE.
+func (c config) quirk(m *stun.Message) Quirk {
+	if len(c.quirks) == 0 {
+		// Fast path, quirks are disabled by default.
+		return Quirk{}
+	}
+	software, err := m.Get(stun.AttrSoftware)
+	if err != nil {
+		return Quirk{}
+	}
+	for _, q := range c.quirks {
+		if q.match(software) {
+			return q
+		}
+	}
+	return Quirk{}
+}
+
+// mapped returns addr translated via first matching NAT mapping, or addr
+// itself if none matches.
+func (c config) mapped(addr turn.Addr) turn.Addr {
+	for _, m := range c.natMap {
+		if m.Private.Equal(addr.IP) {
+			return turn.Addr{IP: m.Public, Port: addr.Port}
+		}
+	}
+	return addr
+}
+
+// resolveServices returns services that should be served on addr, using
+// first matching ListenerServices or all services.
+func resolveServices(options Options, addr turn.Addr) Service {
+	for _, l := range options.ListenerServices {
+		if l.match(addr) {
+			return l.Services
+		}
+	}
+	return ServiceAll
+}
+
+// resolveName returns name of listener on localAddr that is used in metrics
+// labels, using first matching ListenerName or listener address.
+func resolveName(options Options, localAddr net.Addr) string {
+	var addr turn.Addr
+	switch a := localAddr.(type) {
+	case *net.UDPAddr:
+		addr = turn.Addr{IP: a.IP, Port: a.Port}
+	case *net.TCPAddr:
+		addr = turn.Addr{IP: a.IP, Port: a.Port}
+	case *dgram.Addr:
+		addr = turn.Addr{IP: a.IP, Port: a.Port}
+	}
+	for _, l := range options.ListenerNames {
+		if l.match(addr) {
+			return l.Name
+		}
+	}
+	return localAddr.String()
+}
+
+// transportAllowed reports whether allocations with relay protocol p
+// are allowed.
+func (c config) transportAllowed(p turn.Protocol) bool {
+	if c.transports == nil {
+		return p == turn.ProtoUDP
+	}
+	for _, allowed := range c.transports {
+		if allowed == p {
+			return true
+		}
+	}
+	return false
+}
+
+// newRealmSoftware returns SOFTWARE attributes keyed by realm.
+func newRealmSoftware(software map[string]string) map[string]stun.Software {
+	if len(software) == 0 {
+		return nil
+	}
+	m := make(map[string]stun.Software, len(software))
+	for realm, v := range software {
+		m[realm] = stun.NewSoftware(v)
+	}
+	return m
+}
+
+// resolveSoftware returns SOFTWARE attribute that should be sent by server,
+// using first matching ListenerSoftware or default Software.
+func (s *Server) resolveSoftware(options Options) stun.Software {
+	for _, l := range options.ListenerSoftware {
+		if l.match(s.addr) {
+			return stun.NewSoftware(l.Software)
+		}
+	}
+	return stun.NewSoftware(options.Software)
+}
+
 type metrics interface {
 	incSTUNMessages()
+	incStaleNonce()
+	incRateLimited()
+	incMalformedChannelData()
+	incPeerFiltered()
+	incOversized()
+	incAllocationFailure(reason allocationFailure)
+	observePrune(d time.Duration)
 }
+
+// allocationFailure is reason of failed Allocate request, as in label of
+// gortcd_allocation_failures_total.
+type allocationFailure string
+
+// Reasons of allocation failures, mapped from error responses.
+const (
+	allocationMismatch    allocationFailure = "mismatch"     // 437
+	allocationQuota       allocationFailure = "quota"        // 486
+	allocationCapacity    allocationFailure = "capacity"     // 508
+	allocationServerError allocationFailure = "server_error" // 500
+	allocationFamily      allocationFailure = "family"       // 440
+)
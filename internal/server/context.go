@@ -1,10 +1,14 @@
 package server
 
 import (
+	"encoding/binary"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
 	"gortc.io/stun"
 
 	"gortc.io/gortcd/internal/filter"
@@ -45,18 +49,42 @@ type context struct {
 	cdata     *turn.ChannelData
 	nonce     stun.Nonce
 	realm     stun.Realm
+	username  stun.Username // set if request is authenticated
 	integrity stun.MessageIntegrity
-	buf       []byte // buf request
+	buf       []byte         // buf request
+	stream    *streamConn    // connection of request received via stream
+	bound     *tcpConnection // peer connection bound by ConnectionBind
+
+	// Attributes of success responses. Setters are passed to build by
+	// pointer, so storing them in pooled context instead of stack
+	// prevents allocation on every request.
+	mapped   turn.Addr
+	relayed  turn.Addr
+	relayed6 turn.Addr // IPv6 relayed address of dual allocation
+	lifetime turn.Lifetime
 }
 
-func (c *context) allowPeer(addr turn.Addr) bool {
-	return c.cfg.peerFilter.Action(addr) == filter.Allow
+func (c *context) peerAction(addr turn.Addr) filter.Action {
+	return c.cfg.peerFilter.Action(addr)
 }
 
 func (c *context) allowClient(addr turn.Addr) bool {
 	return c.cfg.clientFilter.Action(addr) == filter.Allow
 }
 
+func (c *context) userAction(username string) filter.Action {
+	return c.cfg.userFilter.Action(username)
+}
+
+// userFields appends username and realm of authenticated request to
+// fields, so logs can be correlated with credentials.
+func (c *context) userFields(fields ...zap.Field) []zap.Field {
+	if len(c.username) == 0 {
+		return fields
+	}
+	return append(fields, zap.Stringer("username", c.username), zap.Stringer("realm", c.realm))
+}
+
 func (c *context) setTuple() {
 	c.tuple.Proto = c.proto
 	c.tuple.Client = c.client
@@ -66,6 +94,8 @@ func (c *context) setTuple() {
 func (c *context) reset() {
 	c.addr = nil
 	c.conn = nil
+	c.stream = nil
+	c.bound = nil
 	c.cfg = config{}
 	c.time = time.Time{}
 	c.client = turn.Addr{}
@@ -77,7 +107,12 @@ func (c *context) reset() {
 	c.setTuple()
 	c.nonce = c.nonce[:0]
 	c.realm = c.realm[:0]
+	c.username = c.username[:0]
 	c.integrity = nil
+	c.mapped = turn.Addr{}
+	c.relayed = turn.Addr{}
+	c.relayed6 = turn.Addr{}
+	c.lifetime = turn.Lifetime{}
 	c.buf = c.buf[:cap(c.buf)]
 	for i := range c.buf {
 		c.buf[i] = 0
@@ -101,6 +136,15 @@ func (c *context) buildOk(s ...stun.Setter) error {
 	return c.build(stun.ClassSuccessResponse, c.request.Type.Method, s...)
 }
 
+// software returns SOFTWARE attribute of response, preferring one that
+// is configured for realm of request.
+func (c *context) software() stun.Software {
+	if software, ok := c.cfg.realmSoftware[string(c.realm)]; ok {
+		return software
+	}
+	return c.cfg.software
+}
+
 func (c *context) build(class stun.MessageClass, method stun.Method, s ...stun.Setter) error {
 	if c.request.Type.Class == stun.ClassIndication {
 		// No responses for indication.
@@ -113,21 +157,144 @@ func (c *context) build(class stun.MessageClass, method stun.Method, s ...stun.S
 	}
 	c.response.TransactionID = c.request.TransactionID
 	c.response.WriteHeader()
-	if err := c.apply(&c.nonce, &c.realm); err != nil {
-		return err
+	// Zero-length NONCE and REALM are not valid, so adding them only when
+	// set, e.g. not for early errors or unauthenticated requests.
+	if len(c.nonce) > 0 {
+		if err := c.nonce.AddTo(c.response); err != nil {
+			return err
+		}
 	}
-	if len(c.cfg.software) > 0 {
-		if err := c.cfg.software.AddTo(c.response); err != nil {
+	if len(c.realm) > 0 {
+		if err := c.realm.AddTo(c.response); err != nil {
+			return err
+		}
+	}
+	q := c.cfg.quirk(c.request)
+	if method == stun.MethodBinding && !q.NoResponseOrigin && len(c.server.IP) > 0 && !c.server.IP.IsUnspecified() {
+		if err := (*responseOrigin)(&c.server).AddTo(c.response); err != nil {
+			return err
+		}
+	}
+	software := c.software()
+	if len(software) > 0 && !q.SoftwareLast {
+		if err := software.AddTo(c.response); err != nil {
 			return err
 		}
 	}
 	if err := c.apply(s...); err != nil {
 		return err
 	}
+	if len(software) > 0 && q.SoftwareLast {
+		if err := software.AddTo(c.response); err != nil {
+			return err
+		}
+	}
 	if len(c.integrity) > 0 {
 		if err := c.integrity.AddTo(c.response); err != nil {
 			return err
 		}
 	}
+	if c.cfg.noFingerprint || q.NoFingerprint {
+		// FINGERPRINT is optional for responses, see RFC 5389 Section 7.3.
+		return nil
+	}
 	return stun.Fingerprint.AddTo(c.response)
 }
+
+// addMappedAddressAs adds attribute t with addr that is encoded the same
+// way as MAPPED-ADDRESS.
+//
+// See RFC 5389 Section 15.1.
+func addMappedAddressAs(m *stun.Message, t stun.AttrType, addr turn.Addr) error {
+	var (
+		family = addrFamilyIPv4
+		ip     = addr.IP.To4()
+	)
+	if ip == nil {
+		family = addrFamilyIPv6
+		if ip = addr.IP.To16(); ip == nil {
+			return stun.ErrBadIPLength
+		}
+	}
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port))
+	copy(value[4:], ip)
+	m.Add(t, value)
+	return nil
+}
+
+// attrResponseOrigin is RESPONSE-ORIGIN attribute type.
+const attrResponseOrigin stun.AttrType = 0x802b
+
+// responseOrigin represents RESPONSE-ORIGIN attribute, which is encoded
+// the same way as MAPPED-ADDRESS.
+//
+// See RFC 5780 Section 7.3.
+type responseOrigin turn.Addr
+
+// AddTo adds RESPONSE-ORIGIN to message.
+func (a *responseOrigin) AddTo(m *stun.Message) error {
+	return addMappedAddressAs(m, attrResponseOrigin, turn.Addr(*a))
+}
+
+// attrChangedAddress is CHANGED-ADDRESS attribute type from RFC 3489,
+// that was replaced by OTHER-ADDRESS in RFC 5780.
+const attrChangedAddress stun.AttrType = 0x0005
+
+// changedAddress represents CHANGED-ADDRESS attribute, which is encoded
+// the same way as MAPPED-ADDRESS.
+//
+// See RFC 3489 Section 11.2.3.
+type changedAddress turn.Addr
+
+// AddTo adds CHANGED-ADDRESS to message.
+func (a *changedAddress) AddTo(m *stun.Message) error {
+	return addMappedAddressAs(m, attrChangedAddress, turn.Addr(*a))
+}
+
+// attrAdditionalAddressFamily is ADDITIONAL-ADDRESS-FAMILY attribute type,
+// used to request dual allocation.
+//
+// See RFC 8656 Section 18.11.
+const attrAdditionalAddressFamily stun.AttrType = 0x8000
+
+// Address families of ADDITIONAL-ADDRESS-FAMILY.
+const (
+	addrFamilyIPv4 byte = 0x01
+	addrFamilyIPv6 byte = 0x02
+)
+
+// optionalRelayedAddress is XOR-RELAYED-ADDRESS that is added to message
+// only if set, e.g. IPv6 relayed address of dual allocation.
+type optionalRelayedAddress turn.Addr
+
+// AddTo adds XOR-RELAYED-ADDRESS to message if address is set.
+func (a *optionalRelayedAddress) AddTo(m *stun.Message) error {
+	if a.IP == nil {
+		return nil
+	}
+	return (*turn.RelayedAddress)(a).AddTo(m)
+}
+
+// getAddressFamily returns family from ADDITIONAL-ADDRESS-FAMILY or
+// REQUESTED-ADDRESS-FAMILY attribute t of m.
+func getAddressFamily(m *stun.Message, t stun.AttrType) (byte, error) {
+	v, err := m.Get(t)
+	if err != nil {
+		return 0, err
+	}
+	if len(v) != 4 {
+		return 0, errors.Errorf("bad %s length", t)
+	}
+	// Family is followed by 3 reserved bytes.
+	return v[0], nil
+}
+
+// addrFamily returns address family of ip.
+func addrFamily(ip net.IP) byte {
+	if ip.To4() != nil {
+		return addrFamilyIPv4
+	}
+	return addrFamilyIPv6
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gortc.io/stun"
+
+	"gortc.io/gortcd/internal/dgram"
+)
+
+// pipeSession is dgram.Session that reads from in and writes to out.
+type pipeSession struct {
+	in     chan []byte
+	out    chan []byte
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (s *pipeSession) ReadMessage() ([]byte, error) {
+	select {
+	case b := <-s.in:
+		return b, nil
+	case <-s.closed:
+		return nil, errors.New("closed")
+	}
+}
+
+func (s *pipeSession) WriteMessage(b []byte) error {
+	s.out <- append([]byte{}, b...)
+	return nil
+}
+
+func (s *pipeSession) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+func TestServer_ServeDgram(t *testing.T) {
+	c := dgram.New(&dgram.Addr{Net: "quic", IP: net.IPv4(127, 0, 0, 1), Port: 3478}, nil)
+	s, err := New(Options{
+		Log:         zap.NewNop(),
+		Conn:        c,
+		ManualStart: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.network() != "quic" {
+		t.Errorf("unexpected network %q", s.network())
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if serveErr := s.Serve(); serveErr != nil {
+			t.Error(serveErr)
+		}
+	}()
+	defer func() {
+		if closeErr := s.Close(); closeErr != nil {
+			t.Error(closeErr)
+		}
+		<-done
+	}()
+	var (
+		client  = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+		session = &pipeSession{
+			in:     make(chan []byte, 1),
+			out:    make(chan []byte, 1),
+			closed: make(chan struct{}),
+		}
+	)
+	c.Add(client, session)
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	session.in <- req.Raw
+	var res *stun.Message
+	select {
+	case b := <-session.out:
+		res = &stun.Message{Raw: b}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out")
+	}
+	if err = res.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	if res.Type != stun.BindingSuccess || res.TransactionID != req.TransactionID {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	var mapped stun.XORMappedAddress
+	if err = mapped.GetFrom(res); err != nil {
+		t.Fatal(err)
+	}
+	if !mapped.IP.Equal(client.IP) || mapped.Port != client.Port {
+		t.Errorf("unexpected mapped address %s", mapped)
+	}
+}
@@ -0,0 +1,10 @@
+package server
+
+import "strings"
+
+// isErrConnClosedString reports whether err is "use of closed network
+// connection" error by its text, for errors that are not wrapping
+// net.ErrClosed, e.g. on go1.15 and older.
+func isErrConnClosedString(err error) bool {
+	return strings.HasSuffix(err.Error(), "use of closed network connection")
+}
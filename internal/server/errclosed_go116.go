@@ -0,0 +1,15 @@
+//go:build go1.16
+// +build go1.16
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// isErrConnClosed reports whether err is caused by using closed
+// connection.
+func isErrConnClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed) || isErrConnClosedString(err)
+}
@@ -0,0 +1,8 @@
+//go:build !go1.16
+// +build !go1.16
+
+package server
+
+// isErrConnClosed reports whether err is caused by using closed
+// connection.
+func isErrConnClosed(err error) bool { return isErrConnClosedString(err) }
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestIsErrConnClosed(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, readErr := conn.ReadFrom(make([]byte, 10))
+	if readErr == nil {
+		t.Fatal("read from closed conn should fail")
+	}
+	for _, tc := range []struct {
+		name   string
+		err    error
+		closed bool
+	}{
+		{name: "Read", err: readErr, closed: true},
+		{name: "Close", err: conn.Close(), closed: true},
+		{name: "Wrapped", err: fmt.Errorf("failed to write: %w", readErr), closed: true},
+		{name: "Text", err: errors.New("write udp: use of closed network connection"), closed: true},
+		{name: "Other", err: errors.New("connection refused"), closed: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isErrConnClosed(tc.err); got != tc.closed {
+				t.Errorf("isErrConnClosed(%v) = %v", tc.err, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"gortc.io/stun"
+)
+
+const rateLimitShards = 64
+
+// rateLimiter implements token bucket rate limiting keyed by IP address.
+//
+// Buckets are sharded to reduce lock contention between workers.
+type rateLimiter struct {
+	shards [rateLimitShards]rateLimitShard
+}
+
+type rateLimitShard struct {
+	mux     sync.Mutex
+	buckets map[[net.IPv6len]byte]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	l := &rateLimiter{}
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[[net.IPv6len]byte]*tokenBucket)
+	}
+	return l
+}
+
+func (l *rateLimiter) shard(k [net.IPv6len]byte) *rateLimitShard {
+	return &l.shards[int(k[net.IPv6len-1]^k[net.IPv6len-2])%rateLimitShards]
+}
+
+// allow reports whether packet from ip is allowed at t with rate limit of
+// pps packets per second. Burst is equal to pps.
+func (l *rateLimiter) allow(ip net.IP, t time.Time, pps int) bool {
+	var k [net.IPv6len]byte
+	copy(k[:], ip.To16())
+	s := l.shard(k)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	b, ok := s.buckets[k]
+	if !ok {
+		b = &tokenBucket{tokens: float64(pps), last: t}
+		s.buckets[k] = b
+	}
+	if elapsed := t.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * float64(pps)
+		b.last = t
+	}
+	if b.tokens > float64(pps) {
+		b.tokens = float64(pps)
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimitNet returns network of ip with prefix of bits length for IPv4
+// or bits6 length for IPv6 addresses, so all addresses of network share
+// single bucket. Address is returned as is if prefix length is zero.
+func rateLimitNet(ip net.IP, bits, bits6 int) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		if bits == 0 {
+			return ip
+		}
+		return ip4.Mask(net.CIDRMask(bits, 8*net.IPv4len))
+	}
+	if bits6 == 0 {
+		return ip
+	}
+	return ip.Mask(net.CIDRMask(bits6, 8*net.IPv6len))
+}
+
+// prune removes buckets that were not used since t.
+func (l *rateLimiter) prune(t time.Time) {
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.mux.Lock()
+		for k, b := range s.buckets {
+			if b.last.Before(t) {
+				delete(s.buckets, k)
+			}
+		}
+		s.mux.Unlock()
+	}
+}
+
+// isBindingRequest reports whether raw looks like STUN Binding request.
+func isBindingRequest(raw []byte) bool {
+	if !stun.IsMessage(raw) {
+		return false
+	}
+	return binary.BigEndian.Uint16(raw[0:2]) == stun.BindingRequest.Value()
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gortc.io/stun"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var (
+		l   = newRateLimiter()
+		now = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+		a   = net.IPv4(127, 0, 0, 1)
+		b   = net.IPv4(127, 0, 0, 2)
+	)
+	for i := 0; i < 10; i++ {
+		if !l.allow(a, now, 10) {
+			t.Fatalf("packet %d should be allowed", i)
+		}
+	}
+	if l.allow(a, now, 10) {
+		t.Error("packet should be limited")
+	}
+	if !l.allow(b, now, 10) {
+		t.Error("other ip should not be limited")
+	}
+	if !l.allow(a, now.Add(time.Millisecond*100), 10) {
+		t.Error("token should be added")
+	}
+	if l.allow(a, now.Add(time.Millisecond*100), 10) {
+		t.Error("packet should be limited")
+	}
+	l.prune(now.Add(time.Second))
+	for i := range l.shards {
+		if len(l.shards[i].buckets) != 0 {
+			t.Error("buckets should be pruned")
+		}
+	}
+}
+
+func TestRateLimiter_Prefix(t *testing.T) {
+	var (
+		l   = newRateLimiter()
+		now = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+		a   = rateLimitNet(net.IPv4(192, 0, 2, 1), 24, 64)
+		b   = rateLimitNet(net.IPv4(192, 0, 2, 200), 24, 64)
+		c   = rateLimitNet(net.IPv4(192, 0, 3, 1), 24, 64)
+	)
+	for i := 0; i < 5; i++ {
+		if !l.allow(a, now, 10) || !l.allow(b, now, 10) {
+			t.Fatalf("packet %d should be allowed", i)
+		}
+	}
+	if l.allow(b, now, 10) {
+		t.Error("addresses of same network should share bucket")
+	}
+	if !l.allow(c, now, 10) {
+		t.Error("other network should not be limited")
+	}
+}
+
+func TestRateLimitNet(t *testing.T) {
+	for _, tc := range []struct {
+		ip          string
+		bits, bits6 int
+		out         string
+	}{
+		{"192.0.2.33", 0, 0, "192.0.2.33"},
+		{"192.0.2.33", 24, 0, "192.0.2.0"},
+		{"192.0.2.33", 16, 64, "192.0.0.0"},
+		{"::ffff:192.0.2.33", 24, 64, "192.0.2.0"},
+		{"2001:db8:1:2:3::1", 24, 0, "2001:db8:1:2:3::1"},
+		{"2001:db8:1:2:3::1", 0, 64, "2001:db8:1:2::"},
+		{"2001:db8:1:2:3::1", 24, 48, "2001:db8:1::"},
+	} {
+		got := rateLimitNet(net.ParseIP(tc.ip), tc.bits, tc.bits6)
+		if !got.Equal(net.ParseIP(tc.out)) {
+			t.Errorf("%s /%d /%d: %s (got) != %s (expected)", tc.ip, tc.bits, tc.bits6, got, tc.out)
+		}
+	}
+}
+
+func TestIsBindingRequest(t *testing.T) {
+	if !isBindingRequest(stun.MustBuild(stun.TransactionID, stun.BindingRequest).Raw) {
+		t.Error("should be binding request")
+	}
+	if isBindingRequest(stun.MustBuild(stun.TransactionID, stun.BindingSuccess).Raw) {
+		t.Error("should not be binding request")
+	}
+	if isBindingRequest([]byte{1, 2, 3}) {
+		t.Error("should not be binding request")
+	}
+}
@@ -3,6 +3,8 @@ package server
 import (
 	"sync"
 	"sync/atomic"
+
+	"gortc.io/turn"
 )
 
 // Updater handles options update.
@@ -10,6 +12,7 @@ type Updater struct {
 	v         atomic.Value
 	mux       sync.RWMutex
 	listeners []*Server
+	draining  bool
 }
 
 // Get returns current options.
@@ -30,13 +33,85 @@ func (u *Updater) Set(o Options) {
 // Subscribe adds server to listeners.
 func (u *Updater) Subscribe(s *Server) {
 	u.mux.Lock()
+	// Listeners that are started during drain, e.g. on rebind, should
+	// not accept allocations too.
+	s.setDraining(u.draining)
 	u.listeners = append(u.listeners, s)
 	u.mux.Unlock()
 }
 
+// Drain makes all listeners reject new allocations, redirecting clients to
+// alternate servers if configured. Existing allocations are kept until
+// expired, so server can be gracefully rotated.
+func (u *Updater) Drain() {
+	u.mux.Lock()
+	u.draining = true
+	for _, s := range u.listeners {
+		s.setDraining(true)
+	}
+	u.mux.Unlock()
+}
+
+// Draining reports whether Drain was called.
+func (u *Updater) Draining() bool {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+	return u.draining
+}
+
 // NewUpdater initializes new updater from options.
 func NewUpdater(o Options) *Updater {
 	u := &Updater{}
 	u.v.Store(o)
 	return u
 }
+
+// Allocations returns total allocations count of all listeners.
+func (u *Updater) Allocations() int {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+	n := 0
+	for _, s := range u.listeners {
+		n += s.allocs.Stats().Allocations
+	}
+	return n
+}
+
+// Closing reports whether any of listeners is shutting down.
+func (u *Updater) Closing() bool {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+	for _, s := range u.listeners {
+		if s.closing() {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop closes and unsubscribes all listeners that are serving on addr
+// via network ("udp", "tcp", "tls", "quic", "ws" or "wss"), returning
+// count of stopped listeners.
+// Other listeners and their allocations are not affected.
+func (u *Updater) Stop(network string, addr turn.Addr) (int, error) {
+	u.mux.Lock()
+	var (
+		stopped []*Server
+		keep    = u.listeners[:0]
+	)
+	for _, s := range u.listeners {
+		if s.network() == network && s.addr.Equal(addr) {
+			stopped = append(stopped, s)
+			continue
+		}
+		keep = append(keep, s)
+	}
+	u.listeners = keep
+	u.mux.Unlock()
+	for _, s := range stopped {
+		if err := s.Close(); err != nil {
+			return len(stopped), err
+		}
+	}
+	return len(stopped), nil
+}
@@ -1,6 +1,14 @@
 package server
 
-import "testing"
+import (
+	"net"
+	"testing"
+
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+)
 
 func TestNewUpdater(t *testing.T) {
 	opt := Options{
@@ -27,3 +35,121 @@ func TestNewUpdater(t *testing.T) {
 		t.Error("options mismatch")
 	}
 }
+
+func TestUpdater_MetricsEnabled(t *testing.T) {
+	opt := Options{Realm: "realm"}
+	server, stop := newServer(t, opt)
+	defer stop()
+	u := NewUpdater(opt)
+	u.Subscribe(server)
+	c := newTestClient(t, server, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	binding := func() {
+		c.process(stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint))
+	}
+	count := func() float64 { return promtest.ToFloat64(server.promMetrics.stunMessages) }
+	binding()
+	if v := count(); v != 0 {
+		t.Errorf("metrics are disabled, but counted %v", v)
+	}
+	// Hot path uses live config, so toggling takes effect immediately.
+	opt.MetricsEnabled = true
+	u.Set(opt)
+	binding()
+	binding()
+	if v := count(); v != 2 {
+		t.Errorf("unexpected count %v", v)
+	}
+	opt.MetricsEnabled = false
+	u.Set(opt)
+	binding()
+	if v := count(); v != 2 {
+		t.Errorf("metrics are disabled, but counted %v", v)
+	}
+}
+
+func TestUpdater_Drain(t *testing.T) {
+	alternate := turn.Addr{IP: net.IPv4(127, 0, 0, 2), Port: 3478}
+	opt := Options{Realm: "realm"}
+	server, stop := newServer(t, opt)
+	defer stop()
+	u := NewUpdater(opt)
+	u.Subscribe(server)
+	existing := newTestClient(t, server, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	if res := existing.do(turn.AllocateRequest, turn.RequestedTransportUDP); res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	u.Drain()
+	if !u.Draining() {
+		t.Error("should be draining")
+	}
+	c := newTestClient(t, server, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34568})
+	if code := errorCode(c.do(turn.AllocateRequest, turn.RequestedTransportUDP)); code != stun.CodeAllocQuotaReached {
+		t.Errorf("unexpected code %d", code)
+	}
+	// Existing allocation is still served.
+	if res := existing.do(turn.RefreshRequest); res.Type.Class != stun.ClassSuccessResponse {
+		t.Errorf("unexpected response: %s", res)
+	}
+	peer := turn.PeerAddress{IP: net.IPv4(127, 0, 0, 1), Port: 34569}
+	if res := existing.do(turn.CreatePermissionRequest, peer); res.Type.Class != stun.ClassSuccessResponse {
+		t.Errorf("unexpected response: %s", res)
+	}
+	t.Run("Alternate", func(t *testing.T) {
+		opt.AlternateServers = []turn.Addr{alternate}
+		u.Set(opt)
+		c := newTestClient(t, server, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34570})
+		if code := errorCode(c.do(turn.AllocateRequest, turn.RequestedTransportUDP)); code != stun.CodeTryAlternate {
+			t.Errorf("unexpected code %d", code)
+		}
+	})
+	t.Run("Subscribe", func(t *testing.T) {
+		next, stopNext := newServer(t, opt)
+		defer stopNext()
+		u.Subscribe(next)
+		if !next.isDraining() {
+			t.Error("new listener should be draining")
+		}
+	})
+}
+
+func TestUpdater_Health(t *testing.T) {
+	server, stop := newServer(t)
+	u := NewUpdater(Options{})
+	u.Subscribe(server)
+	if u.Allocations() != 0 {
+		t.Error("unexpected allocations")
+	}
+	if u.Closing() {
+		t.Error("should not be closing")
+	}
+	stop()
+	if !u.Closing() {
+		t.Error("should be closing")
+	}
+}
+
+func TestUpdater_Stop(t *testing.T) {
+	first, stopFirst := newServer(t)
+	defer stopFirst()
+	// Second server is closed by Stop, so its stop func is not used.
+	second, _ := newServer(t)
+	u := NewUpdater(Options{})
+	u.Subscribe(first)
+	u.Subscribe(second)
+	n, err := u.Stop("udp", second.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("unexpected stopped count %d", n)
+	}
+	if !second.closing() {
+		t.Error("second should be closed")
+	}
+	if first.closing() || u.Closing() {
+		t.Error("first should not be closed")
+	}
+	if n, _ = u.Stop("udp", second.addr); n != 0 {
+		t.Errorf("unexpected stopped count %d on second stop", n)
+	}
+}
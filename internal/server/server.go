@@ -1,6 +1,9 @@
 package server
 
 import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
 	"io"
 	"net"
 	"runtime"
@@ -17,6 +20,7 @@ import (
 
 	"gortc.io/gortcd/internal/allocator"
 	"gortc.io/gortcd/internal/auth"
+	"gortc.io/gortcd/internal/dgram"
 	"gortc.io/gortcd/internal/filter"
 	"gortc.io/stun"
 	"gortc.io/turn"
@@ -24,8 +28,11 @@ import (
 
 // Server is RFC 5389 basic server implementation.
 //
-// Current implementation is UDP only and not ALTERNATE-SERVER.
-// It does not support backwards compatibility with RFC 3489.
+// Server reads datagrams from Conn, e.g. UDP, QUIC or WebSocket one,
+// and STUN messages framed over stream connections of Listener (TCP or
+// TLS), also serving TCP allocations (RFC 6062) from them. Clients can
+// be redirected via ALTERNATE-SERVER, and RFC 3489 clients get
+// CHANGED-ADDRESS in Binding responses, see Options.
 type Server struct {
 	addr        turn.Addr
 	conns       []io.Closer
@@ -37,10 +44,26 @@ type Server struct {
 	allocs      *allocator.Allocator
 	close       chan struct{}
 	handlers    map[stun.MessageType]handleFunc
+	services    Service
 	pool        *workerPool
 	wg          sync.WaitGroup
+	serveMux    sync.Mutex // serializes Serve setup with Close
 	reusePort   bool
 	promMetrics *promMetrics
+
+	alternateIdx uint32 // round-robin index for alternate servers
+	draining     int32  // rejecting new allocations if 1, accessed atomically
+	limiter      *rateLimiter
+	queued       int64 // packets waiting for free worker, accessed atomically
+	listenPacket func(network, address string) (net.PacketConn, error)
+
+	listener   net.Listener // STUN over TCP, nil for packet conn
+	streamNet  string       // network name of listener, e.g. "tls"
+	streamsMux sync.Mutex
+	streams    map[net.Conn]struct{}
+	active     int64 // open streams, accessed atomically
+	tcp        *tcpRelay
+	tcpRelayIP net.IP // local address of TCP relayed transport addresses
 }
 
 func (s *Server) config() config { return s.cfg.Load().(config) }
@@ -51,32 +74,266 @@ func (s *Server) config() config { return s.cfg.Load().(config) }
 //	* AuthForSTUN
 //	* Software
 //	* Realm
+//	* ListenerRealms
+//	* ListenerSoftware
+//	* BindingRateLimit
+//	* RateLimitPrefix
+//	* RateLimitPrefix6
+//	* AllocateMapped
+//	* DisableFingerprint
+//	* DumpPackets
+//	* WorkerAttempts
+//	* WorkerBackoff
 //	* PeerRule
 //	* ClientRule
+//	* UserRule
 //	* DebugCollect
 //	* MetricsEnabled
+//	* DefaultLifetime
+//	* MaxLifetime
+//	* AlternateServers
+//	* RealmQuotas
+//	* RealmSoftware
+//	* MaxIndicationSize
+//	* MaxRequestSize
+//	* RelayExternalIP
+//	* NATMap
+//	* SecondaryAddr
+//	* Quirks
+//	* DataIndications
+//	* RejectEvenPort
+//	* AllowedTransports
 func (s *Server) setOptions(opt Options) { s.cfg.Store(s.newConfig(opt)) }
 
 // Options is set of available options for Server.
 type Options struct {
-	Software       string // not adding SOFTWARE attribute if blank
-	Realm          string
-	Auth           Auth // no authentication if nil
-	Conn           net.PacketConn
-	Labels         prometheus.Labels // prometheus labels
-	Registry       MetricsRegistry   // prometheus registry
-	MetricsEnabled bool              // enable prometheus metrics (adds overhead)
-	NonceManager   NonceManager      // optional nonce manager implementation
-	PeerRule       filter.Rule
-	ClientRule     filter.Rule // filtering rule for listeners
-	Log            *zap.Logger
-	CollectRate    time.Duration
-	Workers        int           // maximum workers count
-	NonceDuration  time.Duration // no nonce rotate if 0
-	ManualStart    bool          // don't start bg activity
-	AuthForSTUN    bool          // require auth for binding requests
-	ReusePort      bool          // spawn more sockets on same port if available
-	DebugCollect   bool          // debug collect calls
+	Software        string // not adding SOFTWARE attribute if blank
+	Realm           string
+	Auth            Auth // no authentication if nil
+	Conn            net.PacketConn
+	Listener        net.Listener      // STUN over TCP instead of Conn, only TCP allocations
+	ListenerNetwork string            // network name of Listener, e.g. "tls"; "tcp" if blank
+	Labels          prometheus.Labels // prometheus labels
+	Registry        MetricsRegistry   // prometheus registry
+	MetricsEnabled  bool              // enable prometheus metrics (adds overhead), reloadable
+	NonceManager    NonceManager      // optional nonce manager implementation
+	PeerRule        filter.Rule
+	ClientRule      filter.Rule     // filtering rule for listeners
+	UserRule        filter.UserRule // filtering rule for authenticated usernames
+	Log             *zap.Logger
+	CollectRate     time.Duration // prune rate, 1 second if zero
+	Workers         int           // maximum workers count
+	NonceDuration   time.Duration // no nonce rotate if 0
+	NonceGrace      time.Duration // previous nonce is accepted after rotation
+	ManualStart     bool          // don't start bg activity
+	AuthForSTUN     bool          // require auth for binding requests
+	ReusePort       bool          // spawn more sockets on same port if available
+	DebugCollect    bool          // debug collect calls
+	DefaultLifetime time.Duration // 10 minutes if zero
+	MaxLifetime     time.Duration // upper bound for requested lifetime, 1 hour if zero
+	MaxAllocations  int           // no limit if zero
+	MaxPermissions  int           // per allocation, no limit if zero
+	MaxChannels     int           // channel bindings per allocation, no limit if zero
+	// MaxIndicationSize is maximum DATA length of Send indications, e.g.
+	// to avoid relaying datagrams that exceed MTU; no limit if zero.
+	MaxIndicationSize int
+	// MaxRequestSize is maximum size of received datagram, larger ones
+	// are dropped; no limit if zero.
+	MaxRequestSize int
+	IdleTimeout    time.Duration // remove allocations without relayed data, disabled if zero
+	// RealmQuotas limits allocation count per realm of authenticated
+	// credential, no limit for realms that are not listed.
+	RealmQuotas map[string]int
+	// RealmSoftware overrides Software and ListenerSoftware for realm of
+	// request, that is realm of credential if request is authenticated,
+	// e.g. for white-labeled deployments. Blank value disables SOFTWARE.
+	RealmSoftware map[string]string
+	// AlternateServers are used to redirect clients via 300 (Try Alternate)
+	// when MaxAllocations is reached.
+	AlternateServers []turn.Addr
+	// SecondaryAddr is alternate address of server that is reported via
+	// CHANGED-ADDRESS in Binding responses for RFC 3489 clients, not
+	// reported if zero.
+	SecondaryAddr turn.Addr
+	// ListenerRealms overrides Realm for matching listeners.
+	ListenerRealms []ListenerRealm
+	// ListenerSoftware overrides Software for matching listeners.
+	ListenerSoftware []ListenerSoftware
+	// ListenerServices restricts services of matching listeners, all
+	// services are served by default. Not reloadable.
+	ListenerServices []ListenerServices
+	// ListenerNames overrides listener address in "addr" label of metrics,
+	// metrics of listeners with same name are aggregated. Not reloadable.
+	ListenerNames []ListenerName
+	// BindingRateLimit is maximum rate of Binding requests per second from
+	// single IP address, no limit if zero.
+	BindingRateLimit int
+	// RateLimitPrefix is length of IPv4 network prefix that shares
+	// single rate limit bucket, e.g. 24 to limit whole /24 subnets;
+	// buckets are per address if zero. RateLimitPrefix6 is same for
+	// IPv6 addresses.
+	RateLimitPrefix  int
+	RateLimitPrefix6 int
+	// RelayIP is local address for relayed transport addresses, listener
+	// address is used if nil.
+	RelayIP net.IP
+	// RelayPool is set of local addresses for relayed transport addresses
+	// that are selected with RelayStrategy, overriding RelayIP. Ignored
+	// for allocator.RelayListener strategy. Not reloadable.
+	RelayPool     []net.IP
+	RelayStrategy allocator.RelayStrategy
+	// RelayIP6 is local IPv6 address for IPv6 relayed transport addresses
+	// of dual allocations, that are requested with ADDITIONAL-ADDRESS-FAMILY
+	// and rejected with 440 (Address Family not Supported) if nil. Not
+	// reloadable.
+	RelayIP6 net.IP
+	// SocketBuffers are buffer sizes of Conn and relay sockets, OS
+	// defaults if zero. Not reloadable.
+	SocketBuffers allocator.SocketBuffers
+	// RelayDSCP marks relayed packets with DSCP, e.g. for QoS of media;
+	// not set if zero. Not reloadable.
+	RelayDSCP int
+	// AllowedTransports are REQUESTED-TRANSPORT protocols of allowed
+	// allocations, others are rejected with 442 (Unsupported Transport
+	// Protocol). Only UDP is allowed if nil, allocations are rejected if
+	// empty but not nil. UDP allocations are served by Conn and TCP ones
+	// (RFC 6062) by Listener.
+	AllowedTransports []turn.Protocol
+	// DryRun disables relaying data to peers, it is only logged, e.g. to
+	// audit relay destinations of suspicious clients. Not reloadable and
+	// not for production traffic.
+	DryRun bool
+	// MaxWriteFailures is count of consecutive failed writes to peer after
+	// which its permission is removed, e.g. when peer network is down;
+	// disabled if zero. Not reloadable.
+	MaxWriteFailures int
+	// RelayExternalIP is advertised in RELAYED-ADDRESS instead of local
+	// relay address, e.g. when server is behind 1:1 NAT.
+	RelayExternalIP net.IP
+	// NATMap translates observed client addresses that are reported via
+	// XOR-MAPPED-ADDRESS, e.g. when server is behind asymmetric NAT.
+	NATMap []NATMapping
+	// DumpPackets logs hex of received and sent packets at debug level.
+	// Verbose and can expose credentials, so only for protocol debugging.
+	DumpPackets bool
+	// AllocateMapped adds MAPPED-ADDRESS and RESPONSE-ORIGIN to Allocate
+	// success responses.
+	AllocateMapped bool
+	// RejectEvenPort makes server reject Allocate requests with EVEN-PORT
+	// via 420 (Unknown Attribute) instead of ignoring it, so clients that
+	// expect port pairs can fall back.
+	RejectEvenPort bool
+	// DataIndications makes server relay peer data via Data indications
+	// even if channel is bound, e.g. for clients that fail to process
+	// ChannelData messages.
+	DataIndications bool
+	// DisableFingerprint disables adding FINGERPRINT to responses, e.g.
+	// for legacy clients that fail to parse it.
+	DisableFingerprint bool
+	// Quirks are compatibility workarounds for clients, first one with
+	// matching SOFTWARE of request is applied to response.
+	Quirks []Quirk
+	// WorkerAttempts is count of attempts to find free worker before
+	// dropping packet, 7 if zero.
+	WorkerAttempts int
+	// WorkerBackoff is delay between attempts to find free worker,
+	// blocking the reader, 300ms if zero.
+	WorkerBackoff time.Duration
+	// Events is optional handler for allocation lifecycle events, not
+	// reloadable.
+	Events allocator.EventHandler
+	// PortAllocator allocates relayed transport addresses, ports are
+	// allocated on demand via allocator.SystemPortAllocator if nil.
+	// Can be shared between servers, not reloadable.
+	PortAllocator allocator.NetPortAllocator
+	// RelayReaders reads relay sockets of all allocations with fixed
+	// count of goroutines, each allocation is read by its own goroutine
+	// if nil. Can be shared between servers, not closed by server and
+	// not reloadable.
+	RelayReaders *allocator.ReaderPool
+	// TLS is configuration of listeners that require certificates, e.g.
+	// TLS or QUIC ones. It is not used by server itself; TLS listener
+	// picks up reloaded one for new connections.
+	TLS *tls.Config
+}
+
+// Quirk is compatibility workaround for clients that fail to process
+// valid responses, e.g. legacy ones.
+type Quirk struct {
+	// Software is prefix of SOFTWARE attribute of requests from client.
+	Software string
+	// NoFingerprint disables FINGERPRINT in responses.
+	NoFingerprint bool
+	// NoResponseOrigin disables RESPONSE-ORIGIN in Binding responses.
+	NoResponseOrigin bool
+	// SoftwareLast moves SOFTWARE of server after other attributes,
+	// before MESSAGE-INTEGRITY.
+	SoftwareLast bool
+}
+
+func (q Quirk) match(software []byte) bool {
+	return strings.HasPrefix(string(software), q.Software)
+}
+
+// ListenerRealm is realm that is advertised by listener on Addr.
+// Unspecified IP of Addr matches any listener on Addr.Port.
+type ListenerRealm struct {
+	Addr  turn.Addr
+	Realm string
+}
+
+func (r ListenerRealm) match(addr turn.Addr) bool { return matchListener(r.Addr, addr) }
+
+// ListenerSoftware is SOFTWARE attribute value that is sent by listener on
+// Addr. Unspecified IP of Addr matches any listener on Addr.Port.
+type ListenerSoftware struct {
+	Addr     turn.Addr
+	Software string
+}
+
+func (l ListenerSoftware) match(addr turn.Addr) bool { return matchListener(l.Addr, addr) }
+
+// Service is set of protocols that are served by listener.
+type Service byte
+
+// Possible services.
+const (
+	ServiceSTUN Service = 1 << iota // Binding requests
+	ServiceTURN                     // allocations and relaying
+
+	ServiceAll = ServiceSTUN | ServiceTURN
+)
+
+// ListenerServices restricts services of listener on Addr, e.g. to serve
+// only public STUN. Unspecified IP of Addr matches any listener on Addr.Port.
+type ListenerServices struct {
+	Addr     turn.Addr
+	Services Service
+}
+
+func (l ListenerServices) match(addr turn.Addr) bool { return matchListener(l.Addr, addr) }
+
+// ListenerName is name of listener on Addr that is used in metrics labels.
+// Unspecified IP of Addr matches any listener on Addr.Port.
+type ListenerName struct {
+	Addr turn.Addr
+	Name string
+}
+
+func (l ListenerName) match(addr turn.Addr) bool { return matchListener(l.Addr, addr) }
+
+// matchListener reports whether pattern matches listener address.
+func matchListener(pattern, addr turn.Addr) bool {
+	if pattern.Port != addr.Port {
+		return false
+	}
+	return pattern.IP == nil || pattern.IP.IsUnspecified() || pattern.IP.Equal(addr.IP)
+}
+
+// NATMapping is 1:1 mapping of Private IP to Public one, port is kept.
+type NATMapping struct {
+	Private net.IP
+	Public  net.IP
 }
 
 // Auth represents message authenticator.
@@ -84,11 +341,30 @@ type Auth interface {
 	Auth(m *stun.Message) (stun.MessageIntegrity, error)
 }
 
+// anyRealmAuth is optionally implemented by Auth to report whether
+// request was authenticated by credential that matches any realm, see
+// auth.Static.AuthAnyRealm.
+type anyRealmAuth interface {
+	AuthAnyRealm(m *stun.Message) (stun.MessageIntegrity, bool, error)
+}
+
+// keyCacheStatser is optionally implemented by Auth to expose statistics
+// of long-term key cache as metrics.
+type keyCacheStatser interface {
+	KeyCacheStats() auth.KeyCacheStats
+}
+
 // NonceManager represents nonce manager (rotate and verify).
 type NonceManager interface {
 	Check(tuple turn.FiveTuple, value stun.Nonce, at time.Time) (stun.Nonce, error)
 }
 
+// nonceStatser is optionally implemented by NonceManager to expose
+// statistics as metrics.
+type nonceStatser interface {
+	Stats() auth.NonceStats
+}
+
 // MetricsRegistry represents prometheus metrics registry.
 type MetricsRegistry interface {
 	Register(c prometheus.Collector) error
@@ -108,18 +384,95 @@ func New(o Options) (*Server, error) {
 	if len(o.Labels) == 0 {
 		o.Labels = prometheus.Labels{}
 	}
-	o.Labels["addr"] = o.Conn.LocalAddr().String()
-	netAlloc, err := allocator.NewNetAllocator(o.Log.Named("port"), o.Conn.LocalAddr(), allocator.SystemPortAllocator{})
+	var localAddr net.Addr
+	switch {
+	case o.Conn != nil:
+		localAddr = o.Conn.LocalAddr()
+		o.Labels["addr"] = resolveName(o, localAddr)
+		if a, ok := localAddr.(*dgram.Addr); ok {
+			// Distinguishing from UDP or TCP listener on same address.
+			o.Labels["addr"] = a.Net + "://" + o.Labels["addr"]
+		}
+	case o.Listener != nil:
+		localAddr = o.Listener.Addr()
+		if o.ListenerNetwork == "" {
+			o.ListenerNetwork = "tcp"
+		}
+		// Distinguishing from UDP listener on same address.
+		o.Labels["addr"] = o.ListenerNetwork + "://" + resolveName(o, localAddr)
+	default:
+		return nil, errors.New("no connection or listener")
+	}
+	// Message-oriented connection has no socket of its own.
+	_, messages := localAddr.(*dgram.Addr)
+	if o.Conn != nil && !messages && o.SocketBuffers != (allocator.SocketBuffers{}) {
+		// OS can clamp requested sizes, so logging effective ones.
+		b, err := allocator.SetSocketBuffers(o.Conn, o.SocketBuffers)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to set socket buffers")
+		}
+		o.Log.Info("socket buffers",
+			zap.Stringer("addr", localAddr),
+			zap.Int("rcvbuf", b.Read), zap.Int("sndbuf", b.Write),
+		)
+	}
+	relayAddr := localAddr
+	switch a := localAddr.(type) {
+	case *net.TCPAddr:
+		// Stream listener relays only TCP allocations, but allocator
+		// still requires packet address.
+		relayAddr = &net.UDPAddr{IP: a.IP}
+	case *dgram.Addr:
+		relayAddr = &net.UDPAddr{IP: a.IP}
+	}
+	if o.RelayIP != nil {
+		if err := checkLocalIP(o.RelayIP); err != nil {
+			return nil, errors.Wrap(err, "bad relay address")
+		}
+		relayAddr = &net.UDPAddr{IP: o.RelayIP}
+	}
+	if o.PortAllocator == nil {
+		o.PortAllocator = allocator.SystemPortAllocator{}
+	}
+	relayAddrs := []net.Addr{relayAddr}
+	if o.RelayStrategy != allocator.RelayListener && len(o.RelayPool) > 0 {
+		relayAddrs = relayAddrs[:0]
+		for _, ip := range o.RelayPool {
+			if err := checkLocalIP(ip); err != nil {
+				return nil, errors.Wrap(err, "bad relay pool address")
+			}
+			relayAddrs = append(relayAddrs, &net.UDPAddr{IP: ip})
+		}
+	}
+	netAlloc, err := allocator.NewNetAllocatorPool(o.Log.Named("port"), relayAddrs, o.RelayStrategy, o.PortAllocator)
 	if err != nil {
 		return nil, err
 	}
+	if o.RelayIP6 != nil {
+		if err := checkLocalIP(o.RelayIP6); err != nil {
+			return nil, errors.Wrap(err, "bad IPv6 relay address")
+		}
+		if err := netAlloc.SetIPv6(o.RelayIP6); err != nil {
+			return nil, errors.Wrap(err, "bad IPv6 relay address")
+		}
+	}
 	allocs := allocator.NewAllocator(allocator.Options{
-		Log:    o.Log.Named("allocator"),
-		Conn:   netAlloc,
-		Labels: o.Labels,
+		Log:              o.Log.Named("allocator"),
+		Conn:             netAlloc,
+		Labels:           o.Labels,
+		MaxAllocations:   o.MaxAllocations,
+		MaxPermissions:   o.MaxPermissions,
+		MaxChannels:      o.MaxChannels,
+		IdleTimeout:      o.IdleTimeout,
+		Events:           o.Events,
+		SocketBuffers:    o.SocketBuffers,
+		DSCP:             o.RelayDSCP,
+		DryRun:           o.DryRun,
+		MaxWriteFailures: o.MaxWriteFailures,
+		Readers:          o.RelayReaders,
 	})
 	if o.NonceManager == nil {
-		o.NonceManager = auth.NewNonceAuth(o.NonceDuration)
+		o.NonceManager = auth.NewNonceAuthWithGrace(o.NonceDuration, o.NonceGrace)
 	}
 	if o.PeerRule == nil {
 		o.PeerRule = filter.AllowAll
@@ -128,42 +481,89 @@ func New(o Options) (*Server, error) {
 		o.ClientRule = filter.AllowAll
 	}
 	s := &Server{
-		auth:        o.Auth,
-		nonce:       o.NonceManager,
-		conn:        o.Conn,
-		allocs:      allocs,
-		close:       make(chan struct{}),
-		reusePort:   reuseport.Available() && o.ReusePort,
-		promMetrics: newPromMetrics(o.Labels),
+		auth:         o.Auth,
+		nonce:        o.NonceManager,
+		conn:         o.Conn,
+		listener:     o.Listener,
+		streamNet:    o.ListenerNetwork,
+		streams:      make(map[net.Conn]struct{}),
+		tcp:          newTCPRelay(),
+		allocs:       allocs,
+		close:        make(chan struct{}),
+		reusePort:    reuseport.Available() && o.ReusePort,
+		listenPacket: reuseport.ListenPacket,
+		promMetrics:  newPromMetrics(o.Labels),
+		limiter:      newRateLimiter(),
 	}
-	s.cfg.Store(s.newConfig(o))
-	s.setHandlers()
-	if a, ok := o.Conn.LocalAddr().(*net.UDPAddr); ok {
+	if a, ok := relayAddr.(*net.UDPAddr); ok {
+		s.tcpRelayIP = a.IP
+	}
+	switch a := localAddr.(type) {
+	case *net.UDPAddr:
 		s.addr.IP = a.IP
 		s.addr.Port = a.Port
-	} else {
+	case *net.TCPAddr:
+		s.addr.IP = a.IP
+		s.addr.Port = a.Port
+	case *dgram.Addr:
+		s.addr.IP = a.IP
+		s.addr.Port = a.Port
+	default:
 		return nil, errors.New("unexpected local addr")
 	}
-	s.log = o.Log.With(zap.Stringer("server", s.addr))
-	if !o.ManualStart {
-		s.Start(o.CollectRate)
-	}
 	if o.Registry != nil {
+		// Listeners with same name have same labels, so sharing metrics
+		// with already registered ones.
 		if err := o.Registry.Register(s.allocs); err != nil {
-			return nil, errors.Wrap(err, "failed to register")
+			registered, ok := registeredCollector(err).(*allocator.Allocator)
+			if !ok {
+				return nil, errors.Wrap(err, "failed to register")
+			}
+			registered.Join(s.allocs)
 		}
 		if err := o.Registry.Register(s.promMetrics); err != nil {
-			return nil, errors.Wrap(err, "failed to register server metrics")
+			registered, ok := registeredCollector(err).(*promMetrics)
+			if !ok {
+				return nil, errors.Wrap(err, "failed to register server metrics")
+			}
+			s.promMetrics = registered
 		}
 	}
+	s.cfg.Store(s.newConfig(o))
+	s.services = resolveServices(o, s.addr)
+	s.setHandlers()
+	s.log = o.Log.With(zap.Stringer("server", s.addr))
 	s.pool = &workerPool{
 		Logger:          s.log.Named("pool"),
 		WorkerFunc:      s.serveConn,
 		MaxWorkersCount: o.Workers,
 	}
+	src := metricsSource{workers: s.workerStats, filters: s.filters}
+	if o.Listener != nil {
+		src.connections = s.activeConnections
+	}
+	if n, ok := o.NonceManager.(nonceStatser); ok {
+		src.nonces = n.Stats
+	}
+	if k, ok := o.Auth.(keyCacheStatser); ok {
+		src.keys = k
+	}
+	s.promMetrics.addSource(src)
+	if !o.ManualStart {
+		s.Start(o.CollectRate)
+	}
 	return s, nil
 }
 
+// registeredCollector returns collector that was already registered with
+// same descriptors, or nil if err is not prometheus.AlreadyRegisteredError.
+func registeredCollector(err error) prometheus.Collector {
+	if e, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		return e.ExistingCollector
+	}
+	return nil
+}
+
 // Start starts background activity.
 func (s *Server) Start(rate time.Duration) { s.startCollect(rate) }
 
@@ -191,22 +591,104 @@ func (s *Server) startCollect(rate time.Duration) {
 	}()
 }
 
-func (s *Server) collect(t time.Time) { s.allocs.Prune(t) }
+// checkLocalIP returns error if ip is not assigned to any local interface.
+func checkLocalIP(ip net.IP) error {
+	if ip.IsUnspecified() {
+		return errors.New("unspecified address")
+	}
+	if ip.IsLoopback() {
+		return nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return errors.Errorf("%s is not local address", ip)
+}
+
+func (s *Server) collect(t time.Time) {
+	start := time.Now()
+	s.allocs.Prune(t)
+	if s.listener != nil {
+		s.pruneTCP(t)
+	}
+	// Full bucket is equal to missing one after one second.
+	s.limiter.prune(t.Add(-time.Second))
+	s.config().metrics.observePrune(time.Since(start))
+}
+
+// workerStats returns count of active workers and count of packets that
+// are waiting for free worker.
+func (s *Server) workerStats() (active, queued int) {
+	active, _ = s.pool.stats()
+	return active, int(atomic.LoadInt64(&s.queued))
+}
+
+// activeConnections returns count of open stream connections.
+func (s *Server) activeConnections() int { return int(atomic.LoadInt64(&s.active)) }
+
+// filters returns current client and peer filtering rules.
+func (s *Server) filters() []namedRule {
+	cfg := s.config()
+	return []namedRule{
+		{name: "client", rule: cfg.clientFilter},
+		{name: "peer", rule: cfg.peerFilter},
+	}
+}
+
+// setDraining sets whether new allocations are rejected, see Updater.Drain.
+func (s *Server) setDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&s.draining, v)
+}
+
+// isDraining reports whether new allocations are rejected.
+func (s *Server) isDraining() bool { return atomic.LoadInt32(&s.draining) == 1 }
+
+// closing reports whether Close was called.
+func (s *Server) closing() bool {
+	select {
+	case <-s.close:
+		return true
+	default:
+		return false
+	}
+}
 
 // Close stops background activity.
 func (s *Server) Close() error {
 	// TODO(ar): Free resources.
 	close(s.close)
 	s.log.Debug("closing")
+	// Waiting for Serve to start workers, so they are not added to wait
+	// group after Wait is called.
+	s.serveMux.Lock()
 	s.pool.Stop()
-	if err := s.conn.Close(); err != nil {
-		s.log.Warn("failed to close connection", zap.Error(err))
+	if s.conn != nil {
+		if err := s.conn.Close(); err != nil {
+			s.log.Warn("failed to close connection", zap.Error(err))
+		}
+	}
+	if s.listener != nil {
+		if err := s.listener.Close(); err != nil {
+			s.log.Warn("failed to close listener", zap.Error(err))
+		}
+		s.closeStreams()
 	}
 	for _, conn := range s.conns {
 		if err := conn.Close(); err != nil {
 			s.log.Warn("failed to close connection", zap.Error(err))
 		}
 	}
+	s.serveMux.Unlock()
 	s.wg.Wait()
 	return nil
 }
@@ -222,6 +704,13 @@ func (s *Server) process(ctx *context) error {
 		return s.processMessage(ctx)
 	case turn.IsChannelData(ctx.request.Raw):
 		return s.processChannelData(ctx)
+	case hasChannelNumber(ctx.request.Raw):
+		// Valid channel number, but length field exceeds message size.
+		ctx.cfg.metrics.incMalformedChannelData()
+		if ce := s.log.Check(zapcore.DebugLevel, "malformed channel data"); ce != nil {
+			ce.Write(zap.Stringer("addr", ctx.client), zap.Int("len", len(ctx.request.Raw)))
+		}
+		return nil
 	default:
 		if ce := s.log.Check(zapcore.DebugLevel, "not looks like stun message"); ce != nil {
 			ce.Write(zap.Stringer("addr", ctx.client))
@@ -230,8 +719,24 @@ func (s *Server) process(ctx *context) error {
 	}
 }
 
+// hasChannelNumber reports whether buf starts with ChannelData header with
+// valid channel number, ignoring length field.
+func hasChannelNumber(buf []byte) bool {
+	if len(buf) < 4 {
+		return false
+	}
+	return turn.ChannelNumber(binary.BigEndian.Uint16(buf)).Valid()
+}
+
 func (s *Server) serveConn(ctx *context) error {
 	ctx.time = time.Now()
+	if max := ctx.cfg.maxRequest; max > 0 && len(ctx.buf) > max {
+		ctx.cfg.metrics.incOversized()
+		if ce := s.log.Check(zapcore.DebugLevel, "dropped packet, too large"); ce != nil {
+			ce.Write(zap.Stringer("addr", ctx.addr), zap.Int("len", len(ctx.buf)))
+		}
+		return nil
+	}
 	ctx.request.Raw = ctx.buf
 	ctx.cdata.Raw = ctx.buf
 	switch a := ctx.addr.(type) {
@@ -242,23 +747,79 @@ func (s *Server) serveConn(ctx *context) error {
 		s.log.Error("unknown addr", zap.Stringer("addr", ctx.addr))
 		return errors.Errorf("unknown addr %s", ctx.addr)
 	}
-	if !ctx.allowClient(ctx.client) {
+	switch ctx.cfg.clientFilter.Action(ctx.client) {
+	case filter.Allow:
+		// Pass.
+	case filter.Reject:
+		if ce := s.log.Check(zapcore.DebugLevel, "client rejected"); ce != nil {
+			ce.Write(zap.Stringer("addr", ctx.client))
+		}
+		s.reject(ctx)
+		return s.writeResponse(ctx)
+	default:
 		if ce := s.log.Check(zapcore.DebugLevel, "client denied"); ce != nil {
 			ce.Write(zap.Stringer("addr", ctx.client))
 		}
 		return nil
 	}
+	if pps := ctx.cfg.bindingRateLimit; pps > 0 && isBindingRequest(ctx.request.Raw) {
+		ip := rateLimitNet(ctx.client.IP, ctx.cfg.rateLimitPrefix, ctx.cfg.rateLimitPrefix6)
+		if !s.limiter.allow(ip, ctx.time, pps) {
+			ctx.cfg.metrics.incRateLimited()
+			if ce := s.log.Check(zapcore.DebugLevel, "rate limited"); ce != nil {
+				ce.Write(zap.Stringer("addr", ctx.client))
+			}
+			return nil
+		}
+	}
 	ctx.setTuple()
+	if ctx.cfg.dump {
+		s.dump("received packet", ctx.client, ctx.request.Raw)
+	}
 	if processErr := s.process(ctx); processErr != nil {
 		if processErr != errNotSTUNMessage {
 			s.log.Error("process failed", zap.Error(processErr))
 		}
 		return nil
 	}
+	return s.writeResponse(ctx)
+}
+
+// reject builds 403 (Forbidden) response if ctx.request is STUN request,
+// other messages are left without response.
+func (s *Server) reject(ctx *context) {
+	if !stun.IsMessage(ctx.request.Raw) {
+		return
+	}
+	ctx.request.Type = stun.MessageType{}
+	if err := ctx.request.Decode(); err != nil || ctx.request.Type.Class != stun.ClassRequest {
+		return
+	}
+	if err := ctx.buildErr(stun.CodeForbidden); err != nil {
+		s.log.Warn("failed to build reject response", zap.Error(err))
+	}
+}
+
+// maxResponseSize bounds responses, so server can't be used for traffic
+// amplification even if misconfigured, e.g. with long SOFTWARE or realm.
+// Value is minimum IPv6 MTU, as in RFC 5389 Section 7.1.
+const maxResponseSize = 1280
+
+func (s *Server) writeResponse(ctx *context) error {
 	if len(ctx.response.Raw) == 0 {
 		// Indication.
 		return nil
 	}
+	if len(ctx.response.Raw) > maxResponseSize {
+		ctx.cfg.metrics.incOversized()
+		s.log.Warn("dropped response, too large",
+			zap.Stringer("addr", ctx.client), zap.Int("len", len(ctx.response.Raw)),
+		)
+		return nil
+	}
+	if ctx.cfg.dump {
+		s.dump("sent packet", ctx.client, ctx.response.Raw)
+	}
 	if setErr := ctx.conn.SetWriteDeadline(ctx.time.Add(time.Second)); setErr != nil {
 		s.log.Warn("failed to set deadline", zap.Error(setErr))
 	}
@@ -270,8 +831,11 @@ func (s *Server) serveConn(ctx *context) error {
 	return nil
 }
 
-func isErrConnClosed(err error) bool {
-	return strings.HasSuffix(err.Error(), "use of closed network connection")
+// dump logs hex of packet b that is received from or sent to addr.
+func (s *Server) dump(msg string, addr turn.Addr, b []byte) {
+	if ce := s.log.Check(zapcore.DebugLevel, msg); ce != nil {
+		ce.Write(zap.Stringer("addr", addr), zap.String("hex", hex.EncodeToString(b)))
+	}
 }
 
 func (s *Server) worker(conn net.PacketConn) {
@@ -293,9 +857,18 @@ func (s *Server) worker(conn net.PacketConn) {
 			}
 			break
 		}
+		if n == len(buf) {
+			// Datagram could be larger than buffer and was truncated.
+			s.config().metrics.incOversized()
+			if ce := s.log.Check(zapcore.DebugLevel, "dropped packet, too large"); ce != nil {
+				ce.Write(zap.Stringer("addr", addr))
+			}
+			continue
+		}
 
 		// Preparing context.
 		ctx := acquireContext()
+		// Responding via same socket to keep source address.
 		ctx.conn = conn
 		ctx.buf = ctx.buf[:cap(ctx.buf)]
 		copy(ctx.buf, buf)
@@ -304,31 +877,63 @@ func (s *Server) worker(conn net.PacketConn) {
 		ctx.server = s.addr
 		ctx.cfg = s.config()
 
-		for i := 0; i < 7; i++ {
-			if s.pool.Serve(ctx) {
-				break
+		if !s.serve(ctx) {
+			if ce := s.log.Check(zapcore.DebugLevel, "dropped packet, no free workers"); ce != nil {
+				ce.Write(zap.Stringer("addr", ctx.addr))
 			}
-			s.log.Warn("not enough workers")
-			time.Sleep(time.Millisecond * 300)
+			putContext(ctx)
 		}
 	}
 }
 
+// serve passes ctx to worker pool, retrying with backoff if all workers
+// are busy. Returns false if no worker was found after all attempts.
+func (s *Server) serve(ctx *context) bool {
+	attempts, backoff := ctx.cfg.workerAttempts, ctx.cfg.workerBackoff
+	for i := 0; i < attempts; i++ {
+		if s.pool.Serve(ctx) {
+			return true
+		}
+		if i == attempts-1 {
+			break
+		}
+		s.log.Warn("not enough workers")
+		atomic.AddInt64(&s.queued, 1)
+		time.Sleep(backoff)
+		atomic.AddInt64(&s.queued, -1)
+	}
+	return false
+}
+
 func (s *Server) start() {
 	s.pool.Start()
 }
 
 // Serve reads packets from connections and responds to BINDING requests.
 func (s *Server) Serve() error {
+	if s.listener != nil {
+		return s.serveStreams()
+	}
+	s.serveMux.Lock()
+	if s.closing() {
+		s.serveMux.Unlock()
+		return nil
+	}
 	s.start()
+	reusePort := s.reusePort
 	for i := 0; i < runtime.GOMAXPROCS(-1); i++ {
 		s.wg.Add(1)
-		if s.reusePort {
+		// Initial connection is also part of REUSEPORT group and kernel
+		// distributes packets to it, so it should be read by worker too.
+		if reusePort && i > 0 {
 			s.log.Debug("reusing port for worker", zap.Int("w", i))
 			laddr := s.conn.LocalAddr()
-			conn, err := reuseport.ListenPacket(laddr.Network(), laddr.String())
+			conn, err := s.listenPacket(laddr.Network(), laddr.String())
 			if err != nil {
-				s.log.Warn("failed to listen for additional socket")
+				// Not retrying for other workers, they will share the
+				// initial connection.
+				s.log.Warn("failed to listen for additional socket, falling back to single socket", zap.Error(err))
+				reusePort = false
 				conn = s.conn
 			} else {
 				s.conns = append(s.conns, conn)
@@ -338,6 +943,7 @@ func (s *Server) Serve() error {
 			go s.worker(s.conn)
 		}
 	}
+	s.serveMux.Unlock()
 	s.wg.Wait()
 	return nil
 }
@@ -12,6 +12,7 @@ import (
 
 	"gortc.io/gortcd/internal/allocator"
 	"gortc.io/gortcd/internal/auth"
+	"gortc.io/gortcd/internal/filter"
 	"gortc.io/turn"
 )
 
@@ -19,19 +20,84 @@ type handleFunc = func(ctx *context) error
 
 var channelBindRequest = stun.NewType(stun.MethodChannelBind, stun.ClassRequest)
 
+// channelBindingLifetime is the lifetime of channel binding, which is not
+// negotiable and is refreshed by ChannelBind request with same parameters.
+//
+// See RFC 5766 Section 11.
+const channelBindingLifetime = time.Minute * 10
+
+// codeMethodNotAllowed is returned for requests of known, but not
+// supported methods.
+const codeMethodNotAllowed stun.ErrorCode = 405
+
+// errMethodNotAllowed is 405 error with explicit reason, because stun
+// package has no default one for this code.
+var errMethodNotAllowed = &stun.ErrorCodeAttribute{
+	Code:   codeMethodNotAllowed,
+	Reason: []byte("Method Not Allowed"),
+}
+
+// unsupportedMethods are recognized methods that have no handlers, e.g.
+// TCP relay methods from RFC 6062 on packet listeners, requests of other
+// methods without handlers are rejected with 400 (Bad Request).
+var unsupportedMethods = map[stun.Method]stun.Setter{
+	stun.MethodConnect:        errMethodNotAllowed,
+	stun.MethodConnectionBind: errMethodNotAllowed,
+}
+
+// setHandlers sets handlers of enabled services, requests for other ones
+// are rejected with 400 (Bad Request).
 func (s *Server) setHandlers() {
-	s.handlers = map[stun.MessageType]handleFunc{
-		stun.BindingRequest:          s.processBindingRequest,
-		turn.AllocateRequest:         s.processAllocateRequest,
-		turn.CreatePermissionRequest: s.processCreatePermissionRequest,
-		turn.RefreshRequest:          s.processRefreshRequest,
-		turn.SendIndication:          s.processSendIndication,
-		channelBindRequest:           s.processChannelBinding,
+	s.handlers = make(map[stun.MessageType]handleFunc)
+	if s.services&ServiceSTUN != 0 {
+		s.handlers[stun.BindingRequest] = s.processBindingRequest
+	}
+	if s.services&ServiceTURN != 0 && s.listener != nil {
+		// Only TCP allocations of RFC 6062 are served over stream.
+		s.handlers[turn.AllocateRequest] = s.processTCPAllocateRequest
+		s.handlers[turn.CreatePermissionRequest] = s.processTCPCreatePermissionRequest
+		s.handlers[turn.RefreshRequest] = s.processTCPRefreshRequest
+		s.handlers[connectRequest] = s.processConnectRequest
+		s.handlers[connectionBindRequest] = s.processConnectionBindRequest
+		return
+	}
+	if s.services&ServiceTURN != 0 {
+		s.handlers[turn.AllocateRequest] = s.processAllocateRequest
+		s.handlers[turn.CreatePermissionRequest] = s.processCreatePermissionRequest
+		s.handlers[turn.RefreshRequest] = s.processRefreshRequest
+		s.handlers[turn.SendIndication] = s.processSendIndication
+		s.handlers[channelBindRequest] = s.processChannelBinding
 	}
 }
 
 // HandlePeerData implements allocator.PeerHandler.
+//
+// Data is written to client via primary connection even if client
+// requests were received by other socket of REUSEPORT group. All sockets
+// of group are bound to same local address, so source address of data
+// is the one that client expects.
+//
+// ChannelData is used if channel is bound to peer, unless DataIndications
+// option is set.
 func (s *Server) HandlePeerData(d []byte, t turn.FiveTuple, a turn.Addr) {
+	if ce := s.log.Check(zapcore.DebugLevel, "got peer data"); ce != nil {
+		ce.Write(zap.Stringer("t", t), zap.Stringer("addr", a), zap.Int("len", len(d)))
+	}
+	if err := s.conn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+		s.log.Error("failed to SetWriteDeadline", zap.Error(err))
+	}
+	if !s.config().dataIndications {
+		if n, err := s.allocs.Bound(t, a); err == nil {
+			// Using channel data, this is the hot path.
+			if err := s.sendChannelData(n, d, t.Client); err != nil {
+				s.log.Error("failed to write", zap.Error(err), zap.Stringer("t", t))
+			}
+			if ce := s.log.Check(zapcore.DebugLevel, "sent data via channel"); ce != nil {
+				ce.Write(zap.Stringer("t", t), zap.Stringer("n", n))
+			}
+			return
+		}
+	}
 	destination := &net.UDPAddr{
 		IP:   t.Client.IP,
 		Port: t.Client.Port,
@@ -39,26 +105,8 @@ func (s *Server) HandlePeerData(d []byte, t turn.FiveTuple, a turn.Addr) {
 	l := s.log.With(
 		zap.Stringer("t", t),
 		zap.Stringer("addr", a),
-		zap.Int("len", len(d)),
 		zap.Stringer("d", destination),
 	)
-	l.Debug("got peer data")
-	if err := s.conn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
-		l.Error("failed to SetWriteDeadline", zap.Error(err))
-	}
-	if n, err := s.allocs.Bound(t, a); err == nil {
-		// Using channel data.
-		d := turn.ChannelData{
-			Number: n,
-			Data:   d,
-		}
-		d.Encode()
-		if _, err := s.conn.WriteTo(d.Raw, destination); err != nil {
-			l.Error("failed to write", zap.Error(err))
-		}
-		l.Debug("sent data via channel", zap.Stringer("n", n))
-		return
-	}
 	m := stun.New()
 	if err := m.Build(stun.TransactionID, stun.NewType(stun.MethodData, stun.ClassIndication),
 		turn.Data(d), turn.PeerAddress(a),
@@ -74,42 +122,238 @@ func (s *Server) HandlePeerData(d []byte, t turn.FiveTuple, a turn.Addr) {
 }
 
 func (s *Server) processBindingRequest(ctx *context) error {
-	return ctx.buildOk((*stun.XORMappedAddress)(&ctx.client))
+	ctx.mapped = ctx.cfg.mapped(ctx.client)
+	if ctx.cfg.secondary.IP != nil {
+		// Helping legacy RFC 3489 clients to discover NAT behavior.
+		return ctx.buildOk(
+			(*stun.XORMappedAddress)(&ctx.mapped),
+			(*changedAddress)(&ctx.cfg.secondary),
+		)
+	}
+	return ctx.buildOk((*stun.XORMappedAddress)(&ctx.mapped))
 }
 
 func (s *Server) processAllocateRequest(ctx *context) error {
 	var transport turn.RequestedTransport
 	if err := transport.GetFrom(ctx.request); err != nil {
+		// Missing or malformed REQUESTED-TRANSPORT, see RFC 5766 Section 6.2.
 		return ctx.buildErr(stun.CodeBadRequest)
 	}
-	lifetime := ctx.cfg.defaultLifetime
-	relayedAddr, err := s.allocs.New(ctx.tuple, ctx.time.Add(lifetime), s)
+	if transport.Protocol != turn.ProtoUDP || !ctx.cfg.transportAllowed(transport.Protocol) {
+		// Only UDP relaying is supported, TCP allocations of RFC 6062 are not.
+		return ctx.buildErr(stun.CodeUnsupportedTransProto)
+	}
+	dual := false
+	switch family, err := getAddressFamily(ctx.request, attrAdditionalAddressFamily); err {
+	case stun.ErrAttributeNotFound:
+		// Pass.
+	case nil:
+		if family != addrFamilyIPv6 || ctx.request.Contains(stun.AttrRequestedAddressFamily) {
+			// Only IPv6 can be additional family, and only in addition to
+			// IPv4, see RFC 8656 Section 7.2.
+			return ctx.buildErr(stun.CodeBadRequest)
+		}
+		dual = true
+	default:
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	dontFragment := ctx.request.Contains(stun.AttrDontFragment)
+	if dontFragment && !allocator.DontFragmentSupported {
+		// Rejecting as described in RFC 5766 Section 6.2.
+		return ctx.buildErr(stun.CodeUnknownAttribute,
+			stun.UnknownAttributes{stun.AttrDontFragment},
+		)
+	}
+	if ctx.cfg.rejectEvenPort && ctx.request.Contains(stun.AttrEvenPort) {
+		// Port pairs are not supported, so rejecting instead of ignoring
+		// comprehension-required attribute.
+		return ctx.buildErr(stun.CodeUnknownAttribute,
+			stun.UnknownAttributes{stun.AttrEvenPort},
+		)
+	}
+	var username stun.Username
+	if err := username.GetFrom(ctx.request); err != nil && err != stun.ErrAttributeNotFound {
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	if allowed, err := s.allowUser(ctx, username); !allowed {
+		return err
+	}
+	if s.isDraining() {
+		// Only existing allocations are served during drain.
+		if alt, ok := s.nextAlternate(ctx); ok {
+			return ctx.buildErr(stun.CodeTryAlternate, &alt)
+		}
+		return ctx.buildErr(stun.CodeAllocQuotaReached)
+	}
+	lifetime, ok := requestedLifetime(ctx)
+	if !ok {
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	// Realm of authenticated credential or advertised one.
+	realm := string(ctx.realm)
+	var (
+		relayedAddr, relayedAddr6 turn.Addr
+		err                       error
+	)
+	if dual {
+		relayedAddr, relayedAddr6, err = s.allocs.NewDual(ctx.tuple, string(username),
+			realm, ctx.cfg.realmQuotas[realm], ctx.time.Add(lifetime), s,
+		)
+	} else {
+		relayedAddr, err = s.allocs.NewInRealm(ctx.tuple, string(username),
+			realm, ctx.cfg.realmQuotas[realm], ctx.time.Add(lifetime), s,
+		)
+	}
+	if err == nil && dontFragment {
+		if dfErr := s.allocs.SetDontFragment(ctx.tuple); dfErr != nil {
+			// Allocation can't be used as requested, see RFC 5766 Section 6.2.
+			s.log.Warn("failed to set DF bit", zap.Error(dfErr))
+			if rmErr := s.allocs.Remove(ctx.tuple); rmErr != nil {
+				s.log.Warn("failed to remove allocation", zap.Error(rmErr))
+			}
+			ctx.cfg.metrics.incAllocationFailure(allocationServerError)
+			return ctx.buildErr(stun.CodeUnknownAttribute,
+				stun.UnknownAttributes{stun.AttrDontFragment},
+			)
+		}
+	}
 	switch err {
 	case nil:
+		if ce := s.log.Check(zapcore.DebugLevel, "allocated"); ce != nil {
+			ce.Write(ctx.userFields(zap.Stringer("tuple", ctx.tuple), zap.Stringer("relayed", relayedAddr))...)
+		}
+		if ctx.cfg.externalIP != nil && addrFamily(ctx.cfg.externalIP) == addrFamily(relayedAddr.IP) {
+			// Socket is bound to local address, but clients should use
+			// the public one, translated by NAT.
+			relayedAddr.IP = ctx.cfg.externalIP
+		}
+		ctx.relayed = relayedAddr
+		// Dual allocation has second XOR-RELAYED-ADDRESS, see RFC 8656
+		// Section 7.2.
+		ctx.relayed6 = relayedAddr6
+		ctx.lifetime = turn.Lifetime{Duration: lifetime}
+		if ctx.cfg.allocateMapped {
+			// Helping clients that use same socket for STUN and TURN to
+			// discover reflexive address during allocation.
+			return ctx.buildOk(
+				(*stun.XORMappedAddress)(&ctx.tuple.Client),
+				(*turn.RelayedAddress)(&ctx.relayed),
+				(*optionalRelayedAddress)(&ctx.relayed6),
+				&ctx.lifetime,
+				(*stun.MappedAddress)(&ctx.tuple.Client),
+				(*responseOrigin)(&ctx.server),
+			)
+		}
 		return ctx.buildOk(
 			(*stun.XORMappedAddress)(&ctx.tuple.Client),
-			(*turn.RelayedAddress)(&relayedAddr),
-			turn.Lifetime{Duration: lifetime},
+			(*turn.RelayedAddress)(&ctx.relayed),
+			(*optionalRelayedAddress)(&ctx.relayed6),
+			&ctx.lifetime,
 		)
 	case allocator.ErrAllocationMismatch:
+		ctx.cfg.metrics.incAllocationFailure(allocationMismatch)
 		return ctx.buildErr(stun.CodeAllocMismatch)
+	case allocator.ErrRealmQuota:
+		ctx.cfg.metrics.incAllocationFailure(allocationQuota)
+		return ctx.buildErr(stun.CodeAllocQuotaReached)
+	case allocator.ErrAddrFamilyNotSupported:
+		// No IPv6 relay address for dual allocation.
+		ctx.cfg.metrics.incAllocationFailure(allocationFamily)
+		return ctx.buildErr(stun.CodeAddrFamilyNotSupported)
+	case allocator.ErrInsufficientCapacity:
+		ctx.cfg.metrics.incAllocationFailure(allocationCapacity)
+		if alt, ok := s.nextAlternate(ctx); ok {
+			// Redirecting client as described in RFC 5389 Section 11.
+			return ctx.buildErr(stun.CodeTryAlternate, &alt)
+		}
+		return ctx.buildErr(stun.CodeInsufficientCapacity)
 	default:
+		ctx.cfg.metrics.incAllocationFailure(allocationServerError)
 		s.log.Warn("failed to allocate", zap.Error(err))
 		return ctx.buildErr(stun.CodeServerError)
 	}
 }
 
+// allowUser applies user filtering rule to username of Allocate request.
+// Request is dropped or rejected with 403 (Forbidden) if false is
+// returned.
+func (s *Server) allowUser(ctx *context, username stun.Username) (bool, error) {
+	switch ctx.userAction(string(username)) {
+	case filter.Allow:
+		return true, nil
+	case filter.Drop:
+		if ce := s.log.Check(zapcore.DebugLevel, "user dropped by filter"); ce != nil {
+			ce.Write(zap.Stringer("username", username), zap.Stringer("client", ctx.client))
+		}
+		return false, nil
+	default:
+		if ce := s.log.Check(zapcore.DebugLevel, "user denied by filter"); ce != nil {
+			ce.Write(zap.Stringer("username", username), zap.Stringer("client", ctx.client))
+		}
+		return false, ctx.buildErr(stun.CodeForbidden)
+	}
+}
+
+// requestedLifetime returns lifetime of new allocation from LIFETIME of
+// Allocate request, reporting false if attribute is malformed.
+func requestedLifetime(ctx *context) (time.Duration, bool) {
+	var requested turn.Lifetime
+	switch err := requested.GetFrom(ctx.request); err {
+	case nil:
+		return ctx.cfg.allocationLifetime(requested.Duration), true
+	case stun.ErrAttributeNotFound:
+		return ctx.cfg.defaultLifetime, true
+	default:
+		return 0, false
+	}
+}
+
 func (s *Server) processRefreshRequest(ctx *context) error {
 	var (
 		lifetime turn.Lifetime
 		allocErr error
+		// removeFamily is set if single relayed address of dual
+		// allocation is removed.
+		removeFamily bool
 	)
-	if err := ctx.request.Parse(&lifetime); err != nil && err != stun.ErrAttributeNotFound {
+	switch err := lifetime.GetFrom(ctx.request); err {
+	case nil:
+		if max := ctx.cfg.maxLifetime; lifetime.Duration > max {
+			lifetime.Duration = max
+		}
+	case stun.ErrAttributeNotFound:
+		lifetime.Duration = ctx.cfg.defaultLifetime
+	default:
 		return errors.Wrap(err, "failed to parse")
 	}
+	family, familyErr := getAddressFamily(ctx.request, stun.AttrRequestedAddressFamily)
+	switch familyErr {
+	case stun.ErrAttributeNotFound:
+		// Pass.
+	case nil:
+		relayed, relayed6, relayedErr := s.allocs.RelayedAddrs(ctx.tuple)
+		if relayedErr != nil {
+			return ctx.buildErr(stun.CodeAllocMismatch)
+		}
+		if addrFamily(relayed.IP) != family && (relayed6.IP == nil || family != addrFamilyIPv6) {
+			return ctx.buildErr(stun.CodePeerAddrFamilyMismatch)
+		}
+		// Relayed addresses of dual allocation share lifetime, so it is
+		// refreshed for both of them, but zero lifetime removes only
+		// relayed address of requested family, keeping the other one.
+		// Allocation is removed with the last relayed address. See RFC
+		// 8656 Section 7.3.
+		removeFamily = relayed6.IP != nil
+	default:
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
 	switch lifetime.Duration {
 	case 0:
-		allocErr = s.allocs.Remove(ctx.tuple)
+		if removeFamily {
+			allocErr = s.allocs.RemoveFamily(ctx.tuple, family == addrFamilyIPv6)
+		} else {
+			allocErr = s.allocs.Remove(ctx.tuple)
+		}
 	default:
 		timeout := ctx.time.Add(lifetime.Duration)
 		allocErr = s.allocs.Refresh(ctx.tuple, timeout)
@@ -125,12 +369,36 @@ func (s *Server) processRefreshRequest(ctx *context) error {
 	}
 }
 
+// getPeerAddresses returns addresses from all XOR-PEER-ADDRESS attributes
+// of m, because CreatePermission request can contain multiple ones.
+//
+// See RFC 5766 Section 9.1.
+func getPeerAddresses(m *stun.Message) ([]turn.Addr, error) {
+	var peers []turn.Addr
+	for _, a := range m.Attributes {
+		if a.Type != stun.AttrXORPeerAddress {
+			continue
+		}
+		// Attribute value is XOR'ed with transaction id, so decoding it
+		// from message with only that attribute.
+		single := &stun.Message{TransactionID: m.TransactionID}
+		single.Add(a.Type, a.Value)
+		var addr turn.PeerAddress
+		if err := addr.GetFrom(single); err != nil {
+			return nil, err
+		}
+		peers = append(peers, turn.Addr(addr))
+	}
+	if len(peers) == 0 {
+		return nil, stun.ErrAttributeNotFound
+	}
+	return peers, nil
+}
+
 func (s *Server) processCreatePermissionRequest(ctx *context) error {
-	var (
-		addr     turn.PeerAddress
-		lifetime turn.Lifetime
-	)
-	if err := addr.GetFrom(ctx.request); err != nil {
+	var lifetime turn.Lifetime
+	peers, err := getPeerAddresses(ctx.request)
+	if err != nil {
 		return errors.Wrap(err, "failed to get create permission request addr")
 	}
 	switch err := lifetime.GetFrom(ctx.request); err {
@@ -144,18 +412,33 @@ func (s *Server) processCreatePermissionRequest(ctx *context) error {
 	default:
 		return errors.Wrap(err, "failed to get lifetime")
 	}
-	s.log.Debug("processing create permission request")
-	var (
-		peerAddr = turn.Addr(addr)
-		timeout  = ctx.time.Add(lifetime.Duration)
-	)
-	if !ctx.allowPeer(peerAddr) {
-		// Sending 403 (Forbidden) as described in RFC 5766 Section 9.1.
-		return ctx.buildErr(stun.CodeForbidden)
+	if ce := s.log.Check(zapcore.DebugLevel, "processing create permission request"); ce != nil {
+		ce.Write(ctx.userFields(zap.Stringer("client", ctx.client), zap.Int("peers", len(peers)))...)
+	}
+	// Whole request is rejected if any of peers is forbidden.
+	for _, peerAddr := range peers {
+		switch ctx.peerAction(peerAddr) {
+		case filter.Allow:
+			// Pass.
+		case filter.Drop:
+			if ce := s.log.Check(zapcore.DebugLevel, "peer dropped by filter"); ce != nil {
+				ce.Write(ctx.userFields(zap.Stringer("peer", peerAddr), zap.Stringer("client", ctx.client))...)
+			}
+			return nil
+		default:
+			// Sending 403 (Forbidden) as described in RFC 5766 Section 9.1.
+			return ctx.buildErr(stun.CodeForbidden)
+		}
 	}
-	switch err := s.allocs.CreatePermission(ctx.tuple, peerAddr, timeout); err {
+	timeout := ctx.time.Add(lifetime.Duration)
+	switch err := s.allocs.CreatePermissions(ctx.tuple, peers, timeout); err {
 	case allocator.ErrAllocationMismatch:
 		return ctx.buildErr(stun.CodeAllocMismatch)
+	case allocator.ErrPeerAddrFamilyMismatch:
+		// Rejecting as described in RFC 6156 Section 5.1.
+		return ctx.buildErr(stun.CodePeerAddrFamilyMismatch)
+	case allocator.ErrPermissionLimit:
+		return ctx.buildErr(stun.CodeInsufficientCapacity)
 	case nil:
 		return ctx.buildOk(&lifetime)
 	default:
@@ -163,17 +446,50 @@ func (s *Server) processCreatePermissionRequest(ctx *context) error {
 	}
 }
 
+// processSendIndication relays data to peer. Indications are not
+// authenticated, so data for 5-tuple without allocation (e.g. from spoofed
+// source) is silently dropped.
 func (s *Server) processSendIndication(ctx *context) error {
 	var (
 		data turn.Data
 		addr turn.PeerAddress
 	)
 	if err := ctx.request.Parse(&data, &addr); err != nil {
-		s.log.Error("failed to parse send indication", zap.Error(err))
-		return errors.Wrap(err, "failed to parse send indication")
+		if ce := s.log.Check(zapcore.DebugLevel, "failed to parse send indication"); ce != nil {
+			ce.Write(zap.Stringer("addr", ctx.client), zap.Error(err))
+		}
+		return nil
+	}
+	if max := ctx.cfg.maxIndication; max > 0 && len(data) > max {
+		ctx.cfg.metrics.incOversized()
+		if ce := s.log.Check(zapcore.DebugLevel, "data is too large, dropping"); ce != nil {
+			ce.Write(zap.Stringer("tuple", ctx.tuple), zap.Int("len", len(data)))
+		}
+		return nil
+	}
+	dontFragment := ctx.request.Contains(stun.AttrDontFragment)
+	if dontFragment && !allocator.DontFragmentSupported {
+		// Datagram can't be sent without DF bit, see RFC 5766 Section 10.2.
+		s.log.Debug("DF bit is not supported, dropping")
+		return nil
+	}
+	if ctx.peerAction(turn.Addr(addr)) != filter.Allow {
+		// Permission could be created before peer filter was changed
+		// on reload, so checking peer on every send.
+		ctx.cfg.metrics.incPeerFiltered()
+		if ce := s.log.Check(zapcore.DebugLevel, "peer filtered, dropping"); ce != nil {
+			ce.Write(zap.Stringer("tuple", ctx.tuple), zap.Stringer("peer", addr))
+		}
+		return nil
 	}
 	s.log.Debug("sending data", zap.Stringer("to", addr))
-	if err := s.sendByPermission(ctx, turn.Addr(addr), data); err != nil {
+	switch err := s.sendByPermission(ctx, turn.Addr(addr), data, dontFragment); err {
+	case nil:
+	case allocator.ErrPermissionNotFound:
+		if ce := s.log.Check(zapcore.DebugLevel, "no allocation or permission, dropping"); ce != nil {
+			ce.Write(zap.Stringer("tuple", ctx.tuple), zap.Stringer("peer", addr))
+		}
+	default:
 		s.log.Warn("send failed", zap.Error(err))
 	}
 	return nil
@@ -188,18 +504,36 @@ func (s *Server) processChannelBinding(ctx *context) error {
 		s.log.Debug("channel binding parse failed", zap.Error(parseErr))
 		return ctx.buildErr(stun.CodeBadRequest)
 	}
+	if !number.Valid() {
+		// Rejecting channel numbers out of 0x4000 through 0x7FFF range
+		// before allocation lookup, see RFC 5766 Section 11.2.
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
 	var (
 		peerAddr = turn.Addr(addr)
-		lifetime = ctx.cfg.defaultLifetime
+		lifetime = channelBindingLifetime
 		timeout  = ctx.time.Add(lifetime)
 	)
-	if !ctx.allowPeer(peerAddr) {
+	switch ctx.peerAction(peerAddr) {
+	case filter.Allow:
+		// Pass.
+	case filter.Drop:
+		if ce := s.log.Check(zapcore.DebugLevel, "peer dropped by filter"); ce != nil {
+			ce.Write(ctx.userFields(zap.Stringer("peer", peerAddr), zap.Stringer("client", ctx.client))...)
+		}
+		return nil
+	default:
 		// Sending 403 (Forbidden) as described in RFC 5766 Section 9.1.
 		return ctx.buildErr(stun.CodeForbidden)
 	}
 	switch err := s.allocs.ChannelBind(ctx.tuple, number, peerAddr, timeout); err {
 	case allocator.ErrAllocationMismatch:
 		return ctx.buildErr(stun.CodeAllocMismatch)
+	case allocator.ErrPeerAddrFamilyMismatch:
+		// Rejecting as described in RFC 6156 Section 5.1.
+		return ctx.buildErr(stun.CodePeerAddrFamilyMismatch)
+	case allocator.ErrPermissionLimit, allocator.ErrChannelLimit:
+		return ctx.buildErr(stun.CodeInsufficientCapacity)
 	case nil:
 		return ctx.buildOk(&number, &turn.Lifetime{Duration: lifetime})
 	default:
@@ -209,6 +543,7 @@ func (s *Server) processChannelBinding(ctx *context) error {
 
 func (s *Server) processChannelData(ctx *context) error {
 	if err := ctx.cdata.Decode(); err != nil {
+		ctx.cfg.metrics.incMalformedChannelData()
 		if ce := s.log.Check(zapcore.DebugLevel, "failed to decode channel data"); ce != nil {
 			ce.Write(zap.Stringer("addr", ctx.client), zap.Error(err))
 		}
@@ -217,7 +552,19 @@ func (s *Server) processChannelData(ctx *context) error {
 	if ce := s.log.Check(zapcore.DebugLevel, "got channel data"); ce != nil {
 		ce.Write(zap.Int("channel", int(ctx.cdata.Number)), zap.Int("len", ctx.cdata.Length))
 	}
-	return s.sendByBinding(ctx, ctx.cdata.Number, ctx.cdata.Data)
+	switch err := s.sendByBinding(ctx, ctx.cdata.Number, ctx.cdata.Data); err {
+	case nil:
+		return nil
+	case allocator.ErrPermissionNotFound:
+		// Same as for send indication, dropping data for 5-tuple without
+		// allocation or channel binding.
+		if ce := s.log.Check(zapcore.DebugLevel, "no allocation or binding, dropping"); ce != nil {
+			ce.Write(zap.Stringer("tuple", ctx.tuple), zap.Int("channel", int(ctx.cdata.Number)))
+		}
+		return nil
+	default:
+		return err
+	}
 }
 
 func (s *Server) needAuth(ctx *context) bool {
@@ -233,12 +580,31 @@ func (s *Server) needAuth(ctx *context) bool {
 	return true
 }
 
+// authenticate authenticates m, also reporting whether credential that
+// matches any realm was used.
+func (s *Server) authenticate(m *stun.Message) (stun.MessageIntegrity, bool, error) {
+	if a, ok := s.auth.(anyRealmAuth); ok {
+		return a.AuthAnyRealm(m)
+	}
+	i, err := s.auth.Auth(m)
+	return i, false, err
+}
+
 func (s *Server) processMessage(ctx *context) error {
+	// Message.Reset does not reset type, but it is needed to distinguish
+	// header decoding errors.
+	ctx.request.Type = stun.MessageType{}
 	if err := ctx.request.Decode(); err != nil {
 		if ce := s.log.Check(zapcore.DebugLevel, "failed to decode request"); ce != nil {
 			ce.Write(zap.Stringer("addr", ctx.client), zap.Error(err))
 		}
-		return nil
+		if ctx.request.Type.Method == 0 {
+			// Header was not decoded, so transaction is unknown.
+			return nil
+		}
+		// Attributes are malformed, but header is valid and it is possible
+		// to respond with error.
+		return ctx.buildErr(stun.CodeBadRequest)
 	}
 	ctx.realm = ctx.cfg.realm
 	if ce := s.log.Check(zapcore.DebugLevel, "got message"); ce != nil {
@@ -272,11 +638,25 @@ func (s *Server) processMessage(ctx *context) error {
 			return ctx.buildErr(stun.CodeUnauthorized)
 		}
 		if nonceErr == auth.ErrStaleNonce {
+			ctx.cfg.metrics.incStaleNonce()
 			return ctx.buildErr(stun.CodeStaleNonce)
 		}
-		switch integrity, err := s.auth.Auth(ctx.request); err {
+		switch integrity, anyRealm, err := s.authenticate(ctx.request); err {
 		case nil:
 			ctx.integrity = integrity
+			// Credential can belong to realm that differs from advertised
+			// one, so echoing the realm that was used for authentication.
+			// Realm of wildcard credential is chosen by client, so keeping
+			// advertised one, e.g. to charge allocation to its quota.
+			if realm, getErr := ctx.request.Get(stun.AttrRealm); getErr == nil && !anyRealm {
+				ctx.realm = realm
+			}
+			if getErr := ctx.username.GetFrom(ctx.request); getErr != nil {
+				ctx.username = ctx.username[:0]
+			}
+			if ce := s.log.Check(zapcore.DebugLevel, "authenticated"); ce != nil {
+				ce.Write(ctx.userFields(zap.Stringer("addr", ctx.client), zap.Stringer("t", ctx.request.Type))...)
+			}
 		default:
 			if ce := s.log.Check(zapcore.DebugLevel, "failed to auth"); ce != nil {
 				ce.Write(zap.Stringer("addr", ctx.client), zap.Stringer("req", ctx.request), zap.Error(err))
@@ -289,6 +669,12 @@ func (s *Server) processMessage(ctx *context) error {
 	if ok {
 		return h(ctx)
 	}
+	if e, known := unsupportedMethods[ctx.request.Type.Method]; known {
+		if ce := s.log.Check(zapcore.DebugLevel, "unsupported method"); ce != nil {
+			ce.Write(ctx.userFields(zap.Stringer("t", ctx.request.Type), zap.Stringer("addr", ctx.client))...)
+		}
+		return ctx.buildErr(e)
+	}
 	s.log.Warn("unsupported request type", zap.Stringer("t", ctx.request.Type))
 	return ctx.buildErr(stun.CodeBadRequest)
 }
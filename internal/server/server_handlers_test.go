@@ -2,14 +2,38 @@ package server
 
 import (
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
 	"gortc.io/stun"
 
+	"gortc.io/gortcd/internal/allocator"
+	"gortc.io/gortcd/internal/auth"
+	"gortc.io/gortcd/internal/filter"
 	"gortc.io/turn"
 )
 
+// getMappedAddressAs decodes attribute t that is encoded the same way as
+// MAPPED-ADDRESS.
+func getMappedAddressAs(m *stun.Message, t stun.AttrType) (turn.Addr, error) {
+	v, err := m.Get(t)
+	if err != nil {
+		return turn.Addr{}, err
+	}
+	mapped := new(stun.Message)
+	mapped.Add(stun.AttrMappedAddress, v)
+	var addr stun.MappedAddress
+	if err = addr.GetFrom(mapped); err != nil {
+		return turn.Addr{}, err
+	}
+	return turn.Addr(addr), nil
+}
+
 func TestServer_processAllocationRequest(t *testing.T) {
 	s, stop := newServer(t)
 	defer stop()
@@ -90,6 +114,28 @@ func TestServer_processAllocationRequest(t *testing.T) {
 				t.Error("bad lifetime")
 			}
 		})
+		t.Run("RefreshMaxLifetime", func(t *testing.T) {
+			m = stun.MustBuild(stun.TransactionID, turn.RefreshRequest,
+				turn.Lifetime{Duration: time.Hour * 24},
+				username, realm, nonce, peer, i, stun.Fingerprint,
+			)
+			ctx.request.Raw = append(ctx.request.Raw[:0], m.Raw...)
+			if err := s.process(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if ctx.response.Type.Class != stun.ClassSuccessResponse {
+				var errCode stun.ErrorCodeAttribute
+				errCode.GetFrom(ctx.response)
+				t.Errorf("unexpected error %s: %s", errCode, ctx.response)
+			}
+			var lifetime turn.Lifetime
+			if getErr := lifetime.GetFrom(ctx.response); getErr != nil {
+				t.Error(getErr)
+			}
+			if lifetime.Duration != ctx.cfg.maxLifetime {
+				t.Errorf("lifetime %s not limited to %s", lifetime.Duration, ctx.cfg.maxLifetime)
+			}
+		})
 		t.Run("Dealloc", func(t *testing.T) {
 			m = stun.MustBuild(stun.TransactionID, turn.RefreshRequest,
 				turn.Lifetime{},
@@ -133,3 +179,1140 @@ func TestServer_processAllocationRequest(t *testing.T) {
 		}
 	})
 }
+
+// testClient performs authenticated requests directly via Server.process.
+type testClient struct {
+	t         testing.TB
+	s         *Server
+	ctx       *context
+	username  stun.Username
+	realm     stun.Realm
+	nonce     stun.Nonce
+	integrity stun.MessageIntegrity
+}
+
+// newTestClient initializes client with provided address and obtains
+// realm and nonce from server, assuming credentials from newServer.
+func newTestClient(t testing.TB, s *Server, addr turn.Addr) *testClient {
+	t.Helper()
+	c := &testClient{
+		t: t,
+		s: s,
+		ctx: &context{
+			request:  new(stun.Message),
+			response: new(stun.Message),
+			client:   addr,
+			server:   s.addr,
+			proto:    turn.ProtoUDP,
+		},
+		username: stun.NewUsername("username"),
+	}
+	c.ctx.setTuple()
+	res := c.process(stun.MustBuild(stun.TransactionID, turn.AllocateRequest, c.username, stun.Fingerprint))
+	if err := res.Parse(&c.realm, &c.nonce); err != nil {
+		t.Fatal(err)
+	}
+	c.integrity = stun.NewLongTermIntegrity("username", c.realm.String(), "secret")
+	return c
+}
+
+func (c *testClient) process(m *stun.Message) *stun.Message {
+	c.t.Helper()
+	c.ctx.cfg = c.s.config()
+	c.ctx.time = time.Now()
+	c.ctx.response.Reset()
+	c.ctx.request.Raw = append(c.ctx.request.Raw[:0], m.Raw...)
+	if err := c.s.process(c.ctx); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.ctx.response
+}
+
+// do performs authenticated request with provided type and attributes.
+func (c *testClient) do(t stun.MessageType, setters ...stun.Setter) *stun.Message {
+	c.t.Helper()
+	s := []stun.Setter{stun.TransactionID, t}
+	s = append(s, setters...)
+	s = append(s, c.username, c.realm, c.nonce, c.integrity, stun.Fingerprint)
+	return c.process(stun.MustBuild(s...))
+}
+
+func errorCode(m *stun.Message) stun.ErrorCode {
+	var errCode stun.ErrorCodeAttribute
+	if err := errCode.GetFrom(m); err != nil {
+		return 0
+	}
+	return errCode.Code
+}
+
+func TestServer_processAllocateRequestCapacity(t *testing.T) {
+	alternate := turn.Addr{IP: net.IPv4(10, 0, 0, 2), Port: 3478}
+	s, stop := newServer(t, Options{
+		Realm:          "realm",
+		MaxAllocations: 1,
+	})
+	defer stop()
+	first := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	if res := first.do(turn.AllocateRequest, turn.RequestedTransportUDP); res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	second := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34568})
+	t.Run("InsufficientCapacity", func(t *testing.T) {
+		res := second.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+		if code := errorCode(res); code != stun.CodeInsufficientCapacity {
+			t.Errorf("unexpected code %d", code)
+		}
+	})
+	t.Run("TryAlternate", func(t *testing.T) {
+		s.setOptions(Options{
+			Realm:            "realm",
+			AlternateServers: []turn.Addr{alternate},
+		})
+		res := second.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+		if code := errorCode(res); code != stun.CodeTryAlternate {
+			t.Errorf("unexpected code %d", code)
+		}
+		var alt alternateServer
+		if err := alt.GetFrom(res); err != nil {
+			t.Fatal(err)
+		}
+		if !turn.Addr(alt).Equal(alternate) {
+			t.Errorf("unexpected alternate server %s", alt)
+		}
+	})
+}
+
+func TestServer_processMessageRealm(t *testing.T) {
+	serverConn, serverAddr := listenUDP(t)
+	s, stop := newServer(t, Options{
+		Realm: "realm",
+		Conn:  serverConn,
+		Auth: auth.NewStatic([]auth.StaticCredential{
+			{Username: "username", Password: "secret", Realm: "customer"},
+			{Username: "username", Password: "secret", Realm: "other"},
+		}),
+		ListenerRealms: []ListenerRealm{
+			{Addr: turn.Addr{IP: net.IPv4zero, Port: serverAddr.Port}, Realm: "customer"},
+		},
+	})
+	defer stop()
+	t.Run("Listener", func(t *testing.T) {
+		c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+		if c.realm.String() != "customer" {
+			t.Fatalf("unexpected realm %q", c.realm)
+		}
+		res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+		if res.Type.Class != stun.ClassSuccessResponse {
+			t.Fatalf("unexpected response: %s", res)
+		}
+	})
+	t.Run("Credential", func(t *testing.T) {
+		c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34568})
+		c.realm = stun.NewRealm("other")
+		c.integrity = stun.NewLongTermIntegrity("username", "other", "secret")
+		res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+		if res.Type.Class != stun.ClassSuccessResponse {
+			t.Fatalf("unexpected response: %s", res)
+		}
+		var realm stun.Realm
+		if err := realm.GetFrom(res); err != nil {
+			t.Fatal(err)
+		}
+		if realm.String() != "other" {
+			t.Errorf("credential realm %q not echoed", realm)
+		}
+	})
+}
+
+// countingPortAllocator counts opened relay sockets.
+type countingPortAllocator struct {
+	allocator.SystemPortAllocator
+	opened int
+}
+
+func (a *countingPortAllocator) AllocatePort(proto turn.Protocol, network, defaultAddr string) (allocator.NetAllocation, error) {
+	a.opened++
+	return a.SystemPortAllocator.AllocatePort(proto, network, defaultAddr)
+}
+
+func TestServer_processAllocateRequestDontFragmentFailed(t *testing.T) {
+	if !allocator.DontFragmentSupported {
+		t.Skip("DF bit is not supported")
+	}
+	// Wrapped relay socket has no file descriptor, so DF bit can't be set.
+	ports := &closeRecordingPortAllocator{NetPortAllocator: allocator.SystemPortAllocator{}}
+	s, stop := newServer(t, Options{
+		Realm:         "realm",
+		PortAllocator: ports,
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP, turn.DontFragment)
+	if code := errorCode(res); code != stun.CodeUnknownAttribute {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	if n := s.allocs.Stats().Allocations; n != 0 {
+		t.Errorf("allocation should be released, got %d", n)
+	}
+	if closed := atomic.LoadInt32(&ports.closed); closed != 1 {
+		t.Errorf("relay socket closed %d times, expected 1", closed)
+	}
+}
+
+func TestServer_processAllocateRequestUnauthenticated(t *testing.T) {
+	ports := new(countingPortAllocator)
+	s, stop := newServer(t, Options{
+		Realm:         "realm",
+		PortAllocator: ports,
+	})
+	defer stop()
+	// Initial request without integrity is done by newTestClient.
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	t.Run("BadPassword", func(t *testing.T) {
+		integrity := c.integrity
+		defer func() { c.integrity = integrity }()
+		c.integrity = stun.NewLongTermIntegrity("username", c.realm.String(), "bad")
+		if code := errorCode(c.do(turn.AllocateRequest, turn.RequestedTransportUDP)); code != stun.CodeUnauthorized {
+			t.Errorf("unexpected code %d", code)
+		}
+	})
+	t.Run("StaleNonce", func(t *testing.T) {
+		nonce := c.nonce
+		defer func() { c.nonce = nonce }()
+		c.nonce = stun.NewNonce("bad")
+		if code := errorCode(c.do(turn.AllocateRequest, turn.RequestedTransportUDP)); code != stun.CodeStaleNonce {
+			t.Errorf("unexpected code %d", code)
+		}
+	})
+	if ports.opened != 0 {
+		t.Fatalf("%d relay sockets opened before auth", ports.opened)
+	}
+	if n := s.allocs.Stats().Allocations; n != 0 {
+		t.Fatalf("unexpected allocations count %d", n)
+	}
+	if res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP); res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	if ports.opened != 1 {
+		t.Errorf("unexpected relay sockets count %d", ports.opened)
+	}
+}
+
+func TestServer_processMessageNonceReuse(t *testing.T) {
+	s, stop := newServer(t)
+	defer stop()
+	a := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	b := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 2), Port: 34567})
+	b.nonce = a.nonce
+	if code := errorCode(b.do(turn.AllocateRequest, turn.RequestedTransportUDP)); code != stun.CodeStaleNonce {
+		t.Errorf("unexpected code %d", code)
+	}
+	if res := a.do(turn.AllocateRequest, turn.RequestedTransportUDP); res.Type.Class != stun.ClassSuccessResponse {
+		t.Errorf("unexpected response: %s", res)
+	}
+}
+
+func TestServer_processMessageMalformed(t *testing.T) {
+	s, stop := newServer(t)
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	checkResponse := func(t *testing.T, res *stun.Message, req *stun.Message) {
+		t.Helper()
+		if code := errorCode(res); code != stun.CodeBadRequest {
+			t.Errorf("unexpected code %d", code)
+		}
+		if res.TransactionID != req.TransactionID {
+			t.Error("unexpected transaction ID")
+		}
+		if !res.Contains(stun.AttrSoftware) {
+			t.Error("no SOFTWARE")
+		}
+		if err := stun.Fingerprint.Check(res); err != nil {
+			t.Errorf("bad FINGERPRINT: %v", err)
+		}
+		for _, a := range res.Attributes {
+			if a.Length == 0 {
+				t.Errorf("zero-length %s attribute", a.Type)
+			}
+		}
+	}
+	t.Run("BadFingerprint", func(t *testing.T) {
+		m := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+		m.Raw[len(m.Raw)-1]++
+		checkResponse(t, c.process(m), m)
+	})
+	t.Run("BadAttribute", func(t *testing.T) {
+		m := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.NewSoftware("client"))
+		// Setting length of SOFTWARE attribute beyond message end.
+		m.Raw[22] = 0xff
+		checkResponse(t, c.process(m), m)
+	})
+	t.Run("BadHeader", func(t *testing.T) {
+		m := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.NewSoftware("client"))
+		// Truncating message, so header length is invalid.
+		m.Raw = m.Raw[:len(m.Raw)-4]
+		if res := c.process(m); len(res.Raw) != 0 {
+			t.Errorf("unexpected response: %s", res)
+		}
+	})
+}
+
+func TestServer_processAllocateRequestMapped(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:          "realm",
+		AllocateMapped: true,
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	var mapped stun.MappedAddress
+	if err := mapped.GetFrom(res); err != nil {
+		t.Fatal(err)
+	}
+	if !turn.Addr(mapped).Equal(c.ctx.client) {
+		t.Errorf("unexpected mapped address %s", mapped)
+	}
+	origin, err := getMappedAddressAs(res, attrResponseOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !origin.Equal(s.addr) {
+		t.Errorf("unexpected origin %s", origin)
+	}
+	// MESSAGE-INTEGRITY and FINGERPRINT should be last ones.
+	n := len(res.Attributes)
+	if n < 2 || res.Attributes[n-2].Type != stun.AttrMessageIntegrity || res.Attributes[n-1].Type != stun.AttrFingerprint {
+		t.Errorf("bad attribute order: %s", res)
+	}
+	if err := c.integrity.Check(res); err != nil {
+		t.Error(err)
+	}
+	if err := stun.Fingerprint.Check(res); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServer_processNoAllocation(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	s, stop := newServer(t, Options{
+		Realm: "realm",
+		Log:   zap.New(core),
+	})
+	defer stop()
+	// Client has no allocation, e.g. spoofed source.
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	peer := turn.PeerAddress{IP: net.IPv4(127, 0, 0, 1), Port: 34568}
+	t.Run("SendIndication", func(t *testing.T) {
+		res := c.process(stun.MustBuild(stun.TransactionID, turn.SendIndication,
+			turn.Data{1, 2, 3, 4}, peer, stun.Fingerprint,
+		))
+		if len(res.Raw) != 0 {
+			t.Errorf("unexpected response: %s", res)
+		}
+	})
+	t.Run("SendIndicationMalformed", func(t *testing.T) {
+		res := c.process(stun.MustBuild(stun.TransactionID, turn.SendIndication, stun.Fingerprint))
+		if len(res.Raw) != 0 {
+			t.Errorf("unexpected response: %s", res)
+		}
+	})
+	t.Run("ChannelData", func(t *testing.T) {
+		d := &turn.ChannelData{Number: 0x4000, Data: []byte{1, 2, 3, 4}}
+		d.Encode()
+		c.ctx.cfg = s.config()
+		c.ctx.response.Reset()
+		c.ctx.request.Raw = append(c.ctx.request.Raw[:0], d.Raw...)
+		c.ctx.cdata = &turn.ChannelData{Raw: c.ctx.request.Raw}
+		if err := s.process(c.ctx); err != nil {
+			t.Fatal(err)
+		}
+		if len(c.ctx.response.Raw) != 0 {
+			t.Error("unexpected response")
+		}
+	})
+	for _, e := range logs.All() {
+		t.Errorf("unexpected log entry: %s", e.Message)
+	}
+}
+
+// additionalFamilySetter adds raw ADDITIONAL-ADDRESS-FAMILY value.
+type additionalFamilySetter []byte
+
+func (v additionalFamilySetter) AddTo(m *stun.Message) error {
+	m.Add(attrAdditionalAddressFamily, v)
+	return nil
+}
+
+func TestServer_processAllocateRequestAdditionalFamily(t *testing.T) {
+	s, stop := newServer(t, Options{Realm: "realm"})
+	defer stop()
+	for _, tc := range []struct {
+		name  string
+		value []byte
+		code  stun.ErrorCode
+	}{
+		{"IPv6", []byte{addrFamilyIPv6, 0, 0, 0}, stun.CodeAddrFamilyNotSupported},
+		{"IPv4", []byte{addrFamilyIPv4, 0, 0, 0}, stun.CodeBadRequest},
+		{"Malformed", []byte{addrFamilyIPv6}, stun.CodeBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+			res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP,
+				additionalFamilySetter(tc.value),
+			)
+			if code := errorCode(res); code != tc.code {
+				t.Errorf("unexpected code %d", code)
+			}
+		})
+	}
+}
+
+type requestedFamilySetter []byte
+
+func (v requestedFamilySetter) AddTo(m *stun.Message) error {
+	m.Add(stun.AttrRequestedAddressFamily, v)
+	return nil
+}
+
+func TestServer_processRefreshRequestFamily(t *testing.T) {
+	s, stop := newServer(t, Options{Realm: "realm"})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	if res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP); res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	// Relay is IPv4 only, so removing IPv6 relay should fail and keep
+	// the allocation intact.
+	res := c.do(turn.RefreshRequest, turn.Lifetime{}, requestedFamilySetter{addrFamilyIPv6, 0, 0, 0})
+	if code := errorCode(res); code != stun.CodePeerAddrFamilyMismatch {
+		t.Errorf("unexpected code %d", code)
+	}
+	res = c.do(turn.RefreshRequest, turn.Lifetime{}, requestedFamilySetter{addrFamilyIPv4})
+	if code := errorCode(res); code != stun.CodeBadRequest {
+		t.Errorf("unexpected code %d", code)
+	}
+	if n := s.allocs.Stats().Allocations; n != 1 {
+		t.Fatalf("unexpected allocations count %d", n)
+	}
+	res = c.do(turn.RefreshRequest, turn.Lifetime{}, requestedFamilySetter{addrFamilyIPv4, 0, 0, 0})
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	if n := s.allocs.Stats().Allocations; n != 0 {
+		t.Errorf("unexpected allocations count %d", n)
+	}
+	res = c.do(turn.RefreshRequest, requestedFamilySetter{addrFamilyIPv4, 0, 0, 0})
+	if code := errorCode(res); code != stun.CodeAllocMismatch {
+		t.Errorf("unexpected code %d", code)
+	}
+	t.Run("Dual", func(t *testing.T) {
+		conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+		if err != nil {
+			t.Skip("IPv6 is not available")
+		}
+		if err = conn.Close(); err != nil {
+			t.Fatal(err)
+		}
+		s, stop := newServer(t, Options{Realm: "realm", RelayIP6: net.IPv6loopback})
+		defer stop()
+		peerConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peerConn.Close()
+		var (
+			c     = newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+			pa    = peerConn.LocalAddr().(*net.UDPAddr)
+			peer  = turn.Addr{IP: pa.IP, Port: pa.Port}
+			peer6 = turn.Addr{IP: net.IPv6loopback, Port: 34568}
+		)
+		res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP,
+			additionalFamilySetter{addrFamilyIPv6, 0, 0, 0},
+		)
+		if res.Type.Class != stun.ClassSuccessResponse {
+			t.Fatalf("unexpected response: %s", res)
+		}
+		addrs := relayedAddresses(t, res)
+		if len(addrs) != 2 {
+			t.Fatalf("unexpected relayed addresses %v", addrs)
+		}
+		for _, b := range []struct {
+			n    turn.ChannelNumber
+			peer turn.Addr
+		}{
+			{0x4000, peer},
+			{0x4001, peer6},
+		} {
+			res = c.do(channelBindRequest, b.n, turn.PeerAddress(b.peer))
+			if res.Type.Class != stun.ClassSuccessResponse {
+				t.Fatalf("unexpected response: %s", res)
+			}
+		}
+		res = c.do(turn.RefreshRequest, turn.Lifetime{}, requestedFamilySetter{addrFamilyIPv6, 0, 0, 0})
+		if res.Type.Class != stun.ClassSuccessResponse {
+			t.Fatalf("unexpected response: %s", res)
+		}
+		relayed, relayed6, err := s.allocs.RelayedAddrs(c.ctx.tuple)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !relayed.Equal(addrs[0]) || relayed6.IP != nil {
+			t.Errorf("unexpected relayed addresses %s, %s", relayed, relayed6)
+		}
+		if st := s.allocs.Stats(); st.Permissions != 1 || st.Bindings != 1 {
+			t.Errorf("unexpected stats %+v", st)
+		}
+		if n, boundErr := s.allocs.Bound(c.ctx.tuple, peer); boundErr != nil || n != 0x4000 {
+			t.Errorf("unexpected binding %s, %v", n, boundErr)
+		}
+		if _, sendErr := s.allocs.Send(c.ctx.tuple, peer6, []byte("data")); sendErr == nil {
+			t.Error("IPv6 peer should not be permitted")
+		}
+		if _, err = s.allocs.SendBound(c.ctx.tuple, 0x4000, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if err = peerConn.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 100)
+		n, from, err := peerConn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "data" || from.(*net.UDPAddr).Port != addrs[0].Port {
+			t.Errorf("unexpected data %q from %s", buf[:n], from)
+		}
+		// IPv6 relay socket is closed, so its port can be bound again.
+		conn, err = net.ListenUDP("udp6", &net.UDPAddr{IP: addrs[1].IP, Port: addrs[1].Port})
+		if err != nil {
+			t.Fatalf("IPv6 relay socket is not closed: %v", err)
+		}
+		if err = conn.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// Allocation is removed with the last relayed address.
+		res = c.do(turn.RefreshRequest, turn.Lifetime{}, requestedFamilySetter{addrFamilyIPv4, 0, 0, 0})
+		if res.Type.Class != stun.ClassSuccessResponse {
+			t.Fatalf("unexpected response: %s", res)
+		}
+		if n := s.allocs.Stats().Allocations; n != 0 {
+			t.Errorf("unexpected allocations count %d", n)
+		}
+	})
+}
+
+// relayedAddresses returns addresses of all XOR-RELAYED-ADDRESS
+// attributes of m.
+func relayedAddresses(t *testing.T, m *stun.Message) []turn.Addr {
+	t.Helper()
+	var addrs []turn.Addr
+	for _, a := range m.Attributes {
+		if a.Type != stun.AttrXORRelayedAddress {
+			continue
+		}
+		single := &stun.Message{TransactionID: m.TransactionID}
+		single.Add(a.Type, a.Value)
+		var addr turn.RelayedAddress
+		if err := addr.GetFrom(single); err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, turn.Addr(addr))
+	}
+	return addrs
+}
+
+func TestServer_processAllocateRequestDual(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip("IPv6 is not available")
+	}
+	if err = conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, stop := newServer(t, Options{Realm: "realm", RelayIP6: net.IPv6loopback})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	t.Run("RequestedFamily", func(t *testing.T) {
+		res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP,
+			additionalFamilySetter{addrFamilyIPv6, 0, 0, 0},
+			requestedFamilySetter{addrFamilyIPv4, 0, 0, 0},
+		)
+		if code := errorCode(res); code != stun.CodeBadRequest {
+			t.Errorf("unexpected code %d", code)
+		}
+	})
+	res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP,
+		additionalFamilySetter{addrFamilyIPv6, 0, 0, 0},
+	)
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	addrs := relayedAddresses(t, res)
+	if len(addrs) != 2 {
+		t.Fatalf("unexpected relayed addresses %v", addrs)
+	}
+	if addrFamily(addrs[0].IP) != addrFamilyIPv4 || !addrs[1].IP.Equal(net.IPv6loopback) {
+		t.Errorf("unexpected relayed addresses %v", addrs)
+	}
+	// Permissions of both families are allowed for dual allocation.
+	res = c.do(turn.CreatePermissionRequest,
+		turn.PeerAddress{IP: net.IPv4(127, 0, 0, 1), Port: 34568},
+		turn.PeerAddress{IP: net.IPv6loopback, Port: 34568},
+	)
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	// Zero lifetime removes only IPv6 relayed address, see
+	// TestServer_processRefreshRequestFamily.
+	res = c.do(turn.RefreshRequest, turn.Lifetime{}, requestedFamilySetter{addrFamilyIPv6, 0, 0, 0})
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	if n := s.allocs.Stats().Allocations; n != 1 {
+		t.Errorf("unexpected allocations count %d", n)
+	}
+}
+
+func TestServer_processAllocateRequestUserFilter(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:    "realm",
+		UserRule: filter.NewUserFilter(filter.Allow, filter.StaticUserRule(filter.Deny, "username")),
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+	if code := errorCode(res); code != stun.CodeForbidden {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	// Rules are reloadable.
+	s.setOptions(Options{Realm: "realm"})
+	res = c.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+}
+
+func TestServer_processCreatePermissionPeerFilter(t *testing.T) {
+	peer := turn.PeerAddress{IP: net.IPv4(127, 0, 0, 1), Port: 34568}
+	for _, tc := range []struct {
+		name   string
+		action filter.Action
+		code   stun.ErrorCode
+	}{
+		{"Deny", filter.Deny, stun.CodeForbidden},
+		{"Reject", filter.Reject, stun.CodeForbidden},
+		{"Drop", filter.Drop, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, stop := newServer(t, Options{
+				Realm:    "realm",
+				PeerRule: filter.NewFilter(tc.action),
+			})
+			defer stop()
+			c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+			if res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP); res.Type.Class != stun.ClassSuccessResponse {
+				t.Fatalf("unexpected response: %s", res)
+			}
+			res := c.do(turn.CreatePermissionRequest, peer)
+			if tc.code == 0 {
+				if len(res.Raw) != 0 {
+					t.Errorf("unexpected response: %s", res)
+				}
+				return
+			}
+			if code := errorCode(res); code != tc.code {
+				t.Errorf("unexpected response: %s", res)
+			}
+		})
+	}
+}
+
+func TestServer_processCreatePermissionMultiplePeers(t *testing.T) {
+	forbidden, err := filter.ForbidNet("127.0.0.3/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, stop := newServer(t, Options{
+		Realm:    "realm",
+		PeerRule: filter.NewFilter(filter.Allow, forbidden),
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	if res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP); res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	res := c.do(turn.CreatePermissionRequest,
+		turn.PeerAddress{IP: net.IPv4(127, 0, 0, 1), Port: 34568},
+		turn.PeerAddress{IP: net.IPv4(127, 0, 0, 3), Port: 34568},
+	)
+	if code := errorCode(res); code != stun.CodeForbidden {
+		t.Errorf("unexpected response: %s", res)
+	}
+	if n := s.allocs.Stats().Permissions; n != 0 {
+		t.Errorf("no permissions should be installed, got %d", n)
+	}
+	res = c.do(turn.CreatePermissionRequest,
+		turn.PeerAddress{IP: net.IPv4(127, 0, 0, 1), Port: 34568},
+		turn.PeerAddress{IP: net.IPv4(127, 0, 0, 2), Port: 34568},
+	)
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	if n := s.allocs.Stats().Permissions; n != 2 {
+		t.Errorf("unexpected permissions count %d", n)
+	}
+}
+
+func TestServer_processSendIndicationPeerFilterReload(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm: "realm",
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	if res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP); res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	peer := turn.PeerAddress{IP: net.IPv4(127, 0, 0, 1), Port: 34568}
+	if res := c.do(turn.CreatePermissionRequest, peer); res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	// Tightening peer filter after permission is created.
+	s.setOptions(Options{
+		Realm:    "realm",
+		PeerRule: filter.NewFilter(filter.Deny),
+	})
+	m := new(countingMetrics)
+	cfg := s.config()
+	cfg.metrics = m
+	s.cfg.Store(cfg)
+	c.process(stun.MustBuild(stun.TransactionID, turn.SendIndication,
+		turn.Data{1, 2, 3, 4}, peer, stun.Fingerprint,
+	))
+	if m.peerFiltered != 1 {
+		t.Errorf("indication should be dropped by filter")
+	}
+}
+
+func TestServer_processSendIndicationMaxSize(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:             "realm",
+		MaxIndicationSize: 4,
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	if res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP); res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	peer := turn.PeerAddress{IP: net.IPv4(127, 0, 0, 1), Port: 34568}
+	if res := c.do(turn.CreatePermissionRequest, peer); res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	m := new(countingMetrics)
+	cfg := s.config()
+	cfg.metrics = m
+	s.cfg.Store(cfg)
+	for _, data := range []turn.Data{
+		{1, 2, 3, 4},
+		{1, 2, 3, 4, 5},
+	} {
+		c.process(stun.MustBuild(stun.TransactionID, turn.SendIndication,
+			data, peer, stun.Fingerprint,
+		))
+	}
+	if m.oversized != 1 {
+		t.Errorf("unexpected oversized count %d", m.oversized)
+	}
+}
+
+func TestServer_processMessageUsername(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm: "realm",
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	if len(c.ctx.userFields()) != 0 {
+		t.Error("unauthenticated request should have no user fields")
+	}
+	if res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP); res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	if c.ctx.username.String() != "username" {
+		t.Errorf("unexpected username %q", c.ctx.username)
+	}
+	fields := c.ctx.userFields(zap.String("foo", "bar"))
+	if len(fields) != 3 || fields[1].Key != "username" || fields[2].Key != "realm" {
+		t.Errorf("unexpected fields %v", fields)
+	}
+}
+
+func TestServer_processAllocateRequestEvenPort(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:          "realm",
+		RejectEvenPort: true,
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP, turn.EvenPort{ReservePort: true})
+	if code := errorCode(res); code != stun.CodeUnknownAttribute {
+		t.Fatalf("unexpected code %d", code)
+	}
+	var unknown stun.UnknownAttributes
+	if err := unknown.GetFrom(res); err != nil {
+		t.Fatal(err)
+	}
+	if len(unknown) != 1 || unknown[0] != stun.AttrEvenPort {
+		t.Errorf("unexpected unknown attributes %s", unknown)
+	}
+	// Ignored by default.
+	s.setOptions(Options{Realm: "realm"})
+	res = c.do(turn.AllocateRequest, turn.RequestedTransportUDP, turn.EvenPort{ReservePort: true})
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Errorf("unexpected response: %s", res)
+	}
+}
+
+func TestServer_processAllocateRequestTransport(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm: "realm",
+	})
+	defer stop()
+	for i, tc := range []struct {
+		name  string
+		attrs []stun.Setter
+		code  stun.ErrorCode
+	}{
+		{"Missing", nil, stun.CodeBadRequest},
+		{"TCP", []stun.Setter{turn.RequestedTransport{Protocol: 6}}, stun.CodeUnsupportedTransProto},
+		{"Unknown", []stun.Setter{turn.RequestedTransport{Protocol: 255}}, stun.CodeUnsupportedTransProto},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567 + i})
+			res := c.do(turn.AllocateRequest, tc.attrs...)
+			if code := errorCode(res); code != tc.code {
+				t.Errorf("unexpected code %d", code)
+			}
+		})
+	}
+}
+
+func TestServer_processAllocateRequestAllowedTransports(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:             "realm",
+		AllowedTransports: []turn.Protocol{6},
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+	if code := errorCode(res); code != stun.CodeUnsupportedTransProto {
+		t.Fatalf("unexpected code %d", code)
+	}
+	// Only UDP is allowed by default.
+	s.setOptions(Options{Realm: "realm"})
+	res = c.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Errorf("unexpected response: %s", res)
+	}
+}
+
+func TestConfig_transportAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		transports []turn.Protocol
+		udp, tcp   bool
+	}{
+		{"Default", nil, true, false},
+		{"None", []turn.Protocol{}, false, false},
+		{"TCP", []turn.Protocol{6}, false, true},
+		{"Both", []turn.Protocol{turn.ProtoUDP, 6}, true, true},
+	} {
+		cfg := config{transports: tc.transports}
+		if got := cfg.transportAllowed(turn.ProtoUDP); got != tc.udp {
+			t.Errorf("%s: udp allowed = %v", tc.name, got)
+		}
+		if got := cfg.transportAllowed(6); got != tc.tcp {
+			t.Errorf("%s: tcp allowed = %v", tc.name, got)
+		}
+	}
+}
+
+func TestServer_processAllocateRequestLifetime(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:           "realm",
+		DefaultLifetime: time.Minute * 10,
+		MaxLifetime:     time.Hour,
+	})
+	defer stop()
+	for i, tc := range []struct {
+		name      string
+		requested time.Duration
+		granted   time.Duration
+	}{
+		{"Huge", time.Hour * 24 * 365, time.Hour},
+		{"Small", time.Second, time.Minute * 10},
+		{"InRange", time.Minute * 30, time.Minute * 30},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567 + i})
+			res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP,
+				turn.Lifetime{Duration: tc.requested},
+			)
+			if res.Type.Class != stun.ClassSuccessResponse {
+				t.Fatalf("unexpected response: %s", res)
+			}
+			var lifetime turn.Lifetime
+			if err := lifetime.GetFrom(res); err != nil {
+				t.Fatal(err)
+			}
+			if lifetime.Duration != tc.granted {
+				t.Errorf("granted %s, expected %s", lifetime.Duration, tc.granted)
+			}
+		})
+	}
+}
+
+func TestServer_DisableFingerprint(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:              "realm",
+		DisableFingerprint: true,
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	if res.Contains(stun.AttrFingerprint) {
+		t.Error("unexpected FINGERPRINT")
+	}
+	// MESSAGE-INTEGRITY should be last one and still valid.
+	n := len(res.Attributes)
+	if n == 0 || res.Attributes[n-1].Type != stun.AttrMessageIntegrity {
+		t.Errorf("bad attribute order: %s", res)
+	}
+	if err := c.integrity.Check(res); err != nil {
+		t.Error(err)
+	}
+	// Option is reloadable.
+	s.setOptions(Options{Realm: "realm"})
+	res = c.do(turn.RefreshRequest)
+	if err := stun.Fingerprint.Check(res); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServer_Quirks(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:    "realm",
+		Software: "gortcd",
+		Quirks: []Quirk{
+			{
+				Software:         "legacy",
+				NoFingerprint:    true,
+				NoResponseOrigin: true,
+				SoftwareLast:     true,
+			},
+		},
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	t.Run("Match", func(t *testing.T) {
+		res := c.process(stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+			stun.NewSoftware("legacy client 1.0"), stun.Fingerprint,
+		))
+		if res.Type.Class != stun.ClassSuccessResponse {
+			t.Fatalf("unexpected response: %s", res)
+		}
+		if res.Contains(stun.AttrFingerprint) {
+			t.Error("unexpected FINGERPRINT")
+		}
+		if res.Contains(attrResponseOrigin) {
+			t.Error("unexpected RESPONSE-ORIGIN")
+		}
+		n := len(res.Attributes)
+		if n == 0 || res.Attributes[n-1].Type != stun.AttrSoftware {
+			t.Errorf("SOFTWARE should be last: %s", res)
+		}
+	})
+	t.Run("NoMatch", func(t *testing.T) {
+		res := c.process(stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+			stun.NewSoftware("modern client"), stun.Fingerprint,
+		))
+		if res.Type.Class != stun.ClassSuccessResponse {
+			t.Fatalf("unexpected response: %s", res)
+		}
+		if err := stun.Fingerprint.Check(res); err != nil {
+			t.Error(err)
+		}
+		if !res.Contains(attrResponseOrigin) {
+			t.Error("RESPONSE-ORIGIN should be added")
+		}
+	})
+}
+
+func TestServer_processBindingRequestChangedAddress(t *testing.T) {
+	secondary := turn.Addr{IP: net.IPv4(127, 0, 0, 2), Port: 3479}
+	s, stop := newServer(t, Options{
+		Realm:         "realm",
+		SecondaryAddr: secondary,
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	res := c.process(stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint))
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	changed, err := getMappedAddressAs(res, attrChangedAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed.Equal(secondary) {
+		t.Errorf("unexpected changed address %s", changed)
+	}
+	s.setOptions(Options{Realm: "realm"})
+	res = c.process(stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint))
+	if res.Contains(attrChangedAddress) {
+		t.Error("unexpected CHANGED-ADDRESS")
+	}
+}
+
+func TestServer_processBindingRequestNATMap(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm: "realm",
+		NATMap: []NATMapping{
+			{Private: net.IPv4(10, 0, 0, 5), Public: net.IPv4(203, 0, 113, 5)},
+		},
+	})
+	defer stop()
+	for _, tc := range []struct {
+		client   turn.Addr
+		expected turn.Addr
+	}{
+		{
+			client:   turn.Addr{IP: net.IPv4(10, 0, 0, 5), Port: 34567},
+			expected: turn.Addr{IP: net.IPv4(203, 0, 113, 5), Port: 34567},
+		},
+		{
+			client:   turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567},
+			expected: turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567},
+		},
+	} {
+		c := newTestClient(t, s, tc.client)
+		res := c.process(stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint))
+		var mapped stun.XORMappedAddress
+		if err := mapped.GetFrom(res); err != nil {
+			t.Fatal(err)
+		}
+		if !turn.Addr(mapped).Equal(tc.expected) {
+			t.Errorf("%s: unexpected mapped address %s", tc.client, mapped)
+		}
+	}
+}
+
+func TestServer_ListenerServices(t *testing.T) {
+	serverConn, serverAddr := listenUDP(t)
+	s, stop := newServer(t, Options{
+		Realm: "realm",
+		Conn:  serverConn,
+		ListenerServices: []ListenerServices{
+			{Addr: turn.Addr{IP: net.IPv4zero, Port: serverAddr.Port}, Services: ServiceSTUN},
+		},
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	res := c.process(stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint))
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	res = c.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+	if code := errorCode(res); code != stun.CodeBadRequest {
+		t.Errorf("unexpected response: %s", res)
+	}
+}
+
+func TestServer_processUnsupportedMethod(t *testing.T) {
+	s, stop := newServer(t, Options{Realm: "realm"})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	for _, tc := range []struct {
+		method stun.Method
+		code   stun.ErrorCode
+	}{
+		{stun.MethodConnect, codeMethodNotAllowed},
+		{stun.MethodConnectionBind, codeMethodNotAllowed},
+		{stun.Method(0x0ff), stun.CodeBadRequest},
+	} {
+		res := c.do(stun.NewType(tc.method, stun.ClassRequest))
+		if code := errorCode(res); code != tc.code {
+			t.Errorf("%s: unexpected code %d", tc.method, code)
+		}
+	}
+}
+
+func TestServer_processChannelBindingNumber(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm: "realm",
+	})
+	defer stop()
+	peer := turn.PeerAddress{IP: net.IPv4(127, 0, 0, 2), Port: 1234}
+	for i, tc := range []struct {
+		name     string
+		allocate bool
+		number   turn.ChannelNumber
+		code     stun.ErrorCode
+	}{
+		{"Invalid", true, 0x3FFF, stun.CodeBadRequest},
+		{"InvalidNoAllocation", false, 0x3FFF, stun.CodeBadRequest},
+		{"Reserved", true, 0x8000, stun.CodeBadRequest},
+		{"NoAllocation", false, 0x4000, stun.CodeAllocMismatch},
+		{"Valid", true, 0x4000, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567 + i})
+			if tc.allocate {
+				if res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP); res.Type.Class != stun.ClassSuccessResponse {
+					t.Fatalf("unexpected response: %s", res)
+				}
+			}
+			res := c.do(channelBindRequest, tc.number, peer)
+			if code := errorCode(res); code != tc.code {
+				t.Errorf("unexpected code %d", code)
+			}
+		})
+	}
+}
+
+func TestServer_processAllocateRequestFailureMetrics(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:          "realm",
+		MaxAllocations: 1,
+	})
+	defer stop()
+	m := new(countingMetrics)
+	cfg := s.config()
+	cfg.metrics = m
+	s.cfg.Store(cfg)
+	first := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	if res := first.do(turn.AllocateRequest, turn.RequestedTransportUDP); res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	if res := first.do(turn.AllocateRequest, turn.RequestedTransportUDP); errorCode(res) != stun.CodeAllocMismatch {
+		t.Errorf("unexpected response: %s", res)
+	}
+	second := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34568})
+	if res := second.do(turn.AllocateRequest, turn.RequestedTransportUDP); errorCode(res) != stun.CodeInsufficientCapacity {
+		t.Errorf("unexpected response: %s", res)
+	}
+	for reason, expected := range map[allocationFailure]int{
+		allocationMismatch:    1,
+		allocationCapacity:    1,
+		allocationQuota:       0,
+		allocationServerError: 0,
+	} {
+		if got := m.allocationFailures[reason]; got != expected {
+			t.Errorf("%s: unexpected count %d", reason, got)
+		}
+	}
+}
@@ -1,13 +1,53 @@
 package server
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gortc.io/gortcd/internal/auth"
+	"gortc.io/gortcd/internal/filter"
+)
 
 type noopMetrics struct{}
 
-func (noopMetrics) incSTUNMessages() {}
+func (noopMetrics) incSTUNMessages()           {}
+func (noopMetrics) incStaleNonce()             {}
+func (noopMetrics) incRateLimited()            {}
+func (noopMetrics) incMalformedChannelData()   {}
+func (noopMetrics) incPeerFiltered()           {}
+func (noopMetrics) incOversized()              {}
+func (noopMetrics) observePrune(time.Duration) {}
+
+func (noopMetrics) incAllocationFailure(allocationFailure) {}
 
 type promMetrics struct {
 	stunMessages prometheus.Counter
+	staleNonce   prometheus.Counter
+	rateLimited  prometheus.Counter
+	malformedCD  prometheus.Counter
+	peerFiltered prometheus.Counter
+	oversized    prometheus.Counter
+	allocFailed  *prometheus.CounterVec
+	prune        prometheus.Histogram
+
+	// Servers of listeners with same name share metrics, so gauges are
+	// summed over sources of all servers.
+	sourcesMux sync.Mutex
+	sources    []metricsSource
+
+	workersActive     *prometheus.Desc
+	workersQueued     *prometheus.Desc
+	connectionsActive *prometheus.Desc
+	noncesIssued      *prometheus.Desc
+	noncesValidated   *prometheus.Desc
+	noncesStale       *prometheus.Desc
+	noncesActive      *prometheus.Desc
+	keyCacheHits      *prometheus.Desc
+	keyCacheMisses    *prometheus.Desc
+	keyCacheSize      *prometheus.Desc
+	filterHits        *prometheus.Desc
 }
 
 func newPromMetrics(labels prometheus.Labels) *promMetrics {
@@ -17,16 +57,228 @@ func newPromMetrics(labels prometheus.Labels) *promMetrics {
 			Help:        "gortcd received STUN messages count excluding filtered by rules",
 			ConstLabels: labels,
 		}),
+		staleNonce: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "gortcd_stale_nonce_total",
+			Help:        "gortcd 438 (Stale Nonce) responses count",
+			ConstLabels: labels,
+		}),
+		rateLimited: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "gortcd_ratelimited_total",
+			Help:        "gortcd packets dropped by rate limiter count",
+			ConstLabels: labels,
+		}),
+		malformedCD: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "gortcd_malformed_channeldata_total",
+			Help:        "gortcd dropped ChannelData messages with invalid length count",
+			ConstLabels: labels,
+		}),
+		peerFiltered: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "gortcd_peer_filtered_total",
+			Help:        "gortcd Send indications dropped by peer filter count",
+			ConstLabels: labels,
+		}),
+		oversized: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "gortcd_oversized_total",
+			Help:        "gortcd packets and Send indications dropped because of size count",
+			ConstLabels: labels,
+		}),
+		allocFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "gortcd_allocation_failures_total",
+			Help:        "gortcd failed Allocate requests count by reason",
+			ConstLabels: labels,
+		}, []string{"reason"}),
+		prune: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "gortcd_prune_duration_seconds",
+			Help:        "gortcd duration of periodic allocation and rate limiter pruning",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(0.00001, 4, 10), // 10µs to 2.6s
+		}),
+		workersActive: prometheus.NewDesc("gortcd_workers_active",
+			"gortcd workers that are currently processing packets", nil, labels,
+		),
+		workersQueued: prometheus.NewDesc("gortcd_workers_queued",
+			"gortcd packets that are waiting for free worker", nil, labels,
+		),
+		connectionsActive: prometheus.NewDesc("gortcd_active_connections",
+			"gortcd open TCP connections of listener", nil, labels,
+		),
+		noncesIssued: prometheus.NewDesc("gortcd_nonces_issued_total",
+			"gortcd issued nonces count, including rotated ones", nil, labels,
+		),
+		noncesValidated: prometheus.NewDesc("gortcd_nonces_validated_total",
+			"gortcd valid nonce checks count", nil, labels,
+		),
+		noncesStale: prometheus.NewDesc("gortcd_nonces_stale_total",
+			"gortcd nonces rejected as stale count", nil, labels,
+		),
+		noncesActive: prometheus.NewDesc("gortcd_nonces_active",
+			"gortcd currently tracked nonces", nil, labels,
+		),
+		keyCacheHits: prometheus.NewDesc("gortcd_auth_key_cache_hits_total",
+			"gortcd long-term keys found in cache count", nil, labels,
+		),
+		keyCacheMisses: prometheus.NewDesc("gortcd_auth_key_cache_misses_total",
+			"gortcd long-term keys derived on cache miss count", nil, labels,
+		),
+		keyCacheSize: prometheus.NewDesc("gortcd_auth_key_cache_size",
+			"gortcd currently cached long-term keys", nil, labels,
+		),
+		filterHits: prometheus.NewDesc("gortcd_filter_hits_total",
+			"gortcd matches of client and peer filtering rules count",
+			[]string{"filter", "rule", "action"}, labels,
+		),
 	}
 	return p
 }
 
+// metricsSource provides gauges of single server.
+type metricsSource struct {
+	workers     func() (active, queued int) // optional
+	connections func() int                  // optional, for stream listeners
+	nonces      func() auth.NonceStats      // optional
+	keys        keyCacheStatser             // optional
+	filters     func() []namedRule          // optional
+}
+
+// namedRule is client or peer filtering rule of server.
+type namedRule struct {
+	name string // "client" or "peer"
+	rule filter.Rule
+}
+
+// filterHitKey is label set of gortcd_filter_hits_total.
+type filterHitKey struct {
+	filter string
+	rule   string
+	action filter.Action
+}
+
+func (m *promMetrics) addSource(src metricsSource) {
+	m.sourcesMux.Lock()
+	m.sources = append(m.sources, src)
+	m.sourcesMux.Unlock()
+}
+
 func (m *promMetrics) Describe(d chan<- *prometheus.Desc) {
 	d <- m.stunMessages.Desc()
+	d <- m.staleNonce.Desc()
+	d <- m.rateLimited.Desc()
+	d <- m.malformedCD.Desc()
+	d <- m.peerFiltered.Desc()
+	d <- m.oversized.Desc()
+	m.allocFailed.Describe(d)
+	d <- m.prune.Desc()
+	d <- m.workersActive
+	d <- m.workersQueued
+	d <- m.connectionsActive
+	d <- m.noncesIssued
+	d <- m.noncesValidated
+	d <- m.noncesStale
+	d <- m.noncesActive
+	d <- m.keyCacheHits
+	d <- m.keyCacheMisses
+	d <- m.keyCacheSize
+	d <- m.filterHits
 }
 
 func (m *promMetrics) Collect(c chan<- prometheus.Metric) {
 	m.stunMessages.Collect(c)
+	m.staleNonce.Collect(c)
+	m.rateLimited.Collect(c)
+	m.malformedCD.Collect(c)
+	m.peerFiltered.Collect(c)
+	m.oversized.Collect(c)
+	m.allocFailed.Collect(c)
+	m.prune.Collect(c)
+	m.sourcesMux.Lock()
+	sources := m.sources
+	m.sourcesMux.Unlock()
+	var (
+		workers, connections, nonces bool
+		active, queued, open         int
+		s                            auth.NonceStats
+		k                            auth.KeyCacheStats
+		hits                         = make(map[filterHitKey]uint64)
+		// Servers can share same rule lists and authenticator, so
+		// counting each once.
+		seen     = make(map[*filter.List]bool)
+		seenKeys = make(map[keyCacheStatser]bool)
+	)
+	for _, src := range sources {
+		if src.filters != nil {
+			for _, r := range src.filters() {
+				list, ok := r.rule.(*filter.List)
+				if !ok || seen[list] {
+					continue
+				}
+				seen[list] = true
+				for _, h := range list.Hits() {
+					hits[filterHitKey{filter: r.name, rule: h.Rule, action: h.Action}] += h.Hits
+				}
+			}
+		}
+		if src.workers != nil {
+			a, q := src.workers()
+			active, queued, workers = active+a, queued+q, true
+		}
+		if src.connections != nil {
+			open, connections = open+src.connections(), true
+		}
+		if src.nonces != nil {
+			n := src.nonces()
+			s.Issued += n.Issued
+			s.Validated += n.Validated
+			s.Stale += n.Stale
+			s.Active += n.Active
+			nonces = true
+		}
+		if src.keys != nil && !seenKeys[src.keys] {
+			seenKeys[src.keys] = true
+			n := src.keys.KeyCacheStats()
+			k.Hits += n.Hits
+			k.Misses += n.Misses
+			k.Size += n.Size
+		}
+	}
+	if workers {
+		c <- prometheus.MustNewConstMetric(m.workersActive, prometheus.GaugeValue, float64(active))
+		c <- prometheus.MustNewConstMetric(m.workersQueued, prometheus.GaugeValue, float64(queued))
+	}
+	if connections {
+		c <- prometheus.MustNewConstMetric(m.connectionsActive, prometheus.GaugeValue, float64(open))
+	}
+	if nonces {
+		c <- prometheus.MustNewConstMetric(m.noncesIssued, prometheus.CounterValue, float64(s.Issued))
+		c <- prometheus.MustNewConstMetric(m.noncesValidated, prometheus.CounterValue, float64(s.Validated))
+		c <- prometheus.MustNewConstMetric(m.noncesStale, prometheus.CounterValue, float64(s.Stale))
+		c <- prometheus.MustNewConstMetric(m.noncesActive, prometheus.GaugeValue, float64(s.Active))
+	}
+	if len(seenKeys) > 0 {
+		c <- prometheus.MustNewConstMetric(m.keyCacheHits, prometheus.CounterValue, float64(k.Hits))
+		c <- prometheus.MustNewConstMetric(m.keyCacheMisses, prometheus.CounterValue, float64(k.Misses))
+		c <- prometheus.MustNewConstMetric(m.keyCacheSize, prometheus.GaugeValue, float64(k.Size))
+	}
+	for h, n := range hits {
+		c <- prometheus.MustNewConstMetric(m.filterHits, prometheus.CounterValue, float64(n),
+			h.filter, h.rule, h.action.String(),
+		)
+	}
 }
 
 func (m *promMetrics) incSTUNMessages() { m.stunMessages.Inc() }
+
+func (m *promMetrics) incStaleNonce() { m.staleNonce.Inc() }
+
+func (m *promMetrics) incRateLimited() { m.rateLimited.Inc() }
+
+func (m *promMetrics) incMalformedChannelData() { m.malformedCD.Inc() }
+
+func (m *promMetrics) incPeerFiltered() { m.peerFiltered.Inc() }
+
+func (m *promMetrics) incOversized() { m.oversized.Inc() }
+
+func (m *promMetrics) incAllocationFailure(reason allocationFailure) {
+	m.allocFailed.WithLabelValues(string(reason)).Inc()
+}
+
+func (m *promMetrics) observePrune(d time.Duration) { m.prune.Observe(d.Seconds()) }
@@ -2,18 +2,47 @@ package server
 
 import (
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+
+	"gortc.io/gortcd/internal/auth"
+	"gortc.io/gortcd/internal/filter"
+	"gortc.io/turn"
 )
 
 func TestPromMetrics(t *testing.T) {
 	pm := newPromMetrics(prometheus.Labels{"foo": "bar"})
+	pm.addSource(metricsSource{
+		workers:     func() (int, int) { return 1, 2 },
+		connections: func() int { return 3 },
+		nonces:      func() auth.NonceStats { return auth.NonceStats{Issued: 2, Active: 1} },
+	})
+	peer := filter.NewFilter(filter.Deny)
+	peer.Action(turn.Addr{})
+	pm.addSource(metricsSource{
+		workers: func() (int, int) { return 3, 4 },
+		filters: func() []namedRule { return []namedRule{{name: "peer", rule: peer}} },
+	})
+	// Same rule list should be counted once.
+	pm.addSource(metricsSource{
+		filters: func() []namedRule {
+			return []namedRule{{name: "peer", rule: peer}, {name: "client", rule: filter.AllowAll}}
+		},
+	})
 	reg := prometheus.NewPedanticRegistry()
 	if err := reg.Register(pm); err != nil {
 		t.Error(err)
 	}
 	for i := 0; i < 10; i++ {
 		pm.incSTUNMessages()
+		pm.incStaleNonce()
+		pm.incRateLimited()
+		pm.incMalformedChannelData()
+		pm.incPeerFiltered()
+		pm.incOversized()
+		pm.incAllocationFailure(allocationQuota)
+		pm.observePrune(time.Millisecond)
 	}
 	if _, err := reg.Gather(); err != nil {
 		t.Error(err)
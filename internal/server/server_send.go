@@ -1,6 +1,9 @@
 package server
 
 import (
+	"net"
+	"sync"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
@@ -15,10 +18,54 @@ func (s *Server) sendByBinding(ctx *context, n turn.ChannelNumber, data []byte)
 	return err
 }
 
-func (s *Server) sendByPermission(ctx *context, addr turn.Addr, data []byte) error {
+// sendByPermission relays data to addr, setting DF bit on datagram if
+// dontFragment is true.
+func (s *Server) sendByPermission(ctx *context, addr turn.Addr, data []byte, dontFragment bool) error {
 	if ce := s.log.Check(zapcore.DebugLevel, "searching for allocation"); ce != nil {
 		ce.Write(zap.Stringer("tuple", ctx.tuple), zap.Stringer("addr", addr))
 	}
-	_, err := s.allocs.Send(ctx.tuple, addr, data)
+	var err error
+	if dontFragment {
+		_, err = s.allocs.SendDontFragment(ctx.tuple, addr, data)
+	} else {
+		_, err = s.allocs.Send(ctx.tuple, addr, data)
+	}
+	return err
+}
+
+// channelDataBuffer is reusable buffer for sending ChannelData messages.
+type channelDataBuffer struct {
+	raw  []byte
+	addr net.UDPAddr
+}
+
+var channelDataPool = &sync.Pool{
+	New: func() interface{} {
+		return &channelDataBuffer{raw: make([]byte, 0, 2048)}
+	},
+}
+
+// appendChannelData appends ChannelData message with channel number n
+// and payload d to buf, padding it to 4 bytes like turn.ChannelData.Encode.
+//
+// See RFC 5766 Section 11.4.
+func appendChannelData(buf []byte, n turn.ChannelNumber, d []byte) []byte {
+	buf = append(buf, byte(n>>8), byte(n), byte(len(d)>>8), byte(len(d)))
+	buf = append(buf, d...)
+	for len(buf)%4 != 0 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+// sendChannelData writes ChannelData message to client without allocations.
+func (s *Server) sendChannelData(n turn.ChannelNumber, d []byte, client turn.Addr) error {
+	b := channelDataPool.Get().(*channelDataBuffer)
+	b.raw = appendChannelData(b.raw[:0], n, d)
+	b.addr.IP = client.IP
+	b.addr.Port = client.Port
+	_, err := s.conn.WriteTo(b.raw, &b.addr)
+	b.addr.IP = nil
+	channelDataPool.Put(b)
 	return err
 }
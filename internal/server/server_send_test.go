@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gortc.io/gortcd/internal/testutil"
+	"gortc.io/turn"
+)
+
+// discardConn is net.PacketConn that discards all writes.
+type discardConn struct {
+	net.PacketConn
+	addr    net.Addr
+	written int
+}
+
+func (c *discardConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.written += len(b)
+	return len(b), nil
+}
+
+func (c *discardConn) LocalAddr() net.Addr                { return c.addr }
+func (c *discardConn) SetWriteDeadline(t time.Time) error { return nil }
+func (c *discardConn) Close() error                       { return nil }
+
+func TestAppendChannelData(t *testing.T) {
+	for _, size := range []int{0, 1, 3, 4, 5, 100} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		raw := appendChannelData(nil, 0x4001, data)
+		if len(raw)%4 != 0 {
+			t.Errorf("%d: not padded", size)
+		}
+		c := &turn.ChannelData{Raw: raw}
+		if err := c.Decode(); err != nil {
+			t.Fatalf("%d: %v", size, err)
+		}
+		if c.Number != 0x4001 {
+			t.Errorf("%d: unexpected number %s", size, c.Number)
+		}
+		if !bytes.Equal(c.Data, data) {
+			t.Errorf("%d: unexpected data", size)
+		}
+	}
+}
+
+func TestServer_HandlePeerData(t *testing.T) {
+	conn := &discardConn{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3478}}
+	s, stop := newServer(t, Options{
+		Log:  zap.NewNop(),
+		Conn: conn,
+	})
+	defer stop()
+	var (
+		now   = time.Now()
+		peer  = turn.Addr{IP: net.IPv4(127, 0, 0, 2), Port: 1234}
+		tuple = turn.FiveTuple{
+			Client: turn.Addr{IP: net.IPv4(127, 0, 0, 3), Port: 4321},
+			Server: s.addr,
+			Proto:  turn.ProtoUDP,
+		}
+	)
+	if _, err := s.allocs.New(tuple, "", now.Add(time.Minute), s); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s.allocs.Remove(tuple); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := s.allocs.ChannelBind(tuple, 0x4001, peer, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 100)
+	s.HandlePeerData(data, tuple, peer)
+	if conn.written != len(data)+4 {
+		t.Errorf("unexpected written length %d", conn.written)
+	}
+	t.Run("ZeroAlloc", func(t *testing.T) {
+		testutil.ShouldNotAllocate(t, func() {
+			s.HandlePeerData(data, tuple, peer)
+		})
+	})
+}
+
+func TestServer_HandlePeerDataIndications(t *testing.T) {
+	conn := &discardConn{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3478}}
+	s, stop := newServer(t, Options{
+		Log:             zap.NewNop(),
+		Conn:            conn,
+		DataIndications: true,
+	})
+	defer stop()
+	var (
+		now   = time.Now()
+		peer  = turn.Addr{IP: net.IPv4(127, 0, 0, 2), Port: 1234}
+		tuple = turn.FiveTuple{
+			Client: turn.Addr{IP: net.IPv4(127, 0, 0, 3), Port: 4321},
+			Server: s.addr,
+			Proto:  turn.ProtoUDP,
+		}
+	)
+	if _, err := s.allocs.New(tuple, "", now.Add(time.Minute), s); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s.allocs.Remove(tuple); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := s.allocs.ChannelBind(tuple, 0x4001, peer, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 100)
+	s.HandlePeerData(data, tuple, peer)
+	// Data indication has STUN header and attributes, so it is larger
+	// than ChannelData.
+	if conn.written <= len(data)+4 {
+		t.Errorf("unexpected written length %d", conn.written)
+	}
+	// Option is reloadable.
+	s.setOptions(Options{})
+	conn.written = 0
+	s.HandlePeerData(data, tuple, peer)
+	if conn.written != len(data)+4 {
+		t.Errorf("unexpected written length %d", conn.written)
+	}
+}
@@ -1,17 +1,27 @@
 package server
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"runtime"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/libp2p/go-reuseport"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"go.uber.org/zap/zaptest/observer"
 
 	"gortc.io/stun"
 
+	"gortc.io/gortcd/internal/allocator"
 	"gortc.io/gortcd/internal/auth"
+	"gortc.io/gortcd/internal/filter"
 	"gortc.io/gortcd/internal/testutil"
 	"gortc.io/turn"
 )
@@ -135,6 +145,75 @@ func TestServer_notStun(t *testing.T) {
 
 var cfgNoop = config{metrics: metricsNoop}
 
+type countingMetrics struct {
+	noopMetrics
+	malformedChannelData int
+	prunes               int
+	peerFiltered         int
+	oversized            int
+	allocationFailures   map[allocationFailure]int
+}
+
+func (m *countingMetrics) incAllocationFailure(reason allocationFailure) {
+	if m.allocationFailures == nil {
+		m.allocationFailures = make(map[allocationFailure]int)
+	}
+	m.allocationFailures[reason]++
+}
+
+func (m *countingMetrics) incPeerFiltered() { m.peerFiltered++ }
+
+func (m *countingMetrics) incOversized() { m.oversized++ }
+
+func (m *countingMetrics) incMalformedChannelData() { m.malformedChannelData++ }
+
+func (m *countingMetrics) observePrune(time.Duration) { m.prunes++ }
+
+func TestServer_collectObservesPrune(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Log:         zap.NewNop(),
+		ManualStart: true,
+	})
+	defer stop()
+	m := new(countingMetrics)
+	s.cfg.Store(config{metrics: m})
+	s.collect(time.Now())
+	if m.prunes != 1 {
+		t.Errorf("unexpected prune observations: %d", m.prunes)
+	}
+}
+
+func TestServer_malformedChannelData(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Log: zap.NewNop(),
+	})
+	defer stop()
+	m := new(countingMetrics)
+	ctx := &context{
+		request:  new(stun.Message),
+		response: new(stun.Message),
+		cdata:    new(turn.ChannelData),
+		cfg:      config{metrics: m},
+		client:   turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567},
+	}
+	// Channel 0x4001 with length 0xFFFF, but only 4 bytes of data.
+	ctx.request.Raw = []byte{0x40, 0x01, 0xFF, 0xFF, 1, 2, 3, 4}
+	if err := s.process(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if m.malformedChannelData != 1 {
+		t.Errorf("unexpected malformed count %d", m.malformedChannelData)
+	}
+	if len(ctx.response.Raw) != 0 {
+		t.Error("unexpected response")
+	}
+	testutil.ShouldNotAllocate(t, func() {
+		if err := s.process(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
 func TestServer_badRequest(t *testing.T) {
 	s, stop := newServer(t)
 	defer stop()
@@ -186,3 +265,612 @@ func TestServer_badFingerprint(t *testing.T) {
 		t.Error("unexpected success")
 	}
 }
+
+func TestServer_ServeReusePort(t *testing.T) {
+	if !reuseport.Available() {
+		t.Skip("reuseport is not available")
+	}
+	serverConn, err := reuseport.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	serverAddr := serverConn.LocalAddr().(*net.UDPAddr)
+	s, err := New(Options{
+		Log:         zap.NewNop(),
+		Conn:        serverConn,
+		ReusePort:   true,
+		ManualStart: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if serveErr := s.Serve(); serveErr != nil {
+			t.Error(serveErr)
+		}
+	}()
+	defer func() {
+		if closeErr := s.Close(); closeErr != nil {
+			t.Error(closeErr)
+		}
+		<-done
+	}()
+	// Kernel distributes packets between sockets by source address, so
+	// using multiple clients to hit all sockets of REUSEPORT group.
+	for i := 0; i < 32; i++ {
+		c, _ := listenUDP(t)
+		req := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+		buf := make([]byte, 1024)
+		var (
+			n    int
+			from *net.UDPAddr
+		)
+		// Retrying because workers can still be starting.
+		for attempt := 0; attempt < 10 && n == 0; attempt++ {
+			if _, err = c.WriteToUDP(req.Raw, serverAddr); err != nil {
+				t.Fatal(err)
+			}
+			if err = c.SetReadDeadline(time.Now().Add(time.Millisecond * 100)); err != nil {
+				t.Fatal(err)
+			}
+			n, from, _ = c.ReadFromUDP(buf)
+		}
+		if n == 0 {
+			t.Fatalf("client %d: no response", i)
+		}
+		if !from.IP.Equal(serverAddr.IP) || from.Port != serverAddr.Port {
+			t.Errorf("client %d: response from %s, expected %s", i, from, serverAddr)
+		}
+		if closeErr := c.Close(); closeErr != nil {
+			t.Error(closeErr)
+		}
+	}
+}
+
+func TestServer_ReusePortPeerDataSource(t *testing.T) {
+	if !reuseport.Available() {
+		t.Skip("reuseport is not available")
+	}
+	serverConn, err := reuseport.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	serverAddr := serverConn.LocalAddr().(*net.UDPAddr)
+	s, err := New(Options{
+		Log:         zap.NewNop(),
+		Conn:        serverConn,
+		ReusePort:   true,
+		ManualStart: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if serveErr := s.Serve(); serveErr != nil {
+			t.Error(serveErr)
+		}
+	}()
+	defer func() {
+		if closeErr := s.Close(); closeErr != nil {
+			t.Error(closeErr)
+		}
+		<-done
+	}()
+	c, clientAddr := listenUDP(t)
+	defer func() {
+		if closeErr := c.Close(); closeErr != nil {
+			t.Error(closeErr)
+		}
+	}()
+	// Peer data is written via primary socket regardless of which socket
+	// of group received client requests, so source must be the same.
+	s.HandlePeerData([]byte{1, 2, 3}, turn.FiveTuple{
+		Client: turn.Addr{IP: clientAddr.IP, Port: clientAddr.Port},
+		Server: turn.Addr{IP: serverAddr.IP, Port: serverAddr.Port},
+		Proto:  turn.ProtoUDP,
+	}, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 5000})
+	buf := make([]byte, 1024)
+	if err = c.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, from, err := c.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !from.IP.Equal(serverAddr.IP) || from.Port != serverAddr.Port {
+		t.Errorf("data from %s, expected %s", from, serverAddr)
+	}
+	if !stun.IsMessage(buf[:n]) {
+		t.Error("expected data indication")
+	}
+}
+
+func TestNew_RelayIP(t *testing.T) {
+	t.Run("NotLocal", func(t *testing.T) {
+		serverConn, _ := listenUDP(t)
+		if _, err := New(Options{
+			Conn:        serverConn,
+			RelayIP:     net.IPv4(192, 0, 2, 1),
+			ManualStart: true,
+		}); err == nil {
+			t.Error("should error")
+		}
+	})
+	t.Run("Unspecified", func(t *testing.T) {
+		serverConn, _ := listenUDP(t)
+		if _, err := New(Options{
+			Conn:        serverConn,
+			RelayIP:     net.IPv4zero,
+			ManualStart: true,
+		}); err == nil {
+			t.Error("should error")
+		}
+	})
+	t.Run("Loopback", func(t *testing.T) {
+		relayIP := net.IPv4(127, 0, 0, 2)
+		s, stop := newServer(t, Options{
+			Realm:   "realm",
+			RelayIP: relayIP,
+		})
+		defer stop()
+		c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+		res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+		if res.Type.Class != stun.ClassSuccessResponse {
+			t.Fatalf("unexpected response: %s", res)
+		}
+		var relayed turn.RelayedAddress
+		if err := relayed.GetFrom(res); err != nil {
+			t.Fatal(err)
+		}
+		if !relayed.IP.Equal(relayIP) {
+			t.Errorf("unexpected relayed address %s", relayed)
+		}
+	})
+}
+
+func TestServer_RelayExternalIP(t *testing.T) {
+	externalIP := net.IPv4(198, 51, 100, 10)
+	s, stop := newServer(t, Options{
+		Realm:           "realm",
+		RelayExternalIP: externalIP,
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	var relayed turn.RelayedAddress
+	if err := relayed.GetFrom(res); err != nil {
+		t.Fatal(err)
+	}
+	if !relayed.IP.Equal(externalIP) {
+		t.Errorf("unexpected relayed address %s", relayed)
+	}
+}
+
+// closeRecordingConn counts Close calls.
+type closeRecordingConn struct {
+	net.PacketConn
+	closed *int32
+}
+
+func (c closeRecordingConn) Close() error {
+	atomic.AddInt32(c.closed, 1)
+	return c.PacketConn.Close()
+}
+
+// closeRecordingPortAllocator counts closed relay sockets.
+type closeRecordingPortAllocator struct {
+	allocator.NetPortAllocator
+	closed int32
+}
+
+func (a *closeRecordingPortAllocator) AllocatePort(proto turn.Protocol, network, defaultAddr string) (allocator.NetAllocation, error) {
+	n, err := a.NetPortAllocator.AllocatePort(proto, network, defaultAddr)
+	if err != nil {
+		return n, err
+	}
+	n.Conn = closeRecordingConn{PacketConn: n.Conn, closed: &a.closed}
+	return n, nil
+}
+
+func TestServer_PooledPortAllocator(t *testing.T) {
+	// Single port, so pool is exhausted if port is not returned.
+	pool, err := allocator.NewSystemPortPooledAllocator(zap.NewNop(), net.IPv4(127, 0, 0, 1), 34040, 34040)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	ports := &closeRecordingPortAllocator{NetPortAllocator: pool}
+	s, stop := newServer(t, Options{
+		Realm:         "realm",
+		PortAllocator: ports,
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	var relayed turn.RelayedAddress
+	if err = relayed.GetFrom(res); err != nil {
+		t.Fatal(err)
+	}
+	if relayed.Port != 34040 {
+		t.Fatalf("relayed address %s is not from pool", relayed)
+	}
+	peerConn, peerAddr := listenUDP(t)
+	defer peerConn.Close()
+	peer := turn.PeerAddress{IP: peerAddr.IP, Port: peerAddr.Port}
+	if res = c.do(turn.CreatePermissionRequest, peer); res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	c.process(stun.MustBuild(stun.TransactionID, turn.SendIndication,
+		turn.Data{1, 2, 3, 4}, peer, stun.Fingerprint,
+	))
+	buf := make([]byte, 1024)
+	if err = peerConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, from, err := peerConn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], []byte{1, 2, 3, 4}) {
+		t.Errorf("unexpected data %x", buf[:n])
+	}
+	if from.Port != relayed.Port {
+		t.Errorf("data from %s, expected %s", from, relayed)
+	}
+	// Port should be returned to pool on deallocation.
+	if res = c.do(turn.RefreshRequest, turn.Lifetime{}); res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	if closed := atomic.LoadInt32(&ports.closed); closed != 1 {
+		t.Fatalf("relay socket closed %d times, expected 1", closed)
+	}
+	if res = c.do(turn.AllocateRequest, turn.RequestedTransportUDP); res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	if err = relayed.GetFrom(res); err != nil {
+		t.Fatal(err)
+	}
+	if relayed.Port != 34040 {
+		t.Errorf("relayed address %s is not from pool", relayed)
+	}
+}
+
+func TestServer_ListenerNames(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	var servers []*Server
+	for i := 0; i < 2; i++ {
+		conn, addr := listenUDP(t)
+		s, err := New(Options{
+			Log:         zap.NewNop(),
+			Conn:        conn,
+			Registry:    reg,
+			ManualStart: true,
+			ListenerNames: []ListenerName{
+				{Addr: turn.Addr{IP: net.IPv4zero, Port: addr.Port}, Name: "public"},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		servers = append(servers, s)
+	}
+	// Servers with same name should share metrics instead of failing
+	// registration.
+	if servers[0].promMetrics != servers[1].promMetrics {
+		t.Error("metrics should be shared")
+	}
+	if _, err := reg.Gather(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServer_RealmQuota(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:       "realm",
+		RealmQuotas: map[string]int{"realm": 1},
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	c = newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34568})
+	res = c.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+	if code := errorCode(res); code != stun.CodeAllocQuotaReached {
+		t.Errorf("unexpected code %d", code)
+	}
+}
+
+func TestServer_RealmQuotaAnyRealm(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:       "realm",
+		RealmQuotas: map[string]int{"realm": 1},
+		Auth: auth.NewStatic([]auth.StaticCredential{
+			{Username: "username", Password: "secret", Realm: auth.AnyRealm},
+		}),
+	})
+	defer stop()
+	c := newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34567})
+	res := c.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	// Wildcard credential can't escape quota by choosing unlisted realm.
+	c = newTestClient(t, s, turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 34568})
+	c.realm = stun.NewRealm("unlisted.org")
+	c.integrity = stun.NewLongTermIntegrity("username", "unlisted.org", "secret")
+	res = c.do(turn.AllocateRequest, turn.RequestedTransportUDP)
+	if code := errorCode(res); code != stun.CodeAllocQuotaReached {
+		t.Errorf("unexpected code %d", code)
+	}
+}
+
+func TestServer_ServeReusePortFallback(t *testing.T) {
+	serverConn, serverAddr := listenUDP(t)
+	s, err := New(Options{
+		Log:         zap.NewNop(),
+		Conn:        serverConn,
+		ManualStart: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulating REUSEPORT that is reported as available, but fails.
+	s.reusePort = true
+	var calls int32
+	s.listenPacket = func(network, address string) (net.PacketConn, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errors.New("not available")
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if serveErr := s.Serve(); serveErr != nil {
+			t.Error(serveErr)
+		}
+	}()
+	defer func() {
+		if closeErr := s.Close(); closeErr != nil {
+			t.Error(closeErr)
+		}
+		<-done
+	}()
+	c, _ := listenUDP(t)
+	defer c.Close()
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	buf := make([]byte, 1024)
+	n := 0
+	for attempt := 0; attempt < 10 && n == 0; attempt++ {
+		if _, err = c.WriteToUDP(req.Raw, serverAddr); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.SetReadDeadline(time.Now().Add(time.Millisecond * 100)); err != nil {
+			t.Fatal(err)
+		}
+		n, _, _ = c.ReadFromUDP(buf)
+	}
+	if n == 0 {
+		t.Error("no response")
+	}
+	if runtime.GOMAXPROCS(-1) > 1 {
+		if got := atomic.LoadInt32(&calls); got != 1 {
+			t.Errorf("unexpected listen attempts %d", got)
+		}
+	}
+}
+
+func TestServer_ListenerSoftware(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:    "realm",
+		Software: "gortcd",
+	})
+	defer stop()
+	if got := s.config().software.String(); got != "gortcd" {
+		t.Errorf("unexpected software %q", got)
+	}
+	s.setOptions(Options{
+		Software: "gortcd",
+		ListenerSoftware: []ListenerSoftware{
+			{Addr: turn.Addr{IP: net.IPv4(127, 0, 0, 2), Port: s.addr.Port}, Software: "other"},
+			{Addr: turn.Addr{IP: net.IPv4zero, Port: s.addr.Port}, Software: "node-1"},
+		},
+	})
+	if got := s.config().software.String(); got != "node-1" {
+		t.Errorf("unexpected software %q", got)
+	}
+}
+
+func TestServer_RealmSoftware(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:    "realm",
+		Software: "gortcd",
+		RealmSoftware: map[string]string{
+			"customer.org": "Customer TURN",
+			"silent.org":   "",
+		},
+	})
+	defer stop()
+	for _, tc := range []struct {
+		realm    string
+		software string
+	}{
+		{realm: "realm", software: "gortcd"},
+		{realm: "customer.org", software: "Customer TURN"},
+		{realm: "silent.org", software: ""},
+	} {
+		ctx := &context{cfg: s.config(), realm: stun.NewRealm(tc.realm)}
+		if got := ctx.software().String(); got != tc.software {
+			t.Errorf("%s: unexpected software %q", tc.realm, got)
+		}
+	}
+}
+
+func TestServer_serveConnClientReject(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:      "realm",
+		ClientRule: filter.NewFilter(filter.Reject),
+	})
+	defer stop()
+	c, _ := listenUDP(t)
+	defer c.Close()
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	ctx := &context{
+		request:  new(stun.Message),
+		response: new(stun.Message),
+		cdata:    new(turn.ChannelData),
+		cfg:      s.config(),
+		conn:     s.conn,
+		addr:     c.LocalAddr(),
+		buf:      append([]byte{}, req.Raw...),
+	}
+	if err := s.serveConn(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if code := errorCode(ctx.response); code != stun.CodeForbidden {
+		t.Errorf("unexpected response: %s", ctx.response)
+	}
+}
+
+func TestServer_DumpPackets(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	s, stop := newServer(t, Options{
+		Realm:       "realm",
+		Log:         zap.New(core),
+		DumpPackets: true,
+	})
+	defer stop()
+	c, _ := listenUDP(t)
+	defer c.Close()
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	ctx := &context{
+		request:  new(stun.Message),
+		response: new(stun.Message),
+		cdata:    new(turn.ChannelData),
+		cfg:      s.config(),
+		conn:     s.conn,
+		addr:     c.LocalAddr(),
+		buf:      append([]byte{}, req.Raw...),
+	}
+	if err := s.serveConn(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []struct {
+		msg string
+		raw []byte
+	}{
+		{"received packet", req.Raw},
+		{"sent packet", ctx.response.Raw},
+	} {
+		entries := logs.FilterMessage(e.msg).All()
+		if len(entries) != 1 {
+			t.Fatalf("%s: unexpected entries count %d", e.msg, len(entries))
+		}
+		if got := entries[0].ContextMap()["hex"]; got != hex.EncodeToString(e.raw) {
+			t.Errorf("%s: unexpected hex %v", e.msg, got)
+		}
+	}
+}
+
+func TestServer_MaxRequestSize(t *testing.T) {
+	s, stop := newServer(t, Options{
+		Realm:          "realm",
+		MaxRequestSize: 100,
+	})
+	defer stop()
+	c, _ := listenUDP(t)
+	defer c.Close()
+	m := new(countingMetrics)
+	cfg := s.config()
+	cfg.metrics = m
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	for _, buf := range [][]byte{
+		append([]byte{}, req.Raw...),
+		make([]byte, 101),
+	} {
+		ctx := &context{
+			request:  new(stun.Message),
+			response: new(stun.Message),
+			cdata:    new(turn.ChannelData),
+			cfg:      cfg,
+			conn:     s.conn,
+			addr:     c.LocalAddr(),
+			buf:      buf,
+		}
+		if err := s.serveConn(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.oversized != 1 {
+		t.Errorf("unexpected oversized count %d", m.oversized)
+	}
+}
+
+// BenchmarkServer_serveConn measures hot path of request processing,
+// from decoding datagram to writing response.
+func BenchmarkServer_serveConn(b *testing.B) {
+	conn := &discardConn{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3478}}
+	s, stop := newServer(b, Options{
+		Realm: "realm",
+		Log:   zap.NewNop(),
+		Conn:  conn,
+	})
+	defer stop()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 34567}
+	newContext := func(req *stun.Message) *context {
+		return &context{
+			request:  new(stun.Message),
+			response: new(stun.Message),
+			cdata:    new(turn.ChannelData),
+			cfg:      s.config(),
+			conn:     s.conn,
+			addr:     addr,
+			server:   s.addr,
+			buf:      append([]byte{}, req.Raw...),
+		}
+	}
+	b.Run("Binding", func(b *testing.B) {
+		ctx := newContext(stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint))
+		b.ReportAllocs()
+		b.SetBytes(int64(len(ctx.buf)))
+		for i := 0; i < b.N; i++ {
+			if err := s.serveConn(ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Allocate", func(b *testing.B) {
+		c := newTestClient(b, s, turn.Addr{IP: addr.IP, Port: addr.Port})
+		ctx := newContext(stun.MustBuild(stun.TransactionID, turn.AllocateRequest,
+			turn.RequestedTransportUDP, c.username, c.realm, c.nonce, c.integrity,
+			stun.Fingerprint,
+		))
+		b.ReportAllocs()
+		b.SetBytes(int64(len(ctx.buf)))
+		for i := 0; i < b.N; i++ {
+			if err := s.serveConn(ctx); err != nil {
+				b.Fatal(err)
+			}
+			// Removing allocation, so next request is not a mismatch.
+			b.StopTimer()
+			if ctx.response.Type.Class != stun.ClassSuccessResponse {
+				b.Fatalf("unexpected response: %s", ctx.response)
+			}
+			if err := s.allocs.Remove(ctx.tuple); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+		}
+	})
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+
+	"gortc.io/gortcd/internal/allocator"
+	"gortc.io/gortcd/internal/dgram"
+)
+
+// protoTCP is IANA assigned protocol number for TCP.
+const protoTCP turn.Protocol = 6
+
+const (
+	stunHeaderSize = 20
+	// streamIdleTimeout is maximum duration between messages on stream
+	// after which connection is closed.
+	streamIdleTimeout = time.Minute * 5
+)
+
+var errStreamMessageTooBig = errors.New("message is too big")
+
+// readStreamMessage reads single STUN message from r to buf, returning
+// message length. STUN messages are self-delimiting, so message size is
+// obtained from header as described in RFC 5389 Section 7.2.2.
+func readStreamMessage(r io.Reader, buf []byte) (int, error) {
+	if len(buf) < stunHeaderSize {
+		return 0, io.ErrShortBuffer
+	}
+	if _, err := io.ReadFull(r, buf[:stunHeaderSize]); err != nil {
+		return 0, err
+	}
+	if !stun.IsMessage(buf[:stunHeaderSize]) {
+		return 0, errNotSTUNMessage
+	}
+	size := stunHeaderSize + int(binary.BigEndian.Uint16(buf[2:4]))
+	if size > len(buf) {
+		return 0, errStreamMessageTooBig
+	}
+	if _, err := io.ReadFull(r, buf[stunHeaderSize:size]); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// network returns network name of server listener, that is "udp", "tcp",
+// "tls" or transport of message-oriented connection, e.g. "quic".
+func (s *Server) network() string {
+	if s.listener != nil {
+		return s.streamNet
+	}
+	if a, ok := s.conn.LocalAddr().(*dgram.Addr); ok {
+		return a.Net
+	}
+	return "udp"
+}
+
+// serveStreams accepts connections on listener until Close.
+func (s *Server) serveStreams() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.closing() {
+				return nil
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				s.log.Warn("accept failed", zap.Error(err))
+				time.Sleep(time.Millisecond * 5)
+				continue
+			}
+			return err
+		}
+		if !s.trackStream(conn) {
+			continue
+		}
+		go s.serveStream(conn)
+	}
+}
+
+// trackStream adds conn to active streams, closing it and returning false
+// if server is closing. Wait group is incremented under same lock as
+// closeStreams is called, so Close never misses the stream.
+func (s *Server) trackStream(conn net.Conn) bool {
+	s.streamsMux.Lock()
+	defer s.streamsMux.Unlock()
+	if s.closing() {
+		if err := conn.Close(); err != nil {
+			s.log.Debug("failed to close stream", zap.Error(err))
+		}
+		return false
+	}
+	s.streams[conn] = struct{}{}
+	atomic.AddInt64(&s.active, 1)
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) closeStreams() {
+	s.streamsMux.Lock()
+	for conn := range s.streams {
+		if err := conn.Close(); err != nil {
+			s.log.Debug("failed to close stream", zap.Error(err))
+		}
+	}
+	s.streamsMux.Unlock()
+}
+
+// serveStream processes requests from conn until error or idle timeout.
+// Connection is control one if TCP allocation is created on it and is
+// kept open until allocation expires, or data one if it is bound to
+// connection to peer, see RFC 6062.
+func (s *Server) serveStream(conn net.Conn) {
+	defer s.wg.Done()
+	stream := &streamConn{Conn: conn}
+	defer func() {
+		if err := s.tcp.remove(stream); err != nil && err != allocator.ErrAllocationMismatch && !isErrConnClosed(err) {
+			s.log.Debug("failed to remove tcp allocation", zap.Error(err))
+		}
+		s.streamsMux.Lock()
+		delete(s.streams, conn)
+		s.streamsMux.Unlock()
+		atomic.AddInt64(&s.active, -1)
+		if err := conn.Close(); err != nil && !isErrConnClosed(err) {
+			s.log.Debug("failed to close stream", zap.Error(err))
+		}
+	}()
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		s.log.Error("unknown addr", zap.Stringer("addr", conn.RemoteAddr()))
+		return
+	}
+	client := turn.Addr{IP: remote.IP, Port: remote.Port}
+	ctx := acquireContext()
+	defer putContext(ctx)
+	for {
+		ctx.reset()
+		deadline := time.Now().Add(streamIdleTimeout)
+		if expires := s.tcp.expires(stream); expires.After(deadline) {
+			// Control connection is not closed while allocation is alive.
+			deadline = expires
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			s.log.Warn("failed to set deadline", zap.Error(err))
+			return
+		}
+		n, err := readStreamMessage(conn, ctx.buf)
+		if err != nil {
+			if ce := s.log.Check(zapcore.DebugLevel, "failed to read from stream"); ce != nil {
+				ce.Write(zap.Stringer("addr", client), zap.Error(err))
+			}
+			return
+		}
+		ctx.time = time.Now()
+		ctx.cfg = s.config()
+		ctx.client = client
+		ctx.server = s.addr
+		ctx.proto = protoTCP
+		ctx.stream = stream
+		ctx.request.Raw = ctx.buf[:n]
+		if !ctx.allowClient(ctx.client) {
+			if ce := s.log.Check(zapcore.DebugLevel, "client denied"); ce != nil {
+				ce.Write(zap.Stringer("addr", ctx.client))
+			}
+			return
+		}
+		ctx.setTuple()
+		if processErr := s.process(ctx); processErr != nil {
+			s.log.Error("process failed", zap.Error(processErr))
+			return
+		}
+		if len(ctx.response.Raw) == 0 {
+			continue
+		}
+		if writeErr := stream.writeMessage(ctx.response.Raw, ctx.time); writeErr != nil {
+			if !isErrConnClosed(writeErr) {
+				s.log.Warn("write failed", zap.Error(writeErr))
+			}
+			if ctx.bound != nil {
+				_ = s.tcp.removeConnection(ctx.bound)
+			}
+			return
+		}
+		if c := ctx.bound; c != nil {
+			// Connection carries only relayed data after ConnectionBind.
+			s.relayConnection(conn, c)
+			return
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gortc.io/stun"
+)
+
+func TestReadStreamMessage(t *testing.T) {
+	first := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	second := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.NewSoftware("test"))
+	r := bytes.NewReader(append(append([]byte{}, first.Raw...), second.Raw...))
+	buf := make([]byte, 2048)
+	for _, m := range []*stun.Message{first, second} {
+		n, err := readStreamMessage(r, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], m.Raw) {
+			t.Error("unexpected message")
+		}
+	}
+	if _, err := readStreamMessage(r, buf); err != io.EOF {
+		t.Errorf("unexpected error: %v", err)
+	}
+	t.Run("TooBig", func(t *testing.T) {
+		m := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.NewSoftware("test"))
+		if _, err := readStreamMessage(bytes.NewReader(m.Raw), make([]byte, len(m.Raw)-1)); err != errStreamMessageTooBig {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	t.Run("NotSTUN", func(t *testing.T) {
+		if _, err := readStreamMessage(bytes.NewReader(make([]byte, 32)), buf); err != errNotSTUNMessage {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestServer_ServeTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Options{
+		Log:         zap.NewNop(),
+		Listener:    l,
+		ManualStart: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if serveErr := s.Serve(); serveErr != nil {
+			t.Error(serveErr)
+		}
+	}()
+	defer func() {
+		if closeErr := s.Close(); closeErr != nil {
+			t.Error(closeErr)
+		}
+		<-done
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.SetDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatal(err)
+	}
+	// Sending two requests to check framing.
+	for i := 0; i < 2; i++ {
+		req := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+		if _, err = c.Write(req.Raw); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1024)
+		n, err := readStreamMessage(c, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := &stun.Message{Raw: buf[:n]}
+		if err = res.Decode(); err != nil {
+			t.Fatal(err)
+		}
+		if res.Type != stun.BindingSuccess || res.TransactionID != req.TransactionID {
+			t.Fatalf("unexpected response: %s", res)
+		}
+		var mapped stun.XORMappedAddress
+		if err = mapped.GetFrom(res); err != nil {
+			t.Fatal(err)
+		}
+		local := c.LocalAddr().(*net.TCPAddr)
+		if !mapped.IP.Equal(local.IP) || mapped.Port != local.Port {
+			t.Errorf("unexpected mapped address %s", mapped)
+		}
+	}
+	if n := s.activeConnections(); n != 1 {
+		t.Errorf("unexpected active connections: %d", n)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for s.activeConnections() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection is still active after close")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
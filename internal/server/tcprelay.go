@@ -0,0 +1,649 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-reuseport"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+
+	"gortc.io/gortcd/internal/allocator"
+	"gortc.io/gortcd/internal/filter"
+)
+
+// TCP allocations of RFC 6062 are served by stream listener. Allocation
+// lives on control connection, where client sends Connect requests and
+// receives ConnectionAttempt indications, and each connection to peer is
+// bound to separate data connection by ConnectionBind request.
+
+var (
+	connectRequest              = stun.NewType(stun.MethodConnect, stun.ClassRequest)
+	connectionBindRequest       = stun.NewType(stun.MethodConnectionBind, stun.ClassRequest)
+	connectionAttemptIndication = stun.NewType(stun.MethodConnectionAttempt, stun.ClassIndication)
+)
+
+const (
+	// connectionBindTimeout is duration in which connection to peer must
+	// be bound to data connection, otherwise it is closed.
+	//
+	// See RFC 6062 Section 5.2 and 5.3.
+	connectionBindTimeout = time.Second * 30
+	// peerConnectTimeout bounds connection to peer of Connect request,
+	// control connection is not read until it is established.
+	peerConnectTimeout = time.Second * 10
+)
+
+var (
+	errConnectionExists  = errors.New("connection to peer already exists")
+	errUnknownConnection = errors.New("unknown connection id")
+	errConnectionUser    = errors.New("connection belongs to other user")
+)
+
+// connectionID represents CONNECTION-ID attribute.
+//
+// See RFC 6062 Section 6.2.1.
+type connectionID uint32
+
+const connectionIDSize = 4
+
+// AddTo adds CONNECTION-ID to message.
+func (c connectionID) AddTo(m *stun.Message) error {
+	v := make([]byte, connectionIDSize)
+	binary.BigEndian.PutUint32(v, uint32(c))
+	m.Add(stun.AttrConnectionID, v)
+	return nil
+}
+
+// GetFrom decodes CONNECTION-ID from message.
+func (c *connectionID) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrConnectionID)
+	if err != nil {
+		return err
+	}
+	if err = stun.CheckSize(stun.AttrConnectionID, len(v), connectionIDSize); err != nil {
+		return err
+	}
+	*c = connectionID(binary.BigEndian.Uint32(v))
+	return nil
+}
+
+// streamConn is stream connection with serialized writes, because
+// control connection of TCP allocation is also written by acceptor of
+// peer connections.
+type streamConn struct {
+	net.Conn
+	mux sync.Mutex
+}
+
+// writeMessage writes b with deadline, so stalled client can't block
+// other writers.
+func (c *streamConn) writeMessage(b []byte, now time.Time) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if err := c.SetWriteDeadline(now.Add(time.Second)); err != nil {
+		return err
+	}
+	_, err := c.Write(b)
+	return err
+}
+
+// tcpAllocation is TCP allocation that is removed with its control
+// connection.
+type tcpAllocation struct {
+	control     *streamConn
+	listener    net.Listener
+	relayed     turn.Addr
+	username    string
+	expires     time.Time
+	permissions map[string]time.Time // expiration by peer IP
+	conns       map[uint32]*tcpConnection
+}
+
+// tcpConnection is connection between relayed transport address and peer,
+// it is pending until bound to data connection.
+type tcpConnection struct {
+	id      uint32
+	alloc   *tcpAllocation
+	peer    turn.Addr
+	conn    net.Conn
+	expires time.Time // deadline of ConnectionBind
+	bound   bool
+}
+
+// tcpRelay is set of TCP allocations of stream listener.
+type tcpRelay struct {
+	mux    sync.Mutex
+	allocs map[*streamConn]*tcpAllocation
+	conns  map[uint32]*tcpConnection
+}
+
+func newTCPRelay() *tcpRelay {
+	return &tcpRelay{
+		allocs: make(map[*streamConn]*tcpAllocation),
+		conns:  make(map[uint32]*tcpConnection),
+	}
+}
+
+func (r *tcpRelay) get(control *streamConn) *tcpAllocation {
+	r.mux.Lock()
+	a := r.allocs[control]
+	r.mux.Unlock()
+	return a
+}
+
+func (r *tcpRelay) add(a *tcpAllocation) {
+	r.mux.Lock()
+	r.allocs[a.control] = a
+	r.mux.Unlock()
+}
+
+// expires returns expiration time of allocation on control connection,
+// or zero time if there is no allocation.
+func (r *tcpRelay) expires(control *streamConn) time.Time {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if a, ok := r.allocs[control]; ok {
+		return a.expires
+	}
+	return time.Time{}
+}
+
+func (r *tcpRelay) refresh(control *streamConn, expires time.Time) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	a, ok := r.allocs[control]
+	if !ok {
+		return allocator.ErrAllocationMismatch
+	}
+	a.expires = expires
+	return nil
+}
+
+// remove removes allocation of control connection, closing its relayed
+// listener and all connections to peers.
+func (r *tcpRelay) remove(control *streamConn) error {
+	r.mux.Lock()
+	a, ok := r.allocs[control]
+	if !ok {
+		r.mux.Unlock()
+		return allocator.ErrAllocationMismatch
+	}
+	delete(r.allocs, control)
+	conns := make([]net.Conn, 0, len(a.conns))
+	for id, c := range a.conns {
+		delete(r.conns, id)
+		conns = append(conns, c.conn)
+	}
+	r.mux.Unlock()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	return a.listener.Close()
+}
+
+func (r *tcpRelay) createPermissions(control *streamConn, peers []turn.Addr, expires time.Time) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	a, ok := r.allocs[control]
+	if !ok {
+		return allocator.ErrAllocationMismatch
+	}
+	for _, peer := range peers {
+		if addrFamily(peer.IP) != addrFamily(a.relayed.IP) {
+			return allocator.ErrPeerAddrFamilyMismatch
+		}
+	}
+	for _, peer := range peers {
+		a.permissions[peer.IP.String()] = expires
+	}
+	return nil
+}
+
+func (r *tcpRelay) permitted(a *tcpAllocation, ip net.IP, now time.Time) bool {
+	r.mux.Lock()
+	expires, ok := a.permissions[ip.String()]
+	r.mux.Unlock()
+	return ok && expires.After(now)
+}
+
+// hasConnection reports whether allocation has pending or bound
+// connection to peer.
+func (r *tcpRelay) hasConnection(a *tcpAllocation, peer turn.Addr) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, c := range a.conns {
+		if c.peer.Equal(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// addConnection adds pending connection to peer with new CONNECTION-ID.
+func (r *tcpRelay) addConnection(a *tcpAllocation, peer turn.Addr, conn net.Conn, now time.Time) (*tcpConnection, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.allocs[a.control]; !ok {
+		// Removed while connecting.
+		return nil, allocator.ErrAllocationMismatch
+	}
+	for _, c := range a.conns {
+		if c.peer.Equal(peer) {
+			return nil, errConnectionExists
+		}
+	}
+	var (
+		id  uint32
+		buf [4]byte
+	)
+	for {
+		if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+			return nil, err
+		}
+		id = binary.BigEndian.Uint32(buf[:])
+		if _, exists := r.conns[id]; !exists {
+			break
+		}
+	}
+	c := &tcpConnection{
+		id:      id,
+		alloc:   a,
+		peer:    peer,
+		conn:    conn,
+		expires: now.Add(connectionBindTimeout),
+	}
+	a.conns[id] = c
+	r.conns[id] = c
+	return c, nil
+}
+
+// bind marks pending connection as bound to data connection of client
+// with username.
+func (r *tcpRelay) bind(id uint32, username string, now time.Time) (*tcpConnection, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	c, ok := r.conns[id]
+	if !ok || c.bound || !c.expires.After(now) {
+		return nil, errUnknownConnection
+	}
+	if c.alloc.username != username {
+		// Only client that owns allocation can bind its connections,
+		// see RFC 6062 Section 5.4.
+		return nil, errConnectionUser
+	}
+	c.bound = true
+	return c, nil
+}
+
+// removeConnection removes and closes connection to peer.
+func (r *tcpRelay) removeConnection(c *tcpConnection) error {
+	r.mux.Lock()
+	if r.conns[c.id] == c {
+		delete(r.conns, c.id)
+		delete(c.alloc.conns, c.id)
+	}
+	r.mux.Unlock()
+	return c.conn.Close()
+}
+
+// prune returns control connections of expired allocations and removes
+// connections to peers that were not bound in time, closing them.
+func (r *tcpRelay) prune(now time.Time) []io.Closer {
+	var closers []io.Closer
+	r.mux.Lock()
+	for control, a := range r.allocs {
+		if !a.expires.After(now) {
+			// Allocation is removed when control connection is closed.
+			closers = append(closers, control)
+		}
+	}
+	for id, c := range r.conns {
+		if c.bound || c.expires.After(now) {
+			continue
+		}
+		delete(r.conns, id)
+		delete(c.alloc.conns, id)
+		closers = append(closers, c.conn)
+	}
+	r.mux.Unlock()
+	return closers
+}
+
+// pruneTCP closes expired TCP allocations and connections to peers.
+func (s *Server) pruneTCP(now time.Time) {
+	for _, c := range s.tcp.prune(now) {
+		if err := c.Close(); err != nil && !isErrConnClosed(err) {
+			s.log.Debug("failed to close expired connection", zap.Error(err))
+		}
+	}
+}
+
+// relayIP returns local address for relayed transport address of TCP
+// allocation on control connection. Unspecified address of listener is
+// replaced with the one that client is connected to.
+func (s *Server) relayIP(control net.Conn) net.IP {
+	if !s.tcpRelayIP.IsUnspecified() {
+		return s.tcpRelayIP
+	}
+	if a, ok := control.LocalAddr().(*net.TCPAddr); ok {
+		return a.IP
+	}
+	return s.tcpRelayIP
+}
+
+func (s *Server) processTCPAllocateRequest(ctx *context) error {
+	var transport turn.RequestedTransport
+	if err := transport.GetFrom(ctx.request); err != nil {
+		// Missing or malformed REQUESTED-TRANSPORT, see RFC 5766 Section 6.2.
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	if transport.Protocol != protoTCP || !ctx.cfg.transportAllowed(protoTCP) {
+		// Only TCP relaying is supported over stream, UDP allocations
+		// are served by packet listeners.
+		return ctx.buildErr(stun.CodeUnsupportedTransProto)
+	}
+	if ctx.request.Contains(stun.AttrDontFragment) ||
+		ctx.request.Contains(stun.AttrEvenPort) ||
+		ctx.request.Contains(stun.AttrReservationToken) {
+		// Not applicable to TCP allocations, see RFC 6062 Section 5.1.
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	var username stun.Username
+	if err := username.GetFrom(ctx.request); err != nil && err != stun.ErrAttributeNotFound {
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	if allowed, err := s.allowUser(ctx, username); !allowed {
+		return err
+	}
+	if s.isDraining() {
+		if alt, ok := s.nextAlternate(ctx); ok {
+			return ctx.buildErr(stun.CodeTryAlternate, &alt)
+		}
+		return ctx.buildErr(stun.CodeAllocQuotaReached)
+	}
+	lifetime, ok := requestedLifetime(ctx)
+	if !ok {
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	if s.tcp.get(ctx.stream) != nil {
+		ctx.cfg.metrics.incAllocationFailure(allocationMismatch)
+		return ctx.buildErr(stun.CodeAllocMismatch)
+	}
+	ip := s.relayIP(ctx.stream)
+	ln, err := reuseport.Listen("tcp", (&net.TCPAddr{IP: ip}).String())
+	if err != nil {
+		ctx.cfg.metrics.incAllocationFailure(allocationCapacity)
+		s.log.Warn("failed to listen relayed address", zap.Error(err))
+		return ctx.buildErr(stun.CodeInsufficientCapacity)
+	}
+	a := &tcpAllocation{
+		control:     ctx.stream,
+		listener:    ln,
+		username:    string(username),
+		expires:     ctx.time.Add(lifetime),
+		permissions: make(map[string]time.Time),
+		conns:       make(map[uint32]*tcpConnection),
+	}
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+		a.relayed = turn.Addr{IP: addr.IP, Port: addr.Port}
+	}
+	s.tcp.add(a)
+	s.wg.Add(1)
+	go s.acceptPeers(a)
+	if ce := s.log.Check(zapcore.DebugLevel, "allocated tcp"); ce != nil {
+		ce.Write(ctx.userFields(zap.Stringer("tuple", ctx.tuple), zap.Stringer("relayed", a.relayed))...)
+	}
+	ctx.relayed = a.relayed
+	if ctx.cfg.externalIP != nil && addrFamily(ctx.cfg.externalIP) == addrFamily(ctx.relayed.IP) {
+		ctx.relayed.IP = ctx.cfg.externalIP
+	}
+	ctx.lifetime = turn.Lifetime{Duration: lifetime}
+	return ctx.buildOk(
+		(*stun.XORMappedAddress)(&ctx.tuple.Client),
+		(*turn.RelayedAddress)(&ctx.relayed),
+		&ctx.lifetime,
+	)
+}
+
+func (s *Server) processTCPRefreshRequest(ctx *context) error {
+	var lifetime turn.Lifetime
+	switch err := lifetime.GetFrom(ctx.request); err {
+	case nil:
+		if max := ctx.cfg.maxLifetime; lifetime.Duration > max {
+			lifetime.Duration = max
+		}
+	case stun.ErrAttributeNotFound:
+		lifetime.Duration = ctx.cfg.defaultLifetime
+	default:
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	var err error
+	if lifetime.Duration == 0 {
+		err = s.tcp.remove(ctx.stream)
+	} else {
+		err = s.tcp.refresh(ctx.stream, ctx.time.Add(lifetime.Duration))
+	}
+	switch err {
+	case nil:
+		return ctx.buildOk(&lifetime)
+	case allocator.ErrAllocationMismatch:
+		return ctx.buildErr(stun.CodeAllocMismatch)
+	default:
+		if isErrConnClosed(err) {
+			return ctx.buildOk(&lifetime)
+		}
+		s.log.Error("failed to process refresh request", zap.Error(err))
+		return ctx.buildErr(stun.CodeServerError)
+	}
+}
+
+func (s *Server) processTCPCreatePermissionRequest(ctx *context) error {
+	peers, err := getPeerAddresses(ctx.request)
+	if err != nil {
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	var lifetime turn.Lifetime
+	switch err := lifetime.GetFrom(ctx.request); err {
+	case nil:
+		if max := ctx.cfg.maxLifetime; lifetime.Duration > max {
+			lifetime.Duration = max
+		}
+	case stun.ErrAttributeNotFound:
+		lifetime.Duration = ctx.cfg.defaultLifetime
+	default:
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	for _, peer := range peers {
+		switch ctx.peerAction(peer) {
+		case filter.Allow:
+			// Pass.
+		case filter.Drop:
+			return nil
+		default:
+			return ctx.buildErr(stun.CodeForbidden)
+		}
+	}
+	switch err := s.tcp.createPermissions(ctx.stream, peers, ctx.time.Add(lifetime.Duration)); err {
+	case nil:
+		return ctx.buildOk(&lifetime)
+	case allocator.ErrAllocationMismatch:
+		return ctx.buildErr(stun.CodeAllocMismatch)
+	case allocator.ErrPeerAddrFamilyMismatch:
+		return ctx.buildErr(stun.CodePeerAddrFamilyMismatch)
+	default:
+		return errors.Wrap(err, "failed to create permissions")
+	}
+}
+
+// processConnectRequest connects relayed transport address to peer, see
+// RFC 6062 Section 5.2.
+func (s *Server) processConnectRequest(ctx *context) error {
+	var addr turn.PeerAddress
+	if err := addr.GetFrom(ctx.request); err != nil {
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	peer := turn.Addr(addr)
+	switch ctx.peerAction(peer) {
+	case filter.Allow:
+		// Pass.
+	case filter.Drop:
+		if ce := s.log.Check(zapcore.DebugLevel, "peer dropped by filter"); ce != nil {
+			ce.Write(ctx.userFields(zap.Stringer("peer", peer), zap.Stringer("client", ctx.client))...)
+		}
+		return nil
+	default:
+		return ctx.buildErr(stun.CodeForbidden)
+	}
+	a := s.tcp.get(ctx.stream)
+	if a == nil {
+		return ctx.buildErr(stun.CodeAllocMismatch)
+	}
+	if addrFamily(peer.IP) != addrFamily(a.relayed.IP) {
+		return ctx.buildErr(stun.CodePeerAddrFamilyMismatch)
+	}
+	if s.tcp.hasConnection(a, peer) {
+		return ctx.buildErr(stun.CodeConnAlreadyExists)
+	}
+	d := net.Dialer{
+		// Connecting from relayed transport address, so peer sees the
+		// same address as for inbound connections.
+		LocalAddr: a.listener.Addr(),
+		Control:   reuseport.Control,
+		Timeout:   peerConnectTimeout,
+	}
+	conn, err := d.Dial("tcp", peer.String())
+	if err != nil {
+		if ce := s.log.Check(zapcore.DebugLevel, "failed to connect to peer"); ce != nil {
+			ce.Write(ctx.userFields(zap.Stringer("peer", peer), zap.Error(err))...)
+		}
+		return ctx.buildErr(stun.CodeConnTimeoutOrFailure)
+	}
+	c, err := s.tcp.addConnection(a, peer, conn, ctx.time)
+	switch err {
+	case nil:
+		return ctx.buildOk(connectionID(c.id))
+	case errConnectionExists:
+		_ = conn.Close()
+		return ctx.buildErr(stun.CodeConnAlreadyExists)
+	case allocator.ErrAllocationMismatch:
+		_ = conn.Close()
+		return ctx.buildErr(stun.CodeAllocMismatch)
+	default:
+		_ = conn.Close()
+		return errors.Wrap(err, "failed to add connection")
+	}
+}
+
+// processConnectionBindRequest binds data connection that request was
+// received on to connection to peer, see RFC 6062 Section 5.4. Data is
+// relayed after success response is sent.
+func (s *Server) processConnectionBindRequest(ctx *context) error {
+	var id connectionID
+	if err := id.GetFrom(ctx.request); err != nil {
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	if s.tcp.get(ctx.stream) != nil {
+		// Control connection can't be data connection.
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	c, err := s.tcp.bind(uint32(id), string(ctx.username), ctx.time)
+	switch err {
+	case nil:
+		ctx.bound = c
+		return ctx.buildOk()
+	case errConnectionUser:
+		return ctx.buildErr(stun.CodeWrongCredentials)
+	default:
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+}
+
+// acceptPeers accepts connections from peers on relayed transport address
+// of a until listener is closed.
+func (s *Server) acceptPeers(a *tcpAllocation) {
+	defer s.wg.Done()
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				s.log.Warn("accept failed", zap.Error(err))
+				time.Sleep(time.Millisecond * 5)
+				continue
+			}
+			return
+		}
+		s.handlePeerConn(a, conn)
+	}
+}
+
+// handlePeerConn notifies client about connection from permitted peer via
+// ConnectionAttempt indication, other connections are closed.
+//
+// See RFC 6062 Section 5.3.
+func (s *Server) handlePeerConn(a *tcpAllocation, conn net.Conn) {
+	var peer turn.Addr
+	if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		peer = turn.Addr{IP: remote.IP, Port: remote.Port}
+	}
+	now := time.Now()
+	if !s.tcp.permitted(a, peer.IP, now) || s.config().peerFilter.Action(peer) != filter.Allow {
+		if ce := s.log.Check(zapcore.DebugLevel, "peer connection denied"); ce != nil {
+			ce.Write(zap.Stringer("peer", peer), zap.Stringer("relayed", a.relayed))
+		}
+		_ = conn.Close()
+		return
+	}
+	c, err := s.tcp.addConnection(a, peer, conn, now)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	m := stun.New()
+	if err = m.Build(stun.TransactionID, connectionAttemptIndication,
+		turn.PeerAddress(peer), connectionID(c.id),
+		stun.Fingerprint,
+	); err == nil {
+		err = a.control.writeMessage(m.Raw, now)
+	}
+	if err != nil {
+		if !isErrConnClosed(err) {
+			s.log.Warn("failed to send connection attempt", zap.Error(err))
+		}
+		_ = s.tcp.removeConnection(c)
+	}
+}
+
+// relayConnection copies data between data connection of client and
+// bound connection to peer until any of them is closed.
+func (s *Server) relayConnection(data net.Conn, c *tcpConnection) {
+	defer func() {
+		if err := s.tcp.removeConnection(c); err != nil && !isErrConnClosed(err) {
+			s.log.Debug("failed to close peer connection", zap.Error(err))
+		}
+	}()
+	if err := data.SetDeadline(time.Time{}); err != nil {
+		s.log.Warn("failed to set deadline", zap.Error(err))
+		return
+	}
+	done := make(chan struct{}, 2)
+	relay := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go relay(c.conn, data)
+	go relay(data, c.conn)
+	<-done
+	// Unblocking other direction.
+	_ = data.Close()
+	_ = c.conn.Close()
+	<-done
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gortc.io/stun"
+	"gortc.io/turn"
+)
+
+func TestConnectionID(t *testing.T) {
+	m := stun.New()
+	if err := connectionID(0xdeadbeef).AddTo(m); err != nil {
+		t.Fatal(err)
+	}
+	var id connectionID
+	if err := id.GetFrom(m); err != nil {
+		t.Fatal(err)
+	}
+	if id != 0xdeadbeef {
+		t.Errorf("unexpected id: %x", uint32(id))
+	}
+	t.Run("BadSize", func(t *testing.T) {
+		m := stun.New()
+		m.Add(stun.AttrConnectionID, []byte{1, 2})
+		if err := id.GetFrom(m); !stun.IsAttrSizeInvalid(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+// streamRoundTrip writes req to c and reads single message from it.
+func streamRoundTrip(t *testing.T, c net.Conn, req *stun.Message) *stun.Message {
+	t.Helper()
+	if _, err := c.Write(req.Raw); err != nil {
+		t.Fatal(err)
+	}
+	return readStreamResponse(t, c)
+}
+
+func readStreamResponse(t *testing.T, c net.Conn) *stun.Message {
+	t.Helper()
+	buf := make([]byte, 1024)
+	n, err := readStreamMessage(c, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &stun.Message{Raw: buf[:n]}
+	if err = res.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func dialStream(t *testing.T, addr net.Addr) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// checkRelayed writes data to both ends of relayed TCP connection.
+func checkRelayed(t *testing.T, data, peer net.Conn) {
+	t.Helper()
+	for _, pair := range [][2]net.Conn{{data, peer}, {peer, data}} {
+		if _, err := pair[0].Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(pair[1], buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, []byte("hello")) {
+			t.Errorf("unexpected data %q", buf)
+		}
+	}
+}
+
+func TestServer_TCPRelay(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Options{
+		Log:               zap.NewNop(),
+		Listener:          l,
+		ManualStart:       true,
+		AllowedTransports: []turn.Protocol{turn.ProtoUDP, protoTCP},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if serveErr := s.Serve(); serveErr != nil {
+			t.Error(serveErr)
+		}
+	}()
+	defer func() {
+		if closeErr := s.Close(); closeErr != nil {
+			t.Error(closeErr)
+		}
+		<-done
+	}()
+	peers, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peers.Close()
+	control := dialStream(t, l.Addr())
+	defer control.Close()
+	t.Run("UDP", func(t *testing.T) {
+		res := streamRoundTrip(t, control, stun.MustBuild(stun.TransactionID, turn.AllocateRequest,
+			turn.RequestedTransportUDP,
+		))
+		var code stun.ErrorCodeAttribute
+		if err := code.GetFrom(res); err != nil || code.Code != stun.CodeUnsupportedTransProto {
+			t.Errorf("unexpected response: %s", res)
+		}
+	})
+	res := streamRoundTrip(t, control, stun.MustBuild(stun.TransactionID, turn.AllocateRequest,
+		turn.RequestedTransport{Protocol: protoTCP},
+	))
+	if res.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	var relayed turn.RelayedAddress
+	if err = relayed.GetFrom(res); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Mismatch", func(t *testing.T) {
+		res := streamRoundTrip(t, control, stun.MustBuild(stun.TransactionID, turn.AllocateRequest,
+			turn.RequestedTransport{Protocol: protoTCP},
+		))
+		var code stun.ErrorCodeAttribute
+		if err := code.GetFrom(res); err != nil || code.Code != stun.CodeAllocMismatch {
+			t.Errorf("unexpected response: %s", res)
+		}
+	})
+	t.Run("Connect", func(t *testing.T) {
+		peerAddr := peers.Addr().(*net.TCPAddr)
+		res := streamRoundTrip(t, control, stun.MustBuild(stun.TransactionID, connectRequest,
+			turn.PeerAddress{IP: peerAddr.IP, Port: peerAddr.Port},
+		))
+		var id connectionID
+		if err := id.GetFrom(res); err != nil {
+			t.Fatalf("unexpected response: %s", res)
+		}
+		peer, err := peers.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+		if a := peer.RemoteAddr().(*net.TCPAddr); a.Port != relayed.Port {
+			t.Errorf("peer connection is not from relayed address: %s", a)
+		}
+		res = streamRoundTrip(t, control, stun.MustBuild(stun.TransactionID, connectRequest,
+			turn.PeerAddress{IP: peerAddr.IP, Port: peerAddr.Port},
+		))
+		var code stun.ErrorCodeAttribute
+		if err = code.GetFrom(res); err != nil || code.Code != stun.CodeConnAlreadyExists {
+			t.Errorf("unexpected response: %s", res)
+		}
+		data := dialStream(t, l.Addr())
+		defer data.Close()
+		res = streamRoundTrip(t, data, stun.MustBuild(stun.TransactionID, connectionBindRequest, id))
+		if res.Type.Class != stun.ClassSuccessResponse {
+			t.Fatalf("unexpected response: %s", res)
+		}
+		checkRelayed(t, data, peer)
+	})
+	t.Run("UnknownConnection", func(t *testing.T) {
+		data := dialStream(t, l.Addr())
+		defer data.Close()
+		res := streamRoundTrip(t, data, stun.MustBuild(stun.TransactionID, connectionBindRequest,
+			connectionID(1),
+		))
+		var code stun.ErrorCodeAttribute
+		if err := code.GetFrom(res); err != nil || code.Code != stun.CodeBadRequest {
+			t.Errorf("unexpected response: %s", res)
+		}
+	})
+	t.Run("ConnectionAttempt", func(t *testing.T) {
+		relayedAddr := &net.TCPAddr{IP: relayed.IP, Port: relayed.Port}
+		denied := dialStream(t, relayedAddr)
+		defer denied.Close()
+		if _, err := denied.Read(make([]byte, 1)); err == nil {
+			t.Error("connection without permission should be closed")
+		}
+		res := streamRoundTrip(t, control, stun.MustBuild(stun.TransactionID, turn.CreatePermissionRequest,
+			turn.PeerAddress{IP: net.IPv4(127, 0, 0, 1)},
+		))
+		if res.Type.Class != stun.ClassSuccessResponse {
+			t.Fatalf("unexpected response: %s", res)
+		}
+		peer := dialStream(t, relayedAddr)
+		defer peer.Close()
+		attempt := readStreamResponse(t, control)
+		if attempt.Type != connectionAttemptIndication {
+			t.Fatalf("unexpected message: %s", attempt)
+		}
+		var (
+			id   connectionID
+			addr turn.PeerAddress
+		)
+		if err := attempt.Parse(&id, &addr); err != nil {
+			t.Fatal(err)
+		}
+		if local := peer.LocalAddr().(*net.TCPAddr); addr.Port != local.Port {
+			t.Errorf("unexpected peer address %s", addr)
+		}
+		data := dialStream(t, l.Addr())
+		defer data.Close()
+		res = streamRoundTrip(t, data, stun.MustBuild(stun.TransactionID, connectionBindRequest, id))
+		if res.Type.Class != stun.ClassSuccessResponse {
+			t.Fatalf("unexpected response: %s", res)
+		}
+		checkRelayed(t, data, peer)
+	})
+	t.Run("Close", func(t *testing.T) {
+		if err := control.Close(); err != nil {
+			t.Fatal(err)
+		}
+		active := func() int {
+			s.tcp.mux.Lock()
+			defer s.tcp.mux.Unlock()
+			return len(s.tcp.allocs) + len(s.tcp.conns)
+		}
+		deadline := time.Now().Add(time.Second * 5)
+		for active() > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("allocation is not removed")
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	})
+}
@@ -33,6 +33,7 @@ type workerPool struct {
 	lock           sync.Mutex
 	workersCount   int
 	mustStop       bool
+	stoppedEarly   bool // Stop was called before Start
 	ready          []*workerChan
 	stopCh         chan struct{}
 	workerChanPool sync.Pool
@@ -44,6 +45,12 @@ type workerChan struct {
 }
 
 func (wp *workerPool) Start() {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+	if wp.stoppedEarly {
+		// Server was closed before Serve.
+		return
+	}
 	if wp.stopCh != nil {
 		panic("BUG: workerPool already started")
 	}
@@ -63,9 +70,13 @@ func (wp *workerPool) Start() {
 	}()
 }
 
+// Stop stops all workers. If pool is not started yet, it won't start.
 func (wp *workerPool) Stop() {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
 	if wp.stopCh == nil {
-		panic("BUG: workerPool wasn't started")
+		wp.stoppedEarly = true
+		return
 	}
 	close(wp.stopCh)
 	wp.stopCh = nil
@@ -73,7 +84,6 @@ func (wp *workerPool) Stop() {
 	// Stop all the workers waiting for incoming connections.
 	// Do not wait for busy workers - they will stop after
 	// serving the connection and noticing wp.mustStop = true.
-	wp.lock.Lock()
 	ready := wp.ready
 	for i, ch := range ready {
 		ch.ch <- nil
@@ -81,7 +91,6 @@ func (wp *workerPool) Stop() {
 	}
 	wp.ready = ready[:0]
 	wp.mustStop = true
-	wp.lock.Unlock()
 }
 
 func (wp *workerPool) getMaxIdleWorkerDuration() time.Duration {
@@ -126,6 +135,16 @@ func (wp *workerPool) clean(scratch *[]*workerChan) {
 	}
 }
 
+// stats returns count of workers that are currently serving and count of
+// idle ones.
+func (wp *workerPool) stats() (active, idle int) {
+	wp.lock.Lock()
+	active = wp.workersCount - len(wp.ready)
+	idle = len(wp.ready)
+	wp.lock.Unlock()
+	return active, idle
+}
+
 func (wp *workerPool) Serve(c *context) bool {
 	ch := wp.getCh()
 	if ch == nil {
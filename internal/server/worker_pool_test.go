@@ -41,3 +41,40 @@ func testWorkerPoolStartStop(t *testing.T) {
 		wp.Stop()
 	}
 }
+
+func TestWorkerPoolStats(t *testing.T) {
+	release := make(chan struct{})
+	wp := &workerPool{
+		WorkerFunc: func(c *context) error {
+			<-release
+			return nil
+		},
+		MaxWorkersCount: 1,
+		Logger:          zap.NewNop(),
+	}
+	wp.Start()
+	defer wp.Stop()
+	if !wp.Serve(acquireContext()) {
+		t.Fatal("should serve")
+	}
+	if active, _ := wp.stats(); active != 1 {
+		t.Errorf("unexpected active count %d", active)
+	}
+	if wp.Serve(acquireContext()) {
+		t.Error("should not serve, no free workers")
+	}
+	close(release)
+}
+
+func TestWorkerPoolStopBeforeStart(t *testing.T) {
+	wp := &workerPool{
+		WorkerFunc:      func(c *context) error { return nil },
+		MaxWorkersCount: 1,
+		Logger:          zap.NewNop(),
+	}
+	wp.Stop()
+	wp.Start()
+	if wp.stopCh != nil {
+		t.Error("should not start after stop")
+	}
+}
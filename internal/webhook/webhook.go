@@ -0,0 +1,169 @@
+// Package webhook implements HTTP callbacks for allocation events.
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"gortc.io/gortcd/internal/allocator"
+)
+
+// Options is set of options for Hook.
+type Options struct {
+	URL       string
+	Log       *zap.Logger
+	Client    *http.Client      // http client with 5s timeout if nil
+	QueueSize int               // 1024 if zero
+	Labels    prometheus.Labels // prometheus labels
+}
+
+// Default values for Options.
+const (
+	DefaultQueueSize = 1024
+	DefaultTimeout   = time.Second * 5
+)
+
+// Hook posts allocation events to URL.
+//
+// Events are queued and posted asynchronously, so allocate and deallocate
+// paths never block on http request. Events are dropped and counted if
+// queue is full.
+type Hook struct {
+	url     string
+	log     *zap.Logger
+	client  *http.Client
+	queue   chan payload
+	done    chan struct{}
+	wg      sync.WaitGroup
+	dropped uint64 // accessed atomically
+
+	droppedDesc *prometheus.Desc
+}
+
+// payload is JSON body of webhook request.
+type payload struct {
+	Event    string  `json:"event"`
+	Username string  `json:"username"`
+	Client   string  `json:"client"`
+	Relayed  string  `json:"relayed"`
+	Relayed6 string  `json:"relayed6,omitempty"` // of dual allocation
+	Bytes    uint64  `json:"bytes"`              // relayed in both directions
+	Duration float64 `json:"duration"`           // seconds
+}
+
+func newHook(o Options) *Hook {
+	if o.Log == nil {
+		o.Log = zap.NewNop()
+	}
+	if o.Client == nil {
+		o.Client = &http.Client{Timeout: DefaultTimeout}
+	}
+	if o.QueueSize == 0 {
+		o.QueueSize = DefaultQueueSize
+	}
+	return &Hook{
+		url:    o.URL,
+		log:    o.Log,
+		client: o.Client,
+		queue:  make(chan payload, o.QueueSize),
+		done:   make(chan struct{}),
+		droppedDesc: prometheus.NewDesc("gortcd_webhook_dropped_total",
+			"Total number of allocation events dropped on webhook queue overflow.", []string{}, o.Labels),
+	}
+}
+
+// New initializes and starts new Hook.
+func New(o Options) *Hook {
+	h := newHook(o)
+	h.wg.Add(1)
+	go h.run()
+	return h
+}
+
+// HandleAllocationEvent implements allocator.EventHandler.
+func (h *Hook) HandleAllocationEvent(e allocator.Event) {
+	in, out := e.Allocation.Bytes()
+	p := payload{
+		Event:    e.Type.String(),
+		Username: e.Allocation.Username,
+		Client:   e.Allocation.Tuple.Client.String(),
+		Relayed:  e.Allocation.RelayedAddr.String(),
+		Bytes:    in + out,
+		Duration: e.Duration.Seconds(),
+	}
+	if e.Allocation.RelayedAddr6.IP != nil {
+		p.Relayed6 = e.Allocation.RelayedAddr6.String()
+	}
+	select {
+	case h.queue <- p:
+	default:
+		atomic.AddUint64(&h.dropped, 1)
+		h.log.Warn("queue is full, dropping event", zap.String("event", p.Event))
+	}
+}
+
+// Dropped returns total count of dropped events.
+func (h *Hook) Dropped() uint64 {
+	return atomic.LoadUint64(&h.dropped)
+}
+
+func (h *Hook) run() {
+	defer h.wg.Done()
+	for {
+		select {
+		case p := <-h.queue:
+			h.post(p)
+		case <-h.done:
+			return
+		}
+	}
+}
+
+func (h *Hook) post(p payload) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		h.log.Error("failed to marshal", zap.Error(err))
+		return
+	}
+	res, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		h.log.Warn("failed to post", zap.Error(err))
+		return
+	}
+	// Draining body to reuse connection.
+	if _, err = io.Copy(ioutil.Discard, res.Body); err != nil {
+		h.log.Warn("failed to read body", zap.Error(err))
+	}
+	if err = res.Body.Close(); err != nil {
+		h.log.Warn("failed to close body", zap.Error(err))
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		h.log.Warn("unexpected status code", zap.Int("code", res.StatusCode))
+	}
+}
+
+// Close stops posting events. Queued events are discarded.
+func (h *Hook) Close() error {
+	close(h.done)
+	h.wg.Wait()
+	return nil
+}
+
+// Describe implements Collector.
+func (h *Hook) Describe(c chan<- *prometheus.Desc) {
+	c <- h.droppedDesc
+}
+
+// Collect implements Collector.
+func (h *Hook) Collect(c chan<- prometheus.Metric) {
+	c <- prometheus.MustNewConstMetric(h.droppedDesc, prometheus.CounterValue, float64(h.Dropped()))
+}
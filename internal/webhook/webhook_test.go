@@ -0,0 +1,85 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gortc.io/gortcd/internal/allocator"
+	"gortc.io/turn"
+)
+
+func testEvent(t allocator.EventType) allocator.Event {
+	return allocator.Event{
+		Type: t,
+		Allocation: allocator.Allocation{
+			Username: "user",
+			Tuple: turn.FiveTuple{
+				Client: turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 3000},
+				Server: turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 3478},
+				Proto:  turn.ProtoUDP,
+			},
+			RelayedAddr: turn.Addr{IP: net.IPv4(127, 0, 0, 1), Port: 5000},
+		},
+		Duration: time.Second * 30,
+	}
+}
+
+func TestHook_HandleAllocationEvent(t *testing.T) {
+	got := make(chan payload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+		}
+		var p payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		got <- p
+	}))
+	defer srv.Close()
+	h := New(Options{URL: srv.URL})
+	defer func() {
+		if err := h.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	h.HandleAllocationEvent(testEvent(allocator.EventDeallocate))
+	select {
+	case p := <-got:
+		expected := payload{
+			Event:    "deallocate",
+			Username: "user",
+			Client:   "127.0.0.1:3000",
+			Relayed:  "127.0.0.1:5000",
+			Duration: 30,
+		}
+		if p != expected {
+			t.Errorf("unexpected payload %+v", p)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out")
+	}
+}
+
+func TestHook_Overflow(t *testing.T) {
+	// Not starting hook, so queue is never drained.
+	h := newHook(Options{URL: "http://127.0.0.1:0", QueueSize: 1})
+	h.HandleAllocationEvent(testEvent(allocator.EventAllocate))
+	h.HandleAllocationEvent(testEvent(allocator.EventAllocate))
+	if h.Dropped() != 1 {
+		t.Errorf("unexpected dropped count %d", h.Dropped())
+	}
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(h); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.Gather(); err != nil {
+		t.Error(err)
+	}
+}
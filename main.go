@@ -2,6 +2,14 @@ package main
 
 import "gortc.io/gortcd/internal/cli"
 
+// Set via ldflags, e.g. by goreleaser.
+var (
+	version = "dev"
+	commit  = "none"
+)
+
 func main() {
+	cli.Version = version
+	cli.Commit = commit
 	cli.Execute()
 }